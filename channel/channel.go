@@ -22,6 +22,9 @@ type Note struct {
     Num int
     Frames float64
     HasData bool
+    Source *utils.SourceLocation    // Where in the MML source the note was written
+    Group []Note                    // The contents of a nested tuple (when Num is defs.TUPLE_GROUP)
+    Before, After []int             // Commands written immediately before / after the note (e.g. for chords)
 }
 
 
@@ -32,14 +35,22 @@ type Channel struct {
     Frames float64              // The total number of frames used by this channel given the current refresh rate
     LoopFrames float64
     LoopTicks int
+    PlayFrames float64          // The playing time of this channel in frames, at the tempos used
+    LoopPlayFrames float64      // The value of PlayFrames at the loop point
     LoopPoint int
     LastSetLength float64
     CurrentTempo int            // The channel's tempo, in BPM
+    Tempos TempoMap             // Tempo changes made on this channel
+    SongTempos *TempoMap        // Tempo changes that apply to all channels of the song (#TEMPO-AT)
+    Groove *Groove              // The groove applied to note lengths, if any
     CurrentNote Note
     CurrentOctave int           // The currently set octave for this channel
     CurrentVolume int           // The currently set volume for this channel
+    CurrentTranspose int        // The currently set transpose amount (K) for this channel
+    CurrentArpeggio []int       // The command that selected the current arpeggio (EN), or nil if it's off
     Tuple struct {
         Cmds []Note
+        Outer [][]Note          // The contents of the enclosing tuples when tuples are nested
         HasData bool
         Active bool
     }
@@ -55,17 +66,23 @@ type Channel struct {
     HasAnyNote bool             // Whether any notes have been added on this channel
     Active bool                 // Is this channel currently active?
     Cmds []int
+    CmdSources []*utils.SourceLocation  // The source location of each byte in Cmds
+    AddrOperands []int                  // The positions in Cmds of the 2-byte stream addresses used by CMD_J1 / CMD_DJNZ
+    currentSource *utils.SourceLocation // Overrides the location of the current command while notes are written
     UsesEffect map[string]bool
     Loops *LoopStack
     ChannelSpecs defs.ISpecs
     IsVirtualChannel bool
+    Rest, Rest2 int             // The note numbers used for r and s
+    Ctx *utils.Context
+    Timing *timing.Timing
 }
 
 
 func NewChannel() *Channel {
     chn := &Channel{}
     chn.LoopPoint = -1
-    chn.CurrentTempo = 125
+    chn.CurrentTempo = DEFAULT_TEMPO
     chn.CurrentOctave = 4
     chn.CurrentLength = 8 // ToDo: correct init value?
     chn.UsesEffect = map[string]bool{}
@@ -202,21 +219,76 @@ func (chn *Channel) SetMaxVolume(maxVol int) {
 
 func (chn *Channel) AddCmd(cmds []int) {
     chn.Cmds = append(chn.Cmds, cmds...)
+    src := chn.currentSource
+    if src == nil {
+        src = chn.sourceLocation()
+    }
+    for _ = range cmds {
+        chn.CmdSources = append(chn.CmdSources, src)
+    }
+}
+
+
+/* Removes all commands from the channel.
+ */
+func (chn *Channel) ClearCmds() {
+    chn.Cmds = []int{}
+    chn.CmdSources = []*utils.SourceLocation{}
+    chn.AddrOperands = []int{}
+}
+
+
+/* Appends a copy of commands that were compiled to start at position origin of a
+ * command stream. addrOperands are the positions of the stream addresses in cmds,
+ * and the addresses are moved along with the commands.
+ */
+func (chn *Channel) AppendCmds(cmds []int, sources []*utils.SourceLocation, addrOperands []int, origin int) {
+    start := len(chn.Cmds)
+    chn.Cmds = append(chn.Cmds, cmds...)
+    chn.CmdSources = append(chn.CmdSources, sources...)
+    for _, pos := range addrOperands {
+        if pos >= len(cmds) {
+            continue
+        }
+        addr := cmds[pos - 1] + cmds[pos] * 0x100 - origin + start
+        chn.Cmds[start + pos - 1] = addr & 0xFF
+        chn.Cmds[start + pos] = addr / 0x100
+        chn.AddrOperands = append(chn.AddrOperands, start + pos)
+    }
+}
+
+
+/* Returns the source location of the command currently being compiled.
+ */
+func (chn *Channel) sourceLocation() *utils.SourceLocation {
+    if chn.Ctx == nil {
+        return nil
+    }
+    return chn.Ctx.CommandLocation
 }
 
 
 /* Calculate the length of a note in frames based on its length in 32nd notes, the current tempo,
- * the current playback speed and the current note cutoff setting.
+ * the current playback speed and the current note cutoff setting. If the channel uses a tempo map
+ * or a groove the note is assumed to end at the channel's current tick.
  */
 func (chn *Channel) NoteLength(len float64) (frames, cutoffFrames, scaling float64) {
     var length32 int
 
-    frames = (timing.UpdateFreq * 60.0) / float64(chn.CurrentTempo) // frames per quarternote
+    frames = (chn.Timing.UpdateFreq * 60.0) / float64(chn.CurrentTempo) // frames per quarternote
     
-    if timing.UseFractionalDelays {
+    if chn.Timing.UseFractionalDelays {
         scaling = 256.0
-        length32 = int((frames / 8.0) * scaling)    // frames per 32nd note, scaled by 256
-        frames = math.Floor(float64(length32) * len)
+        if chn.UsesTempoMap() {
+            frames = chn.framesBetween(chn.Ticks - int(len), chn.Ticks, scaling)
+        } else {
+            length32 = int((frames / 8.0) * scaling)    // frames per 32nd note, scaled by 256
+            if chn.Groove != nil {
+                frames = chn.grooveFrames(chn.Ticks - int(len), chn.Ticks, float64(length32))
+            } else {
+                frames = math.Floor(float64(length32) * len)
+            }
+        }
         
         if (chn.CurrentCutoff.Typ == defs.CT_FRAMES ||
             chn.CurrentCutoff.Typ == defs.CT_NEG_FRAMES) {
@@ -227,12 +299,20 @@ func (chn *Channel) NoteLength(len float64) (frames, cutoffFrames, scaling float
         
         frames = math.Floor(frames) - math.Floor(cutoffFrames)
         if (frames < 0) {
-            utils.ERROR("Note has negative length")
+            chn.Ctx.ERRORC(utils.DIAG_BAD_LENGTH, "Note has negative length")
         }
     } else {
         scaling = 1.0
-        length32 = int(frames / 8)  // frames per 1/32 note
-        frames = float64(length32) * len
+        if chn.UsesTempoMap() {
+            frames = chn.framesBetween(chn.Ticks - int(len), chn.Ticks, scaling)
+        } else {
+            length32 = int(frames / 8)  // frames per 1/32 note
+            if chn.Groove != nil {
+                frames = chn.grooveFrames(chn.Ticks - int(len), chn.Ticks, float64(length32))
+            } else {
+                frames = float64(length32) * len
+            }
+        }
         if (chn.CurrentCutoff.Typ == defs.CT_FRAMES ||
             chn.CurrentCutoff.Typ == defs.CT_NEG_FRAMES) {
             cutoffFrames = math.Min(float64(chn.CurrentCutoff.Val), frames)
@@ -243,9 +323,9 @@ func (chn *Channel) NoteLength(len float64) (frames, cutoffFrames, scaling float
     }
     
     if (frames < 1.0 * scaling) {
-        utils.WARNING("Note is too short, will not be heard")
+        chn.Ctx.WARNINGC(utils.DIAG_BAD_LENGTH, "Note is too short, will not be heard")
     } else if (int(frames) > int(0x3FFF * scaling + (scaling - 1))) {
-        utils.WARNING("Note is too long, cutting at 16383 frames")
+        chn.Ctx.WARNINGC(utils.DIAG_BAD_LENGTH, "Note is too long, cutting at 16383 frames")
         frames = 0x3FFF * scaling + (scaling - 1)
     }
     
@@ -274,13 +354,13 @@ func SplitLength(len int, scaling float64) []int {
  */
 func (chn *Channel) WriteLength() {
     
-    if timing.UseFractionalDelays {
+    if chn.Timing.UseFractionalDelays {
         len1 := int(math.Floor(chn.CurrentNoteFrames.Active))
         len2 := int(math.Floor(chn.CurrentNoteFrames.Cutoff))
         scaling := 256.0
         
-        timing.UpdateDelayMinMax(len1)
-        timing.UpdateDelayMinMax(len2)
+        chn.Timing.UpdateDelayMinMax(len1)
+        chn.Timing.UpdateDelayMinMax(len2)
 
         chn.AddCmd(SplitLength(int(math.Floor(chn.CurrentNoteFrames.Active)), scaling))      
     } else {
@@ -304,32 +384,40 @@ func (chn *Channel) WriteNote(forceOctChange bool) {
     var len1, len2 int
        
     if chn.CurrentNote.HasData {
+        // The note is written when the next command is compiled, but it
+        // should be located where it appeared in the source
+        chn.currentSource = chn.CurrentNote.Source
+        defer func() { chn.currentSource = nil }()
+
+        if chn.CurrentNote.Num == chn.Rest {
+            chn.CurrentNote.Num = defs.CMD_REST
+        } else if chn.CurrentNote.Num == chn.Rest2 {
+            chn.CurrentNote.Num = defs.CMD_REST2
+        } else {
+            chn.CurrentNote.Num = chn.CurrentNote.Num % 12
+        }
+
+        // Handle any pending octave increase/decrease operations
+        if chn.PendingOctChange == 1 {
+            chn.CurrentNote.Num |= defs.CMD_OCTUP
+        } else if chn.PendingOctChange == -1 {
+            chn.CurrentNote.Num |= defs.CMD_OCTDN
+        }
+
         if !chn.Tuple.Active {
             chn.Frames += chn.CurrentNote.Frames
             chn.Ticks += int(chn.CurrentNote.Frames)
             
             frames, cutoffFrames, scaling = chn.NoteLength(chn.CurrentNote.Frames)
-                                                    
-            if chn.CurrentNote.Num == defs.Rest {
-                chn.CurrentNote.Num = defs.CMD_REST
-            } else if chn.CurrentNote.Num == defs.Rest2 {
-                chn.CurrentNote.Num = defs.CMD_REST2
-            } else {
-                chn.CurrentNote.Num = chn.CurrentNote.Num % 12
-            }
-
-            // Handle any pending octave increase/decrease operations
-            if chn.PendingOctChange == 1 {
-                chn.CurrentNote.Num |= defs.CMD_OCTUP
-            } else if chn.PendingOctChange == -1 {
-                chn.CurrentNote.Num |= defs.CMD_OCTDN
-            }
+            chn.PlayFrames += (frames + cutoffFrames) / scaling
             
-            if timing.UseFractionalDelays {
+            chn.AddCmd(chn.CurrentNote.Before)
+                                                    
+            if chn.Timing.UseFractionalDelays {
                 len1 = int(frames) 
                 len2 = int(cutoffFrames)
-                timing.UpdateDelayMinMax(len1)
-                timing.UpdateDelayMinMax(len2)
+                chn.Timing.UpdateDelayMinMax(len1)
+                chn.Timing.UpdateDelayMinMax(len2)
 
                 if chn.CurrentCutoff.Typ == defs.CT_NORMAL ||
                    chn.CurrentCutoff.Typ == defs.CT_FRAMES {
@@ -370,17 +458,17 @@ func (chn *Channel) WriteNote(forceOctChange bool) {
             } else {
                 len1 = int(frames)
                 len2 = int(cutoffFrames)
-                if len1 < timing.ShortestDelay.Lo {
-                    timing.ShortestDelay.Lo = len1
+                if len1 < chn.Timing.ShortestDelay.Lo {
+                    chn.Timing.ShortestDelay.Lo = len1
                 }
-                if len2 >= 1 && len2 < timing.ShortestDelay.Lo {
-                    timing.ShortestDelay.Lo = len2
+                if len2 >= 1 && len2 < chn.Timing.ShortestDelay.Lo {
+                    chn.Timing.ShortestDelay.Lo = len2
                 }
-                if len1 > timing.LongestDelay {
-                    timing.LongestDelay = len1
+                if len1 > chn.Timing.LongestDelay {
+                    chn.Timing.LongestDelay = len1
                 }
-                if len2 > timing.LongestDelay {
-                    timing.LongestDelay = len2
+                if len2 > chn.Timing.LongestDelay {
+                    chn.Timing.LongestDelay = len2
                 }
                 if len1 > 127 {
                     chn.AddCmd([]int{chn.CurrentNote.Num,
@@ -396,13 +484,10 @@ func (chn *Channel) WriteNote(forceOctChange bool) {
                 } else if len2 >= 1 {
                     chn.AddCmd([]int{defs.CMD_REST, len2})
                 }
-            }  // if timing.UseFractionalDelays
+            }  // if chn.Timing.UseFractionalDelays
+            
+            chn.AddCmd(chn.CurrentNote.After)
         } else {
-            if chn.PendingOctChange == 1 {
-                chn.CurrentNote.Num |= defs.CMD_OCTUP
-            } else if chn.PendingOctChange == -1 {
-                chn.CurrentNote.Num |= defs.CMD_OCTDN
-            }
             chn.Tuple.Cmds = append(chn.Tuple.Cmds, chn.CurrentNote)
         }
 
@@ -417,7 +502,10 @@ func (chn *Channel) WriteNote(forceOctChange bool) {
             chn.AddCmd([]int{defs.CMD_OCTAVE | chn.CurrentOctave})
         } else {
             chn.Tuple.Cmds = append(chn.Tuple.Cmds,
-                                    Note{defs.NON_NOTE_TUPLE_CMD, float64(defs.CMD_OCTAVE | chn.CurrentOctave), true})
+                                    Note{Num: defs.NON_NOTE_TUPLE_CMD,
+                                         Frames: float64(defs.CMD_OCTAVE | chn.CurrentOctave),
+                                         HasData: true,
+                                         Source: chn.sourceLocation()})
         }
         chn.PendingOctChange = 0
     }
@@ -425,29 +513,115 @@ func (chn *Channel) WriteNote(forceOctChange bool) {
 
 
 
+/* Start a new tuple. If a tuple already is active, the new one is nested
+ * inside it.
+ */
+func (chn *Channel) BeginTuple() {
+    if chn.Tuple.Active {
+        chn.Tuple.Outer = append(chn.Tuple.Outer, chn.Tuple.Cmds)
+        chn.Tuple.Cmds = nil
+    }
+    chn.Tuple.Active = true
+}
+
+
+/* Discard any open tuples, along with any loops that were started inside
+ * them. Used when a tuple was left unterminated because of an error.
+ */
+func (chn *Channel) AbortTuple() {
+    for chn.Loops.Len() > 0 && chn.Loops.PeekLoop().TupleDepth > 0 {
+        chn.Loops.PopLoop()
+    }
+    chn.Tuple.Cmds = nil
+    chn.Tuple.Outer = nil
+    chn.Tuple.Active = false
+}
+
+
+/* Get the tuple nesting level (0 when no tuple is active).
+ */
+func (chn *Channel) TupleDepth() int {
+    if !chn.Tuple.Active {
+        return 0
+    }
+    return len(chn.Tuple.Outer) + 1
+}
+
+
+/* End the innermost tuple. A nested tuple becomes a single note of length
+ * tupleLen in the enclosing tuple, while the outermost tuple is written to
+ * the channel's command stream.
+ */
+func (chn *Channel) EndTuple(tupleLen float64) {
+    if len(chn.Tuple.Outer) > 0 {
+        group := Note{Num: defs.TUPLE_GROUP, Frames: tupleLen, HasData: true, Group: chn.Tuple.Cmds}
+        chn.Tuple.Cmds = append(chn.Tuple.Outer[len(chn.Tuple.Outer) - 1], group)
+        chn.Tuple.Outer = chn.Tuple.Outer[:len(chn.Tuple.Outer) - 1]
+    } else {
+        chn.WriteTuple(tupleLen)
+        chn.Tuple.Active = false
+    }
+}
+
+
+/* Expand a [..|..]<count> loop inside a tuple by repeating its contents,
+ * since the notes of a tuple only get their lengths once the whole tuple
+ * is known. The part following the | is left out on the last iteration.
+ */
+func (chn *Channel) UnrollTupleLoop(elem LoopStackElem, count int) {
+    body := append([]Note{}, chn.Tuple.Cmds[elem.StartPos:]...)
+    last := body
+    if elem.Skip1Pos != -1 {
+        last = body[:elem.Skip1Pos - elem.StartPos]
+    }
+    cmds := chn.Tuple.Cmds[:elem.StartPos]
+    for i := 1; i < count; i++ {
+        cmds = append(cmds, body...)
+    }
+    chn.Tuple.Cmds = append(cmds, last...)
+}
+
+
+/* Expand a [..|..]<count> loop that is nested too deeply to be played by
+ * the player by repeating its commands. The part following the | is left
+ * out on the last iteration.
+ */
+func (chn *Channel) UnrollLoop(elem LoopStackElem, count int) {
+    body := append([]int{}, chn.Cmds[elem.StartPos:]...)
+    sources := append([]*utils.SourceLocation{}, chn.CmdSources[elem.StartPos:]...)
+    last := len(body)
+    if elem.Skip1Pos != -1 {
+        last = elem.Skip1Pos - elem.StartPos
+    }
+    // The body can hold loops that the player does play (copied from a pattern)
+    addrOperands := []int{}
+    for len(chn.AddrOperands) > 0 && chn.AddrOperands[len(chn.AddrOperands) - 1] >= elem.StartPos {
+        addrOperands = append([]int{chn.AddrOperands[len(chn.AddrOperands) - 1] - elem.StartPos}, addrOperands...)
+        chn.AddrOperands = chn.AddrOperands[:len(chn.AddrOperands) - 1]
+    }
+    chn.Cmds, chn.CmdSources = chn.Cmds[:elem.StartPos], chn.CmdSources[:elem.StartPos]
+    for i := 1; i < count; i++ {
+        chn.AppendCmds(body, sources, addrOperands, elem.StartPos)
+    }
+    chn.AppendCmds(body[:last], sources[:last], addrOperands, elem.StartPos)
+}
+
+
+/* Write the current tuple to the channel's command stream. The length of the
+ * tuple is divided among its notes in proportion to their lengths, with a
+ * nested tuple counting as one note. The rounding error is carried from each
+ * note to the next, so the tuple is exactly as long as a note of length tupleLen
+ * and long tuple passages stay in sync with the other channels.
+ */
 func (chn *Channel) WriteTuple(tupleLen float64) {
-    var totalFrames, frames, cutoffFrames, scaling float64
-    var w1, w2 int
+    var totalFrames, cutoffFrames, scaling float64
+    var w2 int
    
     chn.Frames += tupleLen
+    chn.Ticks += int(tupleLen)
     
     totalFrames, cutoffFrames, scaling = chn.NoteLength(tupleLen)
-    
-    frames = totalFrames / float64(len(chn.Tuple.Cmds))
-    w1 = int(frames) 
-    for i, _ := range chn.Tuple.Cmds {
-        if chn.Tuple.Cmds[i].Num != defs.NON_NOTE_TUPLE_CMD {
-            chn.Tuple.Cmds[i].Frames = float64(w1)
-        }
-    }
-    for i := 0; i < int(totalFrames) - (w1 * len(chn.Tuple.Cmds)); i++ {
-        for j := 0; j < len(chn.Tuple.Cmds)-1; j++ {
-            if chn.Tuple.Cmds[(i + j) % len(chn.Tuple.Cmds)].Num != defs.NON_NOTE_TUPLE_CMD {
-                chn.Tuple.Cmds[(i + j) % len(chn.Tuple.Cmds)].Frames += 1
-                break
-            }
-        }
-    }
+    chn.PlayFrames += (totalFrames + cutoffFrames) / scaling
     w2 = int(cutoffFrames) 
     
     if chn.CurrentCutoff.Typ == defs.CT_NEG ||
@@ -455,42 +629,76 @@ func (chn *Channel) WriteTuple(tupleLen float64) {
         chn.WriteNoteAndLength(defs.CMD_REST, w2, 1, scaling)
     }
     
-    for i, _ := range chn.Tuple.Cmds {
-        if chn.Tuple.Cmds[i].Num == defs.NON_NOTE_TUPLE_CMD {
-            chn.AddCmd([]int{int(chn.Tuple.Cmds[i].Frames)})
-        } else if chn.Tuple.Cmds[i].Num == defs.Rest {
-            chn.Tuple.Cmds[i].Num = defs.CMD_REST
-        } else if chn.Tuple.Cmds[i].Num == defs.Rest2 {
-            chn.Tuple.Cmds[i].Num = defs.CMD_REST2
-        } else {
-            chn.Tuple.Cmds[i].Num = chn.Tuple.Cmds[i].Num % 12
+    chn.writeTupleCmds(chn.Tuple.Cmds, int(totalFrames), scaling)
+    chn.Tuple.Cmds = nil
+    chn.currentSource = nil
+
+    if w2 >= 1 {
+        chn.Timing.UpdateDelayMinMax(w2)
+    }
+    
+    if chn.CurrentCutoff.Typ == defs.CT_NORMAL ||
+       chn.CurrentCutoff.Typ == defs.CT_FRAMES {
+        chn.WriteNoteAndLength(defs.CMD_REST, w2, 1, scaling)
+    }
+}
+
+
+func (chn *Channel) writeTupleCmds(cmds []Note, totalFrames int, scaling float64) {
+    totalTicks := 0.0
+    for _, cmd := range cmds {
+        if cmd.Num != defs.NON_NOTE_TUPLE_CMD {
+            totalTicks += cmd.Frames
         }
+    }
 
-        if timing.UseFractionalDelays {
-            if int(chn.Tuple.Cmds[i].Frames / 256.0) > 127 {
-                chn.AddCmd([]int{chn.Tuple.Cmds[i].Num,
-                                 int(chn.Tuple.Cmds[i].Frames / 0x8000) | 0x80,
-                                 (int(chn.Tuple.Cmds[i].Frames / 0x100) & 0x7F),
-                                 (int(chn.Tuple.Cmds[i].Frames) & 0xFF)})
-            } else {
-                chn.AddCmd([]int{chn.Tuple.Cmds[i].Num,
-                                 int(chn.Tuple.Cmds[i].Frames / 0x100),
-                                 int(chn.Tuple.Cmds[i].Frames) & 0xFF})
-            }
+    ticks := 0.0
+    start := 0
+    for _, cmd := range cmds {
+        if cmd.Num == defs.NON_NOTE_TUPLE_CMD {
+            chn.currentSource = cmd.Source
+            chn.AddCmd([]int{int(cmd.Frames)})
+            continue
+        }
 
-            timing.UpdateDelayMinMax(int(chn.Tuple.Cmds[i].Frames))
+        // Each note ends where it would end without rounding, rounded to
+        // the nearest frame
+        ticks += cmd.Frames
+        end := int(math.Floor(float64(totalFrames) * ticks / totalTicks + 0.5))
+        if cmd.Num == defs.TUPLE_GROUP {
+            chn.writeTupleCmds(cmd.Group, end - start, scaling)
         } else {
+            chn.currentSource = cmd.Source
+            chn.AddCmd(cmd.Before)
+            chn.writeTupleNote(cmd.Num, end - start, scaling)
+            chn.AddCmd(cmd.After)
         }
+        start = end
     }
-    
+}
 
-    if w2 >= 1 {
-        timing.UpdateDelayMinMax(w2)
+
+func (chn *Channel) writeTupleNote(note int, noteLen int, scaling float64) {
+    if noteLen < 1 {
+        chn.Ctx.WARNINGC(utils.DIAG_BAD_LENGTH, "Note is too short, will not be heard")
+        return
     }
-    
-    if chn.CurrentCutoff.Typ == defs.CT_NORMAL ||
-       chn.CurrentCutoff.Typ == defs.CT_FRAMES {
-        chn.WriteNoteAndLength(defs.CMD_REST, w2, 1, scaling)
+
+    if chn.Timing.UseFractionalDelays {
+        chn.Timing.UpdateDelayMinMax(noteLen)
+        chn.WriteNoteAndLength(note, noteLen, 1, scaling)
+    } else {
+        if noteLen < chn.Timing.ShortestDelay.Lo {
+            chn.Timing.ShortestDelay.Lo = noteLen
+        }
+        if noteLen > chn.Timing.LongestDelay {
+            chn.Timing.LongestDelay = noteLen
+        }
+        if noteLen > 127 {
+            chn.AddCmd([]int{note, (noteLen / 128) | 0x80, (noteLen & 0x7F)})
+        } else {
+            chn.AddCmd([]int{note, noteLen})
+        }
     }
 }
 
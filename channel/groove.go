@@ -0,0 +1,70 @@
+/*
+ * Package channel
+ * Groove implementation
+ *
+ * Part of XPMC.
+ * A groove makes successive steps of the same notated length play for
+ * different amounts of time (e.g. a shuffle), while each full cycle of
+ * steps is exactly as long as it would have been without the groove.
+ */
+ 
+package channel
+
+import (
+    "math"
+)
+
+type Groove struct {
+    Name string
+    Steps []int     // The relative length of each step
+    StepTicks int   // The notated length of one step, in ticks
+    StartTick int   // The tick at which the groove was enabled
+    StartPos float64    // Where StartTick is played, which differs from StartTick if the previous
+                        // groove was changed in the middle of a cycle
+}
+
+
+func (g *Groove) CycleTicks() int {
+    return len(g.Steps) * g.StepTicks
+}
+
+
+/* Get the position at which the given tick is played when the groove is
+ * applied, in (fractional) ticks. The position is the same with and without
+ * the groove at every whole cycle from where the groove was enabled.
+ */
+func (g *Groove) Apply(tick int) float64 {
+    if tick == g.StartTick {
+        return g.StartPos
+    } else if tick < g.StartTick {
+        return float64(tick)
+    }
+    
+    total := 0
+    for _, step := range g.Steps {
+        total += step
+    }
+    cycles := (tick - g.StartTick) / g.CycleTicks()
+    remaining := (tick - g.StartTick) % g.CycleTicks()
+    
+    pos := float64(g.StartTick + cycles * g.CycleTicks())
+    scale := float64(g.CycleTicks()) / float64(total)   // ticks per unit of step length
+    for _, step := range g.Steps {
+        if remaining < g.StepTicks {
+            return pos + float64(step) * scale * float64(remaining) / float64(g.StepTicks)
+        }
+        pos += float64(step) * scale
+        remaining -= g.StepTicks
+    }
+    return pos
+}
+
+
+/* Get the number of frames between the ticks from and to with the channel's
+ * groove applied. Both ends are rounded down to whole (scaled) frames, so
+ * consecutive notes add up to the same length as they would without the groove.
+ */
+func (chn *Channel) grooveFrames(from, to int, framesPerTick float64) float64 {
+    return math.Floor(framesPerTick * chn.Groove.Apply(to) + 1e-6) -
+           math.Floor(framesPerTick * chn.Groove.Apply(from) + 1e-6)
+}
@@ -23,12 +23,19 @@ type LoopStackElem struct {
                        following the '|' occurs. */
     Skip1Ticks int  /* The number of ticks that the channel contains at the point where the part of
                        loop following the '|' starts. */
+    StartPlayFrames float64 /* The channel's playing time in frames at the point where the loop starts. */
+    Skip1PlayFrames float64 /* The channel's playing time in frames at the point where the part of the
+                               loop following the '|' starts. */
     OrigOctave int  /* The current octave at the point where the loop starts. */
     OctChange int   /* The relative octave change within the first part of the loop. */
     HasOctCmd int   /* Set if there's an absolute octave command ('o') within the first part of the loop. */
     Skip1OctChg int /* The relative octave change within the part of the loop following the '|'. */
     Skip1OctCmd int /* Set if there's an absolute octave command ('o') within the part of the loop
                        following the '|'. */
+    TupleDepth int  /* The tuple nesting level at which the loop starts. Loops inside {} are unrolled,
+                       and StartPos / Skip1Pos are then indices into the tuple's commands. */
+    Unrolled bool   /* Set if the loop is nested deeper than the target supports, and will be unrolled
+                       when it ends instead of being played with CMD_LOPCNT / CMD_DJNZ. */
 }
 
 type LoopStack struct {
@@ -47,3 +54,11 @@ func (s *LoopStack) PeekLoop() LoopStackElem {
     return s.Peek().(LoopStackElem)
 }
 
+/* Replace the topmost element with elem. PeekLoop returns a copy, so this is
+ * needed to store any changes made to it.
+ */
+func (s *LoopStack) UpdateLoop(elem LoopStackElem) {
+    s.Pop()
+    s.Push(elem)
+}
+
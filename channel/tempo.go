@@ -0,0 +1,168 @@
+/*
+ * Package channel
+ * Tempo map implementation
+ *
+ * Part of XPMC.
+ * Keeps track of tempo changes and accelerando/ritardando ramps, so that
+ * the length in frames of a note can be computed from its position in time
+ * rather than from the tempo that was last set.
+ */
+ 
+package channel
+
+import (
+    "math"
+    "sort"
+)
+
+const (
+    DEFAULT_TEMPO = 125
+    TICKS_PER_BAR = 32      // The number of ticks (32nd notes) in one bar
+)
+
+type TempoChange struct {
+    Tick int        // The position of the change, in ticks from the start of the channel
+    Tempo int       // The tempo at Tick, in BPM
+    EndTempo int    // The tempo at the end of the ramp (same as Tempo if there's no ramp)
+    RampTicks int   // The length of the ramp in ticks, or 0 for an immediate change
+}
+
+type TempoMap struct {
+    Changes []TempoChange   // Sorted by Tick
+}
+
+
+/* Get the tempo at the given tick, which must not come before the change.
+ */
+func (change TempoChange) TempoAt(tick int) float64 {
+    if change.RampTicks == 0 || tick >= change.Tick + change.RampTicks {
+        return float64(change.EndTempo)
+    }
+    return float64(change.Tempo) +
+           float64(change.EndTempo - change.Tempo) * float64(tick - change.Tick) / float64(change.RampTicks)
+}
+
+
+/* Add a tempo change to the map. A change at the same tick as an existing
+ * one replaces it.
+ */
+func (m *TempoMap) Add(change TempoChange) {
+    i := sort.Search(len(m.Changes), func(i int) bool { return m.Changes[i].Tick >= change.Tick })
+    // The slice may be shared with a copy of the channel, so build a new one
+    changes := append([]TempoChange{}, m.Changes[:i]...)
+    changes = append(changes, change)
+    if i < len(m.Changes) && m.Changes[i].Tick == change.Tick {
+        i++
+    }
+    m.Changes = append(changes, m.Changes[i:]...)
+}
+
+
+func (m *TempoMap) HasRamps() bool {
+    for _, change := range m.Changes {
+        if change.RampTicks > 0 {
+            return true
+        }
+    }
+    return false
+}
+
+
+/* Returns true if the channel's note lengths depend on the song's tempo map
+ * or on a tempo ramp, rather than only on the tempo set with t.
+ */
+func (chn *Channel) UsesTempoMap() bool {
+    return (chn.SongTempos != nil && len(chn.SongTempos.Changes) > 0) ||
+           chn.Tempos.HasRamps()
+}
+
+
+/* Get all tempo changes that apply to the channel, in order. Changes made
+ * on the channel itself take precedence over song-wide changes at the same
+ * tick.
+ */
+func (chn *Channel) tempoChanges() []TempoChange {
+    changes := []TempoChange{}
+    if chn.SongTempos != nil {
+        changes = append(changes, chn.SongTempos.Changes...)
+    }
+    for _, change := range chn.Tempos.Changes {
+        i := sort.Search(len(changes), func(i int) bool { return changes[i].Tick > change.Tick })
+        changes = append(changes[:i], append([]TempoChange{change}, changes[i:]...)...)
+    }
+    return changes
+}
+
+
+func (chn *Channel) framesPerTick(tempo float64) float64 {
+    return (chn.Timing.UpdateFreq * 60.0) / tempo / 8.0
+}
+
+
+/* Get the number of frames played from the start of the channel up to the
+ * given (possibly fractional) tick.
+ */
+func (chn *Channel) framesAtTick(tick float64) float64 {
+    frames := 0.0
+    pos := 0.0
+    current := TempoChange{Tempo: DEFAULT_TEMPO, EndTempo: DEFAULT_TEMPO}
+    
+    for _, change := range chn.tempoChanges() {
+        if float64(change.Tick) >= tick {
+            break
+        }
+        frames += chn.segmentFrames(current, pos, float64(change.Tick))
+        current, pos = change, float64(change.Tick)
+    }
+    return frames + chn.segmentFrames(current, pos, tick)
+}
+
+
+func (chn *Channel) segmentFrames(change TempoChange, from, to float64) float64 {
+    if change.RampTicks == 0 || from >= float64(change.Tick + change.RampTicks) {
+        return (to - from) * chn.framesPerTick(float64(change.EndTempo))
+    }
+    // The tempo is changed once per tick during a ramp
+    frames := 0.0
+    for from < to {
+        next := math.Min(math.Floor(from) + 1, to)
+        frames += (next - from) * chn.framesPerTick(change.TempoAt(int(math.Floor(from))))
+        from = next
+    }
+    return frames
+}
+
+
+/* Get the length in (scaled) frames of the ticks between from and to, with
+ * the channel's groove applied. Both ends are rounded down to whole (scaled)
+ * frames, so that consecutive notes never accumulate any rounding error.
+ */
+func (chn *Channel) framesBetween(from, to int, scaling float64) float64 {
+    start, end := float64(from), float64(to)
+    if chn.Groove != nil {
+        start, end = chn.Groove.Apply(from), chn.Groove.Apply(to)
+    }
+    if start < 0 {
+        end -= start
+        start = 0
+    }
+    return math.Floor(chn.framesAtTick(end) * scaling + 1e-6) -
+           math.Floor(chn.framesAtTick(start) * scaling + 1e-6)
+}
+
+
+/* Returns true if the tempo changes anywhere in the range [from, to).
+ */
+func (chn *Channel) TempoChangesWithin(from, to int) bool {
+    current := TempoChange{Tempo: DEFAULT_TEMPO, EndTempo: DEFAULT_TEMPO}
+    for _, change := range chn.tempoChanges() {
+        if change.Tick >= to {
+            break
+        }
+        if change.Tick >= from {
+            return true
+        }
+        current = change
+    }
+    return current.RampTicks > 0 && current.Tick + current.RampTicks > from
+}
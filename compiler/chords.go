@@ -0,0 +1,198 @@
+/*
+ * Package compiler
+ *
+ * Part of XPMC.
+ * Contains functions for handling chords, which are played either as an
+ * arpeggio on each channel or spread over the active channels.
+ */
+
+package compiler
+
+import (
+    "math"
+    "../channel"
+    "../defs"
+    "../effects"
+    "../utils"
+)
+
+const (
+    CHORD_MODE_ARPEGGIO = 0     // Play the root note with an arpeggio over the chord
+    CHORD_MODE_SPLIT = 1        // Play one note of the chord on each active channel
+)
+
+/* The intervals (in semitones, relative to the root) of the chords that can be
+ * used with the <note>:<chord> syntax.
+ */
+var chordTypes = map[string][]int{
+    "maj":  []int{0, 4, 7},
+    "min":  []int{0, 3, 7},
+    "m":    []int{0, 3, 7},
+    "dim":  []int{0, 3, 6},
+    "aug":  []int{0, 4, 8},
+    "sus2": []int{0, 2, 7},
+    "sus4": []int{0, 5, 7},
+    "5":    []int{0, 7},
+    "6":    []int{0, 4, 7, 9},
+    "m6":   []int{0, 3, 7, 9},
+    "7":    []int{0, 4, 7, 10},
+    "maj7": []int{0, 4, 7, 11},
+    "m7":   []int{0, 3, 7, 10},
+    "dim7": []int{0, 3, 6, 9},
+    "m7b5": []int{0, 3, 6, 10},
+    "add9": []int{0, 4, 7, 14},
+    "9":    []int{0, 4, 7, 10, 14},
+}
+
+
+/* Parses the name of a chord following a ':', and returns the intervals of
+ * the chord. The longest matching name is used, so that any length that
+ * follows can be written without a separator (e.g. c:maj74).
+ */
+func (comp *Compiler) parseChordName() []int {
+    for n := 4; n > 0; n-- {
+        name := comp.ctx.Parser.PeekString(n)
+        if intervals, ok := chordTypes[name]; ok && len(name) == n {
+            comp.ctx.Parser.SkipN(n)
+            return intervals
+        }
+    }
+    comp.ctx.ERRORC(utils.DIAG_CHORD, "Unknown chord: %s", comp.ctx.Parser.PeekString(4))
+    return nil
+}
+
+
+/* Parses a chord on the form 'ceg' (the opening ' has already been read).
+ * The first note is the root, and each following note is placed above the
+ * previous one unless it's preceded by < or >.
+ * Returns the root note (as a character), its sharp/flat and the intervals
+ * of the chord.
+ */
+func (comp *Compiler) parseQuotedChord() (root int, flatSharp int, intervals []int) {
+    root = -1
+    prev := 0
+    octave := 0
+    octaveSet := false
+    
+    for {
+        c := comp.ctx.Parser.Getch()
+        if c == '\'' {
+            break
+        } else if c == '>' || c == '<' {
+            if root == -1 {
+                comp.ctx.ERRORC(utils.DIAG_CHORD, "The root of a chord can not have an octave change")
+            }
+            if c == '>' {
+                octave++
+            } else {
+                octave--
+            }
+            octaveSet = true
+        } else if defs.NoteIndex(c) >= 0 && c != 'r' && c != 's' {
+            fs := 0
+            m := comp.ctx.Parser.Getch()
+            if m == '+' {
+                fs = 1
+            } else if m == '-' {
+                fs = -1
+            } else {
+                comp.ctx.Parser.Ungetch()
+            }
+            note := defs.NoteIndex(c)
+            if fs != 0 && (note + fs < 1 || defs.NoteVal(note + fs) != -2) {
+                comp.ctx.ERRORC(utils.DIAG_CHORD, "Bad note in chord: %c%c", c, m)
+            }
+
+            pitch := note + fs + octave * 12
+            if root == -1 {
+                root, flatSharp = c, fs
+                prev = pitch
+            } else {
+                for !octaveSet && pitch <= prev {
+                    octave++
+                    pitch += 12
+                }
+            }
+            intervals = append(intervals, pitch - (defs.NoteIndex(root) + flatSharp))
+            prev = pitch
+            octaveSet = false
+        } else if c == -1 || c == '\r' || c == '\n' {
+            comp.ctx.ERRORC(utils.DIAG_CHORD, "Missing ' at the end of chord")
+        } else if c != ' ' && c != '\t' {
+            comp.ctx.ERRORC(utils.DIAG_CHORD, "Unexpected character in chord: %c", c)
+        }
+    }
+    
+    if root == -1 {
+        comp.ctx.ERRORC(utils.DIAG_CHORD, "Empty chord")
+    }
+    return
+}
+
+
+/* Returns the number of an inlined arpeggio that loops over the intervals of
+ * a chord, creating it if necessary.
+ */
+func (comp *Compiler) chordArpeggio(intervals []int) int {
+    lst := utils.NewParamList()
+    for _, interval := range intervals {
+        lst.LoopedPart = append(lst.LoopedPart, interval)
+    }
+    if !inRange(lst.LoopedPart, -63, 63) {
+        comp.ctx.ERRORC(utils.DIAG_CHORD, "Chord is too wide for an arpeggio: %s", lst.Format())
+    }
+    
+    freq := defs.EFFECT_STEP_EVERY_FRAME
+    num := comp.effects.Arpeggios.GetKeyFor(lst)
+    if num == -1 || comp.effects.Arpeggios.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) != freq {
+        num = comp.effects.Arpeggios.InlinedDefinitionId
+        comp.effects.Arpeggios.Append(num, lst)
+        comp.effects.Arpeggios.PutExtraInt(num, effects.EXTRA_EFFECT_FREQ, freq)
+        comp.effects.Arpeggios.InlinedDefinitionId++
+    }
+    return num
+}
+
+
+/* Turns the current note of a channel into (a part of) a chord. index is
+ * the position of the channel among the active channels, which decides the
+ * note that it plays in split mode. rootSemitone is the root's position
+ * within its octave (0-11).
+ */
+func (comp *Compiler) applyChord(chn *channel.Channel, index int, rootSemitone int, intervals []int) {
+    if comp.chordMode == CHORD_MODE_ARPEGGIO {
+        num := comp.chordArpeggio(intervals)
+        idx := comp.effects.Arpeggios.FindKey(num) | comp.effects.Arpeggios.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80
+        comp.effects.Arpeggios.AddRef(num)
+        if comp.enRev == 0 {
+            chn.CurrentNote.Before = []int{defs.CMD_ARPMAC, idx + 1}
+            chn.UsesEffect["EN"] = true
+        } else {
+            chn.CurrentNote.Before = []int{defs.CMD_APMAC2, idx + 1}
+            chn.UsesEffect["EN2"] = true
+        }
+        // Go back to the arpeggio that was used before the chord
+        if chn.CurrentArpeggio != nil {
+            chn.CurrentNote.After = chn.CurrentArpeggio
+        } else {
+            chn.CurrentNote.After = []int{defs.CMD_ARPOFF}
+        }
+        return
+    }
+    
+    if index >= len(intervals) {
+        chn.CurrentNote.Num = chn.Rest
+        return
+    }
+    chn.CurrentNote.Num += intervals[index]
+    octave := chn.CurrentOctave + int(math.Floor(float64(rootSemitone + intervals[index]) / 12.0))
+    if octave != chn.CurrentOctave {
+        if octave < chn.GetMinOctave() || octave > chn.GetMaxOctave() {
+            comp.ctx.ERRORC(utils.DIAG_CHORD, "Chord note out of range on channel %s (octave %d)", chn.GetName(), octave)
+        }
+        // The octave is set explicitly for this note, so any pending > or < is included
+        chn.CurrentNote.Before = []int{defs.CMD_OCTAVE | octave}
+        chn.CurrentNote.After = []int{defs.CMD_OCTAVE | chn.CurrentOctave}
+        chn.PendingOctChange = 0
+    }
+}
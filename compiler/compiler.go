@@ -1,10 +1,11 @@
 package compiler
 
 import (
+    "flag"
     "fmt"
+    "path/filepath"
     "strconv"
     "strings"
-    "sync"
     "../channel"
     "../defs"
     "../effects"
@@ -36,6 +37,8 @@ type Compiler struct {
     slur bool
     tie bool
     lastWasChannelSelect bool
+    currentCmd int              // The first character of the command being compiled
+    currentCmdLine int          // The line that the command being compiled started on
 
     dontCompile *GenericStack
     hasElse *GenericStack
@@ -45,26 +48,62 @@ type Compiler struct {
     
     pattern *MmlPattern
     patterns *MmlPatternMap
+    patternAliases map[string]string    // Copies of patterns (see tempoVariant) that are identical to another one
+    patternStart int            // Where the body of the pattern being defined starts in the parser's data
+    patternParser *ParserState  // The parser that the pattern definition began in
+    volumeOffset int            // Added to absolute volumes while compiling a pattern variant
+    grooves map[string][]int    // Grooves defined with #GROOVE
+    drumKits map[string]drumKit // Drum kits defined with #DRUMKIT
+    forVars []string            // The variables of the #FOR blocks being compiled
+    sections map[string]*mmlSection // Sections defined with #SECTION
+    section *mmlSection         // The section being defined, if any
+    chordMode int               // How chords are played (CHORD_MODE_*)
     
     keepChannelsActive bool
     callbacks []string
+    tempoLoops []tempoLoop      // The [] loops being compiled (see beginTempoLoop)
     
     commandHandlers map[string]func(string, defs.ITarget)
     metaCommandHandlers map[string]func(string, defs.ITarget)
+    targetOptions [][2]string   // Name/value pairs given to SetTargetOption
+
+    includeStack []string           // The files currently being compiled, outermost first
+    includedFiles map[string]bool   // Every file compiled so far (by FileKey)
+    onceFiles map[string]bool       // Files containing #PRAGMA ONCE
+
+    ctx *Context
+    effects *effects.Effects
+    timing *timing.Timing
+    Diagnostics *Diagnostics
 }
 
 
 
 func (comp *Compiler) Init(target int) {
+    // Everything that a compilation modifies is owned by the Compiler,
+    // so that several compilations can run side by side.
+    comp.ctx = NewContext()
+    comp.effects = effects.NewEffects()
+    comp.timing = timing.NewTiming()
+    comp.Diagnostics = comp.ctx.Diagnostics
+
     comp.macros = &MmlMacroMap{}
     comp.patterns = &MmlPatternMap{}
+    comp.patternAliases = map[string]string{}
+    comp.grooves = map[string][]int{}
+    comp.drumKits = map[string]drumKit{}
+    comp.sections = map[string]*mmlSection{}
+    comp.chordMode = CHORD_MODE_ARPEGGIO
    
     comp.commandHandlers = map[string]func(string, defs.ITarget){}
     comp.metaCommandHandlers = map[string]func(string, defs.ITarget){}
     
     comp.Songs = map[int]*song.Song{}
-    comp.CurrSong = song.NewSong(1, target, comp)
-    comp.Songs[1] = comp.CurrSong
+    comp.targetOptions = nil
+    comp.includeStack = nil
+    comp.includedFiles = map[string]bool{}
+    comp.onceFiles = map[string]bool{}
+    comp.newSong(1, target)
     
     comp.dontCompile = NewGenericStack()
     comp.hasElse = NewGenericStack()
@@ -73,11 +112,51 @@ func (comp *Compiler) Init(target int) {
     comp.hasElse.Push(false)
     
     comp.lastWasChannelSelect = false
-   
-    defs.Rest  = (comp.CurrSong.Target.GetMaxOctave() + 1 - comp.CurrSong.Target.GetMinOctave()) * 12
-    defs.Rest2 = (comp.CurrSong.Target.GetMaxOctave() + 1 - comp.CurrSong.Target.GetMinOctave()) * 12 + 1
-    
-    effects.Init()
+}
+
+
+/* Sets one of the options that the target registers with RegisterOptions.
+ * The option is applied to the target of the current song, and of any
+ * songs that get created later on.
+ */
+func (comp *Compiler) SetTargetOption(name string, value string) error {
+    if err := setTargetOption(comp.CurrSong.Target, name, value); err != nil {
+        return err
+    }
+    comp.targetOptions = append(comp.targetOptions, [2]string{name, value})
+    return nil
+}
+
+func setTargetOption(target defs.ITarget, name string, value string) error {
+    flags := flag.NewFlagSet("", flag.ContinueOnError)
+    target.RegisterOptions(flags)
+    if flags.Lookup(name) == nil {
+        return fmt.Errorf("Unknown option for this target: -%s", name)
+    }
+    return flags.Set(name, value)
+}
+
+
+/* Creates a new song and makes it the current one.
+ */
+func (comp *Compiler) newSong(num int, target int) {
+    comp.CurrSong = song.NewSong(num, target, comp)
+    comp.Songs[num] = comp.CurrSong
+    for _, option := range comp.targetOptions {
+        setTargetOption(comp.CurrSong.Target, option[0], option[1])
+    }
+}
+
+
+/* Switches between PAL (50 Hz) and NTSC (60 Hz) timing. PAL is ignored
+ * for targets that don't support it.
+ */
+func (comp *Compiler) SetPAL(pal bool) {
+    if !pal {
+        comp.timing.UpdateFreq = 60.0
+    } else if comp.CurrSong.Target.SupportsPAL() {
+        comp.timing.UpdateFreq = 50.0
+    }
 }
 
 
@@ -167,7 +246,7 @@ func inRange(o interface{}, minimum interface{}, maximum interface{}) bool {
             }
         } else {
             // Unsupported combination of types
-            //ERROR("Bad parameter combination for inRange")
+            //comp.ctx.ERROR("Bad parameter combination for inRange")
             return false
         }
     }
@@ -184,35 +263,25 @@ func abs(x int) int {
 }
 
 
+/* Writes the pending note of every channel. The channels are handled one at
+ * a time, since writing a note can report diagnostics (which abort the
+ * current command by panicking).
+ */
 func (comp *Compiler) writeAllPendingNotes(forceOctChange bool) {
-    w := &sync.WaitGroup{}
     for _, chn := range comp.CurrSong.Channels {
-        chnCopy := chn
-        w.Add(1)
-        go func() {
-            chnCopy.WriteNote(forceOctChange)
-            w.Done()
-        }()
+        chn.WriteNote(forceOctChange)
     }
-    w.Wait()
 }
 
 
 /* Applies the given command on all active channels.
  */
 func (comp *Compiler) applyCmdOnAllActive(cmdName string, cmd []int) {
-    w := &sync.WaitGroup{}
     for _, chn := range comp.CurrSong.Channels {
-        chnCopy := chn
-        w.Add(1)
-        go func() {
-            if chnCopy.Active {
-                chnCopy.AddCmd(cmd)
-            }
-            w.Done()
-        }()
+        if chn.Active {
+            chn.AddCmd(cmd)
+        }
     }
-    w.Wait()
 }
 
 
@@ -225,7 +294,7 @@ func (comp *Compiler) applyCmdOnAllActiveFM(cmdName string, cmd []int) {
             if chn.SupportsFM() {
                 chn.AddCmd(cmd)
             } else {
-                WARNING(cmdName + " is not supported for channel " + chn.GetName())
+                comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "%s is not supported for channel %s", cmdName, chn.GetName())
             }
         }
     }
@@ -243,18 +312,93 @@ func (comp *Compiler) applyEffectOnAllActiveSupported(cmdName string, cmd []int,
                 chn.AddCmd(cmd)
                 go effMap.AddRef(num)
             } else {
-                WARNING(cmdName + " is not supported for channel " + chn.GetName())
+                comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "%s is not supported for channel %s", cmdName, chn.GetName())
             }
         }
     }
 }
                                                         
                                                                         
+/* Reads a comma-separated list of macro parameters or arguments, up to and
+ * including the closing parenthesis. <name>=<value> pairs are returned as
+ * single strings.
+ */
+func (comp *Compiler) getMacroArgs() []string {
+    args := []string{}
+    for {
+        t := comp.ctx.Parser.GetStringUntil(",)=\t\r\n ")
+        comp.ctx.Parser.SkipWhitespace()
+        n := comp.ctx.Parser.Getch()
+        if n == '=' {
+            t += "=" + comp.ctx.Parser.GetStringUntil(",)\t\r\n ")
+            comp.ctx.Parser.SkipWhitespace()
+            n = comp.ctx.Parser.Getch()
+        }
+        args = append(args, t)
+        if n == -1 || n == ')' {
+            break
+        }
+    }
+    return args
+}
+
+
+/* Tries to parse an expression ({oct+1}) or an assignment to a local
+ * ({n = len*2}) following a { in the body of the macro being defined.
+ * Returns false, without consuming anything, if what follows the { isn't
+ * an expression (e.g. if it's a tuplet).
+ */
+func (comp *Compiler) parseMacroExpression() bool {
+    s := comp.ctx.Parser.PeekString(256)
+    end := strings.IndexByte(s, '}')
+    if end < 0 || strings.ContainsAny(s[:end], "{\n") {
+        return false
+    }
+    s = s[:end]
+
+    local := ""
+    if eq := strings.IndexByte(s, '='); eq >= 0 {
+        local = strings.TrimSpace(s[:eq])
+        if !IsIdentifier(local) {
+            return false
+        }
+        s = s[eq+1:]
+    }
+
+    names, err := ExpressionNames(s)
+    if err != nil {
+        return false
+    }
+    strParam := ""
+    for _, name := range names {
+        if idx := comp.macro.FindParam(name); idx >= 0 && comp.macro.params[idx].typ == MACRO_PARAM_STR {
+            strParam = name
+        } else if !comp.macro.isNumericName(name) {
+            // Not an expression, e.g. a tuplet
+            return false
+        }
+    }
+    if strParam != "" {
+        comp.ctx.ERRORC(DIAG_MACRO, "%s is a string parameter and can not be used in an expression", strParam)
+    }
+    if local != "" {
+        if comp.macro.FindParam(local) >= 0 {
+            comp.ctx.ERRORC(DIAG_MACRO, "Can not assign to the macro parameter %s", local)
+        }
+        comp.macro.AppendAssignment(local, s)
+    } else {
+        comp.macro.AppendExpression(s)
+    }
+    comp.ctx.Parser.SkipN(end + 1)
+    return true
+}
+
+
 /* Generates an error if the rune in c isn't a valid channel name.
  */
 func (comp *Compiler) assertIsChannelName(c int) {
     if !strings.ContainsRune(comp.CurrSong.Target.GetChannelNames(), rune(c)) {
-        ERROR("Unexpected character: " + string(byte(c)))
+        comp.ctx.ERRORC(DIAG_UNEXPECTED_CHAR, "Unexpected character: %c", c)
     }
 }
 
@@ -264,15 +408,15 @@ func (comp *Compiler) assertIsChannelName(c int) {
  * in the effect map.
  */ 
 func (comp *Compiler) assertEffectIdExistsAndChannelsActive(name string, eff *effects.EffectMap) (int, int, error) {
-    s := Parser.GetNumericString()
+    s := comp.ctx.Parser.GetNumericString()
     num, err := strconv.Atoi(s)
     idx := -1
     if err == nil {
         idx = eff.FindKey(num)
         if comp.CurrSong.GetNumActiveChannels() == 0 {
-            ERROR(name + " requires at least one active channel")
+            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "%s requires at least one active channel", name)
         } else if idx < 0 {
-            ERROR("Undefined macro: " + name + s)
+            comp.ctx.ERRORC(DIAG_MACRO, "Undefined macro: %s%s", name, s)
         }
     }
     return num, idx, err
@@ -283,8 +427,8 @@ func (comp *Compiler) assertEffectIdExistsAndChannelsActive(name string, eff *ef
  * the input data are 'O', 'F'. Generates an error otherwise.
  */
 func (comp *Compiler) assertDisablingEffect(name string, cmd int) {
-    c := Parser.Getch()
-    s := string(byte(c)) + string(byte(Parser.Getch()))
+    c := comp.ctx.Parser.Getch()
+    s := string(byte(c)) + string(byte(comp.ctx.Parser.Getch()))
     if s == "OF" {
         if name == "EN" && cmd == defs.CMD_ARPOFF {
             comp.applyCmdOnAllActive(name, []int{cmd})  // ENOF has a short form that only requires a single byte
@@ -292,7 +436,7 @@ func (comp *Compiler) assertDisablingEffect(name string, cmd int) {
             comp.applyCmdOnAllActive(name, []int{cmd, 0})
         }
     } else {
-        ERROR("Syntax error. Found " + name + s + ". Did you mean " + name + "OF?")
+        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error. Found %s%s. Did you mean %sOF?", name, s, name)
     }
 }
 
@@ -303,44 +447,43 @@ func (comp *Compiler) handleAtCommand() {
     for _, chn := range comp.CurrSong.Channels {
         chn.WriteNote(true)
     }
-    m := Parser.Getch()
+    m := comp.ctx.Parser.Getch()
     s := ""
     if m == '@' {
-        s = "@" + Parser.GetNumericString()
+        s = "@" + comp.ctx.Parser.GetNumericString()
     } else if IsNumeric(m) {
-        Parser.Ungetch()
-        s = Parser.GetNumericString()
+        comp.ctx.Parser.Ungetch()
+        s = comp.ctx.Parser.GetNumericString()
     } else {
-        Parser.Ungetch()
-        s = Parser.GetAlphaString()
-        s += Parser.GetNumericString()
+        comp.ctx.Parser.Ungetch()
+        s = comp.ctx.Parser.GetAlphaString()
+        s += comp.ctx.Parser.GetNumericString()
     }
 
     if len(s) > 0 {
         if strings.HasPrefix(s, "@") {
             num, err := strconv.Atoi(s[1:])
             if err == nil {
-                idx := effects.DutyMacros.FindKey(num) 
+                idx := comp.effects.DutyMacros.FindKey(num) 
                 numChannels := 0
                 for _, chn := range comp.CurrSong.Channels {
                     if chn.Active {
                         numChannels++
                         if chn.SupportsDutyChange() > 0 {
-                            idx |= effects.DutyMacros.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80    // Effect frequency
+                            idx |= comp.effects.DutyMacros.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80    // Effect frequency
                             chn.AddCmd([]int{defs.CMD_DUTMAC, idx + 1})
-                            effects.DutyMacros.AddRef(num)
+                            comp.effects.DutyMacros.AddRef(num)
                             chn.UsesEffect["DM"] = true
                         } else {
-                            WARNING("Unsupported command for channel " +
-                                          chn.GetName() + ": @@")
+                            comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for channel %s: @@", chn.GetName())
                         }
                     }
                 }
                 if numChannels == 0 {
-                    WARNING("Use of @@ with no channels active")
+                    comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Use of @@ with no channels active")
                 }
             } else {
-                ERROR("Expected a number: " + s)
+                comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Expected a number: %s", s)
             }
         } else {
             num, err := strconv.Atoi(s)
@@ -358,15 +501,15 @@ func (comp *Compiler) handleAtCommand() {
 
             // Feedback macro definition
             } else if strings.HasPrefix(s, "FBM") {
-                comp.handleEffectDefinition("FBM", s, effects.FeedbackMacros, func(parm *ParamList) bool {
+                comp.handleEffectDefinition("FBM", s, comp.effects.FeedbackMacros, func(parm *ParamList) bool {
                         if !parm.IsEmpty() {
                             if inRange(parm.MainPart, 0, 7) && inRange(parm.LoopedPart, 0, 7) {
                                 return true;
                             } else {
-                                ERROR("Value of out range (allowed: 0-7): " + parm.Format())
+                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Value of out range (allowed: 0-7): %s", parm.Format())
                             }
                         } else {
-                            ERROR("Empty list for FBM")
+                            comp.ctx.ERRORC(DIAG_SYNTAX, "Empty list for FBM")
                         }
                         return false
                     })
@@ -385,26 +528,26 @@ func (comp *Compiler) handleAtCommand() {
 
             // Pitch macro definition
             } else if strings.HasPrefix(s, "EP") {
-                comp.handleEffectDefinition("EP", s, effects.PitchMacros, func(parm *ParamList) bool {
+                comp.handleEffectDefinition("EP", s, comp.effects.PitchMacros, func(parm *ParamList) bool {
                         if !parm.IsEmpty() {
                             return true
                         } else {
-                            ERROR("Empty list for EP")
+                            comp.ctx.ERRORC(DIAG_SYNTAX, "Empty list for EP")
                         }
                         return false
                     })
 
             // Portamento definition
             } else if strings.HasPrefix(s, "PT") {
-                comp.handleEffectDefinition("PT", s, effects.Portamentos, func(parm *ParamList) bool {
+                comp.handleEffectDefinition("PT", s, comp.effects.Portamentos, func(parm *ParamList) bool {
                         if len(parm.MainPart) == 2 && len(parm.LoopedPart) == 0 {
                             if inRange(parm.MainPart, []int{0, 1}, []int{127, 127}) {
                                 return true
                             } else {
-                                ERROR("Value of out range: " + parm.Format())
+                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Value of out range: %s", parm.Format())
                             }
                         } else {
-                            ERROR("Bad PT: " + parm.Format())
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad PT: %s", parm.Format())
                         }
                         return false
                     })
@@ -423,17 +566,17 @@ func (comp *Compiler) handleAtCommand() {
                 if err == nil {
                     idx := 0
                     if !isWTM {
-                        idx = effects.Waveforms.FindKey(num)
+                        idx = comp.effects.Waveforms.FindKey(num)
                     } else {
-                        idx = effects.WaveformMacros.FindKey(num)
+                        idx = comp.effects.WaveformMacros.FindKey(num)
                     }
                     if idx < 0 {
-                        t := Parser.GetString()
+                        t := comp.ctx.Parser.GetString()
                         if t == "=" {
                             if isWTM {
-                                Parser.AllowWTList()
+                                comp.ctx.Parser.AllowWTList()
                             }
-                            lst, err := Parser.GetList()
+                            lst, err := comp.ctx.Parser.GetList()
                             if comp.CurrSong.Target.SupportsWaveTable() {
                                 if err == nil {
                                     if !isWTM { // Regular @WT
@@ -442,22 +585,21 @@ func (comp *Compiler) handleAtCommand() {
                                                        comp.CurrSong.Target.GetMinWavSample(),
                                                        comp.CurrSong.Target.GetMaxWavSample()) {
                                                 if len(lst.MainPart) < comp.CurrSong.Target.GetMinWavLength() {
-                                                    WARNING(fmt.Sprintf("Padding waveform with zeroes (current length: %d, needs to be at least %d)",
-                                                        len(lst.MainPart), comp.CurrSong.Target.GetMinWavLength()))
+                                                    comp.ctx.WARNINGC(DIAG_BAD_LENGTH, "Padding waveform with zeroes (current length: %d, needs to be at least %d)", len(lst.MainPart), comp.CurrSong.Target.GetMinWavLength())
                                                     for padBytes := 0; padBytes < comp.CurrSong.Target.GetMinWavLength() - len(lst.MainPart); padBytes++ {
                                                         lst.MainPart = append(lst.MainPart, 0)
                                                     }
 
                                                 } else if len(lst.MainPart) > comp.CurrSong.Target.GetMaxWavLength() {
-                                                    WARNING("Truncating waveform")
+                                                    comp.ctx.WARNINGC(DIAG_OUT_OF_RANGE, "Truncating waveform")
                                                     lst.MainPart = lst.MainPart[0:comp.CurrSong.Target.GetMaxWavLength()]
                                                 }
-                                                effects.Waveforms.Append(num, lst)
+                                                comp.effects.Waveforms.Append(num, lst)
                                             } else {
-                                                ERROR("Waveform data out of range: " + lst.Format())
+                                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Waveform data out of range: %s", lst.Format())
                                             }
                                         } else {
-                                            ERROR("Loops not supported in waveform: " + lst.Format())
+                                            comp.ctx.ERRORC(DIAG_UNSUPPORTED, "Loops not supported in waveform: %s", lst.Format())
                                         }
                                     } else {            // @WTM
                                         // ToDo: fix
@@ -465,24 +607,24 @@ func (comp *Compiler) handleAtCommand() {
                                         for j := MAIN_PART; j <= LOOPED_PART; j++ {
                                             listPart := lst.GetPart(j)
                                             if (len(*listPart) & 1) == 1 {
-                                                ERROR("Bad WTM list. Length must be even: " + lst.Format())
+                                                comp.ctx.ERRORC(DIAG_BAD_LENGTH, "Bad WTM list. Length must be even: %s", lst.Format())
                                             }
                                             for i, elem := range *listPart {
                                                 if (i & 1) == 0 {
                                                     if wtmElem, ok := elem.([]interface{}); ok {
                                                         if len(wtmElem) == 2 {
                                                             if wtNum, wtNumOk := wtmElem[1].(int); wtNumOk {
-                                                                if effects.Waveforms.FindKey(wtNum) >= 0 {
+                                                                if comp.effects.Waveforms.FindKey(wtNum) >= 0 {
                                                                     convertedList.AppendToPart(j, wtNum)
-                                                                    effects.Waveforms.AddRef(wtNum)
+                                                                    comp.effects.Waveforms.AddRef(wtNum)
                                                                 } else {
-                                                                    ERROR("WT%d has not been declared (at index %d)", wtNum, i)
+                                                                    comp.ctx.ERRORC(DIAG_UNDEFINED, "WT%d has not been declared (at index %d)", wtNum, i)
                                                                 }
                                                             } else {
-                                                                ERROR("Bad WTM list. Expected WT<num> at index %d: " + lst.Format(), i)
+                                                                comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad WTM list. Expected WT<num> at index %d: %s", i, lst.Format())
                                                             }
                                                         } else {
-                                                            ERROR("Bad WTM list. Expected WT<num> <frames>: " + lst.Format())
+                                                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad WTM list. Expected WT<num> <frames>: %s", lst.Format())
                                                         }
                                                     } else {
                                                         switch elem.(type) {
@@ -493,37 +635,37 @@ func (comp *Compiler) handleAtCommand() {
                                                         default:
                                                             fmt.Printf("Unknown type\n")
                                                         }
-                                                        ERROR("Bad WTM list (error at index %d): " + lst.Format(), i)
+                                                        comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad WTM list (error at index %d): %s", i, lst.Format())
                                                     }
                                                 } else {
                                                     if numFrames, ok := elem.(int); ok {
                                                         if !inRange(numFrames, 1, 127) {
-                                                            ERROR("Expected an integer in the range 1..127, got %d", numFrames)
+                                                            comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Expected an integer in the range 1..127, got %d", numFrames)
                                                         }
                                                         convertedList.AppendToPart(j, numFrames)
                                                     } else {
-                                                        ERROR("Bad WTM list. Expected an integer at index %d: " + lst.Format(), i)
+                                                        comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad WTM list. Expected an integer at index %d: %s", i, lst.Format())
                                                     }
                                                 }
                                             }
                                         }
-                                        effects.WaveformMacros.Append(num, convertedList)
-                                        effects.WaveformMacros.PutExtraInt(num, effects.EXTRA_EFFECT_FREQ, comp.getEffectFrequency())                            
+                                        comp.effects.WaveformMacros.Append(num, convertedList)
+                                        comp.effects.WaveformMacros.PutExtraInt(num, effects.EXTRA_EFFECT_FREQ, comp.getEffectFrequency())                            
                                     }
                                  }else {
-                                    ERROR("Bad waveform: " + t)
+                                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad waveform: %s", t)
                                 }
                             } else {
-                                WARNING("Unsupported command for this target: @WT")
+                                comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for this target: @WT")
                             }
                         } else {
-                            ERROR("Expected '='")
+                            comp.ctx.ERRORC(DIAG_SYNTAX, "Expected '='")
                         }
                     } else {
-                        ERROR("Redefinition of @" + s)
+                        comp.ctx.ERRORC(DIAG_REDEFINITION, "Redefinition of @%s", s)
                     }
                 } else {
-                    ERROR("Syntax error: @" + s)
+                    comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: @%s", s)
                 }       
 
             } else if strings.HasPrefix(s, "XPCM") {
@@ -534,14 +676,14 @@ func (comp *Compiler) handleAtCommand() {
 
             } else if strings.HasPrefix(s, "te") {
                 //t := s[2:]
-                m = Parser.Getch()
+                m = comp.ctx.Parser.Getch()
                 num1, err1 := strconv.Atoi(s[2:])
                 num2 := 7
                 err2 := error(nil)
                 if m == ',' {
-                    num2, err2 = strconv.Atoi(Parser.GetNumericString()) 
+                    num2, err2 = strconv.Atoi(comp.ctx.Parser.GetNumericString()) 
                 } else {
-                    Parser.Ungetch()
+                    comp.ctx.Parser.Ungetch()
                 }
 
                 if err1 == nil && err2 == nil {
@@ -549,7 +691,7 @@ func (comp *Compiler) handleAtCommand() {
                         chn.WriteNote(true)
                     }
                     if comp.CurrSong.GetNumActiveChannels() == 0 {
-                        WARNING("Trying to set tone envelope with no active channels")
+                        comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set tone envelope with no active channels")
                     } else {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
@@ -569,16 +711,16 @@ func (comp *Compiler) handleAtCommand() {
                                         }
                                         chn.AddCmd([]int{defs.CMD_HWTE, num1})
                                     } else {
-                                        ERROR("Tone envelope number out of range: " + s)
+                                        comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Tone envelope number out of range: %s", s)
                                     }
                                 } else {
-                                    WARNING("Unsupported command for channel " + chn.GetName() + ": @" + s)
+                                    comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for channel %s: @%s", chn.GetName(), s)
                                 }
                             }
                         }
                     } 
                 } else {
-                    ERROR("Bad tone envelope: " + s)
+                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad tone envelope: %s", s)
                 }
 
             } else if strings.HasPrefix(s, "es") {
@@ -588,7 +730,7 @@ func (comp *Compiler) handleAtCommand() {
                         chn.WriteNote(true)
                     }
                     if comp.CurrSong.GetNumActiveChannels() == 0 {
-                        WARNING("Trying to set envelope speed with no active channels")
+                        comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set envelope speed with no active channels")
                     } else if inRange(num, 0, 65535) {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
@@ -597,15 +739,15 @@ func (comp *Compiler) handleAtCommand() {
                                     num ^= 0xFFFF
                                     chn.AddCmd([]int{defs.CMD_HWES, (num & 0xFF), (num / 0x100)})
                                 default:
-                                    WARNING("Unsupported command for this target: es")
+                                    comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for this target: es")
                                 }
                             }
                         }
                     } else {
-                        ERROR("Bad envelope speed: " + s)
+                        comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad envelope speed: %s", s)
                     }
                 } else {
-                    ERROR("Bad tone envelope: " + s)
+                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad tone envelope: %s", s)
                 }
 
             } else if strings.HasPrefix(s, "ve") {
@@ -626,7 +768,7 @@ func (comp *Compiler) handleAtCommand() {
                         }
                     }
                     if comp.CurrSong.GetNumActiveChannels() == 0 {
-                        WARNING("Trying to set volume envelope with no active channels")
+                        comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set volume envelope with no active channels")
                     } else if err == nil {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
@@ -650,32 +792,32 @@ func (comp *Compiler) handleAtCommand() {
                                         }
                                         chn.AddCmd([]int{defs.CMD_HWVE, num | m})
                                     } else {
-                                        ERROR("Volume envelope value out of range: " + s[2:])
+                                        comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Volume envelope value out of range: %s", s[2:])
                                     }
                                 } else {
-                                    WARNING("Unsupported command for channel " + chn.GetName() + ": @" + s)
+                                    comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for channel %s: @%s", chn.GetName(), s)
                                 }
                             }
                         }
                     } else {
-                        ERROR("Bad volume envelope: " + s)
+                        comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad volume envelope: %s", s)
                     }
                 } else {
-                    ERROR("Bad volume envelope: " + s)
+                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad volume envelope: %s", s)
                 }
 
             // Volume macro definition
             } else if strings.HasPrefix(s, "v") {
                 num, err := strconv.Atoi(s[1:])
                 if err == nil {
-                    idx := effects.VolumeMacros.FindKey(num)
+                    idx := comp.effects.VolumeMacros.FindKey(num)
                     if comp.CurrSong.GetNumActiveChannels() == 0 {
                         if len(comp.patName) > 0 {
                         } else {
                             if idx < 0 {
-                                t := Parser.GetString()
+                                t := comp.ctx.Parser.GetString()
                                 if t == "=" {
-                                    lst, err := Parser.GetList()
+                                    lst, err := comp.ctx.Parser.GetList()
                                     if err == nil {
                                         if inRange(lst.MainPart,
                                                    comp.CurrSong.Target.GetMinVolume(),
@@ -683,83 +825,82 @@ func (comp *Compiler) handleAtCommand() {
                                            inRange(lst.LoopedPart,
                                                    comp.CurrSong.Target.GetMinVolume(),
                                                    comp.CurrSong.Target.GetMaxVolume()) {
-                                            effects.VolumeMacros.Append(num, lst)
-                                            effects.VolumeMacros.PutExtraInt(num, effects.EXTRA_EFFECT_FREQ, comp.getEffectFrequency())
+                                            comp.effects.VolumeMacros.Append(num, lst)
+                                            comp.effects.VolumeMacros.PutExtraInt(num, effects.EXTRA_EFFECT_FREQ, comp.getEffectFrequency())
                                         } else {
-                                            ERROR("@v: Value out of range: " + lst.Format() +
-                                                fmt.Sprintf(", Min=%d Max=%d", comp.CurrSong.Target.GetMinVolume(), comp.CurrSong.Target.GetMaxVolume()))
+                                            comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "@v: Value out of range: %s%s", lst.Format(), fmt.Sprintf(", Min=%d Max=%d", comp.CurrSong.Target.GetMinVolume(), comp.CurrSong.Target.GetMaxVolume()))
                                         }
                                     } else {
-                                        ERROR("Bad volume macro: " + t)
+                                        comp.ctx.ERRORC(DIAG_MACRO, "Bad volume macro: %s", t)
                                     }
                                 } else {
-                                    ERROR("Expected '='")
+                                    comp.ctx.ERRORC(DIAG_SYNTAX, "Expected '='")
                                 }
                             } else {
-                                ERROR("Redefinition of @" + s)
+                                comp.ctx.ERRORC(DIAG_REDEFINITION, "Redefinition of @%s", s)
                             }
                         }
                     } else {
                         if idx < 0 {
-                            ERROR("Undefined macro: @" + s)
+                            comp.ctx.ERRORC(DIAG_MACRO, "Undefined macro: @%s", s)
                         } else {
                             for _, chn := range comp.CurrSong.Channels {
                                 if chn.Active {
-                                    if !effects.VolumeMacros.IsEmpty(num) {
-                                        if effects.VolumeMacros.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) == defs.EFFECT_STEP_EVERY_FRAME {
+                                    if !comp.effects.VolumeMacros.IsEmpty(num) {
+                                        if comp.effects.VolumeMacros.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) == defs.EFFECT_STEP_EVERY_FRAME {
                                             chn.AddCmd([]int{defs.CMD_VOLMAC, idx + 1})
                                         } else {
                                             chn.AddCmd([]int{defs.CMD_VOLMAC, (idx + 1) | 0x80})
                                         }
-                                        effects.VolumeMacros.AddRef(num)
+                                        comp.effects.VolumeMacros.AddRef(num)
                                     }
                                 }
                             }
                         }
                     }
                 } else {
-                    ERROR("Syntax error: @" + s)
+                    comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: @%s", s)
                 }       
 
             // Pulse width macro
             } else if strings.HasPrefix(s, "pw") {
                 num, err := strconv.Atoi(s[2:])
                 if err == nil {
-                    idx := effects.PulseMacros.FindKey(num)
+                    idx := comp.effects.PulseMacros.FindKey(num)
                     if comp.CurrSong.GetNumActiveChannels() == 0 {
                         if len(comp.patName) > 0 {
                         } else {
                             if idx < 0 {
-                                t := Parser.GetString()
+                                t := comp.ctx.Parser.GetString()
                                 if t == "=" {
-                                    lst, err := Parser.GetList()
+                                    lst, err := comp.ctx.Parser.GetList()
                                     if err == nil {
                                         if inRange(lst.MainPart, 0, 15) &&
                                            inRange(lst.LoopedPart, 0, 15) {
-                                            effects.PulseMacros.Append(num, lst)
-                                            effects.PulseMacros.PutExtraInt(num, effects.EXTRA_EFFECT_FREQ, comp.getEffectFrequency())
+                                            comp.effects.PulseMacros.Append(num, lst)
+                                            comp.effects.PulseMacros.PutExtraInt(num, effects.EXTRA_EFFECT_FREQ, comp.getEffectFrequency())
                                         } else {
-                                            ERROR("Value out of range: " + lst.Format())
+                                            comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Value out of range: %s", lst.Format())
                                         }
                                     } else {
-                                        ERROR("Bad pulse width macro: " + t)
+                                        comp.ctx.ERRORC(DIAG_MACRO, "Bad pulse width macro: %s", t)
                                     }
                                 } else {
-                                    ERROR("Expected '='")
+                                    comp.ctx.ERRORC(DIAG_SYNTAX, "Expected '='")
                                 }
                             } else {
-                                ERROR("Redefinition of @" + s)
+                                comp.ctx.ERRORC(DIAG_REDEFINITION, "Redefinition of @%s", s)
                             }
                         }
                     } else {
                         if idx < 0 {
-                            ERROR("Undefined macro: @" + s)
+                            comp.ctx.ERRORC(DIAG_MACRO, "Undefined macro: @%s", s)
                         } else {
                             for _, chn := range comp.CurrSong.Channels {
                                 if chn.Active {
-                                    if !effects.PulseMacros.IsEmpty(num) {
+                                    if !comp.effects.PulseMacros.IsEmpty(num) {
                                         chn.AddCmd([]int{defs.CMD_PULMAC, idx})
-                                        effects.PulseMacros.AddRef(num)
+                                        comp.effects.PulseMacros.AddRef(num)
                                         chn.UsesEffect["PM"] = true  // was "pw"
                                     }
                                 }
@@ -767,7 +908,7 @@ func (comp *Compiler) handleAtCommand() {
                         }
                     }
                 } else {
-                    ERROR("Syntax error: @" + s)
+                    comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: @%s", s)
                 }       
 
             } else if strings.HasPrefix(s, "q") {
@@ -777,7 +918,7 @@ func (comp *Compiler) handleAtCommand() {
                         chn.WriteNote(true)
                     }
                     if comp.CurrSong.GetNumActiveChannels() == 0 {
-                        WARNING("Trying to set cutoff with no active channels")
+                        comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set cutoff with no active channels")
                     } else if num >= -15 && num <= 15 {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
@@ -797,49 +938,434 @@ func (comp *Compiler) handleAtCommand() {
                             }
                         }
                     } else {
-                        ERROR("Bad cutoff: " + s)
+                        comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad cutoff: %s", s)
                     }
                 } else {
-                    ERROR("Bad cutoff: " + s)
+                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad cutoff: %s", s)
                 }
 
             } else {
-                ERROR("Syntax error: @" + s)
+                comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: @%s", s)
             }
         }
     } else {
-        ERROR("Unexpected end of file")
+        comp.ctx.ERRORC(DIAG_SYNTAX, "Unexpected end of file")
     }
 }
 
 
-func (comp *Compiler) CompileFile(fileName string) {
+/* Compiles the given file. Returns an error describing the problems found
+ * if the compilation failed; the same diagnostics can also be found in
+ * comp.Diagnostics.
+ */
+func (comp *Compiler) CompileFile(fileName string) (err error) {
+    return comp.compile(fileName, nil)
+}
+
+/* Compiles MML code that has already been read into memory. fileName is
+ * used in diagnostics and for resolving #INCLUDEs.
+ */
+func (comp *Compiler) CompileSource(fileName string, data []byte) (err error) {
+    return comp.compile(fileName, data)
+}
+
+/* Compiles data, or the contents of fileName if data is nil.
+ */
+func (comp *Compiler) compile(fileName string, data []byte) (err error) {
     var prevLine int
-    var dotOff, tieOff, slurOff bool
+    var newParser *ParserState
     var parserCreationError error
     
-    OldParsers.Push(Parser)
-    
-    Parser,parserCreationError = NewParserState(fileName)
+    // Only the outermost call catches errors; any #INCLUDEd files pass them on
+    isTopLevel := comp.ctx.OldParsers.Len() == 0
+    if isTopLevel {
+        defer func() {
+            // Unwind any parsers left behind by an aborted compilation
+            for comp.ctx.OldParsers.Len() > 0 {
+                comp.ctx.Parser = comp.ctx.OldParsers.PopParserState()
+            }
+            comp.includeStack = nil
+        }()
+        defer comp.ctx.RecoverErrors(&err)
+    }
+
+    key := comp.ctx.FileKey(fileName)
+    if comp.onceFiles[key] {
+        return nil
+    }
+    for _, included := range comp.includeStack {
+        if comp.ctx.FileKey(included) == key {
+            // Show the whole include stack, e.g. "song.mml -> a.mml -> b.mml -> a.mml"
+            chain := []string{}
+            for _, name := range comp.includeStack {
+                chain = append(chain, filepath.Base(name))
+            }
+            chain = append(chain, filepath.Base(fileName))
+            comp.ctx.ERRORC(DIAG_INPUT_FILE, "Circular #INCLUDE: %s", strings.Join(chain, " -> "))
+        }
+    }
+
+    if data != nil {
+        newParser = NewParserStateFromData(fileName, data, comp.ctx)
+    } else {
+        newParser, parserCreationError = NewParserState(fileName, comp.ctx)
+    }
     if parserCreationError != nil {
-        ERROR("Failed to read file: " + fileName);
+        comp.ctx.ERRORC(DIAG_FILE_NOT_FOUND, "Failed to read file: %s", fileName);
     }
+
+    comp.includedFiles[key] = true
+    comp.includeStack = append(comp.includeStack, fileName)
+    comp.ctx.OldParsers.Push(comp.ctx.Parser)
+    comp.ctx.Parser = newParser
     
+    // After an error, skip the rest of the failed command and carry on from there
+    for !comp.compileCommands(&prevLine) {
+        comp.resync()
+    }
+    
+    comp.writeAllPendingNotes(true)
+    comp.ctx.Parser = comp.ctx.OldParsers.PopParserState()
+    comp.includeStack = comp.includeStack[:len(comp.includeStack)-1]
+
+    if isTopLevel {
+        return comp.Diagnostics.Err()
+    }
+    return nil
+}
+
+
+/* Skips the rest of a command that failed to compile. Compilation resumes
+ * at the next command on the same line, or at a } that closes an open pattern
+ * or tuple, so that the pattern or tuple still gets closed. Meta-commands and
+ * definitions are skipped up to the end of the line. Tuples on the active
+ * channels that are still open at the end of the line are discarded.
+ */
+func (comp *Compiler) resync() {
+    if comp.ctx.Parser.LineNum != comp.currentCmdLine {
+        // The failed command already consumed the rest of its line
+        return
+    }
+    wholeLine := comp.currentCmd == '#' || comp.CurrSong.GetNumActiveChannels() == 0
+    tupleOpen := false
+    for _, chn := range comp.CurrSong.Channels {
+        if chn.Active && chn.Tuple.Active {
+            tupleOpen = true
+        }
+    }
+    depth := 0
+    for {
+        c := comp.ctx.Parser.Peekch()
+        if c == -1 || c == '\n' {
+            for _, chn := range comp.CurrSong.Channels {
+                if chn.Active && chn.Tuple.Active {
+                    chn.AbortTuple()
+                }
+            }
+            return
+        }
+        if c == '{' {
+            depth++
+        } else if c == '}' {
+            if depth == 0 && (len(comp.patName) > 0 || tupleOpen) {
+                return
+            } else if depth > 0 {
+                depth--
+            }
+        } else if depth == 0 && !wholeLine && (c == ' ' || c == '\t' || c == '\r') {
+            return
+        }
+        comp.ctx.Parser.Getch()
+    }
+}
+
+
+/* Ends the definition of the current pattern and adds it to the pattern
+ * map.
+ */
+func (comp *Compiler) finishPattern() {
+    patChan := comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ]
+    patChan.AddCmd([]int{defs.CMD_RTS})
+    comp.pattern.Cmds = make([]int, len(patChan.Cmds))
+    copy(comp.pattern.Cmds, patChan.Cmds)
+    comp.pattern.CmdSources = make([]*utils.SourceLocation, len(patChan.CmdSources))
+    copy(comp.pattern.CmdSources, patChan.CmdSources)
+    comp.pattern.AddrOperands = append([]int{}, patChan.AddrOperands...)
+    comp.pattern.HasAnyNote = patChan.HasAnyNote
+    comp.pattern.NumTicks = patChan.Ticks - comp.pattern.startTick
+    comp.pattern.PlayFrames = patChan.PlayFrames
+    comp.patterns.Append(comp.patName, comp.pattern)
+    comp.ctx.Printf("Pattern ticks: %d\n", comp.pattern.NumTicks)
+    /*patterns[1] = append(patterns[1], patName)
+    patterns[2] = append(patterns[2], songs[songNum][length(songs[songNum])])
+    patterns[3] &= hasAnyNote[length(supportedChannels)]
+    patterns[4] &= songLen[songNum][length(supportedChannels)]*/
+    comp.patName = ""
+    patChan.Active = false
+    patChan.ClearCmds()
+}
+
+
+/* Adds a call to the named pattern to the channel.
+ */
+func (comp *Compiler) addPatternCall(chn *channel.Channel, name string) {
+    chn.AddCmd([]int{defs.CMD_JSR, comp.patterns.FindKey(name)})
+    chn.Ticks += comp.patterns.GetNumTicks(name)
+    chn.PlayFrames += comp.patterns.GetPlayFrames(name)
+    chn.HasAnyNote = chn.HasAnyNote || comp.patterns.HasAnyNote(name)
+    chn.UsesEffect["EN"] = true
+    chn.UsesEffect["EN2"] = true
+    chn.UsesEffect["EP"] = true
+    chn.UsesEffect["MP"] = true
+    chn.UsesEffect["DM"] = true
+    chn.UsesEffect["pw"] = true
+}
+
+
+/* Adds a copy of the named pattern's commands (minus its CMD_RTS) to the
+ * channel. This is how calls nested deeper than the player's CMD_JSR can go
+ * are compiled.
+ */
+func (comp *Compiler) addPatternCopy(chn *channel.Channel, name string) {
+    pattern := comp.patterns.data[comp.patterns.FindKey(name)]
+    last := len(pattern.Cmds) - 1
+    chn.AppendCmds(pattern.Cmds[:last], pattern.CmdSources[:last], pattern.AddrOperands, 0)
+    chn.Ticks += pattern.NumTicks
+    chn.PlayFrames += pattern.PlayFrames
+    chn.HasAnyNote = chn.HasAnyNote || pattern.HasAnyNote
+    chn.UsesEffect["EN"] = true
+    chn.UsesEffect["EN2"] = true
+    chn.UsesEffect["EP"] = true
+    chn.UsesEffect["MP"] = true
+    chn.UsesEffect["DM"] = true
+    chn.UsesEffect["pw"] = true
+}
+
+
+/* The arguments of a pattern invocation, e.g. \bass(K+5, v-2, o-1, 2).
+ */
+type patternArgs struct {
+    transpose int   // K+n / K-n
+    volume int      // v+n / v-n, added to the pattern's absolute volumes
+    octave int      // o+n / o-n
+    repeat int      // How many times the pattern is played
+}
+
+
+func (comp *Compiler) parsePatternArgs(s string) patternArgs {
+    args := patternArgs{repeat: 1}
+    if len(strings.TrimSpace(s)) == 0 {
+        return args
+    }
+    for _, arg := range strings.Split(s, ",") {
+        arg = strings.TrimSpace(arg)
+        var dest *int
+        switch {
+        case strings.HasPrefix(arg, "K"):
+            dest = &args.transpose
+        case strings.HasPrefix(arg, "v"):
+            dest = &args.volume
+        case strings.HasPrefix(arg, "o"):
+            dest = &args.octave
+        default:
+            num, err := strconv.Atoi(arg)
+            if err != nil || num < 1 {
+                comp.ctx.ERRORC(DIAG_PATTERN, "Bad pattern argument: %s", arg)
+            }
+            args.repeat = num
+            continue
+        }
+        num, err := strconv.Atoi(arg[1:])
+        if err != nil {
+            comp.ctx.ERRORC(DIAG_PATTERN, "Bad pattern argument: %s", arg)
+        }
+        *dest = num
+    }
+    return args
+}
+
+
+/* Warns that the volume offset of the pattern variant being compiled took
+ * an absolute volume out of range, so that vol was used instead of wanted.
+ */
+func (comp *Compiler) warnVolumeClamped(wanted, vol int) {
+    comp.ctx.WARNINGC(DIAG_VOLUME_CLAMPED, "The volume offset %+d takes the volume of pattern %s to %d, which is limited to %d",
+                      comp.volumeOffset, comp.patName, wanted, vol)
+}
+
+
+/* Compiles a copy of the given pattern with volumeOffset added to all of
+ * its absolute volume commands, and adds it to the pattern map as name.
+ * The copy is compiled from the pattern's source code, starting from the
+ * same channel state as the original. If caller isn't nil, the note lengths
+ * are computed from the tempo map at the tick that the caller is at.
+ */
+func (comp *Compiler) compilePatternVariant(base *MmlPattern, name string, volumeOffset int, caller *channel.Channel) {
+    if len(base.source) == 0 {
+        if volumeOffset != 0 {
+            comp.ctx.ERRORC(DIAG_PATTERN, "Unable to apply a volume offset to pattern %s", name)
+        }
+        comp.ctx.ERRORC(DIAG_TEMPO, "Unable to apply the tempo map to pattern %s", name)
+    }
+
+    patChan := comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ]
+    savedChan := *patChan
+    savedActive := make([]bool, len(comp.CurrSong.Channels))
+    for i, chn := range comp.CurrSong.Channels {
+        savedActive[i] = chn.Active
+        chn.Active = false
+    }
+    savedLocation := comp.ctx.CommandLocation
+    savedParser := comp.ctx.Parser
+    // The variant may be needed while another pattern (or variant) is being defined
+    savedPattern, savedPatName, savedVolumeOffset := comp.pattern, comp.patName, comp.volumeOffset
+    savedPatternStart, savedPatternParser := comp.patternStart, comp.patternParser
+    defer func() {
+        *patChan = savedChan
+        for i, chn := range comp.CurrSong.Channels {
+            chn.Active = savedActive[i]
+        }
+        comp.ctx.CommandLocation = savedLocation
+        comp.pattern, comp.patName, comp.volumeOffset = savedPattern, savedPatName, savedVolumeOffset
+        comp.patternStart, comp.patternParser = savedPatternStart, savedPatternParser
+        if comp.ctx.Parser != savedParser {
+            // The variant failed to compile
+            comp.ctx.Parser = comp.ctx.OldParsers.PopParserState()
+        }
+    }()
+
+    *patChan = base.startState
+    patChan.ClearCmds()
+    patChan.Tuple.Cmds = nil
+    patChan.Tuple.Outer = nil
+    patChan.Active = true
+    comp.patName = name
+    comp.pattern = &MmlPattern{Depth: 1}
+    if caller != nil {
+        // Note lengths are taken from the tempo map at the position the caller is at
+        patChan.Ticks = caller.Ticks
+        patChan.SongTempos = caller.SongTempos
+        comp.pattern.startTick = caller.Ticks
+    }
+    comp.volumeOffset = volumeOffset
+
+    parser := NewParserStateFromData(base.fileName, []byte(base.source), comp.ctx)
+    parser.LineNum = base.line
+    parser.Column = base.column
+    parser.FrameKind, parser.FrameName = FRAME_PATTERN, name
+    prevLine := parser.LineNum
+    comp.ctx.OldParsers.Push(comp.ctx.Parser)
+    comp.ctx.Parser = parser
+    for !comp.compileCommands(&prevLine) {
+        comp.resync()
+    }
+    comp.writeAllPendingNotes(true)
+    comp.ctx.Parser = comp.ctx.OldParsers.PopParserState()
+
+    comp.finishPattern()
+}
+
+
+/* Returns the name of the copy of the pattern base (with the given volume
+ * offset) to call on the channel, or "" if the pattern itself can be used.
+ * When the song has a tempo map (#TEMPO-AT), the lengths of the notes depend
+ * on where the pattern is played, so it is compiled again for the tick that
+ * the channel is at. Copies that turn out identical are shared.
+ */
+func (comp *Compiler) tempoVariant(base string, volume int, chn *channel.Channel) string {
+    if chn.SongTempos == nil || len(chn.SongTempos.Changes) == 0 {
+        return ""
+    }
+    prefix := base
+    if volume != 0 {
+        prefix = fmt.Sprintf("%s(v%+d)", base, volume)
+    }
+    name := fmt.Sprintf("%s@%d", prefix, chn.Ticks)
+    if alias, ok := comp.patternAliases[name]; ok {
+        return alias
+    }
+    if comp.patterns.FindKey(name) < 0 {
+        comp.compilePatternVariant(comp.patterns.data[comp.patterns.FindKey(base)], name, volume, chn)
+        variant := comp.patterns.data[comp.patterns.FindKey(name)]
+        candidates := []string{prefix}
+        for _, key := range comp.patterns.keys {
+            if strings.HasPrefix(key, prefix + "@") && key != name {
+                candidates = append(candidates, key)
+            }
+        }
+        for _, key := range candidates {
+            if idx := comp.patterns.FindKey(key); idx >= 0 && comp.patterns.data[idx].SameCommands(variant) {
+                comp.patterns.RemoveLast()
+                comp.patternAliases[name] = key
+                return key
+            }
+        }
+    }
+    return name
+}
+
+
+/* Parses a tempo on the form  <tempo>[~<end tempo>:<bars>], where the
+ * optional part is a gradual change (accelerando / ritardando) from tempo
+ * to end tempo over the given number of bars.
+ * The Tick field of the returned change is not set.
+ */
+func (comp *Compiler) parseTempo() channel.TempoChange {
+    s := comp.ctx.Parser.GetNumericString()
+    tempo, err := strconv.Atoi(s)
+    if err != nil || !inRange(tempo, 1, comp.CurrSong.Target.GetMaxTempo()) {
+        comp.ctx.ERRORC(DIAG_TEMPO, "Bad tempo: %s", s)
+    }
+    change := channel.TempoChange{Tempo: tempo, EndTempo: tempo}
+    
+    if comp.ctx.Parser.Peekch() == '~' {
+        comp.ctx.Parser.Getch()
+        s = comp.ctx.Parser.GetNumericString()
+        endTempo, err := strconv.Atoi(s)
+        if err != nil || !inRange(endTempo, 1, comp.CurrSong.Target.GetMaxTempo()) {
+            comp.ctx.ERRORC(DIAG_TEMPO, "Bad tempo: %s", s)
+        }
+        if comp.ctx.Parser.Getch() != ':' {
+            comp.ctx.ERRORC(DIAG_TEMPO, "Expected : followed by the length of the tempo change in bars")
+        }
+        s = comp.ctx.Parser.GetNumericString()
+        bars, err := strconv.Atoi(s)
+        if err != nil || bars < 1 {
+            comp.ctx.ERRORC(DIAG_TEMPO, "Bad length of tempo change: %s", s)
+        }
+        change.EndTempo = endTempo
+        change.RampTicks = bars * channel.TICKS_PER_BAR
+    }
+    return change
+}
+
+
+/* Compiles commands until the end of the current file is reached, in which
+ * case true is returned. Returns false if a command failed to compile.
+ */
+func (comp *Compiler) compileCommands(prevLine *int) (done bool) {
+    var dotOff, tieOff, slurOff bool
+
+    defer RecoverCommandError(&done)
+
     for {
         characterHandled := false
 
-        c := Parser.Getch()
+        c := comp.ctx.Parser.Getch()
         if c == -1 {
             break
         }
+        comp.ctx.CommandLocation = comp.ctx.Location()
+        comp.currentCmd = c
+        comp.currentCmdLine = comp.ctx.Parser.LineNum
                 
         c2 := c
                 
         if c == '\n' {
-            Parser.AdvanceLine()
+            comp.ctx.Parser.AdvanceLine()
         }
         
-        if Parser.LineNum > prevLine {
+        if comp.ctx.Parser.LineNum > *prevLine {
             if !comp.keepChannelsActive {
                 for i, _ := range comp.CurrSong.Channels {
                     if i < len(comp.CurrSong.Channels)-1 {
@@ -847,7 +1373,7 @@ func (comp *Compiler) CompileFile(fileName string) {
                     }
                 }
             }
-            prevLine = Parser.LineNum
+            *prevLine = comp.ctx.Parser.LineNum
         }
 
         /* Meta-commands */
@@ -883,175 +1409,208 @@ func (comp *Compiler) CompileFile(fileName string) {
                 for _, chn := range comp.CurrSong.Channels {
                     chn.WriteNote(true)
                 }
-                s := Parser.GetStringInRange(ALPHANUM)
-                Parser.SkipWhitespace()
-                m := Parser.Getch()
+                s := comp.ctx.Parser.GetStringInRange(ALPHANUM)
+                comp.ctx.Parser.SkipWhitespace()
+                m := comp.ctx.Parser.Getch()
                 if len(s) > 0 {
-                    comp.pattern = &MmlPattern{}
                     if m == '(' {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("Pattern invokation with no active channels")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Pattern invokation with no active channels")
                         } else {
-                            if comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].Active {
-                                ERROR("Pattern invokation found inside pattern")
-                            } else {
-                                t := Parser.GetStringUntil(")")
-                                if len(t) > 0 {
-                                }
-                                Parser.SkipWhitespace()
-                                n := Parser.Getch()
-                                if n != ')' {
-                                    ERROR("Expected ), got " + string(byte(n)))
+                            inPattern := len(comp.patName) > 0
+                            t := comp.ctx.Parser.GetStringUntil(")")
+                            args := comp.parsePatternArgs(t)
+                            comp.ctx.Parser.SkipWhitespace()
+                            n := comp.ctx.Parser.Getch()
+                            if n != ')' {
+                                comp.ctx.ERRORC(DIAG_SYNTAX, "Expected ), got %c", n)
+                            }
+
+                            // Pattern invokation
+                            // Patterns called from a pattern variant get the variant's volume offset as well
+                            args.volume += comp.volumeOffset
+                            base := s
+                            idx := comp.patterns.FindKey(s)
+                            if idx < 0 {
+                                comp.ctx.ERRORC(DIAG_PATTERN, "Undefined pattern: %s", s)
+                            }
+                            depth := comp.patterns.GetDepth(s)
+                            if inPattern || comp.section != nil {
+                                // The pattern (or section) being defined has to be called as well
+                                depth++
+                            }
+                            // Calls nested deeper than the player supports get the pattern's
+                            // body compiled in place instead
+                            inline := depth > comp.CurrSong.Target.GetMaxPatternDepth() && (inPattern || comp.section != nil)
+                            if inline {
+                                depth--
+                            }
+                            if args.volume != 0 {
+                                // Volume offsets are applied to a copy of the pattern
+                                variant := fmt.Sprintf("%s(v%+d)", s, args.volume)
+                                if comp.patterns.FindKey(variant) < 0 {
+                                    comp.compilePatternVariant(comp.patterns.data[idx], variant, args.volume, nil)
                                 }
+                                s = variant
+                            }
+                            if depth > comp.CurrSong.Target.GetMaxPatternDepth() {
+                                comp.ctx.ERRORC(DIAG_PATTERN, "Patterns nested too deeply: %d levels (max %d for this target)", depth, comp.CurrSong.Target.GetMaxPatternDepth())
+                            }
+                            if inPattern && depth > comp.pattern.Depth {
+                                comp.pattern.Depth = depth
+                            } else if comp.section != nil && depth > comp.section.depth {
+                                comp.section.depth = depth
+                            }
 
-                                // Pattern invokation
-                                idx := comp.patterns.FindKey(s)
-                                if idx >= 0 {
-                                    for _, chn := range comp.CurrSong.Channels {
-                                        if chn.Active {
-                                            chn.AddCmd([]int{defs.CMD_JSR, idx})
-                                            chn.HasAnyNote = chn.HasAnyNote || comp.patterns.HasAnyNote(s)
-                                            chn.Ticks += comp.patterns.GetNumTicks(s)
-                                            chn.UsesEffect["EN"] = true
-                                            chn.UsesEffect["EN2"] = true
-                                            chn.UsesEffect["EP"] = true
-                                            chn.UsesEffect["MP"] = true
-                                            chn.UsesEffect["DM"] = true
-                                            chn.UsesEffect["pw"] = true
+                            // Transposition and octave shifts are done by the player
+                            transpose := args.transpose + args.octave * 12
+                            if inPattern && transpose != 0 {
+                                // The transpose setting of the caller isn't known here, so it couldn't be restored
+                                comp.ctx.ERRORC(DIAG_PATTERN, "Transposed pattern invokations are not supported inside patterns")
+                            }
+                            for _, chn := range comp.CurrSong.Channels {
+                                if chn.Active && transpose != 0 {
+                                    if !inRange(chn.CurrentTranspose + transpose, -127, 127) {
+                                        comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Transpose value out of range: %d", chn.CurrentTranspose + transpose)
+                                    }
+                                    chn.AddCmd([]int{defs.CMD_TRANSP, chn.CurrentTranspose + transpose})
+                                }
+                            }
+                            for _, chn := range comp.CurrSong.Channels {
+                                if chn.Active {
+                                    for i := 0; i < args.repeat; i++ {
+                                        name := s
+                                        if variant := comp.tempoVariant(base, args.volume, chn); variant != "" && (!inPattern || inline) {
+                                            name = variant
+                                        }
+                                        if inline {
+                                            comp.addPatternCopy(chn, name)
+                                        } else {
+                                            comp.addPatternCall(chn, name)
                                         }
                                     }
-                                } else {
-                                    ERROR("Undefined pattern: " + s)
+                                }
+                            }
+                            for _, chn := range comp.CurrSong.Channels {
+                                if chn.Active && transpose != 0 {
+                                    chn.AddCmd([]int{defs.CMD_TRANSP, chn.CurrentTranspose})
                                 }
                             }
                         }
                     } else if m == '{' {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
                             comp.patName = s
+                            comp.pattern = &MmlPattern{Depth: 1}
                             comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].Active = true
-                            comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].Cmds = []int{}
+                            comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].ClearCmds()
+                            // The length of the pattern is added to the callers, so it must not include earlier patterns
+                            comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].Ticks = 0
+                            comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].PlayFrames = 0
+                            comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].HasAnyNote = false
+                            comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].Tempos = channel.TempoMap{}
+                            comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].Groove = nil
+                            comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].Tempos.Add(channel.TempoChange{
+                                Tempo:    comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].CurrentTempo,
+                                EndTempo: comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].CurrentTempo,
+                            })
+                            // Remember where the pattern came from, so that variants can be compiled from it
+                            pos, _ := comp.ctx.Parser.Position()
+                            comp.pattern.fileName = comp.ctx.Parser.ShortFileName
+                            comp.pattern.line = pos.Line
+                            comp.pattern.column = pos.Column
+                            comp.pattern.startState = *comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ]
+                            comp.patternStart = comp.ctx.Parser.Offset()
+                            comp.patternParser = comp.ctx.Parser
                         } else {
-                            ERROR("Pattern definitions are not allowed while channels are active")
+                            comp.ctx.ERRORC(DIAG_PATTERN, "Pattern definitions are not allowed while channels are active")
                         }
                     } else {
-                        ERROR("Expected ( or {, got " + string(byte(m)))
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Expected ( or {, got %c", m)
                     }
                 } else {
-                    ERROR("Syntax error")
+                    comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error")
                 }
             
             } else if c == '(' {
                 if len(comp.patName) > 0 {
-                    ERROR("Found ( inside pattern")
+                    comp.ctx.ERRORC(DIAG_PATTERN, "Found ( inside pattern")
                 } else if !comp.keepChannelsActive {
                     if comp.CurrSong.GetNumActiveChannels() > 0 && !comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ].Active {
                         comp.keepChannelsActive = true
                     } else {
-                        ERROR("( requires at least one active channel")
+                        comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "( requires at least one active channel")
                     }
                 } else {
-                    ERROR("Unexpected (")
+                    comp.ctx.ERRORC(DIAG_SYNTAX, "Unexpected (")
                 }
                 
             } else if c == ')' {
                 if comp.keepChannelsActive {
                     comp.keepChannelsActive = false
                 } else {
-                    ERROR("Unexpected )")
+                    comp.ctx.ERRORC(DIAG_SYNTAX, "Unexpected )")
                 }
             
             // Macro definition/invokation
             } else if c == '$' {
                 comp.writeAllPendingNotes(true)
-                s := Parser.GetStringInRange(ALPHANUM)
-                Parser.SkipWhitespace()
-                m := Parser.Getch()
+                s := comp.ctx.Parser.GetStringInRange(ALPHANUM)
+                comp.ctx.Parser.SkipWhitespace()
+                m := comp.ctx.Parser.Getch()
                 t := ""
                 if len(s) > 0 {
                     comp.macro = &MmlMacro{}
                     n := 1
                     if m == '(' {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            l := 1
-                            // Read default parameters
-                            for {
-                                t = Parser.GetStringUntil(",)\t\r\n ")
-                                comp.macro.AppendDefaultParam(t)
-                                Parser.SkipWhitespace()
-                                n = Parser.Getch()
-                                if n == -1 || n == ')' {
-                                    break
-                                }
-                                l += 1
+                            // Read the parameters
+                            for _, t = range comp.getMacroArgs() {
+                                param, err := parseMacroParam(t)
+                                if err != nil {
+                                    comp.ctx.ERRORC(DIAG_MACRO, "%s", err.Error())
+                                } else if param.name != "" && comp.macro.FindParam(param.name) >= 0 {
+                                    comp.ctx.ERRORC(DIAG_MACRO, "Duplicate parameter name: %s", param.name)
+                                }
+                                comp.macro.AppendParam(param)
                             }
                             n = 2
                         } else {
                             // Macro invokation
-                            for {
-                                t = Parser.GetStringUntil(",)\t\r\n ")
-                                if len(t) > 0 {
-                                    comp.macro.AppendDefaultParam(t)
-                                }
-                                Parser.SkipWhitespace()
-                                n = Parser.Getch()
-                                if n == -1 || n == ')' {
-                                    break
+                            args, kwNames, kwValues := []string{}, []string{}, []string{}
+                            for _, t = range comp.getMacroArgs() {
+                                if eq := strings.IndexByte(t, '='); eq > 0 {
+                                    kwNames = append(kwNames, t[:eq])
+                                    kwValues = append(kwValues, t[eq+1:])
+                                } else if len(kwNames) > 0 {
+                                    comp.ctx.ERRORC(DIAG_MACRO, "Positional arguments must come before keyword arguments: %s", t)
+                                } else if len(t) > 0 {
+                                    args = append(args, t)
                                 }
                             }
-                            expandedMacro := ""
-                            defaultParm := []string{}
                             idx := comp.macros.FindKey(s)
                             if idx >= 0 {
                                 // Expand the macro
-                                for _, token := range comp.macros.data[idx].data {
-                                    if token.typ == CHAR_VERBATIM {
-                                        // This character should be appended as-is
-                                        if chr, ok := token.val.(byte); ok {
-                                            expandedMacro += string(chr)
-                                        } else {
-                                            ERROR("Internal error. Failed to expand macro (1)")
-                                        }                                        
-                                    } else if token.typ == ARG_REFERENCE {
-                                        // This is an argument reference
-                                        if argNum, ok := token.val.(int); ok {
-                                            argNum--
-                                            if argNum >= 0 && argNum < len(comp.macro.data) {
-                                                if argString, ok2 := comp.macro.data[argNum].val.(string); ok2 {
-                                                    expandedMacro += argString
-                                                } else {
-                                                    ERROR("Internal error. Failed to expand macro")
-                                                }
-                                            } else if argNum >= 0 && argNum < len(defaultParm) {
-                                                expandedMacro += defaultParm[argNum]
-                                            }
-                                        } else {
-                                            ERROR("Internal error. Failed to expand macro (2)")
-                                        }
-                                    } else if token.typ == DEFAULT_PARAM {
-                                        if defaultVal, ok := token.val.(string); ok {
-                                            defaultParm = append(defaultParm, defaultVal)
-                                        } else {
-                                            ERROR("Internal error. Failed to expand macro (3)")
-                                        }
-                                    }
+                                expandedMacro, err := comp.macros.data[idx].Expand(comp.ctx, s, args, kwNames, kwValues)
+                                if err != nil {
+                                    comp.ctx.ERRORC(DIAG_MACRO, "%s", err.Error())
                                 }
-                                INFO("Macro %s expanded to %s on line %d", s, expandedMacro, Parser.LineNum)
+                                comp.ctx.INFO("Macro %s expanded to %s on line %d", s, expandedMacro, comp.ctx.Parser.LineNum)
 
-                                Parser.InsertString(expandedMacro)
+                                comp.ctx.Parser.InsertExpansion(s, expandedMacro, comp.ctx.CommandLocation.SourcePos)
 
                                 if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                    ERROR("Trying to invoke a macro with no channels active")
+                                    comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Trying to invoke a macro with no channels active")
                                 }
                             } else {
-                                ERROR("Undefined macro: " + s)
+                                comp.ctx.ERRORC(DIAG_MACRO, "Undefined macro: %s", s)
                             }
                             n = 0
                         }
                     }
 
                     if n == 2 {                     
-                        Parser.SkipWhitespace()
-                        m = Parser.Getch()
+                        comp.ctx.Parser.SkipWhitespace()
+                        m = comp.ctx.Parser.Getch()
                     }
                     
                     // Macro definition
@@ -1059,49 +1618,64 @@ func (comp *Compiler) CompileFile(fileName string) {
                         idx := comp.macros.FindKey(s)
                         if idx < 0 {
                             if comp.CurrSong.GetNumActiveChannels() == 0 {
+                                depth := 0
                                 for n != '}' {
-                                    n = Parser.Getch()
+                                    n = comp.ctx.Parser.Getch()
                                     if n == '%' {
-                                        t = Parser.GetNumericString()
+                                        t = comp.ctx.Parser.GetStringUntil("%\r\n")
                                         num, err := strconv.Atoi(t)
                                         if err == nil {
                                             comp.macro.AppendArgumentRef(num)
+                                        } else if param := comp.macro.FindParam(t); param >= 0 {
+                                            comp.macro.AppendArgumentRef(param + 1)
+                                        } else if utils.PositionOfString(comp.macro.locals, t) >= 0 {
+                                            comp.macro.AppendExpression(t)
                                         } else {
-                                            ERROR("Syntax error while parsing macro: " + t)
+                                            comp.ctx.ERRORC(DIAG_MACRO, "Syntax error while parsing macro: %s", t)
                                         }
-                                        n = Parser.Getch()
+                                        n = comp.ctx.Parser.Getch()
                                         if n != '%' {
-                                            ERROR("Missing %%")
+                                            comp.ctx.ERRORC(DIAG_SYNTAX, "Missing %%")
                                         }
+                                    } else if n == '{' && comp.parseMacroExpression() {
+                                        continue
+                                    } else if n == '{' {
+                                        // Not an expression, e.g. a tuplet
+                                        depth++
+                                        comp.macro.AppendChar(byte(n))
+                                    } else if n == '}' && depth > 0 {
+                                        depth--
+                                        comp.macro.AppendChar(byte(n))
+                                        n = 0
                                     } else if n == '}' || n == -1 {
                                         break
                                     } else if n == '\n' {
-                                        Parser.AdvanceLine()
+                                        comp.ctx.Parser.AdvanceLine()
                                     } else if n != '\r' {
                                         comp.macro.AppendChar(byte(n))
                                     }
                                 }
                             } else {
-                                ERROR("Macro definitions are not allowed while channels are active")
+                                comp.ctx.ERRORC(DIAG_MACRO, "Macro definitions are not allowed while channels are active")
                             }
                             comp.macros.Append(s, comp.macro)
                         } else {
-                            ERROR("Macro already defined: " + s)
+                            comp.ctx.ERRORC(DIAG_MACRO, "Macro already defined: %s", s)
                         }
 
                     } else if n != 0 {
-                        ERROR("Syntax error: " + string(byte(m)))
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: %c", m)
                     }
                 } else {
-                    ERROR("Expected an identifier following $")
+                    comp.ctx.ERRORC(DIAG_SYNTAX, "Expected an identifier following $")
                 }
 
             // Callback
             } else if c == '!' {
                 comp.writeAllPendingNotes(true)
-                s := Parser.GetStringUntil("(\t\r\n ")
-                Parser.SkipWhitespace()
-                n := Parser.Getch()
+                s := comp.ctx.Parser.GetStringUntil("(\t\r\n ")
+                comp.ctx.Parser.SkipWhitespace()
+                n := comp.ctx.Parser.Getch()
                 if n == '(' {
                     idx := -1
                     for i, cb := range comp.callbacks {
@@ -1115,7 +1689,7 @@ func (comp *Compiler) CompileFile(fileName string) {
                         idx = len(comp.callbacks) - 1
                     }
 
-                    t := Parser.GetStringUntil(")\t\r\n ")
+                    t := comp.ctx.Parser.GetStringUntil(")\t\r\n ")
                     num, err := strconv.Atoi(t)
                     if err == nil {
                         if num == 0 {
@@ -1128,7 +1702,7 @@ func (comp *Compiler) CompileFile(fileName string) {
                                 }
                             }
                             if numChannels == 0 {
-                                ERROR("Trying to set a callback with no channels active")
+                                comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set a callback with no channels active")
                             }
                         } else if num == 1 {
                             // Once
@@ -1140,71 +1714,71 @@ func (comp *Compiler) CompileFile(fileName string) {
                                 }
                             }
                             if numChannels == 0 {
-                                ERROR("Trying to set a callback with no channels active")
+                                comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set a callback with no channels active")
                             }
                         } else {
-                            ERROR("Bad callback frequency: " + s)
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad callback frequency: %s", s)
                         }
                     } else if t == "EVERY-NOTE" {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("Trying to set a callback with no channels active")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set a callback with no channels active")
                         } else {
                             comp.applyCmdOnAllActive("Callback", []int{defs.CMD_CBEVNT, idx})
                         }
 
                     } else if t == "EVERY-VOL-CHANGE" {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("Trying to set a callback with no channels active")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set a callback with no channels active")
                         } else {
                             comp.applyCmdOnAllActive("Callback", []int{defs.CMD_CBEVVC, idx})
                         }
 
                     } else if t == "EVERY-VOL-MIN" {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("Trying to set a callback with no channels active")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set a callback with no channels active")
                         } else {
                             comp.applyCmdOnAllActive("Callback", []int{defs.CMD_CBEVVM, idx})
                         }
 
                     } else if t == "EVERY-OCT-CHANGE" {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("Trying to set a callback with no channels active")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set a callback with no channels active")
                         } else {
                             comp.applyCmdOnAllActive("Callback", []int{defs.CMD_CBEVOC, idx})
                         }
 
                     } else {
-                        ERROR("Bad callback frequency: " + s)
+                        comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad callback frequency: %s", s)
                     }
-                    n = Parser.Getch()
+                    n = comp.ctx.Parser.Getch()
                     if n != ')' {
-                        ERROR("Expected ): " + string(byte(n)))
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Expected ): %c", n)
                     }
                 } else {
-                    ERROR("Expected (: " + string(byte(n)))
+                    comp.ctx.ERRORC(DIAG_SYNTAX, "Expected (: %c", n)
                 }
 
             // Multiline comment
             } else if c == '/' {
                 comp.writeAllPendingNotes(true)
-                m := Parser.Getch()
+                m := comp.ctx.Parser.Getch()
                 if m == '*' {
                     n := 0
                     for n != -1 {
-                        n = Parser.Getch()
+                        n = comp.ctx.Parser.Getch()
                         if n == '*' {
-                            m = Parser.Getch()
+                            m = comp.ctx.Parser.Getch()
                             if m == '/' {
                                 break
                             } else {
-                                Parser.Ungetch()
+                                comp.ctx.Parser.Ungetch()
                             }
                         } else if n == '\n' {
-                            Parser.AdvanceLine()
+                            comp.ctx.Parser.AdvanceLine()
                         }
                     }
                 } else {
-                    ERROR("Syntax error: " + string(byte(c)))
+                    comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: %c", c)
                 }
 
             // Beginning of a [..|..]<num> loop
@@ -1213,14 +1787,13 @@ func (comp *Compiler) CompileFile(fileName string) {
                 if comp.CurrSong.GetNumActiveChannels() == 0 {
                     // ToDo: treat as error?
                 } else {
+                    comp.beginTempoLoop()
                     for _, chn := range comp.CurrSong.Channels {
                         if chn.Active {
-                            if chn.Tuple.Active {
-                                ERROR("Loops not allowed inside {}")
-                            }
-                            chn.Loops.Push(channel.LoopStackElem{
+                            elem := channel.LoopStackElem{
                                 StartPos:   len(chn.Cmds) + 2,
                                 StartTicks: chn.Ticks,
+                                StartPlayFrames: chn.PlayFrames,
                                 Unknown:    -1,
                                 Skip1Pos:   -1,
                                 Skip1Ticks: -1,
@@ -1229,12 +1802,23 @@ func (comp *Compiler) CompileFile(fileName string) {
                                 HasOctCmd:  -1,
                                 Skip1OctChg:0,
                                 Skip1OctCmd:-1,
-                            })
-                            
-                            if chn.Loops.Len() > comp.CurrSong.Target.GetMaxLoopDepth() {
-                                ERROR("Maximum nesting level for loops is " +
-                                            strconv.FormatInt(int64(comp.CurrSong.Target.GetMaxLoopDepth()), 10))
+                                TupleDepth: chn.TupleDepth(),
                             }
+                            if chn.Tuple.Active {
+                                // Loops inside tuples are unrolled when the loop ends
+                                elem.StartPos = len(chn.Tuple.Cmds)
+                                chn.Loops.Push(elem)
+                                continue
+                            }
+                            if chn.Loops.Len() >= comp.CurrSong.Target.GetMaxLoopDepth() {
+                                // Too deep for the player; the loop is unrolled when it ends
+                                comp.ctx.WARNINGC(DIAG_LOOP, "Loops nested more than %d levels deep on channel %s are unrolled", comp.CurrSong.Target.GetMaxLoopDepth(), chn.GetName())
+                                elem.StartPos = len(chn.Cmds)
+                                elem.Unrolled = true
+                                chn.Loops.Push(elem)
+                                continue
+                            }
+                            chn.Loops.Push(elem)
                             chn.AddCmd([]int{defs.CMD_LOPCNT, 0})
                         }
                     }
@@ -1245,18 +1829,31 @@ func (comp *Compiler) CompileFile(fileName string) {
                 if comp.CurrSong.GetNumActiveChannels() == 0 {
                     // ToDo: treat as error?
                 } else {
+                    comp.skipTempoLoop()
                     for _, chn := range comp.CurrSong.Channels {
                         if chn.Active {
                             if chn.Loops.Len() > 0 {
                                 pElem := chn.Loops.PeekLoop()
                                 if pElem.Skip1Pos != -1 {
-                                    ERROR("Only one | allowed per repeat loop")
+                                    comp.ctx.ERRORC(DIAG_LOOP, "Only one | allowed per repeat loop")
+                                }
+                                if pElem.TupleDepth != chn.TupleDepth() {
+                                    comp.ctx.ERRORC(DIAG_LOOP, "Loops can not cross the boundaries of {}")
                                 }
-                                pElem.Skip1Pos = len(chn.Cmds) + 2
                                 pElem.Skip1Ticks = chn.Ticks
-                                chn.AddCmd([]int{defs.CMD_J1, 0, 0})
+                                pElem.Skip1PlayFrames = chn.PlayFrames
+                                if chn.Tuple.Active {
+                                    pElem.Skip1Pos = len(chn.Tuple.Cmds)
+                                } else if pElem.Unrolled {
+                                    pElem.Skip1Pos = len(chn.Cmds)
+                                } else {
+                                    pElem.Skip1Pos = len(chn.Cmds) + 2
+                                    chn.AddrOperands = append(chn.AddrOperands, len(chn.Cmds) + 2)
+                                    chn.AddCmd([]int{defs.CMD_J1, 0, 0})
+                                }
+                                chn.Loops.UpdateLoop(pElem)
                             } else {
-                                ERROR("Unexpected character: |")
+                                comp.ctx.ERRORC(DIAG_LOOP, "Unexpected character: |")
                             }
                         }
                     }
@@ -1265,20 +1862,38 @@ func (comp *Compiler) CompileFile(fileName string) {
             // End of a [..|..]<num> loop
             } else if c == ']' {
                 comp.writeAllPendingNotes(true)
-                t := Parser.GetNumericString()
+                end := comp.ctx.Parser.Offset() - 1
+                t := comp.ctx.Parser.GetNumericString()
                 loopCount, err := strconv.Atoi(t)
+                // A loop that spans a tempo change is compiled once per iteration instead
+                unrolled := err == nil && comp.CurrSong.GetNumActiveChannels() > 0 && comp.endTempoLoop(loopCount, end)
                 for _, chn := range comp.CurrSong.Channels {
-                    if chn.Active {
-                        elem := chn.Loops.PopLoop()
-                        if elem.StartPos != 0 {
+                    if chn.Active && !unrolled {
+                        elem := channel.LoopStackElem{}
+                        if chn.Loops.Len() > 0 {
+                            if chn.Loops.PeekLoop().TupleDepth != chn.TupleDepth() {
+                                comp.ctx.ERRORC(DIAG_LOOP, "Loops can not cross the boundaries of {}")
+                            }
+                            elem = chn.Loops.PopLoop()
+                        }
+                        if elem.StartPos != 0 || elem.TupleDepth > 0 || elem.Unrolled {
                             if err == nil {
                                 if loopCount > 0 {
-                                    // Set the value for CMD_LOPCNT
-                                    chn.Cmds[elem.StartPos - 1] = loopCount
+                                    bodyTicks := chn.Ticks - elem.StartTicks
+                                    if elem.TupleDepth > 0 {
+                                        chn.UnrollTupleLoop(elem, loopCount)
+                                    } else if elem.Unrolled {
+                                        chn.UnrollLoop(elem, loopCount)
+                                    } else {
+                                        // Set the value for CMD_LOPCNT
+                                        chn.Cmds[elem.StartPos - 1] = loopCount
                                     
-                                    chn.AddCmd([]int{defs.CMD_DJNZ, (elem.StartPos & 0xFF), (elem.StartPos / 0x100)})
+                                        chn.AddrOperands = append(chn.AddrOperands, len(chn.Cmds) + 2)
+                                        chn.AddCmd([]int{defs.CMD_DJNZ, (elem.StartPos & 0xFF), (elem.StartPos / 0x100)})
+                                    }
                                     if elem.Skip1Ticks == -1 {
                                         chn.Ticks += (chn.Ticks - elem.StartTicks) * (loopCount - 1)
+                                        chn.PlayFrames += (chn.PlayFrames - elem.StartPlayFrames) * float64(loopCount - 1)
                                         if elem.HasOctCmd == -1 {
                                             chn.CurrentOctave = elem.OrigOctave + elem.OctChange * loopCount
                                         } else {
@@ -1286,12 +1901,16 @@ func (comp *Compiler) CompileFile(fileName string) {
                                         }
                                     } else {
                                         if loopCount < 2 {
-                                            ERROR("Loop count must be >= 2 when | is used")
+                                            comp.ctx.ERRORC(DIAG_LOOP, "Loop count must be >= 2 when | is used")
                                         }
                                         chn.Ticks += (chn.Ticks - elem.StartTicks) * (loopCount - 2) +
                                                      (elem.Skip1Ticks - elem.StartTicks)
-                                        chn.Cmds[elem.Skip1Pos - 1] = len(chn.Cmds) & 0xFF
-                                        chn.Cmds[elem.Skip1Pos] = len(chn.Cmds) / 0x100
+                                        chn.PlayFrames += (chn.PlayFrames - elem.StartPlayFrames) * float64(loopCount - 2) +
+                                                          (elem.Skip1PlayFrames - elem.StartPlayFrames)
+                                        if elem.TupleDepth == 0 && !elem.Unrolled {
+                                            chn.Cmds[elem.Skip1Pos - 1] = len(chn.Cmds) & 0xFF
+                                            chn.Cmds[elem.Skip1Pos] = len(chn.Cmds) / 0x100
+                                        }
 
                                         if elem.Skip1OctCmd == -1 {
                                             if elem.HasOctCmd == -1 {
@@ -1308,14 +1927,25 @@ func (comp *Compiler) CompileFile(fileName string) {
                                             }
                                         }
                                     }
+
+                                    // The notes in the loop have fixed lengths, so all iterations play at the tempo of the first one,
+                                    // unless the loop could be compiled once per iteration
+                                    if elem.TupleDepth == 0 && chn.UsesTempoMap() && chn.TempoChangesWithin(elem.StartTicks + 1, chn.Ticks) {
+                                        comp.ctx.WARNINGC(DIAG_TEMPO, "Tempo change inside a [] loop on channel %s; all iterations use the tempo of the first one", chn.GetName())
+                                    }
+                                    // Likewise for the groove, unless each iteration covers whole groove cycles
+                                    if elem.TupleDepth == 0 && chn.Groove != nil && elem.StartTicks >= chn.Groove.StartTick &&
+                                       bodyTicks % chn.Groove.CycleTicks() != 0 {
+                                        comp.ctx.WARNINGC(DIAG_GROOVE, "The [] loop on channel %s is not a whole number of groove cycles long", chn.GetName())
+                                    }
                                 } else {
-                                    ERROR("Bad loop count: " + t)
+                                    comp.ctx.ERRORC(DIAG_LOOP, "Bad loop count: %s", t)
                                 }
                             } else {
-                                ERROR("Expected a loop count: " + t)
+                                comp.ctx.ERRORC(DIAG_LOOP, "Expected a loop count: %s", t)
                             }
                         } else {
-                            ERROR("Use of ] with no matching [ on channel " + chn.GetName())
+                            comp.ctx.ERRORC(DIAG_LOOP, "Use of ] with no matching [ on channel %s", chn.GetName())
                         }
                     }
                 }
@@ -1330,7 +1960,7 @@ func (comp *Compiler) CompileFile(fileName string) {
                     delta = -1
                 }
                 if comp.CurrSong.GetNumActiveChannels() == 0 {
-                    WARNING("Trying to change octave with no active channels: " + string(byte(c)))
+                    comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to change octave with no active channels: %c", c)
                 } else {
                     for _, chn := range comp.CurrSong.Channels {
                         if chn.Active {
@@ -1346,11 +1976,11 @@ func (comp *Compiler) CompileFile(fileName string) {
                                     } else {
                                         pElem.Skip1OctChg += delta
                                     }
+                                    chn.Loops.UpdateLoop(pElem)
                                 }
                             
                             } else {
-                                ERROR("Octave out of range: " + string(byte(c)) + " (" + 
-                                            strconv.FormatInt(int64(chn.CurrentOctave + delta), 10) + ")")
+                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Octave out of range: %c (%d)", c, chn.CurrentOctave + delta)
                             }
                         }
                     }
@@ -1358,11 +1988,11 @@ func (comp *Compiler) CompileFile(fileName string) {
                 
             } else if c == 'k' {
                 comp.writeAllPendingNotes(true)
-                s := Parser.GetNumericString()
+                s := comp.ctx.Parser.GetNumericString()
                 num, err := strconv.Atoi(s)
                 if err == nil {
                     if comp.CurrSong.GetNumActiveChannels() == 0 {
-                        WARNING("Trying to set length with no active channels")
+                        comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set length with no active channels")
                     } else if inRange(num, 1, 256) {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
@@ -1373,20 +2003,20 @@ func (comp *Compiler) CompileFile(fileName string) {
                             }
                         }
                     } else {
-                        ERROR("Bad length: " + s)
+                        comp.ctx.ERRORC(DIAG_BAD_LENGTH, "Bad length: %s", s)
                     }
                 } else {
-                    ERROR("Bad length: " + s)
+                    comp.ctx.ERRORC(DIAG_BAD_LENGTH, "Bad length: %s", s)
                 }
                         
             } else if c == 'l' {
                 comp.writeAllPendingNotes(true)
-                s := Parser.GetNumericString()
+                s := comp.ctx.Parser.GetNumericString()
                 num, err := strconv.Atoi(s)
                 if err == nil {
                     if comp.CurrSong.GetNumActiveChannels() == 0 {
-                        WARNING("Trying to set length with no active channels")
-                    } else if utils.PositionOfInt(timing.SupportedLengths, num) >= 0 {
+                        comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set length with no active channels")
+                    } else if utils.PositionOfInt(comp.timing.SupportedLengths, num) >= 0 {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
                                 chn.CurrentLength = 32.0 / float64(num)
@@ -1396,20 +2026,20 @@ func (comp *Compiler) CompileFile(fileName string) {
                             }
                         }
                     } else {
-                        ERROR("Bad length: " + s)
+                        comp.ctx.ERRORC(DIAG_BAD_LENGTH, "Bad length: %s", s)
                     }
                 }else {
-                    ERROR("Bad length: " + s)
+                    comp.ctx.ERRORC(DIAG_BAD_LENGTH, "Bad length: %s", s)
                 }
 
             // Set octave
             } else if c == 'o' {
                 comp.writeAllPendingNotes(false)
-                s := Parser.GetNumericString()
+                s := comp.ctx.Parser.GetNumericString()
                 num, err := strconv.Atoi(s)
                 if err == nil {
                     if comp.CurrSong.GetNumActiveChannels() == 0 {
-                        WARNING("Trying to set octave with no active channels")
+                        comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set octave with no active channels")
                     } else {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
@@ -1420,7 +2050,8 @@ func (comp *Compiler) CompileFile(fileName string) {
                                     } else {
                                         chn.Tuple.Cmds = append(chn.Tuple.Cmds, channel.Note{Num: defs.NON_NOTE_TUPLE_CMD,
                                                                                              Frames: float64(defs.CMD_OCTAVE | chn.CurrentOctave),
-                                                                                             HasData: true})
+                                                                                             HasData: true,
+                                                                                             Source: comp.ctx.CommandLocation})
                                     }
                                     if chn.Loops.Len() > 0 {
                                         // We're inside a []-loop
@@ -1434,29 +2065,29 @@ func (comp *Compiler) CompileFile(fileName string) {
                                             pElem.Skip1OctCmd = chn.CurrentOctave
                                             pElem.Skip1OctChg = 0
                                         }
+                                        chn.Loops.UpdateLoop(pElem)
                                     }
                                 
                                 } else {
-                                    ERROR("Octave out of range (" +
-                                                fmt.Sprintf(" (%d vs [%d,%d])", num, chn.GetMinOctave(), chn.GetMaxOctave()))
+                                    comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Octave out of range: %d (vs [%d,%d])", num, chn.GetMinOctave(), chn.GetMaxOctave())
                                 }
                             }
                         }
                     } /*else {
-                        ERROR("Bad octave:", s)
+                        comp.ctx.ERROR("Bad octave:", s)
                     }*/
                 } else {
-                    ERROR("Bad octave: " + s)
+                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad octave: %s", s)
                 }
 
             // Set cutoff
             } else if c == 'q' {
                 comp.writeAllPendingNotes(true)
-                s := Parser.GetNumericString()
+                s := comp.ctx.Parser.GetNumericString()
                 num, err := strconv.Atoi(s)
                 if err == nil {
                     if comp.CurrSong.GetNumActiveChannels() == 0 {
-                        WARNING("Trying to set cutoff with no active channels")
+                        comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set cutoff with no active channels")
                     } else if num >= -8 && num <= 8 {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
@@ -1476,31 +2107,26 @@ func (comp *Compiler) CompileFile(fileName string) {
                             }
                         }
                     } else {
-                        ERROR("Bad cutoff: " + s)
+                        comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad cutoff: %s", s)
                     }
                 } else {
-                    ERROR("Bad cutoff: " + s)
+                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad cutoff: %s", s)
                 }
 
             // Set tempo
             } else if c == 't' {
                 comp.writeAllPendingNotes(true)
-                s := Parser.GetNumericString()
-                num, err := strconv.Atoi(s)
-                if err == nil {
-                    if comp.CurrSong.GetNumActiveChannels() == 0 {
-                        WARNING("Trying to set tempo with no active channels")
-                    } else if inRange(num, 0, comp.CurrSong.Target.GetMaxTempo()) {
-                        for _, chn := range comp.CurrSong.Channels {
-                            if chn.Active {
-                                chn.CurrentTempo = num
-                            }
+                change := comp.parseTempo()
+                if comp.CurrSong.GetNumActiveChannels() == 0 {
+                    comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set tempo with no active channels")
+                } else {
+                    for _, chn := range comp.CurrSong.Channels {
+                        if chn.Active {
+                            chn.CurrentTempo = change.EndTempo
+                            change.Tick = chn.Ticks
+                            chn.Tempos.Add(change)
                         }
-                    } else {
-                        ERROR("Bad tempo: " + s)
                     }
-                } else {
-                    ERROR("Bad tempo: " + s)
                 }
 
             // Set volume
@@ -1513,16 +2139,16 @@ func (comp *Compiler) CompileFile(fileName string) {
                 err := error(nil)
                 s := ""
                 
-                m := Parser.Getch()
+                m := comp.ctx.Parser.Getch()
                 if m == '+' {
                     volType = defs.CMD_VOLUP
-                    if Parser.Getch() == '+' {
+                    if comp.ctx.Parser.Getch() == '+' {
                         volType = defs.CMD_VOLUPC
                     } else {
-                        Parser.Ungetch()
+                        comp.ctx.Parser.Ungetch()
                     }
                     volDelta = 1
-                    s = Parser.GetNumericString()
+                    s = comp.ctx.Parser.GetNumericString()
                     if len(s) > 0 {
                         num, err = strconv.Atoi(s)
                         if err == nil {
@@ -1531,13 +2157,13 @@ func (comp *Compiler) CompileFile(fileName string) {
                     }
                 } else if m == '-' {
                     volType = defs.CMD_VOLDN
-                    if Parser.Getch() == '-' {
+                    if comp.ctx.Parser.Getch() == '-' {
                         volType = defs.CMD_VOLDNC
                     } else {
-                        Parser.Ungetch()
+                        comp.ctx.Parser.Ungetch()
                     }
                     volDelta = 1
-                    s = Parser.GetNumericString()
+                    s = comp.ctx.Parser.GetNumericString()
                     if len(s) > 0 {
                         num, err = strconv.Atoi(s)
                         if err == nil {
@@ -1545,12 +2171,20 @@ func (comp *Compiler) CompileFile(fileName string) {
                         }
                     }
                 } else {
-                    Parser.Ungetch()
-                    s = Parser.GetNumericString()
+                    comp.ctx.Parser.Ungetch()
+                    s = comp.ctx.Parser.GetNumericString()
                     if len(s) > 0 {
                         num, err = strconv.Atoi(s)
+                        if err == nil && comp.volumeOffset != 0 {
+                            // Compiling a pattern variant; the result is limited to the channel's range below
+                            num += comp.volumeOffset
+                            if num < comp.CurrSong.Target.GetMinVolume() {
+                                comp.warnVolumeClamped(num, comp.CurrSong.Target.GetMinVolume())
+                                num = comp.CurrSong.Target.GetMinVolume()
+                            }
+                        }
                     } else {
-                        ERROR("Expected +, - or a number: " + string(byte(m)))
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Expected +, - or a number: %c", m)
                     }
                 }
 
@@ -1559,15 +2193,19 @@ func (comp *Compiler) CompileFile(fileName string) {
                         if len(comp.patName) > 0 {
                             if num >= comp.CurrSong.Target.GetMinVolume() {
                             } else {
-                                ERROR("Bad volume: " + strconv.FormatInt(int64(num), 10))
+                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Bad volume: %d", num)
                             }
                         } else {
-                            WARNING("Trying to set volume with no active channels")
+                            comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set volume with no active channels")
                         }
                     } else if num >= comp.CurrSong.Target.GetMinVolume() {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
                                 if volType == defs.CMD_VOL2 {
+                                    if comp.volumeOffset != 0 && num > chn.GetMaxVolume() {
+                                        comp.warnVolumeClamped(num, chn.GetMaxVolume())
+                                        num = chn.GetMaxVolume()
+                                    }
                                     if num <= chn.GetMaxVolume() {
                                         chn.CurrentVolume = num
                                         if chn.SupportsVolumeChange() > 0 {
@@ -1579,10 +2217,10 @@ func (comp *Compiler) CompileFile(fileName string) {
                                             }
                                         } else {
                                             // TODO: Handle this case (e.g. NES triangle channel)
-                                            WARNING("Setting volume on channel " + chn.GetName() + " is not supported")
+                                            comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Setting volume on channel %s is not supported", chn.GetName())
                                         }
                                     } else {
-                                        ERROR("Bad volume: " + strconv.FormatInt(int64(num), 10))
+                                        comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Bad volume: %d", num)
                                     }
                                 } else {
                                     if volType == defs.CMD_VOLDN {
@@ -1596,10 +2234,10 @@ func (comp *Compiler) CompileFile(fileName string) {
                             }
                         }
                     } else {
-                        ERROR("Bad volume: " + strconv.FormatInt(int64(num), 10))
+                        comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Bad volume: %d", num)
                     }
                 } else {
-                    ERROR("Bad volume: " + s)
+                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad volume: %s", s)
                 }
 
             // Single line comment
@@ -1607,9 +2245,9 @@ func (comp *Compiler) CompileFile(fileName string) {
                 comp.writeAllPendingNotes(true)
                 n := 0
                 for n != -1 {
-                    n = Parser.Getch()
+                    n = comp.ctx.Parser.Getch()
                     if n == '\n' {
-                        Parser.AdvanceLine()
+                        comp.ctx.Parser.AdvanceLine()
                         break
                     } else if n == '\r' {
                         break
@@ -1618,8 +2256,8 @@ func (comp *Compiler) CompileFile(fileName string) {
                 }
 
 
-            // Reads notes (e.g. c d+ a+4 g-1.. e1^8^32 f&f16&f32)
-            } else if defs.NoteIndex(c) >= 0 {
+            // Reads notes (e.g. c d+ a+4 g-1.. e1^8^32 f&f16&f32) and chords ('ceg'4 c:maj7)
+            } else if defs.NoteIndex(c) >= 0 || c == '\'' {
                 if !comp.slur {
                     comp.writeAllPendingNotes(false)
                 }
@@ -1636,100 +2274,95 @@ func (comp *Compiler) CompileFile(fileName string) {
                 extraChars  := 0
                 n           := c
                 note        := 0
+
+                var chord []int
+                chordFlatSharp := 0
+                if c == '\'' {
+                    n, chordFlatSharp, chord = comp.parseQuotedChord()
+                }
                 
                 for n != -1 {
                     if defs.NoteIndex(n) >= 0 {
                         if extraChars > 0 && !comp.slur {
-                            Parser.Ungetch()
+                            comp.ctx.Parser.Ungetch()
                             break
                         }
                         note = defs.NoteIndex(n)
                     } else if n == '&' {
                         if hasTie {
-                            ERROR("Trying to use & and ^ in same expression")
-                        }
-                        for _, chn := range comp.CurrSong.Channels {
-                            if chn.Active && chn.Tuple.Active {
-                                WARNING("Command ignored inside tuple: &")
-                            }
+                            comp.ctx.ERRORC(DIAG_SYNTAX, "Trying to use & and ^ in same expression")
                         }
                         hasSlur = true
                         comp.slur = true
                         note = -1
                     } else if n == '^' {
                         if hasSlur {
-                            ERROR("Trying to use & and ^ in same expression")
-                        }
-                        for _, chn := range comp.CurrSong.Channels {
-                            if chn.Active && chn.Tuple.Active {
-                                WARNING("Command ignored inside tuple: ^")
-                            }
+                            comp.ctx.ERRORC(DIAG_SYNTAX, "Trying to use & and ^ in same expression")
                         }
                         hasTie = true
                         comp.tie = true
                     } else if n == '.' {
-                        for _, chn := range comp.CurrSong.Channels {
-                            if chn.Active && chn.Tuple.Active {
-                                WARNING("Command ignored inside tuple: .")
-                            }
-                        }
                         hasDot = true
                     } else {
-                        Parser.Ungetch()
+                        comp.ctx.Parser.Ungetch()
                         break
                     }
 
                     if (defs.NoteIndex(n) >= 0 && n != 'r' && n != 's') || (extraChars > 0 && note != -1 && comp.slur) {
                         flatSharp = 0
                         ticks = -1 //frames = -1
-                        m := Parser.Getch()
+                        m := comp.ctx.Parser.Getch()
                         if m == '+' {
                             flatSharp = 1
                             if defs.NoteVal(note + flatSharp) != -2 {
-                                ERROR("Bad note: " + string(byte(n)) + "+")
+                                comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad note: %c+", n)
                             }
                         } else if m == '-' {
                             flatSharp = -1
                             if (note + flatSharp < 1) || defs.NoteVal(note + flatSharp) != -2 {
-                                ERROR("Bad note: " + string(byte(n)) + "-")
+                                comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad note: %c-", n)
                             }
                         } else {
-                            Parser.Ungetch()
+                            comp.ctx.Parser.Ungetch()
                         }
                     } else if n == 'r' || n == 's' {
                         flatSharp = 0
                     }
 
+                    if extraChars == 0 && n != 'r' && n != 's' {
+                        if chord != nil {
+                            flatSharp = chordFlatSharp
+                        } else if comp.ctx.Parser.Peekch() == ':' {
+                            comp.ctx.Parser.Getch()
+                            chord = comp.parseChordName()
+                        }
+                    }
+
                     if firstNote == -1 {
                         firstNote = note + flatSharp
                     } else {
                         if (firstNote != note + flatSharp) && note != -1 {
-                            ERROR("Trying to concatenate different notes")
+                            comp.ctx.ERRORC(DIAG_SYNTAX, "Trying to concatenate different notes")
                         }
                     }
 
                     if defs.NoteIndex(n) >= 0 || comp.tie {
-                        s := Parser.GetNumericString()
+                        s := comp.ctx.Parser.GetNumericString()
                         if len(s) > 0 {
                             noteLen, err := strconv.Atoi(s)
                             if err == nil {
-                                if utils.PositionOfInt(timing.SupportedLengths, noteLen) >= 0 { 
+                                if utils.PositionOfInt(comp.timing.SupportedLengths, noteLen) >= 0 { 
                                     ticks = 32 / noteLen //frames = 32.0 / float64(noteLen) 
-                                    for _, chn := range comp.CurrSong.Channels {
-                                        if chn.Active && chn.Tuple.Active {
-                                            WARNING("Note length ignored inside tuple")
-                                        }
-                                    }
                                 } else {
-                                    ERROR("Unsupported length: " + s)
+                                    comp.ctx.ERRORC(DIAG_UNSUPPORTED, "Unsupported length: %s", s)
                                 }
                             } else {
-                                ERROR("Bad length: " + s)
+                                comp.ctx.ERRORC(DIAG_BAD_LENGTH, "Bad length: %s", s)
                             }
                         }
                     }
                     if ticks == -1 && comp.tie {
-                        ERROR("Expected a length")
+                        comp.ctx.ERRORC(DIAG_BAD_LENGTH, "Expected a length")
                     }
 
                     tieOff  = false
@@ -1742,8 +2375,7 @@ func (comp *Compiler) CompileFile(fileName string) {
                             if chn.CurrentOctave <= chn.GetMinOctave() &&
                                note > 0 &&
                                note < chn.GetMinNote() {
-                                WARNING("The frequency of the note can not be reproduced for this octave: " +
-                                              string(byte(defs.NoteVal(note))))
+                                comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "The frequency of the note can not be reproduced for this octave: %c", defs.NoteVal(note))
                             }
                             numChannels++
                             if ticks == -1 {
@@ -1753,11 +2385,15 @@ func (comp *Compiler) CompileFile(fileName string) {
                                 if n != 'r' && n != 's' {
                                     chn.CurrentNote = channel.Note{Num: (chn.CurrentOctave - chn.GetMinOctave()) * 12 + note + flatSharp,
                                                                    Frames: float64(ticks),
-                                                                   HasData: true}
+                                                                   HasData: true,
+                                                                   Source: comp.ctx.CommandLocation}
                                 } else if n == 'r' {
-                                    chn.CurrentNote = channel.Note{Num: defs.Rest, Frames: float64(ticks), HasData: true}
+                                    chn.CurrentNote = channel.Note{Num: chn.Rest, Frames: float64(ticks), HasData: true, Source: comp.ctx.CommandLocation}
                                 } else {
-                                    chn.CurrentNote = channel.Note{Num: defs.Rest2, Frames: float64(ticks), HasData: true}
+                                    chn.CurrentNote = channel.Note{Num: chn.Rest2, Frames: float64(ticks), HasData: true, Source: comp.ctx.CommandLocation}
+                                }
+                                if chord != nil {
+                                    comp.applyChord(chn, numChannels - 1, note + flatSharp, chord)
                                 }
                                 chn.LastSetLength = float64(ticks)
                             } else {
@@ -1767,7 +2403,7 @@ func (comp *Compiler) CompileFile(fileName string) {
                                     if ticks >= 1 {
                                         chn.CurrentNote.Frames += float64(ticks)
                                     } else {
-                                        ERROR("Note length out of range due to dot command")
+                                        comp.ctx.ERRORC(DIAG_BAD_LENGTH, "Note length out of range due to dot command")
                                     }
                                     dotOff = true
                                 } else if comp.tie {
@@ -1776,17 +2412,17 @@ func (comp *Compiler) CompileFile(fileName string) {
                                 } else if comp.slur {
                                     if note != -1 {
                                         if ((chn.CurrentOctave - chn.GetMinOctave()) * 12 + note + flatSharp == chn.CurrentNote.Num) ||
-                                            (chn.CurrentNote.Num == defs.Rest && n == 'r') ||
-                                            (chn.CurrentNote.Num == defs.Rest2 && n == 's') {
+                                            (chn.CurrentNote.Num == chn.Rest && n == 'r') ||
+                                            (chn.CurrentNote.Num == chn.Rest2 && n == 's') {
                                             chn.CurrentNote.Frames += float64(ticks)
                                             chn.LastSetLength = float64(ticks)
                                             slurOff = true
                                         } else {
-                                            ERROR("Bad note: " + string(byte(n)))
+                                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad note: %c", n)
                                         }
                                     }
                                 } else {
-                                    ERROR("Bad note: " + string(byte(n)))
+                                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad note: %c", n)
                                 }
                             }
                         }
@@ -1803,10 +2439,13 @@ func (comp *Compiler) CompileFile(fileName string) {
                     }
                     
                     if numChannels == 0 {
-                        ERROR("Trying to play a note with no active channels")
+                        comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Trying to play a note with no active channels")
+                    }
+                    if extraChars == 0 && chord != nil && comp.chordMode == CHORD_MODE_SPLIT && numChannels != len(chord) {
+                        comp.ctx.WARNINGC(DIAG_CHORD, "Chord with %d notes played on %d channels", len(chord), numChannels)
                     }
 
-                    n = Parser.Getch()
+                    n = comp.ctx.Parser.Getch()
                     extraChars++
                 }
                 comp.tie = false
@@ -1819,64 +2458,52 @@ func (comp *Compiler) CompileFile(fileName string) {
             } else if c == '{' {
                 comp.writeAllPendingNotes(true)
                 if comp.CurrSong.GetNumActiveChannels() == 0 {
-                    ERROR("{ requires at least one active channel")
+                    comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "{ requires at least one active channel")
                 } else {
                     for _, chn := range comp.CurrSong.Channels {
                         if chn.Active {
-                            if !chn.Tuple.Active {
-                                chn.Tuple.Active = true
-                            } else {
-                                //  ERROR("Nested tuples are not allowed", lineNum)
-                            }
+                            chn.BeginTuple()
                         }
                     }
                 }
                 
             } else if c == '}' {
+                bodyEnd := comp.ctx.Parser.Offset() - 1
                 comp.writeAllPendingNotes(true)
-                s := Parser.GetNumericString()
+                s := comp.ctx.Parser.GetNumericString()
                 tupleLen := -1.0
                 if len(s) > 0 {
                     num, err := strconv.Atoi(s)
                     if err == nil {
-                        if utils.PositionOfInt(timing.SupportedLengths, num) >= 0 { 
+                        if utils.PositionOfInt(comp.timing.SupportedLengths, num) >= 0 { 
                             tupleLen = 32.0 / float64(num) 
                         } else {
-                            ERROR("Unsupported length: " + s)
+                            comp.ctx.ERRORC(DIAG_UNSUPPORTED, "Unsupported length: %s", s)
                         }
                     } else {
-                        ERROR("Bad length: " + s)
+                        comp.ctx.ERRORC(DIAG_BAD_LENGTH, "Bad length: %s", s)
                     }
                 }
                 if tupleLen == -1 {
                     if len(comp.patName) > 0 {
-                        patChan := comp.CurrSong.Channels[ len(comp.CurrSong.Channels) - 1 ]
-                        patChan.AddCmd([]int{defs.CMD_RTS})
-                        comp.pattern.Cmds = make([]int, len(patChan.Cmds))
-                        copy(comp.pattern.Cmds, patChan.Cmds)
-                        comp.pattern.HasAnyNote = patChan.HasAnyNote
-                        comp.pattern.NumTicks = patChan.Ticks
-                        comp.patterns.Append(comp.patName, comp.pattern)
-                        fmt.Printf("Pattern ticks: %d\n", patChan.Ticks)
-                        /*patterns[1] = append(patterns[1], patName)
-                        patterns[2] = append(patterns[2], songs[songNum][length(songs[songNum])])
-                        patterns[3] &= hasAnyNote[length(supportedChannels)]
-                        patterns[4] &= songLen[songNum][length(supportedChannels)]*/
-                        comp.patName = ""
-                        patChan.Active = false
-                        patChan.Cmds = []int{}
+                        if comp.ctx.Parser == comp.patternParser && comp.volumeOffset == 0 {
+                            comp.pattern.source = comp.ctx.Parser.GetSource(comp.patternStart, bodyEnd)
+                        }
+                        comp.finishPattern()
                     } else {
-                        ERROR("Syntax error: }")
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: }")
                     }
                 } else {
                     if comp.CurrSong.GetNumActiveChannels() == 0 {
-                        ERROR("Trying to close a tuple with no active channels")
+                        comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Trying to close a tuple with no active channels")
                     } else {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
                                 if chn.Tuple.Active {
-                                    chn.WriteTuple(tupleLen)
-                                    chn.Tuple.Active = false
+                                    if chn.Loops.Len() > 0 && chn.Loops.PeekLoop().TupleDepth == chn.TupleDepth() {
+                                        comp.ctx.ERRORC(DIAG_LOOP, "Unterminated loop inside {}")
+                                    }
+                                    chn.EndTuple(tupleLen)
                                 }
                             }
                         }
@@ -1884,115 +2511,115 @@ func (comp *Compiler) CompileFile(fileName string) {
                 }   
                 
             } else if strings.ContainsRune(comp.CurrSong.Target.GetChannelNames(), rune(c)) ||
-                      strings.ContainsRune("ACDEFKLMOPRSWnpw", rune(c)) {
+                      strings.ContainsRune("ACDEFGKLMOPRSWnpw", rune(c)) {
                 comp.writeAllPendingNotes(true)
                 
-                Parser.Ungetch()    // To make PeekString work
+                comp.ctx.Parser.Ungetch()    // To make PeekString work
                                   
-                if Parser.PeekString(4) == "ADSR" {
-                    Parser.SkipN(4)
+                if comp.ctx.Parser.PeekString(4) == "ADSR" {
+                    comp.ctx.Parser.SkipN(4)
                     s := ""
                     characterHandled = true
-                    //Parser.Ungetch()    // why? is this correct?
+                    //comp.ctx.Parser.Ungetch()    // why? is this correct?
                     num := 0
                     err := error(nil)
-                    m := Parser.Peekch()
+                    m := comp.ctx.Parser.Peekch()
                     if m == '(' {
                         // Implicit ADSR declaration
                         num = comp.handleAdsrEnvelopeDef("", true)
                     } else {
                         // Use a previously declared ADSR
-                        s = Parser.GetNumericString()
+                        s = comp.ctx.Parser.GetNumericString()
                         num, err = strconv.Atoi(s)
                     }
 
                     if err == nil {
-                        idx := effects.ADSRs.FindKey(num)
+                        idx := comp.effects.ADSRs.FindKey(num)
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("ADSR requires at least one active channel")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "ADSR requires at least one active channel")
                         } else if idx >= 0 {
                             for _, chn := range comp.CurrSong.Channels {
                                 if chn.Active {
                                     if chn.SupportsADSR() {
                                         chn.AddCmd([]int{defs.CMD_ADSR, idx})
-                                        effects.ADSRs.AddRef(num)
+                                        comp.effects.ADSRs.AddRef(num)
                                     } else {
-                                        WARNING("Unsupported command for this channel: ADSR")
+                                        comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for this channel: ADSR")
                                     }
                                 }
                             }
                         } else {
-                            ERROR("Undefined macro: ADSR" + s)
+                            comp.ctx.ERRORC(DIAG_MACRO, "Undefined macro: ADSR%s", s)
                         }
                     } else {
-                        ERROR("Expected a number: " + s)
+                        comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Expected a number: %s", s)
                     }
-                } else if Parser.PeekString(2) == "AM" {
-                    Parser.SkipN(2)
-                    s := Parser.GetNumericString()
+                } else if comp.ctx.Parser.PeekString(2) == "AM" {
+                    comp.ctx.Parser.SkipN(2)
+                    s := comp.ctx.Parser.GetNumericString()
                     if len(s) > 0 {
                         characterHandled = true
                         num, err := strconv.Atoi(s)
                         if err == nil {
                             if inRange(num, 0, 1) {
                                 if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                    ERROR("AM requires at least one active channel")
+                                    comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "AM requires at least one active channel")
                                 } else {
                                     comp.applyCmdOnAllActiveFM("AM", []int{defs.CMD_HWAM, num})
                                 }
                             } else {
-                                ERROR("AM out of range")
+                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "AM out of range")
                             }
                         } else {
-                            ERROR("Bad AM: " + s)
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad AM: %s", s)
                         }
                     } else {
-                        //Parser.Ungetch()
+                        //comp.ctx.Parser.Ungetch()
                         comp.assertIsChannelName(c)
                     }                       
   
                 // Channel separation (panning)
-                } else if Parser.PeekString(2) == "CS" {
-                    Parser.SkipN(2)
+                } else if comp.ctx.Parser.PeekString(2) == "CS" {
+                    comp.ctx.Parser.SkipN(2)
                     characterHandled = true
-                    num, idx, err := comp.assertEffectIdExistsAndChannelsActive("CS", effects.PanMacros)
+                    num, idx, err := comp.assertEffectIdExistsAndChannelsActive("CS", comp.effects.PanMacros)
 
                     if err == nil {
                         if comp.CurrSong.Target.SupportsPan() {
-                            idx |= effects.PanMacros.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80
+                            idx |= comp.effects.PanMacros.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80
                             for _, chn := range comp.CurrSong.Channels {
                                 if chn.Active {
                                     chn.AddCmd([]int{defs.CMD_PANMAC, idx + 1})
-                                    effects.PanMacros.AddRef(num)
+                                    comp.effects.PanMacros.AddRef(num)
                                 }
                             }
                         } else {
-                            WARNING("Unsupported command for this target: CS")
+                            comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for this target: CS")
                         }
                     } else {
-                        m := Parser.Getch()
-                        t := string(byte(m)) + string(byte(Parser.Getch()))
+                        m := comp.ctx.Parser.Getch()
+                        t := string(byte(m)) + string(byte(comp.ctx.Parser.Getch()))
                         if t == "OF" {
                             if comp.CurrSong.Target.SupportsPan() {
                                 comp.applyCmdOnAllActive("CS", []int{defs.CMD_PANMAC, 0})
                             }
                         } else {
-                            ERROR("Syntax error: CS" + t)
+                            comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: CS%s", t)
                         }
                     }
                 
                 // Detune
                 } else if c == 'D' {
-                    Parser.SkipN(1)
-                    m := Parser.Getch()
+                    comp.ctx.Parser.SkipN(1)
+                    m := comp.ctx.Parser.Getch()
                     if m == '-' || IsNumeric(m) {
                         characterHandled = true
-                        Parser.Ungetch()
-                        s := Parser.GetNumericString()
+                        comp.ctx.Parser.Ungetch()
+                        s := comp.ctx.Parser.GetNumericString()
                         num, err := strconv.Atoi(s)
                         if err == nil {
                             if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                ERROR("Detune requires at least one active channel")
+                                comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Detune requires at least one active channel")
                             } else {
                                 for _, chn := range comp.CurrSong.Channels {
                                     if chn.Active {
@@ -2006,111 +2633,122 @@ func (comp *Compiler) CompileFile(fileName string) {
                                                     }
                                                     chn.AddCmd([]int{defs.CMD_DETUNE, amount})
                                                 } else {
-                                                    ERROR("Detune value out of range: " + s)
+                                                    comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Detune value out of range: %s", s)
                                                 }
                                             } else {
                                                 if inRange(num, -127, 127) {
                                                     chn.AddCmd([]int{defs.CMD_DETUNE, num})
                                                 } else {
-                                                    ERROR("Detune value out of range: " + s)
+                                                    comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Detune value out of range: %s", s)
                                                 }
                                             }
                                         } else {
-                                            WARNING("Unsupported command for this channel: D")
+                                            comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for this channel: D")
                                         }
                                     }
                                 }
                             }
                         } else {
-                            ERROR("Expected a number: " + s)
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Expected a number: %s", s)
                         }
                     } else {
-                        Parser.Ungetch()
-                        Parser.Ungetch()
-                        //fmt.Printf("*D on line %d, m = %c\n", Parser.LineNum, m)
+                        comp.ctx.Parser.Ungetch()
+                        comp.ctx.Parser.Ungetch()
+                        //fmt.Printf("*D on line %d, m = %c\n", comp.ctx.Parser.LineNum, m)
                         comp.assertIsChannelName(c)
                     }                       
 
                 } else if c == 'K' {
-                    Parser.SkipN(1)
-                    m := Parser.Getch()
+                    comp.ctx.Parser.SkipN(1)
+                    m := comp.ctx.Parser.Getch()
                     if m == '-' || IsNumeric(m) {
                         characterHandled = true
-                        Parser.Ungetch()
-                        s := Parser.GetNumericString()
+                        comp.ctx.Parser.Ungetch()
+                        s := comp.ctx.Parser.GetNumericString()
                         num, err := strconv.Atoi(s)
                         if err == nil {
                             if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                ERROR("Transpose requires at least one active channel")
+                                comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "Transpose requires at least one active channel")
                             } else {
                                 if inRange(num, -127, 127) {
                                     comp.applyCmdOnAllActive("K", []int{defs.CMD_TRANSP, num})
+                                    for _, chn := range comp.CurrSong.Channels {
+                                        if chn.Active {
+                                            chn.CurrentTranspose = num
+                                        }
+                                    }
                                 } else {
-                                    ERROR("Transpose value out of range: " + s)
+                                    comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Transpose value out of range: %s", s)
                                 }
                             }
                         } else {
-                            ERROR("Expected a number: " + s)
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Expected a number: %s", s)
                         }
                     } else {
-                        Parser.Ungetch()
-                        Parser.Ungetch()
+                        comp.ctx.Parser.Ungetch()
+                        comp.ctx.Parser.Ungetch()
                         comp.assertIsChannelName(c)
                     }       
                 
                 // Arpeggio select ("EN<num>")
-                } else if Parser.PeekString(2) == "EN" {
-                    Parser.SkipN(2)
+                } else if comp.ctx.Parser.PeekString(2) == "EN" {
+                    comp.ctx.Parser.SkipN(2)
                     characterHandled = true
                     
                     num := 0
                     idx := 0
                     err := error(nil)
-                    m := Parser.Peekch()
+                    m := comp.ctx.Parser.Peekch()
                     if m == '(' {
                         // Implicit EN declaration
                         num = comp.handleArpeggioDef("", true)
-                        idx = effects.Arpeggios.FindKey(num)
+                        idx = comp.effects.Arpeggios.FindKey(num)
                     } else {
                         // Use a previously declared EN
-                        num, idx, err = comp.assertEffectIdExistsAndChannelsActive("EN", effects.Arpeggios)
+                        num, idx, err = comp.assertEffectIdExistsAndChannelsActive("EN", comp.effects.Arpeggios)
                     }             
 
                     if err == nil {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
-                                if !effects.Arpeggios.IsEmpty(num) {
-                                    effects.Arpeggios.AddRef(num)
-                                    idx |= effects.Arpeggios.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80
+                                if !comp.effects.Arpeggios.IsEmpty(num) {
+                                    comp.effects.Arpeggios.AddRef(num)
+                                    idx |= comp.effects.Arpeggios.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80
                                     if comp.enRev == 0 {
-                                        chn.AddCmd([]int{defs.CMD_ARPMAC, idx + 1})
+                                        chn.CurrentArpeggio = []int{defs.CMD_ARPMAC, idx + 1}
                                         //ToDo fix: usesEN[1] += 1
                                         chn.UsesEffect["EN"] = true
                                     } else {
-                                        chn.AddCmd([]int{defs.CMD_APMAC2, idx + 1})
+                                        chn.CurrentArpeggio = []int{defs.CMD_APMAC2, idx + 1}
                                         //ToDo: fix: usesEN[2] += 1
                                         chn.UsesEffect["EN2"] = true
                                     }
+                                    chn.AddCmd(chn.CurrentArpeggio)
                                 }
                             }
                         }
                     } else {
                         comp.assertDisablingEffect("EN", defs.CMD_ARPOFF)
+                        for _, chn := range comp.CurrSong.Channels {
+                            if chn.Active {
+                                chn.CurrentArpeggio = nil
+                            }
+                        }
                     }
 
                 // Pitch macro select ("EP<num>")
-                } else if Parser.PeekString(2) == "EP" {
-                    Parser.SkipN(2)
+                } else if comp.ctx.Parser.PeekString(2) == "EP" {
+                    comp.ctx.Parser.SkipN(2)
                     characterHandled = true
-                    num, idx, err := comp.assertEffectIdExistsAndChannelsActive("EP", effects.PitchMacros)
+                    num, idx, err := comp.assertEffectIdExistsAndChannelsActive("EP", comp.effects.PitchMacros)
 
                     if err == nil {
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
-                                if !effects.PitchMacros.IsEmpty(num) {
-                                    idx |= effects.PitchMacros.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80
+                                if !comp.effects.PitchMacros.IsEmpty(num) {
+                                    idx |= comp.effects.PitchMacros.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80
                                     chn.AddCmd([]int{defs.CMD_SWPMAC, idx + 1})
-                                    effects.PitchMacros.AddRef(num)
+                                    comp.effects.PitchMacros.AddRef(num)
                                     chn.UsesEffect["EP"] = true
                                 }
                             }
@@ -2120,104 +2758,104 @@ func (comp *Compiler) CompileFile(fileName string) {
                     }
 
                 // FM feedback select
-                } else if Parser.PeekString(2) == "FB" {
-                    Parser.SkipN(2)
-                    s := Parser.GetNumericString()
+                } else if comp.ctx.Parser.PeekString(2) == "FB" {
+                    comp.ctx.Parser.SkipN(2)
+                    s := comp.ctx.Parser.GetNumericString()
                     if len(s) > 0 {
                         characterHandled = true
                         num, err := strconv.Atoi(s)
                         if err == nil {
                             if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                ERROR("FB requires at least one active channel")
+                                comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "FB requires at least one active channel")
                             } else {
                                 if inRange(num, 0, 7) {
                                     comp.applyCmdOnAllActiveFM("FB", []int{defs.CMD_FEEDBK | num})
                                 } else {
-                                    ERROR(fmt.Sprintf("Feedback value out of range: %d", num))
+                                    comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Feedback value out of range: %d", num)
                                 }
                             }
                         } else {
-                            ERROR("Bad feedback value: " +  s)
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad feedback value: %s", s)
                         }
                     } else {
-                        m := Parser.Getch()
+                        m := comp.ctx.Parser.Getch()
                         if m == 'M' {
-                            s = Parser.GetNumericString()
+                            s = comp.ctx.Parser.GetNumericString()
                             if len(s) > 0 {
                                 characterHandled = true
                                 num, err := strconv.Atoi(s)
                                 if err == nil {
                                     if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                        ERROR("FBM requires at least one active channel")
+                                        comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "FBM requires at least one active channel")
                                     } else {
-                                        idx := effects.FeedbackMacros.FindKey(num)
+                                        idx := comp.effects.FeedbackMacros.FindKey(num)
                                         if idx >= 0 {
-                                            idx |= effects.FeedbackMacros.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80                
+                                            idx |= comp.effects.FeedbackMacros.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80                
                                             for _, chn := range comp.CurrSong.Channels {
                                                 if chn.Active {
                                                     if chn.SupportsFM() {
                                                         //if o[2] >=0 and o[2] <= 7 then
                                                             chn.AddCmd([]int{defs.CMD_FBKMAC, idx})
-                                                            effects.FeedbackMacros.AddRef(num)
+                                                            comp.effects.FeedbackMacros.AddRef(num)
 
                                                         //else
-                                                        //  ERROR(sprintf("Feedback value out of range: %d", o[2]))
+                                                        //  comp.ctx.ERROR(sprintf("Feedback value out of range: %d", o[2]))
                                                         //end if
                                                     } else {
-                                                        WARNING("FBM commands on non-FM channels are ignored")
+                                                        comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "FBM commands on non-FM channels are ignored")
                                                     }
                                                 }
                                             }
                                         } else {
-                                            ERROR("Undefined macro: FBM" + s)
+                                            comp.ctx.ERRORC(DIAG_MACRO, "Undefined macro: FBM%s", s)
                                         }
                                     }
                                 } else {
-                                    ERROR("Bad feedback value:" + s)
+                                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad feedback value:%s", s)
                                 }
                             } else {
-                                Parser.Ungetch()
-                                Parser.Ungetch()
+                                comp.ctx.Parser.Ungetch()
+                                comp.ctx.Parser.Ungetch()
                                 comp.assertIsChannelName(c)
                             }
                         } else {
-                            Parser.Ungetch()
-                            Parser.Ungetch()
+                            comp.ctx.Parser.Ungetch()
+                            comp.ctx.Parser.Ungetch()
                             comp.assertIsChannelName(c)
                         }
                     }
 
                 // Filter select ("FT<num>")
-                } else if Parser.PeekString(2) == "FT" {
-                    Parser.SkipN(2)
+                } else if comp.ctx.Parser.PeekString(2) == "FT" {
+                    comp.ctx.Parser.SkipN(2)
                     characterHandled = true
-                    s := Parser.GetNumericString()
+                    s := comp.ctx.Parser.GetNumericString()
                     num, err := strconv.Atoi(s)
                     if err == nil {
                         idx := -1
                         if comp.CurrSong.Target.GetID() != targets.TARGET_AT8 {
-                            idx = effects.Filters.FindKey(num)
+                            idx = comp.effects.Filters.FindKey(num)
                         }
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("FT requires at least one active channel")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "FT requires at least one active channel")
                         } else if idx >= 0 {
                             for _, chn := range comp.CurrSong.Channels {
                                 if chn.Active {
                                     if chn.SupportsFilter() {
                                         chn.AddCmd([]int{defs.CMD_FILTER, idx + 1})
-                                        effects.Filters.AddRef(num)
+                                        comp.effects.Filters.AddRef(num)
                                     } else {
-                                        WARNING("Unsupported command for this channel: FT")
+                                        comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for this channel: FT")
                                     }
                                 }
                             }
                         } else if comp.CurrSong.Target.GetID() == targets.TARGET_AT8 && num == 0 {
                             comp.applyCmdOnAllActive("FT", []int{defs.CMD_FILTER, 1})
                         } else {
-                            ERROR("Undefined macro: FT" + s)
+                            comp.ctx.ERRORC(DIAG_MACRO, "Undefined macro: FT%s", s)
                         }
-                    } else if Parser.PeekString(2) == "OF" {
-                        Parser.SkipN(2)
+                    } else if comp.ctx.Parser.PeekString(2) == "OF" {
+                        comp.ctx.Parser.SkipN(2)
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
                                 if chn.SupportsFilter() {
@@ -2226,16 +2864,16 @@ func (comp *Compiler) CompileFile(fileName string) {
                             }
                         }
                     } else {
-                        ERROR("Syntax error: expected FT<num> or FTOF")
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: expected FT<num> or FTOF")
                     }
          
                 // Loop
                 } else if c == 'L' {
-                    Parser.SkipN(1)
+                    comp.ctx.Parser.SkipN(1)
                     if comp.CurrSong.GetNumActiveChannels() == 0 || comp.lastWasChannelSelect {
                         if !strings.ContainsRune(comp.CurrSong.Target.GetChannelNames(), rune(c)) {
                             comp.writeAllPendingNotes(true)
-                            WARNING(fmt.Sprintf("Trying to set a loop point with no active channels (last=%d)", comp.lastWasChannelSelect))
+                            comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to set a loop point with no active channels (last=%t)", comp.lastWasChannelSelect)
                             characterHandled = true
                         }
                     } else {
@@ -2248,9 +2886,10 @@ func (comp *Compiler) CompileFile(fileName string) {
                                 if chn.LoopPoint == -1 {
                                     chn.LoopPoint = len(chn.Cmds)
                                     chn.LoopFrames = chn.Frames
+                                    chn.LoopPlayFrames = chn.PlayFrames
                                     chn.LoopTicks = chn.Ticks
                                 } else {
-                                    ERROR("Loop point already defined for channel " + chn.GetName())
+                                    comp.ctx.ERRORC(DIAG_REDEFINITION, "Loop point already defined for channel %s", chn.GetName())
                                 }
                             }
                         }
@@ -2258,17 +2897,17 @@ func (comp *Compiler) CompileFile(fileName string) {
 
         
                 // Vibrato select                       
-                } else if Parser.PeekString(2) == "MP" {
-                    Parser.SkipN(2)
+                } else if comp.ctx.Parser.PeekString(2) == "MP" {
+                    comp.ctx.Parser.SkipN(2)
                     characterHandled = true
-                    num, idx, err := comp.assertEffectIdExistsAndChannelsActive("MP", effects.Vibratos)
+                    num, idx, err := comp.assertEffectIdExistsAndChannelsActive("MP", comp.effects.Vibratos)
 
                     if err == nil {
-                        idx |= effects.Vibratos.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80
+                        idx |= comp.effects.Vibratos.GetExtraInt(num, effects.EXTRA_EFFECT_FREQ) * 0x80
                         for _, chn := range comp.CurrSong.Channels {
                             if chn.Active {
                                 chn.AddCmd([]int{defs.CMD_VIBMAC, idx + 1})
-                                effects.Vibratos.AddRef(num)
+                                comp.effects.Vibratos.AddRef(num)
                                 chn.UsesEffect["MP"] = true
                             }
                         }
@@ -2276,16 +2915,16 @@ func (comp *Compiler) CompileFile(fileName string) {
                         comp.assertDisablingEffect("MP", defs.CMD_VIBMAC);
                     }
 
-                } else if Parser.PeekString(2) == "MF" {
-                    Parser.SkipN(2)
-                    s := Parser.GetNumericString()
+                } else if comp.ctx.Parser.PeekString(2) == "MF" {
+                    comp.ctx.Parser.SkipN(2)
+                    s := comp.ctx.Parser.GetNumericString()
                     if len(s) > 0 {
                         characterHandled = true
                         num, err := strconv.Atoi(s)
                         if err == nil {
                             if inRange(num, 0, 15) {
                                 if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                    ERROR("MF requires at least one active channel")
+                                    comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "MF requires at least one active channel")
                                 } else {
                                     for _, chn := range comp.CurrSong.Channels {
                                         if chn.Active {
@@ -2301,51 +2940,51 @@ func (comp *Compiler) CompileFile(fileName string) {
                                                 }
                                                 chn.AddCmd([]int{defs.CMD_MULT, num})
                                             } else {
-                                                WARNING("MF ignored for non-FM channel")
+                                                comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "MF ignored for non-FM channel")
                                             }
                                         }
                                     }
                                 }
                             } else {
-                                ERROR("MF out of range: " + s)
+                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "MF out of range: %s", s)
                             } 
                         } else {
-                            ERROR("Bad MF: " + s)
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad MF: %s", s)
                         }
                      } else {
-                        Parser.Ungetch()
+                        comp.ctx.Parser.Ungetch()
                         comp.assertIsChannelName(c)
                     }
 
                 // Modulator select ("MOD<num>")
-                } else if Parser.PeekString(3) == "MOD" {
-                    Parser.SkipN(3)
-                    s := Parser.GetNumericString()
+                } else if comp.ctx.Parser.PeekString(3) == "MOD" {
+                    comp.ctx.Parser.SkipN(3)
+                    s := comp.ctx.Parser.GetNumericString()
                     if len(s) > 0 {
                         characterHandled = true
                         num, err := strconv.Atoi(s)
                         if err == nil {
-                            idx := effects.MODs.FindKey(num)
+                            idx := comp.effects.MODs.FindKey(num)
                             if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                ERROR("MOD requires at least one active channel")
+                                comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "MOD requires at least one active channel")
                             } else if idx >= 0 {
                                 for _, chn := range comp.CurrSong.Channels {
                                     if chn.Active {
                                         if chn.SupportsFM() || chn.GetChipID() == specs.CHIP_HUC6280 {
                                             chn.AddCmd([]int{defs.CMD_MODMAC, idx + 1})
-                                            effects.MODs.AddRef(num)
+                                            comp.effects.MODs.AddRef(num)
                                         }
                                     }
                                 }
                             } else {
-                                ERROR("Undefined macro: MOD" + s)
+                                comp.ctx.ERRORC(DIAG_MACRO, "Undefined macro: MOD%s", s)
                             }
                         } else {
-                            ERROR("Bad MOD: " + s)
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad MOD: %s", s)
                         }
                     } else {
-                        m := Parser.Getch()
-                        t := string(byte(m)) + string(byte(Parser.Getch()))
+                        m := comp.ctx.Parser.Getch()
+                        t := string(byte(m)) + string(byte(comp.ctx.Parser.Getch()))
                         if t == "OF" {
                             // Modulator off ("MODOF")
                             characterHandled = true
@@ -2357,280 +2996,332 @@ func (comp *Compiler) CompileFile(fileName string) {
                                 }
                             }
                         } else {
-                            Parser.Ungetch()
-                            Parser.Ungetch()
-                            Parser.Ungetch()
-                            Parser.Ungetch()
+                            comp.ctx.Parser.Ungetch()
+                            comp.ctx.Parser.Ungetch()
+                            comp.ctx.Parser.Ungetch()
+                            comp.ctx.Parser.Ungetch()
                             comp.assertIsChannelName(c)
                         }
                     }
 
                 } else if c == 'M' {
-                    Parser.SkipN(1)
-                    m := Parser.Getch()
+                    comp.ctx.Parser.SkipN(1)
+                    m := comp.ctx.Parser.Getch()
                     if IsNumeric(m) {
                         // Mode change ("M<num>")
                         characterHandled = true
-                        Parser.Ungetch()
-                        s := Parser.GetNumericString()
+                        comp.ctx.Parser.Ungetch()
+                        s := comp.ctx.Parser.GetNumericString()
                         num, err := strconv.Atoi(s)
                         if err == nil {
                             if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                ERROR("M requires at least one active channel")
+                                comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "M requires at least one active channel")
                             } else if inRange(num, 0, 15) {
                                 comp.applyCmdOnAllActive("M", []int{defs.CMD_MODE | num})
                             } else {
-                                ERROR("Bad mode: " + s)
+                                comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad mode: %s", s)
                             }
                         } else {
-                            ERROR("Bad mode:" + s)
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad mode:%s", s)
                         }
                     } else {
-                        Parser.Ungetch()
+                        comp.ctx.Parser.Ungetch()
                         comp.assertIsChannelName(c)
                     }
 
                 // FM operator select
-                } else if Parser.PeekString(2) == "OP" {
-                    Parser.SkipN(2)
+                } else if comp.ctx.Parser.PeekString(2) == "OP" {
+                    comp.ctx.Parser.SkipN(2)
                     if !comp.lastWasChannelSelect {
-                        s := Parser.GetNumericString()
+                        s := comp.ctx.Parser.GetNumericString()
                         if len(s) > 0 {
                             characterHandled = true
                             num, err := strconv.Atoi(s)
                             if err == nil {
                                 if inRange(num, 0, 4) {
                                     if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                        ERROR("OP requires at least one active channel")
+                                        comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "OP requires at least one active channel")
                                     } else {
                                         comp.applyCmdOnAllActiveFM("OP", []int{defs.CMD_OPER | num})
                                     }
                                 } else {
-                                    ERROR("OP out of range: " + s)
+                                    comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "OP out of range: %s", s)
                                 }
                             } else {
-                                ERROR("Bad OP: " + s)
+                                comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad OP: %s", s)
                             }
                         } else {
-                            Parser.Ungetch()
+                            comp.ctx.Parser.Ungetch()
                             comp.assertIsChannelName(c)
                         }
                     } else {
-                        Parser.Ungetch()
+                        comp.ctx.Parser.Ungetch()
                         comp.assertIsChannelName(c)
                     }
 
                 // Portamento select
-                } else if Parser.PeekString(2) == "PT" {
-                    Parser.SkipN(2)
+                } else if comp.ctx.Parser.PeekString(2) == "PT" {
+                    comp.ctx.Parser.SkipN(2)
                     characterHandled = true
-                    s := Parser.GetNumericString()
+                    s := comp.ctx.Parser.GetNumericString()
                     num, err := strconv.Atoi(s)
                     if err == nil {
-                        idx := effects.Portamentos.FindKey(num)
+                        idx := comp.effects.Portamentos.FindKey(num)
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("PT requires at least one active channel")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "PT requires at least one active channel")
                         } else if idx >= 0 {
                             // TODO: set portamento
-                            WARNING("PT command not yet implemented")
+                            comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "PT command not yet implemented")
                         } else {
-                            ERROR("Undefined macro: PT" + s)
+                            comp.ctx.ERRORC(DIAG_MACRO, "Undefined macro: PT%s", s)
                         }
                     } else {
-                        m := Parser.Getch()
-                        t := string(byte(m)) + string(byte(Parser.Getch()))
+                        m := comp.ctx.Parser.Getch()
+                        t := string(byte(m)) + string(byte(comp.ctx.Parser.Getch()))
                         if t == "OF" {
                             // TODO: deactivate portamento
                         } else {
-                            ERROR("Syntax error: PT" + s)
+                            comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: PT%s", s)
                         }
                     }
 
 
                 // Ring modulation select ("RING<num>")
-                } else if Parser.PeekString(4) == "RING" {
-                    Parser.SkipN(4)
+                } else if comp.ctx.Parser.PeekString(4) == "RING" {
+                    comp.ctx.Parser.SkipN(4)
                     characterHandled = true
-                    s := Parser.GetNumericString()
+                    s := comp.ctx.Parser.GetNumericString()
                     num, err := strconv.Atoi(s)
                     if err == nil {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("RING requires at least one active channel")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "RING requires at least one active channel")
                         } else if inRange(num, 0, 1) {
                             for _, chn := range comp.CurrSong.Channels {
                                 if chn.Active {
                                     if chn.SupportsRingMod() {
                                         chn.AddCmd([]int{defs.CMD_HWRM, num})
                                     } else {
-                                        WARNING("Unsupported command for this channel: RING")
+                                        comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for this channel: RING")
                                     }
                                 }
                             }
                         } else {
-                            ERROR("RING out of range: " + s)
+                            comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "RING out of range: %s", s)
                         }
                     } else {
-                        ERROR("Syntax error: RING" + s)
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: RING%s", s)
                     }
                         
                 // Rate scaling ("RS<num>")
-                } else if Parser.PeekString(2) == "RS" && !comp.lastWasChannelSelect {
-                    Parser.SkipN(2)
+                } else if comp.ctx.Parser.PeekString(2) == "RS" && !comp.lastWasChannelSelect {
+                    comp.ctx.Parser.SkipN(2)
                     characterHandled = true
-                    s := Parser.GetNumericString()
+                    s := comp.ctx.Parser.GetNumericString()
                     num, err := strconv.Atoi(s)
                     if err == nil {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("RS requires at least one active channel")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "RS requires at least one active channel")
                         } else if inRange(num, 0, 3) {
                             comp.applyCmdOnAllActiveFM("RS", []int{defs.CMD_RSCALE, num})
                         } else {
-                            ERROR("RS out of range: " + s)
+                            comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "RS out of range: %s", s)
                         }
                     } else {
-                        ERROR("Syntax error: RS" + s)
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: RS%s", s)
+                    }
+
+                // Groove ("GROOVE(name[,steplength])", or "GROOVE()" to turn it off)
+                } else if comp.ctx.Parser.PeekString(6) == "GROOVE" {
+                    comp.ctx.Parser.SkipN(6)
+                    characterHandled = true
+                    if comp.ctx.Parser.Getch() != '(' {
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: expected (")
+                    }
+                    name := strings.TrimSpace(comp.ctx.Parser.GetStringUntil(",)"))
+                    stepLen := 8
+                    if comp.ctx.Parser.Peekch() == ',' {
+                        comp.ctx.Parser.Getch()
+                        s := comp.ctx.Parser.GetNumericString()
+                        num, err := strconv.Atoi(s)
+                        if err != nil || utils.PositionOfInt(comp.timing.SupportedLengths, num) < 0 {
+                            comp.ctx.ERRORC(DIAG_UNSUPPORTED, "Unsupported length: %s", s)
+                        }
+                        stepLen = num
+                    }
+                    if comp.ctx.Parser.Getch() != ')' {
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: expected )")
+                    }
+                    steps, defined := comp.grooves[name]
+                    if len(name) > 0 && !defined {
+                        comp.ctx.ERRORC(DIAG_GROOVE, "Undefined groove: %s", name)
+                    }
+                    if comp.CurrSong.GetNumActiveChannels() == 0 {
+                        comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "GROOVE requires at least one active channel")
+                    }
+                    for _, chn := range comp.CurrSong.Channels {
+                        if chn.Active {
+                            // The previous groove may have left the channel ahead or behind in
+                            // the middle of a cycle; the next note makes up for it
+                            startPos := float64(chn.Ticks)
+                            if chn.Groove != nil {
+                                startPos = chn.Groove.Apply(chn.Ticks)
+                            }
+                            chn.Groove = nil
+                            if len(name) > 0 {
+                                chn.Groove = &channel.Groove{Name: name,
+                                                             Steps: steps,
+                                                             StepTicks: 32 / stepLen,
+                                                             StartTick: chn.Ticks,
+                                                             StartPos: startPos}
+                            } else if startPos != float64(chn.Ticks) {
+                                chn.Groove = &channel.Groove{Steps: []int{1},
+                                                             StepTicks: 1,
+                                                             StartTick: chn.Ticks,
+                                                             StartPos: startPos}
+                            }
+                        }
                     }
 
                 // Hard sync ("SYNC<num>")
-                } else if Parser.PeekString(4) == "SYNC" {
-                    Parser.SkipN(4)
+                } else if comp.ctx.Parser.PeekString(4) == "SYNC" {
+                    comp.ctx.Parser.SkipN(4)
                     characterHandled = true
-                    s := Parser.GetNumericString()
+                    s := comp.ctx.Parser.GetNumericString()
                     num, err := strconv.Atoi(s)
                     if err == nil {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("SYNC requires at least one active channel")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "SYNC requires at least one active channel")
                         } else if inRange(num, 0, 1) {
                             for _, chn := range comp.CurrSong.Channels {
                                 if chn.Active {
                                     if chn.SupportsRingMod() {
                                         chn.AddCmd([]int{defs.CMD_SYNC, num})
                                     } else {
-                                        WARNING("Unsupported command for this channel: SYNC")
+                                        comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for this channel: SYNC")
                                     }
                                 }
                             }
                         } else {
-                            ERROR("SYNC out of range: " + s)
+                            comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "SYNC out of range: %s", s)
                         }
                     } else {
-                        ERROR("Syntax error: SYNC" + s)
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: SYNC%s", s)
                     }
                 
                 // SSG Envelope Generator mode ("SSG<num>")
-                } else if Parser.PeekString(3) == "SSG" {
-                    Parser.SkipN(3)
+                } else if comp.ctx.Parser.PeekString(3) == "SSG" {
+                    comp.ctx.Parser.SkipN(3)
                     characterHandled = true
-                    s := Parser.GetNumericString()
+                    s := comp.ctx.Parser.GetNumericString()
                     num, err := strconv.Atoi(s)
                     if err == nil {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("SSG requires at least one active channel")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "SSG requires at least one active channel")
                         } else if inRange(num, 0, 7) {
                             comp.applyCmdOnAllActiveFM("SSG", []int{defs.CMD_SSG, num + 1})
                         } else {
-                            ERROR("SSG out of range: " + s)
+                            comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "SSG out of range: %s", s)
                         }
                     } else {
-                        m := Parser.Getch()
-                        t := string(byte(m)) + string(byte(Parser.Getch()))
+                        m := comp.ctx.Parser.Getch()
+                        t := string(byte(m)) + string(byte(comp.ctx.Parser.Getch()))
                         if t == "OF" {
                             for _, chn := range comp.CurrSong.Channels {
                                 if chn.Active {
                                     if chn.SupportsFM() {
                                         chn.AddCmd([]int{defs.CMD_SSG, 0})
                                     } else {
-                                        WARNING("SSG commands not supported for channel " + chn.GetName())
+                                        comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "SSG commands not supported for channel %s", chn.GetName())
                                     }
                                 }
                             }
                         } else {
-                            ERROR("Syntax error: SSG" + s)
+                            comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: SSG%s", s)
                         }
                     }
 
-                } else if Parser.PeekString(2) == "WT" {
+                } else if comp.ctx.Parser.PeekString(2) == "WT" {
                     // WT / WTM
-                    Parser.SkipN(2)
+                    comp.ctx.Parser.SkipN(2)
                     characterHandled = true
                     isWTM := false
-                    m := Parser.Getch()
+                    m := comp.ctx.Parser.Getch()
                     if m == 'M' {
                         isWTM = true
                     } else {
-                        Parser.Ungetch()
+                        comp.ctx.Parser.Ungetch()
                     }
-                    s := Parser.GetNumericString()
+                    s := comp.ctx.Parser.GetNumericString()
                     num, err := strconv.Atoi(s)
                     if err == nil {
                         if !isWTM {
-                            idx := effects.Waveforms.FindKey(num)
+                            idx := comp.effects.Waveforms.FindKey(num)
                             if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                ERROR("WT requires at least one active channel")
+                                comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "WT requires at least one active channel")
                             } else if idx >= 0 {
                                 if comp.CurrSong.GetNumActiveChannels() > 0 {
                                     comp.applyEffectOnAllActiveSupported("WT", []int{defs.CMD_LDWAVE, idx + 1},
                                                                     func(c *channel.Channel) bool { return c.SupportsWaveTable() },
-                                                                    effects.Waveforms, num)
+                                                                    comp.effects.Waveforms, num)
                                 } else {
-                                    WARNING("Trying to use WT with no channels active")
+                                    comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to use WT with no channels active")
                                 }
                             } else if comp.CurrSong.Target.SupportsWaveTable() {
-                                ERROR("Undefined macro: WT" + s)
+                                comp.ctx.ERRORC(DIAG_MACRO, "Undefined macro: WT%s", s)
                             }
                         } else {
-                            idx := effects.WaveformMacros.FindKey(num)
+                            idx := comp.effects.WaveformMacros.FindKey(num)
                             if comp.CurrSong.GetNumActiveChannels() == 0 {
-                                ERROR("WTM requires at least one active channel")
+                                comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "WTM requires at least one active channel")
                             } else if idx >= 0 {
                                 if comp.CurrSong.GetNumActiveChannels() > 0 {
                                     comp.applyEffectOnAllActiveSupported("WTM", []int{defs.CMD_WAVMAC, idx + 1},
                                                                     func(c *channel.Channel) bool { return c.SupportsWaveTable() },
-                                                                    effects.WaveformMacros, num)
+                                                                    comp.effects.WaveformMacros, num)
                                     /*for i = 1 to length(supportedChannels) do
                                         if activeChannels[i] then
                                             if supportsWave[i] then
                                                 chn.AddCmd([]int{defs.CMD_WAVMAC, idx})
                                                 waveformMacros = assoc_reference(waveformMacros, o[2])
                                             else
-                                                WARNING("Unsupported command for channel " & supportedChannels[i] & ": WTM")
+                                                comp.ctx.WARNING("Unsupported command for channel " & supportedChannels[i] & ": WTM")
                                             end if
                                         end if
                                     end for*/
                                 } else {
-                                    WARNING("Trying to use WTM with no channels active")
+                                    comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to use WTM with no channels active")
                                 }
                             } else if comp.CurrSong.Target.SupportsWaveTable() {
-                                ERROR("Undefined macro: WTM" + s)
+                                comp.ctx.ERRORC(DIAG_MACRO, "Undefined macro: WTM%s", s)
                             }
                         }
                     } else {
-                        m = Parser.Getch()
-                        t := string(byte(m)) + string(byte(Parser.Getch()))
+                        m = comp.ctx.Parser.Getch()
+                        t := string(byte(m)) + string(byte(comp.ctx.Parser.Getch()))
                         if t == "OF" {
                             for _, chn := range comp.CurrSong.Channels {
                                 if chn.Active {
                                     if chn.SupportsWaveTable() {
                                         chn.AddCmd([]int{defs.CMD_LDWAVE, 0})
                                     } else {
-                                        WARNING("WT commands not supported for channel " + chn.GetName())
+                                        comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "WT commands not supported for channel %s", chn.GetName())
                                     }
                                 }
                             }
                         } else {
-                            ERROR("Syntax error: WT" + s)
+                            comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: WT%s", s)
                         }
                     }
 
                 // Noise speed
                 } else if c == 'n' {
-                    Parser.SkipN(1)
+                    comp.ctx.Parser.SkipN(1)
                     characterHandled = true
-                    s := Parser.GetNumericString()
+                    s := comp.ctx.Parser.GetNumericString()
                     num, err := strconv.Atoi(s)
                     if err == nil && inRange(num, 0, 63) {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("n requires at least one active channel")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "n requires at least one active channel")
                         } else {
                             if comp.CurrSong.GetNumActiveChannels() > 0 {
                                 for _, chn := range comp.CurrSong.Channels {
@@ -2639,68 +3330,68 @@ func (comp *Compiler) CompileFile(fileName string) {
                                         case targets.TARGET_AST, targets.TARGET_KSS, targets.TARGET_CPC:
                                             chn.AddCmd([]int{defs.CMD_HWNS, num ^ 0x3F})
                                         default:
-                                            WARNING("Unsupported command for this channel: n")
+                                            comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for this channel: n")
                                         }
                                     }
                                 }
                             } else {
-                                WARNING("Trying to use n with no channels active")
+                                comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to use n with no channels active")
                             }
                         }
                     } else {
-                        ERROR("Bad n: " + s)
+                        comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad n: %s", s)
                     }
                     
-                } else if Parser.PeekString(2) == "pw" {
-                    Parser.SkipN(2)
+                } else if comp.ctx.Parser.PeekString(2) == "pw" {
+                    comp.ctx.Parser.SkipN(2)
                     characterHandled = true
-                    s := Parser.GetNumericString()
+                    s := comp.ctx.Parser.GetNumericString()
                     num, err := strconv.Atoi(s)
                     if err == nil && inRange(num, 0, 15) {
                         if comp.CurrSong.GetNumActiveChannels() == 0 {
-                            ERROR("pw requires at least one active channel")
+                            comp.ctx.ERRORC(DIAG_NO_ACTIVE_CHANNEL, "pw requires at least one active channel")
                         } else {
                             if comp.CurrSong.GetNumActiveChannels() > 0 {
                                 comp.applyCmdOnAllActive("pw", []int{defs.CMD_PULSE | num})
                             } else {
-                                WARNING("Trying to use pw with no channels active")
+                                comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Trying to use pw with no channels active")
                             }
                         }
                     } else {
-                        ERROR("Bad pw: " + s)
+                        comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad pw: %s", s)
                     }
                 
                 } else if c == 'w' {
-                    Parser.SkipN(1)
+                    comp.ctx.Parser.SkipN(1)
                     wrType := defs.CMD_WRMEM
-                    m := Parser.Getch()
+                    m := comp.ctx.Parser.Getch()
                     if m == '(' {
                         wrType = defs.CMD_WRPORT
                     } else {
-                        Parser.Ungetch()
+                        comp.ctx.Parser.Ungetch()
                     }
-                    s := Parser.GetNumericString()
+                    s := comp.ctx.Parser.GetNumericString()
                     if len(s) > 0 {
                         addr, err := strconv.Atoi(s)
                         if err == nil {
                             if inRange(addr, 0, 0xFFFF) {
-                                m = Parser.Getch()
+                                m = comp.ctx.Parser.Getch()
                                 if wrType == defs.CMD_WRPORT {
                                     if m != ')' {
-                                        ERROR("Expected ')'")
+                                        comp.ctx.ERRORC(DIAG_SYNTAX, "Expected ')'")
                                     }
-                                    m = Parser.Getch()
+                                    m = comp.ctx.Parser.Getch()
                                 }
                                 if m != ',' {
-                                    ERROR("Expected ','")
+                                    comp.ctx.ERRORC(DIAG_SYNTAX, "Expected ','")
                                 }
-                                s = Parser.GetNumericString()
+                                s = comp.ctx.Parser.GetNumericString()
                                 if len(s) == 0 {
-                                    ERROR("Missing second argument for w")
+                                    comp.ctx.ERRORC(DIAG_SYNTAX, "Missing second argument for w")
                                 }
                                 val, err := strconv.Atoi(s)
                                 if err != nil {
-                                    ERROR("Bad second argument for w")
+                                    comp.ctx.ERRORC(DIAG_SYNTAX, "Bad second argument for w")
                                 }
                                 for _, chn := range comp.CurrSong.Channels {
                                     if chn.Active {
@@ -2712,20 +3403,20 @@ func (comp *Compiler) CompileFile(fileName string) {
                                 }
                                 characterHandled = true
                             } else {
-                                ERROR("Memory address out of range: " + s)
+                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Memory address out of range: %s", s)
                             }
                         } else {
-                            ERROR("Bad first argument for w: " + s)
+                            comp.ctx.ERRORC(DIAG_SYNTAX, "Bad first argument for w: %s", s)
                         }
                     } else {
-                        ERROR("Bad first argument for w")
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Bad first argument for w")
                     }
                 }
                 
                 if !characterHandled {
-                    Parser.SkipN(1)
+                    comp.ctx.Parser.SkipN(1)
                     comp.assertIsChannelName(c)
-                    //fmt.Printf("Char not handled: '%c' on line %d (c3='%c')\n", c, Parser.LineNum, c3)
+                    //fmt.Printf("Char not handled: '%c' on line %d (c3='%c')\n", c, comp.ctx.Parser.LineNum, c3)
                     for _, chn := range comp.CurrSong.Channels {
                         if !comp.lastWasChannelSelect {
                             chn.Active = false
@@ -2736,30 +3427,29 @@ func (comp *Compiler) CompileFile(fileName string) {
                     }
                 }
             } else if strings.ContainsRune("\t\r\n ", rune(c)) {
-                //fmt.Printf("Whitespace on line %d\n", Parser.LineNum)
+                //fmt.Printf("Whitespace on line %d\n", comp.ctx.Parser.LineNum)
                 for _, chn := range comp.CurrSong.Channels {
                     chn.WriteNote(c == 10)
                 }
             } else {
                 if c == '%' {
-                    ERROR("Unexpected character: %%")
+                    comp.ctx.ERRORC(DIAG_UNEXPECTED_CHAR, "Unexpected character: %%")
                 } else {
-                    ERROR("Unexpected character: " + string(byte(c)))
+                    comp.ctx.ERRORC(DIAG_UNEXPECTED_CHAR, "Unexpected character: %c", c)
                 }
             }
             
             comp.lastWasChannelSelect = strings.ContainsRune(comp.CurrSong.Target.GetChannelNames(), rune(c2))
             /*if comp.lastWasChannelSelect {
-                fmt.Printf("%c on line %d\n", c2, Parser.LineNum)
+                fmt.Printf("%c on line %d\n", c2, comp.ctx.Parser.LineNum)
             } else {
-                fmt.Printf("'%c' on line %d\n", c2, Parser.LineNum)
+                fmt.Printf("'%c' on line %d\n", c2, comp.ctx.Parser.LineNum)
             }*/          
         }               
                 
     }
-    
-    comp.writeAllPendingNotes(true)
-    Parser = OldParsers.PopParserState()
+
+    return true
 }
 
 
@@ -2771,7 +3461,7 @@ func (comp *Compiler) removeUnusedEffect(effMap *effects.EffectMap, effCmd []int
     for pos < numKeys {
         key := effMap.GetKeyAt(pos)
         if key == -1 {
-            utils.ERROR("Unable to iterate over effects")
+            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Unable to iterate over effects")
         }
         if !effMap.IsReferenced(key) {
             for _, sng := range comp.GetSongs() {
@@ -2801,15 +3491,83 @@ func (comp *Compiler) removeUnusedEffect(effMap *effects.EffectMap, effCmd []int
 
 
 func (comp *Compiler) RemoveUnusedEffects() {
-    effectsRemoved := comp.removeUnusedEffect(effects.VolumeMacros, []int{defs.CMD_VOLMAC})
-    effectsRemoved += comp.removeUnusedEffect(effects.PitchMacros, []int{defs.CMD_SWPMAC})
-    effectsRemoved += comp.removeUnusedEffect(effects.DutyMacros, []int{defs.CMD_DUTMAC})
-    effectsRemoved += comp.removeUnusedEffect(effects.FeedbackMacros, []int{defs.CMD_FBKMAC})
-    effectsRemoved += comp.removeUnusedEffect(effects.PulseMacros, []int{defs.CMD_PULMAC})
-    effectsRemoved += comp.removeUnusedEffect(effects.Arpeggios, []int{defs.CMD_ARPMAC, defs.CMD_APMAC2})
-    effectsRemoved += comp.removeUnusedEffect(effects.Vibratos, []int{defs.CMD_VIBMAC})
-    effectsRemoved += comp.removeUnusedEffect(effects.ADSRs, []int{defs.CMD_ADSR})
-    effectsRemoved += comp.removeUnusedEffect(effects.MODs, []int{defs.CMD_MODMAC})
-    effectsRemoved += comp.removeUnusedEffect(effects.Filters, []int{defs.CMD_FILTER})
-    utils.INFO("Removed %d unused effects", effectsRemoved)
+    effectsRemoved := comp.removeUnusedEffect(comp.effects.VolumeMacros, []int{defs.CMD_VOLMAC})
+    effectsRemoved += comp.removeUnusedEffect(comp.effects.PitchMacros, []int{defs.CMD_SWPMAC})
+    effectsRemoved += comp.removeUnusedEffect(comp.effects.DutyMacros, []int{defs.CMD_DUTMAC})
+    effectsRemoved += comp.removeUnusedEffect(comp.effects.FeedbackMacros, []int{defs.CMD_FBKMAC})
+    effectsRemoved += comp.removeUnusedEffect(comp.effects.PulseMacros, []int{defs.CMD_PULMAC})
+    effectsRemoved += comp.removeUnusedEffect(comp.effects.Arpeggios, []int{defs.CMD_ARPMAC, defs.CMD_APMAC2})
+    effectsRemoved += comp.removeUnusedEffect(comp.effects.Vibratos, []int{defs.CMD_VIBMAC})
+    effectsRemoved += comp.removeUnusedEffect(comp.effects.ADSRs, []int{defs.CMD_ADSR})
+    effectsRemoved += comp.removeUnusedEffect(comp.effects.MODs, []int{defs.CMD_MODMAC})
+    effectsRemoved += comp.removeUnusedEffect(comp.effects.Filters, []int{defs.CMD_FILTER})
+    comp.ctx.INFO("Removed %d unused effects", effectsRemoved)
+}
+
+
+/* Ends the command sequence of each channel with a jump to its loop point
+ * (or an END marker), and checks that all channels have the same length.
+ * Should be called once after a successful compilation.
+ */
+func (comp *Compiler) FinishSongs() {
+    // The END/JMP commands don't correspond to anything in the source
+    comp.ctx.CommandLocation = nil
+    for _, song := range comp.Songs {
+        for _, chn := range song.Channels {
+            if chn.IsVirtual() {
+                continue
+            }
+            // A groove cycle that isn't completed has no later note to make up for it
+            if chn.Groove != nil && chn.Groove.Apply(chn.Ticks) != float64(chn.Ticks) {
+                drift := chn.Groove.Apply(chn.Ticks) - float64(chn.Ticks)
+                if drift < 0 {
+                    drift = -drift
+                }
+                comp.Diagnostics.Add(Diagnostic{Severity: SEVERITY_WARNING,
+                                                Code: DIAG_GROOVE,
+                                                Message: fmt.Sprintf("Channel %s ends in the middle of a groove cycle, and is out of time by %.1f ticks",
+                                                                     chn.GetName(), drift)})
+            }
+            chn.LoopTicks = chn.Ticks - chn.LoopTicks
+            if chn.LoopPoint == -1 {
+                chn.AddCmd([]int{defs.CMD_END})
+            } else {
+                if !chn.HasAnyNote {
+                    chn.AddCmd([]int{defs.CMD_END})
+                } else {
+                    chn.AddCmd([]int{defs.CMD_JMP, chn.LoopPoint & 0xFF, chn.LoopPoint / 0x100})
+                }
+            }
+        }
+    }
+
+    // Compare the total lengths of all channels
+    ticks := -1
+    for _, song := range comp.Songs {
+        for _, chn := range song.Channels {
+            if chn.IsVirtual() {
+                continue
+            }
+            if chn.HasAnyNote {
+                if ticks == -1 {
+                    ticks = chn.Ticks
+                } else if chn.Ticks != ticks {
+                    comp.Diagnostics.Add(Diagnostic{Severity: SEVERITY_WARNING,
+                                                    Code: DIAG_LENGTH_MISMATCH,
+                                                    Message: fmt.Sprintf("Mismatch in length between channels in song %d", song.Num)})
+                    break
+                }
+            }
+        }
+    }
+}
+
+
+/* Writes the output files for the current song's target.
+ */
+func (comp *Compiler) Output(outputFormat int) (err error) {
+    defer comp.ctx.RecoverErrors(&err)
+
+    comp.CurrSong.Target.Output(outputFormat)
+    return comp.Diagnostics.Err()
 }
@@ -0,0 +1,103 @@
+/*
+ * Package compiler
+ *
+ * Part of XPMC.
+ * Contains functions for writing a debug map, which tells where in
+ * the MML source each byte of the compiled song data came from.
+ */
+
+package compiler
+
+import (
+    "encoding/json"
+    "io"
+    "sort"
+    "../utils"
+)
+
+/* A run of consecutive bytes that came from the same source location.
+ */
+type debugMapEntry struct {
+    Offset int     `json:"offset"`
+    Length int     `json:"length"`
+    *utils.SourceLocation
+}
+
+type debugMapChannel struct {
+    Name string                 `json:"name"`
+    Size int                    `json:"size"`
+    Entries []debugMapEntry     `json:"entries"`
+}
+
+type debugMapSong struct {
+    Num int                     `json:"song"`
+    Channels []debugMapChannel  `json:"channels"`
+}
+
+type debugMapPattern struct {
+    Name string                 `json:"name"`
+    Size int                    `json:"size"`
+    Entries []debugMapEntry     `json:"entries"`
+}
+
+type debugMap struct {
+    Songs []debugMapSong        `json:"songs"`
+    Patterns []debugMapPattern  `json:"patterns"`
+}
+
+
+/* Groups consecutive bytes with the same source location. Bytes without
+ * a location (like the END marker at the end of each channel) are left out.
+ */
+func debugMapEntries(sources []*utils.SourceLocation) []debugMapEntry {
+    entries := []debugMapEntry{}
+    for i, src := range sources {
+        if src == nil {
+            continue
+        }
+        if n := len(entries); n > 0 &&
+           entries[n-1].SourceLocation == src &&
+           entries[n-1].Offset + entries[n-1].Length == i {
+            entries[n-1].Length++
+        } else {
+            entries = append(entries, debugMapEntry{Offset: i, Length: 1, SourceLocation: src})
+        }
+    }
+    return entries
+}
+
+
+/* Writes a JSON map from the byte offsets within each channel and pattern
+ * to the location in the MML source that the bytes were compiled from.
+ */
+func (comp *Compiler) WriteDebugMap(w io.Writer) error {
+    dm := debugMap{Songs: []debugMapSong{}, Patterns: []debugMapPattern{}}
+
+    nums := []int{}
+    for num := range comp.Songs {
+        nums = append(nums, num)
+    }
+    sort.Ints(nums)
+    for _, num := range nums {
+        sng := debugMapSong{Num: num, Channels: []debugMapChannel{}}
+        for _, chn := range comp.Songs[num].Channels {
+            if chn.IsVirtual() {
+                continue
+            }
+            sng.Channels = append(sng.Channels, debugMapChannel{Name: chn.Name,
+                                                                Size: len(chn.Cmds),
+                                                                Entries: debugMapEntries(chn.CmdSources)})
+        }
+        dm.Songs = append(dm.Songs, sng)
+    }
+
+    for i, pat := range comp.patterns.data {
+        dm.Patterns = append(dm.Patterns, debugMapPattern{Name: comp.patterns.keys[i],
+                                                          Size: len(pat.Cmds),
+                                                          Entries: debugMapEntries(pat.CmdSources)})
+    }
+
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    return enc.Encode(dm)
+}
@@ -0,0 +1,355 @@
+/*
+ * Package compiler
+ *
+ * Part of XPMC.
+ * Contains functions for handling drum kits (#DRUMKIT) and drum tracks
+ * (#DRUMS), which are expanded into MML for each of the channels that
+ * the drums are played on.
+ */
+
+package compiler
+
+import (
+    "strconv"
+    "strings"
+    "../targets"
+    "../utils"
+)
+
+/* The YM2413's rhythm key bits. In rhythm mode (M1) on the SMS, the number
+ * of a note played on channel K, counted from octave 1, holds the key bits
+ * of the rhythm sounds to play, so that several of them can be played at
+ * the same time.
+ */
+var ym2413RhythmBits = map[string]int{
+    "BD":  0x10,    // Bass drum
+    "SD":  0x08,    // Snare drum
+    "TOM": 0x04,    // Tom-tom
+    "CYM": 0x02,    // Top cymbal
+    "HH":  0x01,    // Hi-hat
+}
+
+const YM2413_RHYTHM_CHANNEL = "K"
+
+var drumNoteNames = []string{"c", "c+", "d", "d+", "e", "f", "f+", "g", "g+", "a", "a+", "b"}
+
+/* The commands that turn off the settings of a drum sound that can be turned
+ * off, by command name.
+ */
+var drumSettingResets = map[string]string{
+    "CS":  "CSOF",
+    "EN":  "ENOF",
+    "EP":  "EPOF",
+    "FT":  "FTOF",
+    "MOD": "MODOF",
+    "MP":  "MPOF",
+    "PT":  "PTOF",
+    "SSG": "SSGOF",
+}
+
+type drumSound struct {
+    name string
+    channel string      // The name of the channel that plays the sound
+    note string         // The note, including any octave command (e.g. "o2c")
+    settings []string   // Commands that set up the channel for the sound (e.g. "@v1", "EP2")
+    rhythm int          // The YM2413 rhythm key bits of the sound, or 0 if it isn't a rhythm sound
+}
+
+type drumKit map[byte]*drumSound
+
+
+/* Handles a #DRUMKIT definition on the form
+ *  <kit> <name> <symbol> = <channel> <note> <settings...>
+ * where the settings are any of @v<n>, @<n>, EP<n>, @XPCM<n>, etc. Instead
+ * of a channel and a note, one of BD, SD, TOM, CYM and HH can be given to
+ * use the YM2413's rhythm sounds on the SMS.
+ */
+func (comp *Compiler) handleDrumKitDef() {
+    kitName := comp.ctx.Parser.GetString()
+    name := comp.ctx.Parser.GetString()
+    symbol := comp.ctx.Parser.GetString()
+    if len(symbol) != 1 || strings.ContainsAny(symbol, ".()= \t") {
+        comp.ctx.ERRORC(utils.DIAG_DRUMS, "DRUMKIT: Bad symbol for %s: %s", name, symbol)
+    }
+    if comp.ctx.Parser.GetString() != "=" {
+        comp.ctx.ERRORC(utils.DIAG_SYNTAX, "Expected '='")
+    }
+
+    sound := &drumSound{name: name}
+    for _, t := range strings.Fields(comp.ctx.Parser.GetRestOfLine()) {
+        if len(t) == 1 && strings.Contains(comp.CurrSong.Target.GetChannelNames(), t) {
+            sound.channel = t
+        } else if bits, isRhythm := ym2413RhythmBits[t]; isRhythm {
+            if comp.CurrSong.Target.GetID() != targets.TARGET_SMS {
+                comp.ctx.ERRORC(utils.DIAG_DRUMS, "DRUMKIT: %s is only supported for the SMS", t)
+            }
+            sound.channel, sound.note, sound.rhythm = YM2413_RHYTHM_CHANNEL, rhythmNote(bits), bits
+        } else if isDrumNote(t) {
+            sound.note = t
+        } else {
+            sound.settings = append(sound.settings, t)
+        }
+    }
+    if len(sound.channel) == 0 || len(sound.note) == 0 {
+        comp.ctx.ERRORC(utils.DIAG_DRUMS, "DRUMKIT: %s needs a channel and a note", name)
+    }
+
+    if comp.drumKits[kitName] == nil {
+        comp.drumKits[kitName] = drumKit{}
+    }
+    comp.drumKits[kitName][symbol[0]] = sound
+}
+
+
+/* Returns the note that plays the rhythm sounds with the given key bits.
+ */
+func rhythmNote(bits int) string {
+    return "o" + strconv.Itoa(1 + bits / 12) + drumNoteNames[bits % 12]
+}
+
+
+/* Returns the name of the command that a drum sound setting uses, e.g. "@v"
+ * for "@v1" or "EP" for "EP2".
+ */
+func drumSettingName(setting string) string {
+    return strings.TrimRight(strings.SplitN(setting, "+", 2)[0], "-0123456789")
+}
+
+
+/* Returns the setting of the sound that uses the named command, or "".
+ */
+func (sound *drumSound) setting(name string) string {
+    for _, setting := range sound.settings {
+        if drumSettingName(setting) == name {
+            return setting
+        }
+    }
+    return ""
+}
+
+
+/* Returns true if s is a note with an optional octave, e.g. c, d+ or o3e-.
+ */
+func isDrumNote(s string) bool {
+    if strings.HasPrefix(s, "o") {
+        s = strings.TrimLeft(s[1:], "0123456789")
+    }
+    return len(s) >= 1 && len(s) <= 2 &&
+           strings.ContainsRune("abcdefg", rune(s[0])) &&
+           (len(s) == 1 || s[1] == '+' || s[1] == '-')
+}
+
+
+/* Parses the steps of a drum track. Each step is either a symbol from the
+ * kit, a . for a step without any hit, or several symbols within () that
+ * are played at the same time. Whitespace is ignored.
+ */
+func (comp *Compiler) parseDrumSteps(kit drumKit, track string) [][]*drumSound {
+    steps := [][]*drumSound{}
+    for i := 0; i < len(track); i++ {
+        c := track[i]
+        if c == ' ' || c == '\t' {
+            continue
+        } else if c == '.' {
+            steps = append(steps, nil)
+        } else if c == '(' {
+            end := strings.IndexByte(track[i:], ')')
+            if end < 0 {
+                comp.ctx.ERRORC(utils.DIAG_DRUMS, "Missing ) in drum track")
+            }
+            hits := []*drumSound{}
+            for j := i + 1; j < i + end; j++ {
+                hits = append(hits, comp.drumSound(kit, track[j]))
+            }
+            steps = append(steps, hits)
+            i += end
+        } else {
+            steps = append(steps, []*drumSound{comp.drumSound(kit, c)})
+        }
+    }
+    return steps
+}
+
+
+func (comp *Compiler) drumSound(kit drumKit, symbol byte) *drumSound {
+    sound, ok := kit[symbol]
+    if !ok {
+        comp.ctx.ERRORC(utils.DIAG_DRUMS, "Unknown drum in drum track: %c", symbol)
+    }
+    return sound
+}
+
+
+/* Handles a #DRUMS line on the form  <kit> <step length> <steps>, e.g.
+ *  #DRUMS std 16 k.s. k.s. (kh).s. kks.
+ * Every channel used by the kit gets one note (or rest) per step, so the
+ * channels stay in sync even if some of them aren't hit.
+ */
+func (comp *Compiler) handleDrumTrack() {
+    kitName := comp.ctx.Parser.GetString()
+    kit, ok := comp.drumKits[kitName]
+    if !ok {
+        comp.ctx.ERRORC(utils.DIAG_DRUMS, "Undefined drum kit: %s", kitName)
+    }
+    s := comp.ctx.Parser.GetNumericString()
+    stepLen, err := strconv.Atoi(s)
+    if err != nil || utils.PositionOfInt(comp.timing.SupportedLengths, stepLen) < 0 {
+        comp.ctx.ERRORC(utils.DIAG_UNSUPPORTED, "Unsupported length: %s", s)
+    }
+    pos, _ := comp.ctx.Parser.Position()
+    steps := comp.parseDrumSteps(kit, comp.ctx.Parser.GetRestOfLine())
+
+    // The channels used by the kit, in the target's channel order
+    channels := []string{}
+    for _, c := range comp.CurrSong.Target.GetChannelNames() {
+        for _, sound := range kit {
+            if sound.channel == string(c) {
+                channels = append(channels, sound.channel)
+                break
+            }
+        }
+    }
+
+    mml := ""
+    for _, chnName := range channels {
+        // Find the hits on this channel. Rhythm sounds that are hit at the same
+        // time are played as a single note with all their key bits set.
+        hits := make([]*drumSound, len(steps))
+        for i, step := range steps {
+            for _, sound := range step {
+                if sound.channel != chnName {
+                    continue
+                }
+                if hits[i] == nil {
+                    hits[i] = sound
+                } else if hits[i].rhythm != 0 && sound.rhythm != 0 {
+                    bits := hits[i].rhythm | sound.rhythm
+                    hits[i] = &drumSound{name: hits[i].name + "+" + sound.name,
+                                         channel: chnName,
+                                         note: rhythmNote(bits),
+                                         settings: append(append([]string{}, hits[i].settings...), sound.settings...),
+                                         rhythm: bits}
+                } else {
+                    comp.ctx.ERRORC(utils.DIAG_DRUMS, "%s and %s are both played on channel %s in the same step", hits[i].name, sound.name, chnName)
+                }
+            }
+        }
+
+        // The commands set by any of the sounds played on this channel
+        settingNames := []string{}
+        for _, hit := range hits {
+            if hit != nil {
+                for _, setting := range hit.settings {
+                    if name := drumSettingName(setting); utils.PositionOfString(settingNames, name) < 0 {
+                        settingNames = append(settingNames, name)
+                    }
+                }
+            }
+        }
+
+        length := strconv.Itoa(stepLen)
+        mml += chnName
+        var prev *drumSound
+        for i, hit := range hits {
+            if hit == nil {
+                if i > 0 {
+                    // Extend the previous note (or rest)
+                    mml += "^" + length
+                } else {
+                    mml += " r" + length
+                }
+                continue
+            }
+            if prev == nil || hit.name != prev.name {
+                if hit.rhythm != 0 && (prev == nil || prev.rhythm == 0) {
+                    mml += " M1"
+                } else if hit.rhythm == 0 && prev != nil && prev.rhythm != 0 {
+                    mml += " M0"
+                }
+                // Set up everything that the previous sound changed, so that
+                // none of its settings carry over to this sound
+                for _, name := range settingNames {
+                    if setting := hit.setting(name); len(setting) > 0 {
+                        mml += " " + setting
+                    } else if prev != nil && len(prev.setting(name)) > 0 {
+                        mml += " " + comp.resetDrumSetting(chnName, name, hit, prev)
+                    }
+                }
+            }
+            mml += " " + hit.note + length
+            prev = hit
+        }
+
+        // Undo the settings that can be undone, so that they don't carry over
+        // to whatever follows the drum track
+        if prev != nil {
+            for _, name := range settingNames {
+                if _, canReset := drumSettingResets[name]; (canReset || name == "v") && len(prev.setting(name)) > 0 {
+                    mml += " " + comp.resetDrumSetting(chnName, name, nil, prev)
+                }
+            }
+            if prev.rhythm != 0 {
+                mml += " M0"
+            }
+        }
+        mml += "\n"
+    }
+
+    comp.compileDrumTrack(mml, kitName, pos)
+}
+
+
+/* Returns the command that undoes the named setting of the sound prev before
+ * the sound hit is played (or at the end of the drum track if hit is nil).
+ * Volumes are set back to the volume the channel had before the drum track.
+ */
+func (comp *Compiler) resetDrumSetting(chnName string, name string, hit, prev *drumSound) string {
+    if reset, ok := drumSettingResets[name]; ok {
+        return reset
+    }
+    if name == "v" {
+        for _, chn := range comp.CurrSong.Channels {
+            if chn.GetName() == chnName {
+                return "v" + strconv.Itoa(chn.CurrentVolume)
+            }
+        }
+    }
+    comp.ctx.ERRORC(utils.DIAG_DRUMS, "%s sets %s on channel %s, which can't be undone for %s; give %s a %s setting as well",
+                    prev.name, prev.setting(name), chnName, hit.name, hit.name, name)
+    return ""
+}
+
+
+/* Compiles the MML generated for a drum track. The channels that were active
+ * before the drum track are active again afterwards.
+ */
+func (comp *Compiler) compileDrumTrack(mml string, kitName string, pos utils.SourcePos) {
+    savedActive := make([]bool, len(comp.CurrSong.Channels))
+    for i, chn := range comp.CurrSong.Channels {
+        savedActive[i] = chn.Active
+    }
+    savedLocation := comp.ctx.CommandLocation
+    savedParser := comp.ctx.Parser
+    defer func() {
+        for i, chn := range comp.CurrSong.Channels {
+            chn.Active = savedActive[i]
+        }
+        comp.ctx.CommandLocation = savedLocation
+        if comp.ctx.Parser != savedParser {
+            comp.ctx.Parser = comp.ctx.OldParsers.PopParserState()
+        }
+    }()
+
+    parser := utils.NewParserStateFromData(pos.File, []byte(mml), comp.ctx)
+    parser.LineNum = pos.Line
+    parser.Column = pos.Column
+    parser.FrameKind, parser.FrameName = utils.FRAME_DRUMS, kitName
+    prevLine := parser.LineNum
+    comp.ctx.OldParsers.Push(comp.ctx.Parser)
+    comp.ctx.Parser = parser
+    for !comp.compileCommands(&prevLine) {
+        comp.resync()
+    }
+    comp.writeAllPendingNotes(true)
+    comp.ctx.Parser = comp.ctx.OldParsers.PopParserState()
+}
@@ -30,23 +30,23 @@ func (comp *Compiler) getEffectFrequency() int {
     
     retVal = defs.EFFECT_STEP_EVERY_FRAME
     
-    Parser.SkipWhitespace()
-    n = Parser.Getch()
+    comp.ctx.Parser.SkipWhitespace()
+    n = comp.ctx.Parser.Getch()
     if n == '(' {
-        t := Parser.GetStringUntil(")\t\r\n ")
+        t := comp.ctx.Parser.GetStringUntil(")\t\r\n ")
         if t == "EVERY-FRAME" {
             retVal = defs.EFFECT_STEP_EVERY_FRAME
         } else if t == "EVERY-NOTE" {
             retVal = defs.EFFECT_STEP_EVERY_NOTE
         } else {
-            ERROR("Unsupported effect frequency: " + t)
+            comp.ctx.ERRORC(DIAG_UNSUPPORTED, "Unsupported effect frequency: %s", t)
         }
         
-        if Parser.Getch() != ')' {
-            ERROR("Syntax error: expected )")
+        if comp.ctx.Parser.Getch() != ')' {
+            comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: expected )")
         }
     } else {
-        Parser.Ungetch()
+        comp.ctx.Parser.Ungetch()
     }
     
     return retVal
@@ -56,53 +56,53 @@ func (comp *Compiler) getEffectFrequency() int {
 func (comp *Compiler) handleAdsrEnvelopeDef(cmd string, isInlined bool) int {
     num := -1
     if isInlined {              
-        Parser.SetListDelimiters("()")
-        lst, err := Parser.GetList()
+        comp.ctx.Parser.SetListDelimiters("()")
+        lst, err := comp.ctx.Parser.GetList()
         key := -1
         if err == nil {
             if len(lst.LoopedPart) == 0 {
                 if len(lst.MainPart) == comp.CurrSong.Target.GetAdsrLen() {
                     if inRange(lst.MainPart, 0, comp.CurrSong.Target.GetAdsrMax()) {
-                        key = effects.ADSRs.GetKeyFor(lst)
+                        key = comp.effects.ADSRs.GetKeyFor(lst)
                         if key == -1 {
-                            effects.ADSRs.Append(effects.ADSRs.InlinedDefinitionId, lst)
-                            num = effects.ADSRs.InlinedDefinitionId
-                            effects.ADSRs.InlinedDefinitionId++
+                            comp.effects.ADSRs.Append(comp.effects.ADSRs.InlinedDefinitionId, lst)
+                            num = comp.effects.ADSRs.InlinedDefinitionId
+                            comp.effects.ADSRs.InlinedDefinitionId++
                         } else {
                             num = key
                         }
                     } else {
-                        ERROR("ADSR parameters out of range: " + lst.Format())
+                        comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "ADSR parameters out of range: %s", lst.Format())
                     }
                 } else {
-                    ERROR("Bad number of ADSR parameters: " + lst.Format())
+                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad number of ADSR parameters: %s", lst.Format())
                 }
             } else {
-                ERROR("Bad ADSR: " + lst.Format())
+                comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad ADSR: %s", lst.Format())
             }
         } else {
-            ERROR("Bad ADSR: Unable to parse parameter list")
+            comp.ctx.ERRORC(DIAG_SYNTAX, "Bad ADSR: Unable to parse parameter list")
         }
     } else {
         // Normal definition
-        num = comp.handleEffectDefinition("ADSR", cmd, effects.ADSRs, func(parm *ParamList) bool {
+        num = comp.handleEffectDefinition("ADSR", cmd, comp.effects.ADSRs, func(parm *ParamList) bool {
                 if !parm.IsEmpty() {
                     if len(parm.LoopedPart) == 0 {
                         if len(parm.MainPart) == comp.CurrSong.Target.GetAdsrLen() {
                             if inRange(parm.MainPart, 0, comp.CurrSong.Target.GetAdsrMax()) {
                                 return true
                             } else {
-                                ERROR("ADSR parameters out of range: " + parm.Format())
+                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "ADSR parameters out of range: %s", parm.Format())
                             }
                         } else {
-                            ERROR("Bad number of ADSR parameters: " + parm.Format())
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad number of ADSR parameters: %s", parm.Format())
                         }
                     } else {
-                        ERROR("| loops are not allowed in ADSR envelopes: " + parm.Format())
+                        comp.ctx.ERRORC(DIAG_LOOP, "| loops are not allowed in ADSR envelopes: %s", parm.Format())
                     }
                     return true
                 } else {
-                    ERROR("Empty list for ADSR")
+                    comp.ctx.ERRORC(DIAG_SYNTAX, "Empty list for ADSR")
                 }
                 return false
             })
@@ -116,38 +116,38 @@ func (comp *Compiler) handleArpeggioDef(cmd string, isInlined bool) int {
     num := -1
     if isInlined {
         // Inlined definition
-        Parser.SetListDelimiters("()")
-        lst, err := Parser.GetList()
+        comp.ctx.Parser.SetListDelimiters("()")
+        lst, err := comp.ctx.Parser.GetList()
         key := -1
         if err == nil {
             if inRange(lst.MainPart, -63, 63) && inRange(lst.LoopedPart, -63, 63) {
                 freq := comp.getEffectFrequency()             
-                key = effects.Arpeggios.GetKeyFor(lst)
-                if key == -1 || effects.Arpeggios.GetExtraInt(key, effects.EXTRA_EFFECT_FREQ) != freq {
-                    effects.Arpeggios.Append(effects.Arpeggios.InlinedDefinitionId, lst)
-                    effects.Arpeggios.PutExtraInt(effects.Arpeggios.InlinedDefinitionId, effects.EXTRA_EFFECT_FREQ, freq)                
-                    num = effects.Arpeggios.InlinedDefinitionId
-                    effects.Arpeggios.InlinedDefinitionId++
+                key = comp.effects.Arpeggios.GetKeyFor(lst)
+                if key == -1 || comp.effects.Arpeggios.GetExtraInt(key, effects.EXTRA_EFFECT_FREQ) != freq {
+                    comp.effects.Arpeggios.Append(comp.effects.Arpeggios.InlinedDefinitionId, lst)
+                    comp.effects.Arpeggios.PutExtraInt(comp.effects.Arpeggios.InlinedDefinitionId, effects.EXTRA_EFFECT_FREQ, freq)                
+                    num = comp.effects.Arpeggios.InlinedDefinitionId
+                    comp.effects.Arpeggios.InlinedDefinitionId++
                 } else {
                     num = key
                 }
             } else {
-                ERROR("Value of out range (allowed: -63-63): " + lst.Format())
+                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Value of out range (allowed: -63-63): %s", lst.Format())
             }
         } else {
-            ERROR("Bad EN: Unable to parse parameter list")
+            comp.ctx.ERRORC(DIAG_SYNTAX, "Bad EN: Unable to parse parameter list")
         }
     } else {
         // Normal definition
-        num = comp.handleEffectDefinition("EN", cmd, effects.Arpeggios, func(parm *ParamList) bool {
+        num = comp.handleEffectDefinition("EN", cmd, comp.effects.Arpeggios, func(parm *ParamList) bool {
                     if !parm.IsEmpty() {
                         if inRange(parm.MainPart, -63, 63) && inRange(parm.LoopedPart, -63, 63) {
                             return true;
                         } else {
-                            ERROR("Value of out range (allowed: -63-63): " + parm.Format())
+                            comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Value of out range (allowed: -63-63): %s", parm.Format())
                         }
                     } else {
-                        ERROR("Empty list for EN")
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Empty list for EN")
                     }
                     return false
                 })
@@ -160,27 +160,27 @@ func (comp *Compiler) handleArpeggioDef(cmd string, isInlined bool) int {
 /* Handles definitions of duty macros (@<n> = { ... })
  */
 func (comp *Compiler) handleDutyMacDef(num int) {
-    idx := effects.DutyMacros.FindKey(num) 
+    idx := comp.effects.DutyMacros.FindKey(num) 
     if comp.CurrSong.GetNumActiveChannels() == 0 {
         if idx < 0 {
-            t := Parser.GetString()
+            t := comp.ctx.Parser.GetString()
             if t == "=" {
-                lst, err := Parser.GetList()
+                lst, err := comp.ctx.Parser.GetList()
                 if err == nil {
                     if len(lst.MainPart) != 0 || len(lst.LoopedPart) != 0 {
-                        effects.DutyMacros.Append(num, lst)
-                        effects.DutyMacros.PutExtraInt(num, effects.EXTRA_EFFECT_FREQ, comp.getEffectFrequency())
+                        comp.effects.DutyMacros.Append(num, lst)
+                        comp.effects.DutyMacros.PutExtraInt(num, effects.EXTRA_EFFECT_FREQ, comp.getEffectFrequency())
                     } else {
-                        ERROR("Empty list for @")
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Empty list for @")
                     }
                 } else {
-                    ERROR("Syntax error, unable to parse list")
+                    comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error, unable to parse list")
                 }
             } else {
-                ERROR("Expected '=', got: " + t)
+                comp.ctx.ERRORC(DIAG_SYNTAX, "Expected '=', got: %s", t)
             }
         } else {
-            ERROR("Redefinition of @" + strconv.FormatInt(int64(num), 10))
+            comp.ctx.ERRORC(DIAG_REDEFINITION, "Redefinition of @%d", num)
         }
     } else {
         numChannels := 0
@@ -191,19 +191,19 @@ func (comp *Compiler) handleDutyMacDef(num int) {
                     if !chn.Tuple.Active {
                         chn.AddCmd([]int{defs.CMD_DUTY | num})
                     } else {
-                        chn.Tuple.Cmds = append(chn.Tuple.Cmds, channel.Note{Num: 0xFFFF, Frames: float64(defs.CMD_DUTY | num), HasData: true})
+                        chn.Tuple.Cmds = append(chn.Tuple.Cmds, channel.Note{Num: 0xFFFF, Frames: float64(defs.CMD_DUTY | num), HasData: true, Source: comp.ctx.CommandLocation})
                     }
                 } else {
                     if chn.SupportsDutyChange() == -1 {
-                        WARNING("Unsupported command for channel " + chn.GetName() + ": @")
+                        comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for channel %s: @", chn.GetName())
                     } else {
-                        ERROR("@ out of range: " + strconv.FormatInt(int64(num), 10))
+                        comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "@ out of range: %d", num)
                     }
                 }
             }
         }
         if numChannels == 0 {
-            WARNING("Use of @ with no channels active")
+            comp.ctx.WARNINGC(DIAG_NO_ACTIVE_CHANNEL, "Use of @ with no channels active")
         }
     }
                             
@@ -215,12 +215,12 @@ func (comp *Compiler) handlePanMacDef(cmd string) {
     num, err := strconv.Atoi(cmd[2:])
     if err == nil {
         // Already defined?
-        idx := effects.PanMacros.FindKey(num)
+        idx := comp.effects.PanMacros.FindKey(num)
         if idx < 0 {
             // ..no. Get the '=' sign and then the list of values
-            t := Parser.GetString()
+            t := comp.ctx.Parser.GetString()
             if t == "=" {
-                lst, err := Parser.GetList()
+                lst, err := comp.ctx.Parser.GetList()
                 if err == nil {
                     // The list must contain at least one value
                     if !lst.IsEmpty() {
@@ -232,27 +232,27 @@ func (comp *Compiler) handlePanMacDef(cmd string) {
                               comp.CurrSong.Target.GetID() == targets.TARGET_SFC) ||
                            comp.CurrSong.Target.GetID() == targets.TARGET_PCE {
                             // Store this effect among the pan macros
-                            effects.PanMacros.Append(num, lst)
+                            comp.effects.PanMacros.Append(num, lst)
                             // And store the effect frequency for this particular effect (whether it should
                             // be applied once per frame or once per note).
-                            effects.PanMacros.PutExtraInt(num, effects.EXTRA_EFFECT_FREQ, comp.getEffectFrequency())
+                            comp.effects.PanMacros.PutExtraInt(num, effects.EXTRA_EFFECT_FREQ, comp.getEffectFrequency())
                         } else {
-                            ERROR("Value of out range (allowed: -63-63): " + lst.Format())
+                            comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Value of out range (allowed: -63-63): %s", lst.Format())
                         }
                     } else {
-                        ERROR("Empty list for CS")
+                        comp.ctx.ERRORC(DIAG_SYNTAX, "Empty list for CS")
                     }
                 } else {
-                    ERROR("Bad CS: " + t)
+                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad CS: %s", t)
                 }
             } else {
-                ERROR("Expected '='")
+                comp.ctx.ERRORC(DIAG_SYNTAX, "Expected '='")
             }
         } else {
-            ERROR("Redefinition of @" + cmd)
+            comp.ctx.ERRORC(DIAG_REDEFINITION, "Redefinition of @%s", cmd)
         }
     } else {
-        ERROR("Syntax error: @" + cmd)
+        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: @%s", cmd)
     }
 }
 
@@ -260,7 +260,7 @@ func (comp *Compiler) handlePanMacDef(cmd string) {
 /* Handle definitions of filters ("@FT<xy> = {...}")
  */
 func (comp *Compiler) handleFilterDef(cmd string) {
-    _ = comp.handleEffectDefinition("FT", cmd, effects.Filters, func(parm *ParamList) bool {
+    _ = comp.handleEffectDefinition("FT", cmd, comp.effects.Filters, func(parm *ParamList) bool {
             if !parm.IsEmpty() {
                 if comp.CurrSong.Target.GetID() == targets.TARGET_C64 {
                     if len(parm.MainPart) == 3 && len(parm.LoopedPart) == 0 {
@@ -273,7 +273,7 @@ func (comp *Compiler) handleFilterDef(cmd string) {
                 }
                 return false
             } else {
-                ERROR("Empty list for FT")
+                comp.ctx.ERRORC(DIAG_SYNTAX, "Empty list for FT")
             }
             return false
         })  
@@ -285,62 +285,62 @@ func (comp *Compiler) handleFilterDef(cmd string) {
 func (comp *Compiler) handleModMacDef(cmd string) {
     num, err := strconv.Atoi(cmd[3:])
     if err == nil {
-        idx := effects.MODs.FindKey(num)
+        idx := comp.effects.MODs.FindKey(num)
         if idx < 0 {
-            t := Parser.GetString()
+            t := comp.ctx.Parser.GetString()
             if t == "=" {
-                lst, err := Parser.GetList()
+                lst, err := comp.ctx.Parser.GetList()
                 if err == nil {
                     switch comp.CurrSong.Target.GetID() {
                     case targets.TARGET_SMD:
                         // 3 parameter version: Genesis/Megadrive (YM2612)
                         if len(lst.MainPart) == 3 && len(lst.LoopedPart) == 0 {
                             if inRange(lst.MainPart, 0, []int{7, 7, 3}) {
-                                effects.MODs.Append(num, lst)
+                                comp.effects.MODs.Append(num, lst)
                             } else {
-                                ERROR("Value of out range: " + lst.Format())
+                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Value of out range: %s", lst.Format())
                             }
                         } else {
-                            ERROR("Bad MOD, expected 3 parameters: " + lst.Format())
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad MOD, expected 3 parameters: %s", lst.Format())
                         }
                     case targets.TARGET_CPS, targets.TARGET_X68:
                         // 6 parameter version: CPS-1, X68000 (YM2151)
                         if len(lst.MainPart) == 6 && len(lst.LoopedPart) == 0 {
                             if inRange(lst.MainPart, 0, []int{255, 127, 127, 3, 7, 3}) {
-                                effects.MODs.Append(num, lst)
+                                comp.effects.MODs.Append(num, lst)
                             } else {
-                                ERROR("Value of out range: " + lst.Format())
+                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Value of out range: %s", lst.Format())
                             }
                         } else {
-                            ERROR("Bad MOD, expected 6 parameters: " + lst.Format())
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad MOD, expected 6 parameters: %s", lst.Format())
                         }
                     case targets.TARGET_PCE:
                         // 2 parameter version: PC-Engine (HuC6280)
                         if len(lst.MainPart) == 2 && len(lst.LoopedPart) == 0 {
                             if inRange(lst.MainPart, 0, []int{255, 3}) {
-                                effects.MODs.Append(num, lst)
+                                comp.effects.MODs.Append(num, lst)
                             } else {
-                                ERROR("Value of out range: " + lst.Format())
+                                comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Value of out range: %s", lst.Format())
                             }
                         } else {
-                            ERROR("Bad MOD, expected 2 parameters: " + lst.Format())
+                            comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad MOD, expected 2 parameters: %s", lst.Format())
                         }
                     case targets.TARGET_KSS:
                         // ToDo: allow both 3-parameter and 6-parameter versions
                     default:
-                        effects.MODs.Append(num, &utils.ParamList{})
+                        comp.effects.MODs.Append(num, &utils.ParamList{})
                     }
                 } else {
-                    ERROR("Bad MOD: " + t)
+                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad MOD: %s", t)
                 }
             } else {
-                ERROR("Expected '='")
+                comp.ctx.ERRORC(DIAG_SYNTAX, "Expected '='")
             }
         } else {
-            ERROR("Redefinition of @" + cmd)
+            comp.ctx.ERRORC(DIAG_REDEFINITION, "Redefinition of @%s", cmd)
         }
     } else {
-        ERROR("Syntax error: @" + cmd)
+        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: @%s", cmd)
     }   
 }
 
@@ -348,15 +348,15 @@ func (comp *Compiler) handleModMacDef(cmd string) {
 /* Handles definitions of vibratos ("@MP<xy> = { ... }")
  */
 func (comp *Compiler) handleVibratoDef(cmd string) {
-    _ = comp.handleEffectDefinition("MP", cmd, effects.Vibratos, func(parm *ParamList) bool {
+    _ = comp.handleEffectDefinition("MP", cmd, comp.effects.Vibratos, func(parm *ParamList) bool {
             if len(parm.MainPart) == 3 && len(parm.LoopedPart) == 0 {
                 if inRange(parm.MainPart, []int{0, 1, 0}, []int{127, 127, 63}) {
                     return true
                 } else {
-                    ERROR("Value of out range: " + parm.Format())
+                    comp.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Value of out range: %s", parm.Format())
                 }
             } else {
-                ERROR("Bad MP: " + parm.Format())
+                comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad MP: %s", parm.Format())
             }
             return false
         })
@@ -366,51 +366,51 @@ func (comp *Compiler) handleVibratoDef(cmd string) {
 func (comp *Compiler) handleXpcmDef(cmd string) {
     num, err := strconv.Atoi(cmd[4:])
     if err == nil {
-        idx := effects.PCMs.FindKey(num)
+        idx := comp.effects.PCMs.FindKey(num)
         if idx < 0 {
-            t := Parser.GetString()
+            t := comp.ctx.Parser.GetString()
             if t == "=" {
-                lst, err := Parser.GetList()
+                lst, err := comp.ctx.Parser.GetList()
                 if comp.CurrSong.Target.SupportsPCM() {
                     if err == nil {
                         if len(lst.LoopedPart) == 0 {
                             if len(lst.MainPart) > 0 {
                                 if pcmFileName, ok := lst.MainPart[0].(string); ok {
                                     if !strings.ContainsRune(pcmFileName, rune(':')) && pcmFileName[0] != os.PathSeparator {
-                                        pcmFileName = Parser.WorkDir + pcmFileName
+                                        pcmFileName = comp.ctx.Parser.WorkDir + pcmFileName
                                         lst.MainPart[0] = pcmFileName
                                     }
                                     if len(lst.MainPart) > 2 {
                                         // {"filename" samplerate volume}
-                                        lst.LoopedPart = append(lst.LoopedPart, wav.ConvertWav(pcmFileName, lst.MainPart[1].(int), lst.MainPart[2].(int)))
+                                        lst.LoopedPart = append(lst.LoopedPart, wav.ConvertWav(comp.ctx, pcmFileName, lst.MainPart[1].(int), lst.MainPart[2].(int)))
                                     } else {
                                         // {"filename" samlerate}
-                                        lst.LoopedPart = append(lst.LoopedPart, wav.ConvertWav(pcmFileName, lst.MainPart[1].(int), 100))
+                                        lst.LoopedPart = append(lst.LoopedPart, wav.ConvertWav(comp.ctx, pcmFileName, lst.MainPart[1].(int), 100))
                                     }
-                                    effects.PCMs.Append(num, lst)
+                                    comp.effects.PCMs.Append(num, lst)
                                 } else {
-                                    ERROR("Bad XPCM: " + lst.Format())
+                                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad XPCM: %s", lst.Format())
                                 }
                             } else {
-                                ERROR("Bad XPCM: " + lst.Format())
+                                comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad XPCM: %s", lst.Format())
                             }
                         } else {
-                            ERROR("Loops not supported in XPCM: " + lst.Format())
+                            comp.ctx.ERRORC(DIAG_UNSUPPORTED, "Loops not supported in XPCM: %s", lst.Format())
                         }
                     } else {
-                        ERROR("Bad XPCM: " + t)
+                        comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad XPCM: %s", t)
                     }
                 } else {
-                    WARNING("Unsupported command for this target: @XPCM")
+                    comp.ctx.WARNINGC(DIAG_UNSUPPORTED, "Unsupported command for this target: @XPCM")
                 }
             } else {
-                ERROR("Expected '='")
+                comp.ctx.ERRORC(DIAG_SYNTAX, "Expected '='")
             }
         } else {
-            ERROR("Redefinition of @" + cmd)
+            comp.ctx.ERRORC(DIAG_REDEFINITION, "Redefinition of @%s", cmd)
         }
     } else {
-        ERROR("Syntax error: @" + cmd)
+        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: @%s", cmd)
     }       
 }
 
@@ -420,9 +420,9 @@ func (comp *Compiler) handleEffectDefinition(effName string, mmlString string, e
     if err == nil {
         idx := effMap.FindKey(num)
         if idx < 0 {
-            t := Parser.GetString()
+            t := comp.ctx.Parser.GetString()
             if t == "=" {
-                lst, err := Parser.GetList()
+                lst, err := comp.ctx.Parser.GetList()
                 if err == nil {
                     if pred(lst) {
                         freq := comp.getEffectFrequency()
@@ -438,16 +438,16 @@ func (comp *Compiler) handleEffectDefinition(effName string, mmlString string, e
                         }
                     }
                 } else {
-                    ERROR("Bad " + effName +": " + lst.Format())
+                    comp.ctx.ERRORC(DIAG_BAD_ARGUMENT, "Bad %s: %s", effName, lst.Format())
                 }
             } else {
-                ERROR("Expected '='")
+                comp.ctx.ERRORC(DIAG_SYNTAX, "Expected '='")
             }
         } else {
-            ERROR("Redefinition of @" + mmlString)
+            comp.ctx.ERRORC(DIAG_REDEFINITION, "Redefinition of @%s", mmlString)
         }
     } else {
-        ERROR("Syntax error: @" + mmlString)
+        comp.ctx.ERRORC(DIAG_SYNTAX, "Syntax error: @%s", mmlString)
     }
     
     return num
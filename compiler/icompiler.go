@@ -3,6 +3,9 @@ package compiler
 import (
     "sort"
     "../defs"
+    "../effects"
+    "../timing"
+    "../utils"
 )
 
 func (comp *Compiler) GetShortFileName() string {
@@ -21,6 +24,18 @@ func (comp *Compiler) GetPatterns() []defs.IMmlPattern {
     return patterns
 }
 
+func (comp *Compiler) GetContext() *utils.Context {
+    return comp.ctx
+}
+
+func (comp *Compiler) GetEffects() *effects.Effects {
+    return comp.effects
+}
+
+func (comp *Compiler) GetTiming() *timing.Timing {
+    return comp.timing
+}
+
 func (comp *Compiler) GetCurrentSong() defs.ISong {
     return comp.CurrSong
 }
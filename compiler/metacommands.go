@@ -11,16 +11,16 @@
 package compiler
 
 import (
+    "path"
+    "path/filepath"
     "strconv"
     "strings"
+    "../channel"
     "../defs"
-    "../song"
     "../targets"
-    "../timing"
     "../utils"
 )
 
-import . "../utils"
 
 const (
     POLARITY_POSITIVE = 0
@@ -35,24 +35,24 @@ const (
  * how the ops should be interpreted.
  * Returns 1 if the expression is true, otherwise 0
  */
-func evalIfdefExpr(polarity int) int {
-    s := Parser.GetStringUntil("&|\r\n")
-    expr := IsDefined(s)
+func (comp *Compiler) evalIfdefExpr(polarity int) int {
+    s := comp.ctx.Parser.GetStringUntil("&|\r\n")
+    expr := comp.ctx.IsDefined(s)
     for {
-        s = Parser.GetStringInRange("&|")
+        s = comp.ctx.Parser.GetStringInRange("&|")
         if s == "&" {
-            s = Parser.GetStringUntil("&|\r\n")
+            s = comp.ctx.Parser.GetStringUntil("&|\r\n")
             if polarity == POLARITY_POSITIVE {
-                expr = expr & IsDefined(s)
+                expr = expr & comp.ctx.IsDefined(s)
             } else {
-                expr = expr | IsDefined(s)
+                expr = expr | comp.ctx.IsDefined(s)
             }
         } else if s == "|" {
-            s = Parser.GetStringUntil("&|\r\n")
+            s = comp.ctx.Parser.GetStringUntil("&|\r\n")
             if polarity == POLARITY_POSITIVE {
-                expr = expr | IsDefined(s)
+                expr = expr | comp.ctx.IsDefined(s)
             } else {
-                expr = expr & IsDefined(s)
+                expr = expr & comp.ctx.IsDefined(s)
             }
         } else {
             break
@@ -63,24 +63,87 @@ func evalIfdefExpr(polarity int) int {
 }
 
 
+/* Evaluates the expression of an #IF or #ELIF.
+ * Returns 1 if the expression is true (non-zero), otherwise 0
+ */
+func (comp *Compiler) evalIfExpr(s string) (int, error) {
+    val, err := comp.ctx.EvalExpression(s)
+    if err == nil && val != 0 {
+        return 1, nil
+    }
+    return 0, err
+}
+
+
+/* Returns the path of an #INCLUDEd file. The file is looked for in the
+ * directory of the including file first, and then in each of the include
+ * directories.
+ */
+func (comp *Compiler) findInclude(fileName string) string {
+    if filepath.IsAbs(fileName) || strings.HasPrefix(fileName, "/") {
+        return fileName
+    }
+    localName := comp.ctx.Parser.WorkDir + fileName
+    if comp.ctx.FileExists(localName) {
+        return localName
+    }
+    for _, dir := range comp.ctx.IncludePaths {
+        name := path.Join(filepath.ToSlash(dir), fileName)
+        if comp.ctx.FileExists(name) {
+            return name
+        }
+    }
+    return localName
+}
+
+
 /* Handles commands starting with '#', i.e. a meta command.
  */
 func (comp *Compiler) handleMetaCommand() {
     if comp.dontCompile.PeekInt() != 0 {
-        s := Parser.GetString()
+        s := comp.ctx.Parser.GetString()
         switch s {
         case "IFDEF":
-            expr := evalIfdefExpr(POLARITY_POSITIVE)
+            expr := comp.evalIfdefExpr(POLARITY_POSITIVE)
             comp.dontCompile.Push((expr ^ 1) | comp.dontCompile.PeekInt())
             comp.hasElse.Push(false)
 
         case "IFNDEF":
-            expr := evalIfdefExpr(POLARITY_NEGATIVE)
+            expr := comp.evalIfdefExpr(POLARITY_NEGATIVE)
             comp.dontCompile.Push(expr | comp.dontCompile.PeekInt())
             comp.hasElse.Push(false)             
 
+        case "IF":
+            // The enclosing block isn't being compiled, so neither is this one
+            _ = comp.ctx.Parser.GetRestOfLine()
+            comp.dontCompile.Push(1 | comp.dontCompile.PeekInt())
+            comp.hasElse.Push(false)
+
+        case "ELIF":
+            s := comp.ctx.Parser.GetRestOfLine()
+            if comp.dontCompile.Len() > 1 {
+                if !comp.hasElse.PeekBool() {
+                    if (comp.dontCompile.PeekInt() & ELSIFDEF_TAKEN) != ELSIFDEF_TAKEN {
+                        _ = comp.dontCompile.PopInt()
+                        // Only evaluate the expression if the enclosing block is being compiled
+                        expr, err := 0, error(nil)
+                        if comp.dontCompile.PeekInt() == 0 {
+                            expr, err = comp.evalIfExpr(s)
+                        }
+                        comp.dontCompile.Push((expr ^ 1) | comp.dontCompile.PeekInt())
+                        if err != nil {
+                            comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "ELIF: %s", err.Error())
+                        }
+                    }
+                } else {
+                    comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "ELIF found after ELSE")
+                }
+            } else {
+                comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "ELIF with no matching IF")
+            }
+
         case "ELSIFDEF":
-            expr := evalIfdefExpr(POLARITY_POSITIVE)
+            expr := comp.evalIfdefExpr(POLARITY_POSITIVE)
             if comp.dontCompile.Len() > 1 {
                 if !comp.hasElse.PeekBool() {
                     if (comp.dontCompile.PeekInt() & ELSIFDEF_TAKEN) != ELSIFDEF_TAKEN {
@@ -88,10 +151,10 @@ func (comp *Compiler) handleMetaCommand() {
                         comp.dontCompile.Push((expr ^ 1) | comp.dontCompile.PeekInt())
                     }
                 } else {
-                    ERROR("ELSIFDEF found after ELSE")
+                    comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "ELSIFDEF found after ELSE")
                 }
             } else {
-                ERROR("ELSIFDEF with no matching IFDEF")
+                comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "ELSIFDEF with no matching IFDEF")
             }                   
 
 
@@ -105,10 +168,10 @@ func (comp *Compiler) handleMetaCommand() {
                     _ = comp.hasElse.PopBool()
                     comp.hasElse.Push(true)
                 } else {
-                    ERROR("Only one ELSE allowed per IFDEF")
+                    comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "Only one ELSE allowed per IFDEF")
                 }
             } else {
-                ERROR("ELSE with no matching IFDEF")
+                comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "ELSE with no matching IFDEF")
             }
 
         case "ENDIF":
@@ -116,7 +179,7 @@ func (comp *Compiler) handleMetaCommand() {
                 _ = comp.dontCompile.PopInt()
                 _ = comp.hasElse.PopBool()
             } else {
-                ERROR("ENDIF with no matching IFDEF")
+                comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "ENDIF with no matching IFDEF")
             }
         }
     } else {
@@ -124,34 +187,57 @@ func (comp *Compiler) handleMetaCommand() {
             chn.WriteNote(true)
         }
 
-        cmd := Parser.GetString()
+        cmd := comp.ctx.Parser.GetString()
 
         switch cmd {
         case "IFDEF":
-            expr := evalIfdefExpr(POLARITY_POSITIVE)
+            expr := comp.evalIfdefExpr(POLARITY_POSITIVE)
             comp.dontCompile.Push((expr ^ 1) | comp.dontCompile.PeekInt())
             comp.hasElse.Push(false)
 
         case "IFNDEF":
-            expr := evalIfdefExpr(POLARITY_NEGATIVE)
+            expr := comp.evalIfdefExpr(POLARITY_NEGATIVE)
             comp.dontCompile.Push(expr | comp.dontCompile.PeekInt())
             comp.hasElse.Push(false)
 
-        case "ELSIFDEF":
+        case "IF":
+            expr, err := comp.evalIfExpr(comp.ctx.Parser.GetRestOfLine())
+            comp.dontCompile.Push((expr ^ 1) | comp.dontCompile.PeekInt())
+            comp.hasElse.Push(false)
+            if err != nil {
+                comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "IF: %s", err.Error())
+            }
+
+        case "ELSIFDEF", "ELIF":
             if comp.dontCompile.Len() > 1 {
                 if !comp.hasElse.PeekBool() {
-                    _ = Parser.GetStringUntil("\r\n")
+                    _ = comp.ctx.Parser.GetRestOfLine()
                     _ = comp.dontCompile.PopInt()
                     // Getting here means that the current IFDEF/ELSIFDEF was true,
                     // so whatever is in subsequent ELSIFDEF/ELSE clauses should not
                     // be compiled.
                     comp.dontCompile.Push(ELSIFDEF_TAKEN)
                 } else {
-                    ERROR("ELSIFDEF found after ELSE")
+                    comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "%s found after ELSE", cmd)
                 }
             } else {
-                ERROR("ELSIFDEF with no matching IFDEF")
+                comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "%s with no matching IFDEF", cmd)
+            }
+
+        case "DEFINE":
+            sym := comp.ctx.Parser.GetString()
+            s := comp.ctx.Parser.GetRestOfLine()
+            val := 1
+            if len(s) > 0 {
+                var err error
+                if val, err = comp.ctx.EvalExpression(s); err != nil {
+                    comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "DEFINE: %s", err.Error())
+                }
             }
+            comp.ctx.DefineSymbol(sym, val)
+
+        case "UNDEF":
+            comp.ctx.UndefineSymbol(comp.ctx.Parser.GetString())
 
         case "ELSE":
             if comp.dontCompile.Len() > 1 {
@@ -161,10 +247,10 @@ func (comp *Compiler) handleMetaCommand() {
                     _ = comp.hasElse.PopBool()
                     comp.hasElse.Push(true)
                 } else {
-                    ERROR("Only one ELSE allowed per IFDEF")
+                    comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "Only one ELSE allowed per IFDEF")
                 }
             } else {
-                ERROR("ELSE with no matching IFDEF")
+                comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "ELSE with no matching IFDEF")
             }
 
         case "ENDIF":
@@ -172,82 +258,168 @@ func (comp *Compiler) handleMetaCommand() {
                 _ = comp.dontCompile.PopInt()
                 _ = comp.hasElse.PopBool()
             } else {
-                ERROR("ENDIF with no matching IFDEF")
+                comp.ctx.ERRORC(utils.DIAG_CONDITIONAL, "ENDIF with no matching IFDEF")
             }
                     
         case "TITLE":
-            comp.CurrSong.Title = Parser.GetStringUntil("\r\n")
+            comp.CurrSong.Title = comp.ctx.Parser.GetStringUntil("\r\n")
 
         case "TUNE":
             comp.CurrSong.TuneSmsPitch = true
 
         case "COMPOSER":
-            comp.CurrSong.Composer = Parser.GetStringUntil("\r\n")
+            comp.CurrSong.Composer = comp.ctx.Parser.GetStringUntil("\r\n")
 
         case "PROGRAMER","PROGRAMMER":
-            comp.CurrSong.Programmer = Parser.GetStringUntil("\r\n")
+            comp.CurrSong.Programmer = comp.ctx.Parser.GetStringUntil("\r\n")
 
         case "GAME":
-            comp.CurrSong.Game = Parser.GetStringUntil("\r\n")
+            comp.CurrSong.Game = comp.ctx.Parser.GetStringUntil("\r\n")
 
         case "ALBUM":
-            comp.CurrSong.Album = Parser.GetStringUntil("\r\n")
+            comp.CurrSong.Album = comp.ctx.Parser.GetStringUntil("\r\n")
 
         case "ERROR":
-            Parser.SkipWhitespace()
-            if Parser.Getch() == '"' {
-                s := Parser.GetStringUntil("\"")
-                if Parser.Getch() == '"' {
-                    ERROR(s)
+            comp.ctx.Parser.SkipWhitespace()
+            if comp.ctx.Parser.Getch() == '"' {
+                s := comp.ctx.Parser.GetStringUntil("\"")
+                if comp.ctx.Parser.Getch() == '"' {
+                    comp.ctx.ERRORC(utils.DIAG_USER, "%s", s)
                 } else {
-                    ERROR("Malformed #ERROR, missing ending \"")
+                    comp.ctx.ERRORC(utils.DIAG_SYNTAX, "Malformed #ERROR, missing ending \"")
                 }
             } else {
-                ERROR("Malformed #ERROR, missing starting \"")
+                comp.ctx.ERRORC(utils.DIAG_SYNTAX, "Malformed #ERROR, missing starting \"")
             }
 
         case "WARNING":
-            Parser.SkipWhitespace()
-            if Parser.Getch() == '"' {
-                s := Parser.GetStringUntil("\"")
-                if Parser.Getch() == '"' {
-                    WARNING(s)
+            comp.ctx.Parser.SkipWhitespace()
+            if comp.ctx.Parser.Getch() == '"' {
+                s := comp.ctx.Parser.GetStringUntil("\"")
+                if comp.ctx.Parser.Getch() == '"' {
+                    comp.ctx.WARNINGC(utils.DIAG_USER, "%s", s)
                 } else {
-                    ERROR("Malformed #WARNING, missing ending \"")
+                    comp.ctx.ERRORC(utils.DIAG_SYNTAX, "Malformed #WARNING, missing ending \"")
                 }
             } else {
-                ERROR("Malformed #WARNING, missing starting \"")
+                comp.ctx.ERRORC(utils.DIAG_SYNTAX, "Malformed #WARNING, missing starting \"")
             }
                     
-        case "INCLUDE":
-            Parser.SkipWhitespace()
-            if Parser.Getch() == '"' {
-                s := Parser.GetStringUntil("\"")
-                if Parser.Getch() == '"' {
+        case "INCLUDE", "INCLUDE-ONCE":
+            comp.ctx.Parser.SkipWhitespace()
+            if comp.ctx.Parser.Getch() == '"' {
+                s := comp.ctx.Parser.GetStringUntil("\"")
+                if comp.ctx.Parser.Getch() == '"' {
                     if len(s) > 0 {
                         if !strings.ContainsRune(s, ':') && s[0] != '\\' {
-                            s = Parser.WorkDir + s
+                            s = comp.findInclude(s)
+                        }
+                        // #INCLUDE-ONCE skips files that have already been included
+                        if cmd == "INCLUDE" || !comp.includedFiles[comp.ctx.FileKey(s)] {
+                            comp.CompileFile(s)
                         }
-                        comp.CompileFile(s)
                     }
                 } else {
-                    ERROR("Malformed #INCLUDE, missing ending \"")
+                    comp.ctx.ERRORC(utils.DIAG_SYNTAX, "Malformed #%s, missing ending \"", cmd)
                 }
             } else {
-                ERROR("Malformed #INCLUDE, missing starting \"")
+                comp.ctx.ERRORC(utils.DIAG_SYNTAX, "Malformed #%s, missing starting \"", cmd)
             }
 
-        case "PAL":
-            if comp.CurrSong.Target.SupportsPAL() {
-                timing.UpdateFreq = 50.0
+        case "PRAGMA":
+            s := comp.ctx.Parser.GetRestOfLine()
+            if s == "ONCE" {
+                // Any later #INCLUDEs of this file will be ignored
+                current := comp.includeStack[len(comp.includeStack)-1]
+                comp.onceFiles[comp.ctx.FileKey(current)] = true
+            } else {
+                comp.ctx.WARNINGC(utils.DIAG_UNKNOWN_COMMAND, "Unknown #PRAGMA: %s", s)
+            }
+
+        case "TEMPO-AT":
+            // #TEMPO-AT <bar> <tempo>[~<end tempo>:<bars>]
+            s := comp.ctx.Parser.GetNumericString()
+            bar, err := strconv.Atoi(s)
+            if err != nil || bar < 1 {
+                comp.ctx.ERRORC(utils.DIAG_TEMPO, "%s: Bad bar number: %s", cmd, s)
+            }
+            change := comp.parseTempo()
+            change.Tick = (bar - 1) * channel.TICKS_PER_BAR
+            if len(comp.sections) > 0 {
+                comp.ctx.ERRORC(utils.DIAG_TEMPO, "%s: Can not be used in songs with sections", cmd)
+            }
+            for _, chn := range comp.CurrSong.Channels {
+                if !chn.IsVirtual() && chn.Ticks > change.Tick {
+                    comp.ctx.ERRORC(utils.DIAG_TEMPO, "%s: Channel %s is already past bar %d", cmd, chn.GetName(), bar)
+                }
+            }
+            comp.CurrSong.Tempos.Add(change)
+
+        case "GROOVE":
+            // #GROOVE <name> = {<step> <step> ...}
+            name := comp.ctx.Parser.GetString()
+            if _, exists := comp.grooves[name]; exists {
+                comp.ctx.ERRORC(utils.DIAG_GROOVE, "Redefinition of groove %s", name)
+            }
+            if comp.ctx.Parser.GetString() != "=" {
+                comp.ctx.ERRORC(utils.DIAG_SYNTAX, "Expected '='")
             }
+            lst, err := comp.ctx.Parser.GetList()
+            if err != nil {
+                comp.ctx.ERRORC(utils.DIAG_GROOVE, "Bad groove: Unable to parse parameter list")
+            }
+            if len(lst.MainPart) == 0 || len(lst.LoopedPart) != 0 || !isIntSlice(lst.MainPart) {
+                comp.ctx.ERRORC(utils.DIAG_GROOVE, "Bad groove: %s", lst.Format())
+            }
+            steps := []int{}
+            for _, step := range lst.MainPart {
+                if step.(int) < 1 {
+                    comp.ctx.ERRORC(utils.DIAG_GROOVE, "Groove steps must be >= 1: %s", lst.Format())
+                }
+                steps = append(steps, step.(int))
+            }
+            comp.grooves[name] = steps
+
+        case "CHORD-MODE":
+            s := comp.ctx.Parser.GetString()
+            if s == "ARPEGGIO" {
+                comp.chordMode = CHORD_MODE_ARPEGGIO
+            } else if s == "SPLIT" {
+                comp.chordMode = CHORD_MODE_SPLIT
+            } else {
+                comp.ctx.ERRORC(utils.DIAG_BAD_ARGUMENT, "%s: Expected ARPEGGIO or SPLIT, got: %s", cmd, s)
+            }
+
+        case "DRUMKIT":
+            comp.handleDrumKitDef()
+
+        case "DRUMS":
+            comp.handleDrumTrack()
+
+        case "REPEAT":
+            comp.handleRepeat()
+
+        case "FOR":
+            comp.handleFor()
+
+        case "SECTION":
+            comp.handleSection()
+
+        case "ORDER":
+            comp.handleOrder()
+
+        case "END":
+            comp.ctx.ERRORC(utils.DIAG_BLOCK, "END with no matching REPEAT, FOR or SECTION")
+
+        case "PAL":
+            comp.SetPAL(true)
 
         case "NTSC":
-            timing.UpdateFreq = 60.0
+            comp.SetPAL(false)
 
         case "SONG":
-            s := Parser.GetString()
-            num, err := strconv.ParseInt(s, Parser.UserDefinedBase, 0)
+            s := comp.ctx.Parser.GetString()
+            num, err := strconv.ParseInt(s, comp.ctx.Parser.UserDefinedBase, 0)
             if err == nil {
                 if num > 1 && num < 100 {
                     // A song with the given number must not already exist
@@ -258,7 +430,7 @@ func (comp *Compiler) handleMetaCommand() {
                             }
                             // Verify that all []-loops have been closed
                             if chn.Loops.Len() > 0 {
-                                utils.ERROR("Open [ loop on channel %s", chn.Name)
+                                comp.ctx.ERRORC(utils.DIAG_LOOP, "Open [ loop on channel %s", chn.Name)
                             }
                             // Add END markers or jumps at the end of all channels
                             chn.LoopTicks = chn.Ticks - chn.LoopTicks
@@ -274,7 +446,7 @@ func (comp *Compiler) handleMetaCommand() {
                         }
                         
                         if comp.keepChannelsActive || (len(comp.patName) != 0) {
-                            utils.ERROR("Missing }")
+                            comp.ctx.ERRORC(utils.DIAG_SYNTAX, "Missing }")
                         }
                         
                         /*songNum = o[2]
@@ -284,34 +456,33 @@ func (comp *Compiler) handleMetaCommand() {
                         songLoopLen[songNum] = songLen[songNum]*/                   
    
                         // Create a new song and make it the current one
-                        comp.CurrSong = song.NewSong(int(num), comp.CurrSong.Target.GetID(), comp)
-                        comp.Songs[int(num)] = comp.CurrSong
+                        comp.newSong(int(num), comp.CurrSong.Target.GetID())
     
                     } else {
-                        ERROR("Song " + s + " already defined")
+                        comp.ctx.ERRORC(utils.DIAG_REDEFINITION, "Song %s already defined", s)
                     }
                 } else {
-                    ERROR("Bad song number: " + s)
+                    comp.ctx.ERRORC(utils.DIAG_BAD_ARGUMENT, "Bad song number: %s", s)
                 }
             } else {
-                ERROR("Bad song number: " + s)
+                comp.ctx.ERRORC(utils.DIAG_BAD_ARGUMENT, "Bad song number: %s", s)
             }
 
         case "BASE":
-            s := Parser.GetString()
-            newBase, err := strconv.ParseInt(s, 10, 0) //Parser.UserDefinedBase, 0)
+            s := comp.ctx.Parser.GetString()
+            newBase, err := strconv.ParseInt(s, 10, 0) //comp.ctx.Parser.UserDefinedBase, 0)
             if err == nil {
                 if newBase == 10 || newBase == 16 {
-                    Parser.UserDefinedBase = int(newBase)
+                    comp.ctx.Parser.UserDefinedBase = int(newBase)
                 } else {
-                    WARNING(cmd +": Expected 10 or 16, got: " + s)
+                    comp.ctx.WARNINGC(utils.DIAG_BAD_ARGUMENT, "%s: Expected 10 or 16, got: %s", cmd, s)
                 }
             } else {
-                ERROR(cmd +": Expected 10 or 16, got: " + s)
+                comp.ctx.ERRORC(utils.DIAG_BAD_ARGUMENT, "%s: Expected 10 or 16, got: %s", cmd, s)
             }
 
         case "UNIFORM-VOLUME":
-            s := Parser.GetString()
+            s := comp.ctx.Parser.GetString()
             vol, err := strconv.Atoi(s)
             if err == nil {
                 if vol > 1 {
@@ -319,17 +490,17 @@ func (comp *Compiler) handleMetaCommand() {
                         chn.SetMaxVolume(vol)
                     }
                     if vol > 255 {
-                        WARNING("Very large max volume specified: " + s)
+                        comp.ctx.WARNINGC(utils.DIAG_OUT_OF_RANGE, "Very large max volume specified: %s", s)
                     }
                 } else {
-                    ERROR("Volume must be >= 1: " + s)
+                    comp.ctx.ERRORC(utils.DIAG_OUT_OF_RANGE, "Volume must be >= 1: %s", s)
                 }
             } else {
-                ERROR(cmd + ": Expected a positive integer: " + s)
+                comp.ctx.ERRORC(utils.DIAG_BAD_ARGUMENT, "%s: Expected a positive integer: %s", cmd, s)
             }
 
         /*case "GB-VOLUME-CONTROL":
-            s := Parser.GetString()
+            s := comp.ctx.Parser.GetString()
             ctl, err := strconv.Atoi(s)
             if err == nil {
                 if ctl == 1 {
@@ -337,14 +508,14 @@ func (comp *Compiler) handleMetaCommand() {
                 } else if ctl == 0 {
                     comp.gbVolCtrl = 0
                 } else {
-                    WARNING(cmd + ": Expected 0 or 1, got: " + s)
+                    comp.ctx.WARNING(cmd + ": Expected 0 or 1, got: " + s)
                 }
             } else {
-                ERROR(cmd + ": Expected 0 or 1, got: " + s)
+                comp.ctx.ERROR(cmd + ": Expected 0 or 1, got: " + s)
             }
 
         case "GB-NOISE":
-            s := Parser.GetString()
+            s := comp.ctx.Parser.GetString()
             val, err := strconv.Atoi(s)
             if err == nil {
                 if val == 1 {
@@ -358,54 +529,54 @@ func (comp *Compiler) handleMetaCommand() {
                         comp.CurrSong.Channels[3].SetMaxOctave(11)
                     }
                 } else {
-                    WARNING(cmd + ": Expected 0 or 1, defaulting to 0: " + s)
+                    comp.ctx.WARNING(cmd + ": Expected 0 or 1, defaulting to 0: " + s)
                 }
             } else {
-                ERROR(cmd + ": Expected 0 or 1, got: " + s)
+                comp.ctx.ERROR(cmd + ": Expected 0 or 1, got: " + s)
             }*/
 
         case "EN-REV":
-            s := Parser.GetString()
+            s := comp.ctx.Parser.GetString()
             rev, err := strconv.Atoi(s)
             if err == nil {
                 if rev == 1 {
                     comp.enRev = 1
                     if comp.CurrSong.Target.GetID() == targets.TARGET_C64 ||
                        comp.CurrSong.Target.GetID() == targets.TARGET_AT8 {
-                        ERROR("#EN-REV 1 is not supported for this target")
+                        comp.ctx.ERRORC(utils.DIAG_UNSUPPORTED, "#EN-REV 1 is not supported for this target")
                     }
                 } else if rev == 0 {
                     comp.enRev = 0
                 } else {
-                    WARNING(cmd + ": Expected 0 or 1, defaulting to 0: " + s)
+                    comp.ctx.WARNINGC(utils.DIAG_SYNTAX, "%s: Expected 0 or 1, defaulting to 0: %s", cmd, s)
                 }
             } else {
-                ERROR(cmd + ": Expected 0 or 1, got: " + s)
+                comp.ctx.ERRORC(utils.DIAG_SYNTAX, "%s: Expected 0 or 1, got: %s", cmd, s)
             }
 
         case "OCTAVE-REV":
-            s := Parser.GetString()
+            s := comp.ctx.Parser.GetString()
             rev, err := strconv.Atoi(s)
             if err == nil {
                 if rev == 1 {
                     comp.octaveRev = -1
                 } else if rev == 0 {
                 } else {
-                    WARNING(cmd + ": Expected 0 or 1, defaulting to 0:" + s)
+                    comp.ctx.WARNINGC(utils.DIAG_SYNTAX, "%s: Expected 0 or 1, defaulting to 0:%s", cmd, s)
                 }
             } else {
-                ERROR(cmd + ": Expected 0 or 1, got:" + s)
+                comp.ctx.ERRORC(utils.DIAG_SYNTAX, "%s: Expected 0 or 1, got:%s", cmd, s)
             }
 
         case "AUTO-BANKSWITCH":
-            WARNING("Unsupported command: AUTO-BANKSWITCH")
-            _ = Parser.GetString() 
+            comp.ctx.WARNINGC(utils.DIAG_UNSUPPORTED, "Unsupported command: AUTO-BANKSWITCH")
+            _ = comp.ctx.Parser.GetString() 
 
         default:
             if handler, ok := comp.metaCommandHandlers[cmd]; ok {
                 handler(cmd, comp.CurrSong.Target)
             } else {
-                ERROR("Unknown command: " + cmd)
+                comp.ctx.ERRORC(utils.DIAG_UNKNOWN_COMMAND, "Unknown command: %s", cmd)
             }
         }
     }
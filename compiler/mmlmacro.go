@@ -1,12 +1,25 @@
 package compiler
 
-import "../utils"
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "../utils"
+)
 
 // For macro elements
 const (
     ARG_REFERENCE = 1
-    DEFAULT_PARAM = 2
+    EXPRESSION = 2
     CHAR_VERBATIM = 3
+    ASSIGNMENT = 4
+)
+
+// Macro parameter types
+const (
+    MACRO_PARAM_ANY = 0
+    MACRO_PARAM_NUM = 1
+    MACRO_PARAM_STR = 2
 )
 
 type MmlMacroElement struct {
@@ -14,8 +27,25 @@ type MmlMacroElement struct {
     val interface{}
 }
 
+/* A parameter of a macro. Parameters declared the old way, with only a
+ * default value, have no name.
+ */
+type MmlMacroParam struct {
+    name string
+    typ int
+    defaultVal string
+    required bool
+}
+
+type macroAssignment struct {
+    name string
+    expr string
+}
+
 type MmlMacro struct {
     data []*MmlMacroElement
+    params []*MmlMacroParam
+    locals []string
 }
 
 type MmlMacroMap struct {
@@ -48,6 +78,164 @@ func (m *MmlMacro) AppendChar(x byte) {
     m.data = append(m.data, &MmlMacroElement{CHAR_VERBATIM, x})
 }
 
-func (m *MmlMacro) AppendDefaultParam(x string) {
-    m.data = append(m.data, &MmlMacroElement{DEFAULT_PARAM, x})
+func (m *MmlMacro) AppendExpression(x string) {
+    m.data = append(m.data, &MmlMacroElement{EXPRESSION, x})
+}
+
+func (m *MmlMacro) AppendAssignment(name string, x string) {
+    if utils.PositionOfString(m.locals, name) < 0 {
+        m.locals = append(m.locals, name)
+    }
+    m.data = append(m.data, &MmlMacroElement{ASSIGNMENT, &macroAssignment{name, x}})
+}
+
+func (m *MmlMacro) AppendParam(x *MmlMacroParam) {
+    m.params = append(m.params, x)
+}
+
+/* Returns the index of the parameter with the given name, or -1 if there's
+ * no such parameter.
+ */
+func (m *MmlMacro) FindParam(name string) int {
+    for i, param := range m.params {
+        if len(name) > 0 && param.name == name {
+            return i
+        }
+    }
+    return -1
+}
+
+/* Returns true if name can be used in an expression in the macro body, i.e.
+ * if it's a local or a parameter that isn't a string.
+ */
+func (m *MmlMacro) isNumericName(name string) bool {
+    if idx := m.FindParam(name); idx >= 0 {
+        return m.params[idx].typ != MACRO_PARAM_STR
+    }
+    return utils.PositionOfString(m.locals, name) >= 0
+}
+
+
+/* Parses a parameter declaration on the form  <default>,  <name>=<default>
+ * or  <name>:<type>[=<default>], where type is num or str. Parameters without
+ * a default value must be given when the macro is invoked.
+ */
+func parseMacroParam(s string) (*MmlMacroParam, error) {
+    param := &MmlMacroParam{}
+    name := s
+    if eq := strings.IndexByte(s, '='); eq >= 0 {
+        name, param.defaultVal = s[:eq], s[eq+1:]
+    } else if strings.IndexByte(s, ':') >= 0 {
+        param.required = true
+    } else {
+        // An unnamed parameter with a default value
+        param.defaultVal = s
+        return param, nil
+    }
+
+    if colon := strings.IndexByte(name, ':'); colon >= 0 {
+        switch name[colon+1:] {
+        case "num":
+            param.typ = MACRO_PARAM_NUM
+        case "str":
+            param.typ = MACRO_PARAM_STR
+        default:
+            return nil, fmt.Errorf("Unknown parameter type: %s", name[colon+1:])
+        }
+        name = name[:colon]
+    }
+    if len(name) == 0 {
+        return nil, fmt.Errorf("Missing parameter name: %s", s)
+    }
+    if !utils.IsIdentifier(name) {
+        return nil, fmt.Errorf("Bad parameter name: %s", name)
+    }
+    param.name = name
+    if !param.required && param.typ == MACRO_PARAM_NUM {
+        if _, err := strconv.Atoi(param.defaultVal); err != nil {
+            return nil, fmt.Errorf("The default value of %s must be a number: %s", name, param.defaultVal)
+        }
+    }
+    return param, nil
+}
+
+
+/* Returns the body of the macro with the arguments substituted. args are
+ * the positional arguments of the invocation and kwNames/kwValues the
+ * keyword arguments (<name>=<value>). Expressions are evaluated in ctx.
+ */
+func (m *MmlMacro) Expand(ctx *utils.Context, macroName string, args []string, kwNames, kwValues []string) (string, error) {
+    values := []string{}
+    given := []bool{}
+    for _, param := range m.params {
+        values = append(values, param.defaultVal)
+        given = append(given, false)
+    }
+    for i, arg := range args {
+        if i < len(values) {
+            values[i], given[i] = arg, true
+        } else {
+            values = append(values, arg)
+        }
+    }
+    for i, name := range kwNames {
+        idx := m.FindParam(name)
+        if idx < 0 {
+            return "", fmt.Errorf("Macro %s has no parameter named %s", macroName, name)
+        } else if given[idx] {
+            return "", fmt.Errorf("Macro %s: %s was given more than once", macroName, name)
+        }
+        values[idx], given[idx] = kwValues[i], true
+    }
+
+    vars := map[string]string{}
+    for i, param := range m.params {
+        if param.required && !given[i] {
+            return "", fmt.Errorf("Macro %s: Missing argument for %s", macroName, param.name)
+        }
+        if param.typ == MACRO_PARAM_NUM {
+            if _, err := strconv.Atoi(values[i]); err != nil {
+                return "", fmt.Errorf("Macro %s: %s must be a number, got: %s", macroName, param.name, values[i])
+            }
+        }
+        if len(param.name) > 0 {
+            vars[param.name] = values[i]
+        }
+    }
+
+    // Expressions can only use the parameters and locals of the macro
+    lookup := func(name string) (int, bool, error) {
+        num, err := strconv.Atoi(vars[name])
+        if err != nil {
+            return 0, true, fmt.Errorf("%s is not a number: %s", name, vars[name])
+        }
+        return num, true, nil
+    }
+
+    expanded := ""
+    for _, token := range m.data {
+        switch token.typ {
+        case CHAR_VERBATIM:
+            expanded += string(token.val.(byte))
+        case ARG_REFERENCE:
+            // References to missing arguments are expanded to nothing
+            if argNum := token.val.(int) - 1; argNum >= 0 && argNum < len(values) {
+                expanded += values[argNum]
+            }
+        case EXPRESSION:
+            num, err := ctx.EvalExpressionWith(token.val.(string), lookup)
+            if err != nil {
+                return "", fmt.Errorf("Macro %s: %s", macroName, err.Error())
+            }
+            expanded += strconv.Itoa(num)
+        case ASSIGNMENT:
+            assignment := token.val.(*macroAssignment)
+            num, err := ctx.EvalExpressionWith(assignment.expr, lookup)
+            if err != nil {
+                return "", fmt.Errorf("Macro %s: %s", macroName, err.Error())
+            }
+            vars[assignment.name] = strconv.Itoa(num)
+        }
+    }
+    return expanded, nil
 }
@@ -1,12 +1,24 @@
 package compiler
 
-import "../utils"
+import (
+    "../channel"
+    "../utils"
+)
 
 type MmlPattern struct {
     Name string
     Cmds []int
+    CmdSources []*utils.SourceLocation
+    AddrOperands []int          // Where the stream addresses of the pattern's loops are in Cmds
     HasAnyNote bool
     NumTicks int
+    PlayFrames float64
+    Depth int                   // The number of pattern calls that are nested when the pattern is called
+    source string               // The MML code of the pattern's body
+    fileName string             // Where the pattern was defined
+    line, column int
+    startState channel.Channel  // The state of the pattern channel when the definition began
+    startTick int               // The tick that a copy of the pattern was compiled for (see tempoVariant)
 }
 
 type MmlPatternMap struct {
@@ -18,6 +30,20 @@ func (m *MmlPattern) GetCommands() []int {
     return m.Cmds
 }
 
+/* Returns true if both patterns compiled to the same commands.
+ */
+func (m *MmlPattern) SameCommands(other *MmlPattern) bool {
+    if len(m.Cmds) != len(other.Cmds) {
+        return false
+    }
+    for i, cmd := range m.Cmds {
+        if cmd != other.Cmds[i] {
+            return false
+        }
+    }
+    return true
+}
+
 func (m *MmlPatternMap) FindKey(key string) int {
     return utils.PositionOfString(m.keys, key)
 }
@@ -27,6 +53,13 @@ func (m *MmlPatternMap) Append(key string, pat *MmlPattern) {
     m.data = append(m.data, pat)
 }
 
+/* Removes the most recently added pattern.
+ */
+func (m *MmlPatternMap) RemoveLast() {
+    m.keys = m.keys[:len(m.keys) - 1]
+    m.data = m.data[:len(m.data) - 1]
+}
+
 func (m *MmlPatternMap) GetNumTicks(key string) int {
     pos := m.FindKey(key)
     if pos >= 0 {
@@ -35,6 +68,22 @@ func (m *MmlPatternMap) GetNumTicks(key string) int {
     return 0
 }
 
+func (m *MmlPatternMap) GetPlayFrames(key string) float64 {
+    pos := m.FindKey(key)
+    if pos >= 0 {
+        return m.data[pos].PlayFrames
+    }
+    return 0
+}
+
+func (m *MmlPatternMap) GetDepth(key string) int {
+    pos := m.FindKey(key)
+    if pos >= 0 {
+        return m.data[pos].Depth
+    }
+    return 0
+}
+
 func (m *MmlPatternMap) HasAnyNote(key string) bool {
     pos := m.FindKey(key)
     if pos >= 0 {
@@ -0,0 +1,310 @@
+/*
+ * Package compiler
+ *
+ * Part of XPMC.
+ * Contains functions for handling the compile-time repeat blocks
+ * (#REPEAT and #FOR), which are unrolled by the compiler instead of
+ * being turned into runtime loops. [] loops that span a tempo change are
+ * unrolled the same way.
+ */
+
+package compiler
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "../channel"
+    "../utils"
+)
+
+/* Reads the lines following a #REPEAT, #FOR or #SECTION up to the matching #END.
+ * Returns the lines and the position of the first one.
+ */
+func (comp *Compiler) readRepeatBody(cmd string) (string, utils.SourcePos) {
+    // Skip the rest of the line containing the #REPEAT / #FOR
+    for c := comp.ctx.Parser.Getch(); c != '\n'; c = comp.ctx.Parser.Getch() {
+        if c == -1 {
+            comp.ctx.ERRORC(utils.DIAG_BLOCK, "Missing #END for #%s", cmd)
+        }
+    }
+    comp.ctx.Parser.AdvanceLine()
+    pos, _ := comp.ctx.Parser.Position()
+
+    body := ""
+    line := ""
+    depth := 1
+    for {
+        c := comp.ctx.Parser.Getch()
+        if c == '\n' || c == -1 {
+            fields := strings.Fields(line)
+            if len(fields) > 0 && (fields[0] == "#REPEAT" || fields[0] == "#FOR" || fields[0] == "#SECTION") {
+                depth++
+            } else if len(fields) > 0 && fields[0] == "#END" {
+                depth--
+                if depth == 0 {
+                    // Leave the newline for the caller, so that the line count stays correct
+                    comp.ctx.Parser.Ungetch()
+                    break
+                }
+            }
+            if c == -1 {
+                comp.ctx.ERRORC(utils.DIAG_BLOCK, "Missing #END for #%s", cmd)
+            }
+            comp.ctx.Parser.AdvanceLine()
+            body += line + "\n"
+            line = ""
+        } else {
+            line += string(byte(c))
+        }
+    }
+    return body, pos
+}
+
+
+/* Replaces every {expression} in body that uses one of the #FOR variables
+ * with the value of the expression. Only symbols that are currently
+ * defined may be used, so that other {} (e.g. tuplets) are left as they are.
+ */
+func (comp *Compiler) substituteRepeatExpressions(body string) string {
+    result := ""
+    for {
+        start := strings.IndexByte(body, '{')
+        if start < 0 {
+            break
+        }
+        end := strings.IndexAny(body[start+1:], "{}\n")
+        if end < 0 || body[start+1+end] != '}' {
+            result += body[:start+1]
+            body = body[start+1:]
+            continue
+        }
+        end += start + 1
+        expr := body[start+1:end]
+        usesVar, allDefined := false, true
+        names, err := utils.ExpressionNames(expr)
+        for _, name := range names {
+            if utils.PositionOfString(comp.forVars, name) >= 0 {
+                usesVar = true
+            }
+            allDefined = allDefined && comp.ctx.IsDefined(name) != 0
+        }
+        if val, evalErr := comp.ctx.EvalExpression(expr); err == nil && usesVar && allDefined && evalErr == nil {
+            result += body[:start] + strconv.Itoa(val)
+        } else {
+            result += body[:end+1]
+        }
+        body = body[end+1:]
+    }
+    return result + body
+}
+
+
+/* Compiles the lines of a block (e.g. one iteration of a repeat block)
+ * starting at pos. frameKind and name tell where the lines came from in
+ * source locations. A block that starts in the middle of a line (pos.Column
+ * > 0) is compiled on the channels that are active on that line.
+ */
+func (comp *Compiler) compileBlock(body string, frameKind, name string, pos utils.SourcePos) {
+    savedLocation := comp.ctx.CommandLocation
+    savedParser := comp.ctx.Parser
+    defer func() {
+        comp.ctx.CommandLocation = savedLocation
+        if comp.ctx.Parser != savedParser {
+            comp.ctx.Parser = comp.ctx.OldParsers.PopParserState()
+        }
+    }()
+
+    parser := utils.NewParserStateFromData(pos.File, []byte(body), comp.ctx)
+    parser.LineNum = pos.Line
+    parser.Column = pos.Column
+    parser.FrameKind, parser.FrameName = frameKind, name
+    prevLine := parser.LineNum - 1
+    if pos.Column > 0 {
+        prevLine = parser.LineNum
+    }
+    comp.ctx.OldParsers.Push(comp.ctx.Parser)
+    comp.ctx.Parser = parser
+    for !comp.compileCommands(&prevLine) {
+        comp.resync()
+    }
+    comp.writeAllPendingNotes(true)
+    comp.ctx.Parser = comp.ctx.OldParsers.PopParserState()
+}
+
+
+/* Handles #REPEAT <count>, whose body is compiled count times.
+ */
+func (comp *Compiler) handleRepeat() {
+    s := comp.ctx.Parser.GetRestOfLine()
+    count, err := comp.ctx.EvalExpression(s)
+    if err != nil {
+        comp.ctx.ERRORC(utils.DIAG_BLOCK, "REPEAT: %s", err.Error())
+    } else if count < 0 {
+        comp.ctx.ERRORC(utils.DIAG_BLOCK, "REPEAT: Bad count: %d", count)
+    }
+    body, pos := comp.readRepeatBody("REPEAT")
+    for i := 0; i < count; i++ {
+        comp.compileBlock(body, utils.FRAME_REPEAT, "REPEAT " + s, pos)
+    }
+}
+
+
+/* Handles #FOR <var> = <from> TO <to> [STEP <step>]. The body is compiled
+ * once for each value of the variable, which is defined as a symbol while
+ * the body is compiled. {expressions} in the body that use the variable are
+ * replaced by their values, e.g. v{i*2}.
+ */
+func (comp *Compiler) handleFor() {
+    s := comp.ctx.Parser.GetRestOfLine()
+    eq, to := strings.Index(s, "="), strings.Index(s, " TO ")
+    if eq < 0 || to < eq {
+        comp.ctx.ERRORC(utils.DIAG_BLOCK, "FOR: Expected <var> = <from> TO <to>: %s", s)
+    }
+    name := strings.TrimSpace(s[:eq])
+    if !utils.IsIdentifier(name) {
+        comp.ctx.ERRORC(utils.DIAG_BLOCK, "FOR: Bad variable name: %s", name)
+    }
+    fromExpr, toExpr, stepExpr := s[eq+1:to], s[to+4:], "1"
+    if step := strings.Index(toExpr, " STEP "); step >= 0 {
+        toExpr, stepExpr = toExpr[:step], toExpr[step+6:]
+    }
+    from, err := comp.ctx.EvalExpression(fromExpr)
+    last, err2 := comp.ctx.EvalExpression(toExpr)
+    step, err3 := comp.ctx.EvalExpression(stepExpr)
+    if err != nil || err2 != nil || err3 != nil {
+        comp.ctx.ERRORC(utils.DIAG_BLOCK, "FOR: Bad expression: %s", s)
+    } else if step == 0 {
+        comp.ctx.ERRORC(utils.DIAG_BLOCK, "FOR: STEP can not be 0")
+    }
+    body, pos := comp.readRepeatBody("FOR")
+
+    // Restore the symbol if it was defined before the loop
+    oldVal, wasDefined := comp.ctx.SymbolValue(name)
+    comp.forVars = append(comp.forVars, name)
+    defer func() {
+        comp.forVars = comp.forVars[:len(comp.forVars)-1]
+        if wasDefined {
+            comp.ctx.DefineSymbol(name, oldVal)
+        } else {
+            comp.ctx.UndefineSymbol(name)
+        }
+    }()
+    for i := from; (step > 0 && i <= last) || (step < 0 && i >= last); i += step {
+        comp.ctx.DefineSymbol(name, i)
+        comp.compileBlock(comp.substituteRepeatExpressions(body), utils.FRAME_REPEAT, "FOR " + name + "=" + strconv.Itoa(i), pos)
+    }
+}
+
+
+/* A [] loop being compiled. The notes in a loop have fixed lengths, so on
+ * a song with a tempo map, a loop that spans a tempo change is compiled
+ * once per iteration instead (see endTempoLoop).
+ */
+type tempoLoop struct {
+    states []channel.Channel    // The channels of the song at the '[' (nil if there's no tempo map)
+    parser *utils.ParserState   // The parser that the loop began in
+    start int                   // Where the body of the loop starts in the parser's data
+    skip int                    // Where the '|' is in the parser's data, or -1
+    pos utils.SourcePos         // The position of the '['
+}
+
+
+/* Called at the '[' of a loop. Remembers the state of the channels if the
+ * song has a tempo map, so that the loop can be unrolled when it ends.
+ */
+func (comp *Compiler) beginTempoLoop() {
+    loop := tempoLoop{parser: comp.ctx.Parser, start: comp.ctx.Parser.Offset(), skip: -1}
+    loop.pos, _ = comp.ctx.Parser.Position()
+    for _, chn := range comp.CurrSong.Channels {
+        if chn.Active && chn.UsesTempoMap() && !chn.Tuple.Active {
+            loop.states = make([]channel.Channel, len(comp.CurrSong.Channels))
+            for i, c := range comp.CurrSong.Channels {
+                loop.states[i] = *c
+            }
+            break
+        }
+    }
+    comp.tempoLoops = append(comp.tempoLoops, loop)
+}
+
+
+/* Called at the '|' of a loop.
+ */
+func (comp *Compiler) skipTempoLoop() {
+    if n := len(comp.tempoLoops); n > 0 {
+        comp.tempoLoops[n-1].skip = comp.ctx.Parser.Offset() - 1
+    }
+}
+
+
+/* Called at the ']' of a loop with the given count, after the count has
+ * been read. end is where the ']' is in the parser's data. If the loop
+ * spans a tempo change on any of its channels, the channels are reset to
+ * their state at the '[' and the body is compiled count times, and true is
+ * returned. Otherwise the loop is left to the caller.
+ */
+func (comp *Compiler) endTempoLoop(count int, end int) bool {
+    n := len(comp.tempoLoops)
+    if n == 0 {
+        return false
+    }
+    loop := comp.tempoLoops[n-1]
+    comp.tempoLoops = comp.tempoLoops[:n-1]
+    if loop.states == nil || loop.parser != comp.ctx.Parser || count < 1 || (loop.skip >= 0 && count < 2) {
+        return false
+    }
+
+    spansTempoChange := false
+    for i, chn := range comp.CurrSong.Channels {
+        state := &loop.states[i]
+        if !chn.Active {
+            if chn.Ticks != state.Ticks || len(chn.Cmds) != len(state.Cmds) {
+                // The loop contains lines for other channels, which would be compiled again
+                return false
+            }
+            continue
+        }
+        if chn.Loops.Len() == 0 || chn.TupleDepth() > 0 {
+            return false
+        }
+        elem := chn.Loops.PeekLoop()
+        if elem.TupleDepth > 0 || elem.StartTicks != state.Ticks || elem.StartPlayFrames != state.PlayFrames {
+            return false
+        }
+        ticks := (chn.Ticks - elem.StartTicks) * count
+        if elem.Skip1Ticks != -1 {
+            ticks = (chn.Ticks - elem.StartTicks) * (count - 1) + (elem.Skip1Ticks - elem.StartTicks)
+        }
+        if chn.UsesTempoMap() && chn.TempoChangesWithin(elem.StartTicks + 1, elem.StartTicks + ticks) {
+            spansTempoChange = true
+        }
+    }
+    if !spansTempoChange {
+        return false
+    }
+
+    for i, chn := range comp.CurrSong.Channels {
+        if chn.Active {
+            chn.Loops.PopLoop()
+            *chn = loop.states[i]
+        }
+    }
+    // Each iteration ends with a space in place of the ']', which also ends the last note
+    body := loop.parser.GetSource(loop.start, end) + " "
+    last := body
+    if loop.skip >= 0 {
+        // The last iteration ends at the '|'
+        skip := loop.skip - loop.start
+        last = body[:skip] + " "
+        body = body[:skip] + " " + body[skip+1:]
+    }
+    for i := 0; i < count; i++ {
+        if i < count-1 {
+            comp.compileBlock(body, utils.FRAME_LOOP, fmt.Sprintf("iteration %d", i+1), loop.pos)
+        } else {
+            comp.compileBlock(last, utils.FRAME_LOOP, fmt.Sprintf("iteration %d", i+1), loop.pos)
+        }
+    }
+    return true
+}
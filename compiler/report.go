@@ -0,0 +1,110 @@
+/*
+ * Package compiler
+ *
+ * Part of XPMC.
+ * Contains functions for writing a compile report, which lists the
+ * sizes of the songs, channels and tables in machine-readable form.
+ */
+
+package compiler
+
+import (
+    "encoding/json"
+    "io"
+    "sort"
+    "../defs"
+    "../targets"
+)
+
+type reportChannel struct {
+    Name string         `json:"name"`
+    Size int            `json:"size"`        // In bytes
+    Ticks int           `json:"ticks"`
+    LoopTicks int       `json:"loopTicks"`
+    Frames float64      `json:"frames"`
+    LoopFrames float64  `json:"loopFrames"`
+    Used bool           `json:"used"`
+    Effects []string    `json:"effects"`
+}
+
+type reportSong struct {
+    Num int                     `json:"song"`
+    Title string                `json:"title"`
+    Size int                    `json:"size"`
+    Channels []reportChannel    `json:"channels"`
+}
+
+type reportPattern struct {
+    Name string     `json:"name"`
+    Size int        `json:"size"`
+    Ticks int       `json:"ticks"`
+}
+
+type report struct {
+    Target string                `json:"target"`
+    UpdateFreq float64           `json:"updateFreq"`
+    Songs []reportSong           `json:"songs"`
+    Patterns []reportPattern     `json:"patterns"`
+    Tables defs.TableSizes       `json:"tables"`
+}
+
+
+/* Writes a JSON report of the size of each song, channel, pattern and
+ * table. The table sizes are those of the last call to Output.
+ */
+func (comp *Compiler) WriteReport(w io.Writer) error {
+    rep := report{Songs: []reportSong{}, Patterns: []reportPattern{}}
+    if comp.CurrSong != nil {
+        rep.Target = targets.IDToName(comp.CurrSong.Target.GetID())
+        rep.Tables = comp.CurrSong.Target.GetTableSizes()
+    }
+    rep.UpdateFreq = comp.GetTiming().UpdateFreq
+
+    nums := []int{}
+    for num := range comp.Songs {
+        nums = append(nums, num)
+    }
+    sort.Ints(nums)
+    for _, num := range nums {
+        sng := comp.Songs[num]
+        rs := reportSong{Num: num, Title: sng.GetTitle(), Channels: []reportChannel{}}
+        for _, chn := range sng.Channels {
+            if chn.IsVirtual() {
+                continue
+            }
+            effects := []string{}
+            for eff, used := range chn.UsesEffect {
+                if used {
+                    effects = append(effects, eff)
+                }
+            }
+            sort.Strings(effects)
+            // Channels without a loop have no looping part
+            loopTicks, loopFrames := 0, 0.0
+            if chn.LoopPoint != -1 {
+                loopTicks = chn.LoopTicks
+                loopFrames = chn.PlayFrames - chn.LoopPlayFrames
+            }
+            rs.Channels = append(rs.Channels, reportChannel{Name: chn.Name,
+                                                            Size: len(chn.Cmds),
+                                                            Ticks: chn.Ticks,
+                                                            LoopTicks: loopTicks,
+                                                            Frames: chn.PlayFrames,
+                                                            LoopFrames: loopFrames,
+                                                            Used: chn.IsUsed(),
+                                                            Effects: effects})
+            rs.Size += len(chn.Cmds)
+        }
+        rep.Songs = append(rep.Songs, rs)
+    }
+
+    for i, pat := range comp.patterns.data {
+        rep.Patterns = append(rep.Patterns, reportPattern{Name: comp.patterns.keys[i],
+                                                          Size: len(pat.Cmds),
+                                                          Ticks: pat.NumTicks})
+    }
+
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    return enc.Encode(rep)
+}
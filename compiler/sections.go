@@ -0,0 +1,199 @@
+/*
+ * Package compiler
+ *
+ * Part of XPMC.
+ * Contains functions for handling song sections (#SECTION) and the order
+ * list (#ORDER) that arranges them into a song.
+ */
+
+package compiler
+
+import (
+    "strconv"
+    "strings"
+    "../channel"
+    "../defs"
+    "../utils"
+)
+
+/* A section of a song, e.g. a verse or a chorus. The music of each channel
+ * in the section is stored as a pattern named <section>:<channel>.
+ */
+type mmlSection struct {
+    name string
+    channels string     // The names of the channels that the section has music for
+    ticks int           // The length of the section
+    depth int           // The number of pattern calls that are nested when the section is played
+    endStates map[string]channel.Channel    // The state that the section leaves each of its channels in
+}
+
+
+/* Handles #SECTION <name>. The lines up to the matching #END are compiled
+ * like the rest of the song, but what they add to each channel is turned
+ * into a pattern, and the channels are then restored to the state they
+ * had before the section. Sections can't be used together with #TEMPO-AT,
+ * since the tempo map would have to be applied where the section is played.
+ */
+func (comp *Compiler) handleSection() {
+    name := comp.ctx.Parser.GetString()
+    // Read the body first, so that it's skipped even if the section is rejected
+    body, pos := comp.readRepeatBody("SECTION")
+    if len(name) == 0 || strings.ContainsAny(name, ":@") {
+        comp.ctx.ERRORC(utils.DIAG_BLOCK, "SECTION: Bad section name: %s", name)
+    } else if _, defined := comp.sections[name]; defined {
+        comp.ctx.ERRORC(utils.DIAG_BLOCK, "SECTION: Section already defined: %s", name)
+    } else if len(comp.patName) > 0 || comp.section != nil {
+        comp.ctx.ERRORC(utils.DIAG_BLOCK, "SECTION: Sections can not be defined inside patterns or other sections")
+    } else if len(comp.CurrSong.Tempos.Changes) > 0 {
+        comp.ctx.ERRORC(utils.DIAG_TEMPO, "SECTION: Sections can not be used in songs with #TEMPO-AT")
+    }
+
+    channels := comp.CurrSong.Channels[:len(comp.CurrSong.Channels) - 1]
+    savedChannels := make([]channel.Channel, len(channels))
+    for i, chn := range channels {
+        savedChannels[i] = *chn
+        // Like a pattern, each part of the section starts out empty
+        chn.ClearCmds()
+        chn.Ticks = 0
+        chn.PlayFrames = 0
+        chn.HasAnyNote = false
+        chn.LoopPoint = -1
+        chn.Loops = channel.NewLoopStack()
+        chn.Tempos = channel.TempoMap{}
+        chn.Tempos.Add(channel.TempoChange{Tempo: chn.CurrentTempo, EndTempo: chn.CurrentTempo})
+        chn.Groove = nil
+    }
+    section := &mmlSection{name: name, depth: 1, endStates: map[string]channel.Channel{}}
+    comp.section = section
+    defer func() {
+        for i, chn := range channels {
+            *chn = savedChannels[i]
+        }
+        comp.section = nil
+    }()
+
+    comp.compileBlock(body, utils.FRAME_SECTION, name, pos)
+
+    for _, chn := range channels {
+        if len(chn.Cmds) == 0 {
+            continue
+        }
+        if chn.Loops.Len() > 0 || chn.Tuple.Active {
+            comp.ctx.ERRORC(utils.DIAG_BLOCK, "SECTION: Unterminated [] loop or {} on channel %s in section %s", chn.GetName(), name)
+        } else if chn.LoopPoint != -1 {
+            comp.ctx.ERRORC(utils.DIAG_BLOCK, "SECTION: Loop points can not be set inside sections; use @loop in #ORDER")
+        }
+        if len(section.channels) == 0 {
+            section.ticks = chn.Ticks
+        } else if chn.Ticks != section.ticks {
+            comp.ctx.ERRORC(utils.DIAG_BLOCK, "SECTION: Channel %s is %d ticks long in section %s, but channel %c is %d ticks long", chn.GetName(), chn.Ticks, name, section.channels[0], section.ticks)
+        }
+        section.channels += chn.GetName()
+        section.endStates[chn.GetName()] = *chn
+
+        chn.AddCmd([]int{defs.CMD_RTS})
+        pattern := &MmlPattern{Depth: section.depth}
+        pattern.Cmds = append([]int{}, chn.Cmds...)
+        pattern.CmdSources = append([]*utils.SourceLocation{}, chn.CmdSources...)
+        pattern.AddrOperands = append([]int{}, chn.AddrOperands...)
+        pattern.HasAnyNote = chn.HasAnyNote
+        pattern.NumTicks = chn.Ticks
+        pattern.PlayFrames = chn.PlayFrames
+        comp.patterns.Append(name + ":" + chn.GetName(), pattern)
+    }
+    comp.sections[name] = section
+}
+
+
+/* Carries the state that a section left a channel in over to the channel
+ * that the section is played on, so that what follows is compiled from the
+ * octave, volume, etc. that the channel will actually be at.
+ */
+func mergeSectionState(chn *channel.Channel, end *channel.Channel) {
+    chn.CurrentOctave = end.CurrentOctave
+    chn.CurrentVolume = end.CurrentVolume
+    chn.CurrentTranspose = end.CurrentTranspose
+    chn.CurrentArpeggio = end.CurrentArpeggio
+    chn.CurrentLength = end.CurrentLength
+    chn.CurrentCutoff = end.CurrentCutoff
+    if end.CurrentTempo != chn.CurrentTempo {
+        chn.CurrentTempo = end.CurrentTempo
+        chn.Tempos.Add(channel.TempoChange{Tick: chn.Ticks, Tempo: chn.CurrentTempo, EndTempo: chn.CurrentTempo})
+    }
+}
+
+
+/* Returns MML for a rest that is the given number of ticks long,
+ * e.g. r1^4 for 40 ticks.
+ */
+func restMML(ticks int) string {
+    s := ""
+    for ; ticks >= 32; ticks -= 32 {
+        s += "^1"
+    }
+    for length := 2; ticks > 0; length *= 2 {
+        if ticks >= 32 / length {
+            s += "^" + strconv.Itoa(length)
+            ticks -= 32 / length
+        }
+    }
+    return "r" + s[1:]
+}
+
+
+/* Handles #ORDER <section> <section> ... which plays the sections in the
+ * given order on the channels that are used by any of them. @loop before a
+ * section sets the loop point of the channels there. Channels that a section
+ * doesn't use are silent during that section. After each section, the channels
+ * it was played on are left in the state that the section ended in.
+ */
+func (comp *Compiler) handleOrder() {
+    entries := strings.Fields(comp.ctx.Parser.GetRestOfLine())
+    if len(entries) == 0 {
+        comp.ctx.ERRORC(utils.DIAG_BLOCK, "ORDER: Expected a list of sections")
+    }
+    pos, _ := comp.ctx.Parser.Position()
+
+    channelNames := ""
+    for _, entry := range entries {
+        if entry == "@loop" {
+            continue
+        }
+        section, defined := comp.sections[entry]
+        if !defined {
+            comp.ctx.ERRORC(utils.DIAG_BLOCK, "ORDER: Undefined section: %s", entry)
+        }
+        if section.depth > comp.CurrSong.Target.GetMaxPatternDepth() {
+            comp.ctx.ERRORC(utils.DIAG_PATTERN, "Patterns nested too deeply: %d levels (max %d for this target)", section.depth, comp.CurrSong.Target.GetMaxPatternDepth())
+        }
+        for _, c := range section.channels {
+            if !strings.ContainsRune(channelNames, c) {
+                channelNames += string(c)
+            }
+        }
+    }
+
+    comp.writeAllPendingNotes(true)
+    for _, chn := range comp.CurrSong.Channels[:len(comp.CurrSong.Channels) - 1] {
+        if !strings.Contains(channelNames, chn.GetName()) {
+            continue
+        }
+        for _, entry := range entries {
+            if entry == "@loop" {
+                if chn.LoopPoint != -1 {
+                    comp.ctx.ERRORC(utils.DIAG_REDEFINITION, "Loop point already defined for channel %s", chn.GetName())
+                }
+                chn.LoopPoint = len(chn.Cmds)
+                chn.LoopFrames = chn.Frames
+                chn.LoopPlayFrames = chn.PlayFrames
+                chn.LoopTicks = chn.Ticks
+            } else if section := comp.sections[entry]; strings.Contains(section.channels, chn.GetName()) {
+                comp.addPatternCall(chn, entry + ":" + chn.GetName())
+                end := section.endStates[chn.GetName()]
+                mergeSectionState(chn, &end)
+            } else if section.ticks > 0 {
+                comp.compileBlock(chn.GetName() + " " + restMML(section.ticks), utils.FRAME_SECTION, entry, pos)
+            }
+        }
+    }
+}
@@ -9,6 +9,14 @@
  
 package defs
 
+import (
+    "flag"
+    "io"
+    "../effects"
+    "../timing"
+    "../utils"
+)
+
 const (
     CMD_NOTE   = 0x00   // cc+dd+eff+gg+aa+b
     CMD_REST   = 0x0C   // r    
@@ -125,8 +133,7 @@ func EXTENDED_LENGTHS() []int {
 var EFFECT_STRINGS [6]string = [6]string{"EN", "EN2", "EP", "MP", "DM", "PM"}
 
 const NON_NOTE_TUPLE_CMD = 0xFFFF
-
-var Rest, Rest2 int
+const TUPLE_GROUP = 0xFFFE        // A tuple nested inside another tuple
 
 /////////////
 
@@ -150,6 +157,18 @@ type ISpecs interface {
     GetIDs() []int           
 }
 
+/* The sizes in bytes of the different parts of a target's output.
+ */
+type TableSizes struct {
+    Effects int     `json:"effects"`
+    Waveforms int   `json:"waveforms"`
+    Samples int     `json:"samples"`       // One-shot PCM samples (XPCM)
+    Callbacks int   `json:"callbacks"`
+    Patterns int    `json:"patterns"`
+    Songs int       `json:"songs"`         // The channel data of all songs
+    Total int       `json:"total"`
+}
+
 type ITarget interface {
     GetAdsrLen() int        // Number of parameters used for ADSR envelopes on this target
     GetAdsrMax() int        // Max value for ADSR parameters on this target
@@ -159,6 +178,7 @@ type ITarget interface {
     GetExtraInt(name string, defaultVal int) int
     GetID() int             // The ID of this target (one of the TARGET_* constants)
     GetMaxLoopDepth() int   // Max nesting of [] loops on this target
+    GetMaxPatternDepth() int    // Max nesting of pattern calls on this target
     GetMaxTempo() int
     GetMinOctave() int
     GetMaxOctave() int
@@ -168,6 +188,7 @@ type ITarget interface {
     GetMinVolume() int
     GetMinWavLength() int
     GetMinWavSample() int
+    GetTableSizes() TableSizes  // The sizes of the tables written by the last call to Output
     Init()
     Output(outputFormat int)
     SupportsPAL() bool
@@ -175,7 +196,10 @@ type ITarget interface {
     SupportsPCM() bool      // Whether this target supports one-shot PCM samples (XPCM)
     SupportsWaveTable() bool
     SetCompilerItf(icomp ICompiler)
+    SetOutputOpener(opener func(fileName string) (io.Writer, error))  // Overrides how the output files are created (by default they're written to disk)
+    SetOutputSyntax(outputSyntax int) error  // Overrides the target's default assembler syntax (one of the SYNTAX_* constants)
     PutExtraInt(name string, val int)
+    RegisterOptions(flags *flag.FlagSet)  // Adds the target-specific command-line options to flags
 }
 
 type ISong interface {
@@ -207,12 +231,15 @@ type IMmlPattern interface {
 
 type ICompiler interface {
     GetCallbacks() []string
+    GetContext() *utils.Context
     GetCurrentSong() ISong
+    GetEffects() *effects.Effects
     GetNumSongs() int
     GetPatterns() []IMmlPattern
     GetShortFileName() string
     GetSong(num int) ISong
     GetSongs() []ISong
+    GetTiming() *timing.Timing
     SetCommandHandler(cmd string, handler func(string, ITarget))
     SetMetaCommandHandler(cmd string, handler func(string, ITarget))
 }
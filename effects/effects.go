@@ -146,37 +146,43 @@ func NewEffectMap(inlineIdBase int) *EffectMap {
     return e
 }
 
-var Arpeggios *EffectMap
-var Vibratos *EffectMap
-var VolumeMacros *EffectMap
-var DutyMacros *EffectMap
-var PanMacros *EffectMap
-var PitchMacros *EffectMap
-var PulseMacros *EffectMap
-var FeedbackMacros *EffectMap
-var MODs *EffectMap
-var ADSRs *EffectMap
-var Filters *EffectMap
-var Portamentos *EffectMap
-var Waveforms *EffectMap
-var WaveformMacros *EffectMap
-var PCMs *EffectMap
-
-
-func Init() {
-    Arpeggios    = NewEffectMap(INLINED_EFFECT_BASE_ID)
-    Vibratos     = NewEffectMap(INLINED_EFFECT_BASE_ID + 1000)
-    VolumeMacros = NewEffectMap(INLINED_EFFECT_BASE_ID + 2000)
-    DutyMacros   = NewEffectMap(INLINED_EFFECT_BASE_ID + 3000)
-    PanMacros    = NewEffectMap(INLINED_EFFECT_BASE_ID + 4000)
-    PitchMacros  = NewEffectMap(INLINED_EFFECT_BASE_ID + 5000)
-    PulseMacros  = NewEffectMap(INLINED_EFFECT_BASE_ID + 6000)
-    FeedbackMacros = NewEffectMap(INLINED_EFFECT_BASE_ID + 7000)
-    MODs         = NewEffectMap(INLINED_EFFECT_BASE_ID + 8000)
-    ADSRs        = NewEffectMap(INLINED_EFFECT_BASE_ID + 9000)
-    Filters      = NewEffectMap(INLINED_EFFECT_BASE_ID + 10000)
-    Portamentos  = NewEffectMap(INLINED_EFFECT_BASE_ID + 11000)
-    Waveforms    = NewEffectMap(INLINED_EFFECT_BASE_ID + 12000)
-    WaveformMacros = NewEffectMap(INLINED_EFFECT_BASE_ID+13000)
-    PCMs         = NewEffectMap(INLINED_EFFECT_BASE_ID + 14000)
+/* All the effect definitions made during one compilation.
+ */
+type Effects struct {
+    Arpeggios *EffectMap
+    Vibratos *EffectMap
+    VolumeMacros *EffectMap
+    DutyMacros *EffectMap
+    PanMacros *EffectMap
+    PitchMacros *EffectMap
+    PulseMacros *EffectMap
+    FeedbackMacros *EffectMap
+    MODs *EffectMap
+    ADSRs *EffectMap
+    Filters *EffectMap
+    Portamentos *EffectMap
+    Waveforms *EffectMap
+    WaveformMacros *EffectMap
+    PCMs *EffectMap
+}
+
+
+func NewEffects() *Effects {
+    e := &Effects{}
+    e.Arpeggios    = NewEffectMap(INLINED_EFFECT_BASE_ID)
+    e.Vibratos     = NewEffectMap(INLINED_EFFECT_BASE_ID + 1000)
+    e.VolumeMacros = NewEffectMap(INLINED_EFFECT_BASE_ID + 2000)
+    e.DutyMacros   = NewEffectMap(INLINED_EFFECT_BASE_ID + 3000)
+    e.PanMacros    = NewEffectMap(INLINED_EFFECT_BASE_ID + 4000)
+    e.PitchMacros  = NewEffectMap(INLINED_EFFECT_BASE_ID + 5000)
+    e.PulseMacros  = NewEffectMap(INLINED_EFFECT_BASE_ID + 6000)
+    e.FeedbackMacros = NewEffectMap(INLINED_EFFECT_BASE_ID + 7000)
+    e.MODs         = NewEffectMap(INLINED_EFFECT_BASE_ID + 8000)
+    e.ADSRs        = NewEffectMap(INLINED_EFFECT_BASE_ID + 9000)
+    e.Filters      = NewEffectMap(INLINED_EFFECT_BASE_ID + 10000)
+    e.Portamentos  = NewEffectMap(INLINED_EFFECT_BASE_ID + 11000)
+    e.Waveforms    = NewEffectMap(INLINED_EFFECT_BASE_ID + 12000)
+    e.WaveformMacros = NewEffectMap(INLINED_EFFECT_BASE_ID+13000)
+    e.PCMs         = NewEffectMap(INLINED_EFFECT_BASE_ID + 14000)
+    return e
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"./targets"
+)
+
+/* Creates a temporary directory containing the given files and makes it
+ * the working directory. Returns a function that undoes this.
+ */
+func inTempDir(files map[string]string) func() {
+	dir, _ := ioutil.TempDir("", "xpmc")
+	wd, _ := os.Getwd()
+	for name, content := range files {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	os.Chdir(dir)
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+/* Prints the names of the files in the working directory and below.
+ */
+func printFiles() {
+	filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			fmt.Println(filepath.ToSlash(path))
+		}
+		return nil
+	})
+}
+
+func Example_compileBatch() {
+	defer inTempDir(map[string]string{
+		"music/title.mml": "A l4 c d e f\n",
+		"music/bad.mml":   "A o9 c\n",
+		"sfx/jump.mml":    "A l16 c e g\n",
+		"sfx/title.mml":   "A c\n",
+	})()
+	target = targets.TARGET_GBC
+
+	// The results are printed in the order that the files were given in
+	fmt.Println(compileBatch([]string{"music/title.mml", "music/bad.mml", "sfx/jump.mml"}, "build", 2))
+	printFiles()
+
+	// Without -outdir the output files are written next to the input files
+	fmt.Println(compileBatch([]string{"sfx/jump.mml"}, "", 1))
+	printFiles()
+
+	// Files whose output files would have the same names aren't compiled
+	fmt.Println(compileBatch([]string{"music/title.mml", "sfx/title.mml"}, "build", 2))
+	// Output:
+	// music/title.mml:
+	// Song 1, Channel A: 8 bytes, 32 / 32 ticks
+	// Song 1, Channel B: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel C: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel D: 1 bytes, 0 / 0 ticks
+	// music/bad.mml:
+	// [bad.mml:1,4] Error: Octave out of range: 9 (vs [2,7])
+	// sfx/jump.mml:
+	// Song 1, Channel A: 7 bytes, 6 / 6 ticks
+	// Song 1, Channel B: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel C: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel D: 1 bytes, 0 / 0 ticks
+	//
+	// 3 file(s) compiled, 1 failed, 1 error(s), 0 warning(s)
+	// 1
+	// build/jump.asm
+	// build/title.asm
+	// music/bad.mml
+	// music/title.mml
+	// sfx/jump.mml
+	// sfx/title.mml
+	// sfx/jump.mml:
+	// Song 1, Channel A: 7 bytes, 6 / 6 ticks
+	// Song 1, Channel B: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel C: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel D: 1 bytes, 0 / 0 ticks
+	//
+	// 1 file(s) compiled, 0 failed, 0 error(s), 0 warning(s)
+	// 0
+	// build/jump.asm
+	// build/title.asm
+	// music/bad.mml
+	// music/title.mml
+	// sfx/jump.asm
+	// sfx/jump.mml
+	// sfx/title.mml
+	// Error: music/title.mml and sfx/title.mml would both be written to build/title.*
+	// 1
+}
+
+func Example_printTargets() {
+	printTargets(os.Stdout)
+
+	// Targets that can't write any output yet aren't listed, and can't be used
+	for _, name := range []string{"sms", "c64", "nes", "nope"} {
+		*targetName = name
+		fmt.Println(name, checkOptions())
+	}
+	*targetName = ""
+
+	// The target can be given as an option of its own anywhere on the command line
+	fmt.Println(findTargetName([]string{"-o", "out", "song.mml", "--gen"}))
+	// Output:
+	//   ast	Atari ST
+	//   at8	Atari 8-bit
+	//   gbc	Gameboy / Gameboy Color
+	//   gen, smd	SEGA Genesis / Megadrive
+	//   kss	KSS
+	//   pce	PC-Engine
+	//   sgg	SEGA Game Gear
+	//   sms	SEGA Master System
+	// sms true
+	// Error: The c64 target is not implemented
+	// c64 false
+	// Error: The nes target is not implemented
+	// nes false
+	// Error: Unknown target: nope
+	// nope false
+	// gen
+}
@@ -29,6 +29,7 @@ type Song struct {
     Programmer string
     Game string
     Album string
+    Tempos channel.TempoMap     // Tempo changes that apply to all channels (#TEMPO-AT)
 }
 
 
@@ -43,6 +44,7 @@ func NewSong(num int, targetId int, icomp defs.ICompiler) *Song {
         chn.Num = i
         chn.Name = fmt.Sprintf("%c", 'A'+i)
         chn.ChannelSpecs = chnSpecs
+        chn.SongTempos = &s.Tempos
         s.Channels = append(s.Channels, chn)
     }
 
@@ -56,6 +58,13 @@ func NewSong(num int, targetId int, icomp defs.ICompiler) *Song {
     chn.ChannelSpecs = chnSpecs
     chn.IsVirtualChannel = true
     s.Channels = append(s.Channels, chn)
+
+    rest := (s.Target.GetMaxOctave() + 1 - s.Target.GetMinOctave()) * 12
+    for _, chn := range s.Channels {
+        chn.Ctx = icomp.GetContext()
+        chn.Timing = icomp.GetTiming()
+        chn.Rest, chn.Rest2 = rest, rest + 1
+    }
     
     return s
 }
@@ -0,0 +1,339 @@
+package targets
+
+import (
+    "fmt"
+    "sort"
+    "../effects"
+    "../utils"
+)
+
+import . "../defs"
+
+
+/* Big-endian targets are assumed to be 68000-based, and their callbacks are
+ * called through 32-bit pointers (dc.l in the assembly output).
+ */
+func NewCodeGeneratorBinary(itarget ITarget, bigEndian bool) *CodeGeneratorBinary {
+    cg := &CodeGeneratorBinary{
+        CodeGenerator: CodeGenerator{itarget},
+        data: []byte{},
+        symbols: map[string]int{},
+        symbolOrder: []string{},
+        fixups: []binaryFixup{},
+        bigEndian: bigEndian,
+        callbackSize: 2,
+    }
+    if bigEndian {
+        cg.callbackSize = 4
+    }
+    return cg
+}
+
+
+func (cg *CodeGeneratorBinary) addSymbol(name string) {
+    if _, defined := cg.symbols[name]; !defined {
+        cg.symbolOrder = append(cg.symbolOrder, name)
+    }
+    cg.symbols[name] = len(cg.data)
+}
+
+
+/* Big-endian targets are assumed to be 68000-based, and therefore unable
+ * to read words from odd addresses.
+ */
+func (cg *CodeGeneratorBinary) alignWord() {
+    if cg.bigEndian && (len(cg.data) & 1) == 1 {
+        cg.data = append(cg.data, 0)
+    }
+}
+
+
+func (cg *CodeGeneratorBinary) putWord(val int) {
+    if cg.bigEndian {
+        cg.data = append(cg.data, byte(val >> 8), byte(val))
+    } else {
+        cg.data = append(cg.data, byte(val), byte(val >> 8))
+    }
+}
+
+
+/* Reserves space for a pointer to symbol that is size bytes long (2 or 4).
+ * The pointer is filled in by Resolve.
+ */
+func (cg *CodeGeneratorBinary) putPointer(symbol string, size int) {
+    cg.fixups = append(cg.fixups, binaryFixup{len(cg.data), symbol, size})
+    for i := 0; i < size; i += 2 {
+        cg.putWord(0)
+    }
+}
+
+
+func (cg *CodeGeneratorBinary) putBytes(values []int) {
+    for _, val := range values {
+        cg.data = append(cg.data, byte(val))
+    }
+}
+
+
+func (cg *CodeGeneratorBinary) OutputBytes(outFile OutputWriter, values []int, comment string) int {
+    cg.putBytes(values)
+    return len(values)
+}
+
+
+func (cg *CodeGeneratorBinary) OutputWords(outFile OutputWriter, values []int, comment string) int {
+    cg.alignWord()
+    for _, val := range values {
+        cg.putWord(val)
+    }
+    return len(values) * 2
+}
+
+
+/* The callbacks live in the playback library, so they can only be listed
+ * in the relocation list.
+ */
+func (cg *CodeGeneratorBinary) OutputCallbacks(outFile OutputWriter) int {
+    callbacksSize := 0
+
+    cg.alignWord()
+    cg.addSymbol("xpmp_callback_tbl")
+    for _, cb := range cg.itarget.GetCompilerItf().GetCallbacks() {
+        cg.putPointer(cb, cg.callbackSize)
+        callbacksSize += cg.callbackSize
+    }
+
+    cg.itarget.GetCompilerItf().GetContext().INFO("Size of callback table: %d bytes", callbacksSize)
+
+    return callbacksSize
+}
+
+
+func (cg *CodeGeneratorBinary) OutputChannelData(outFile OutputWriter) int {
+    songDataSize := 0
+
+    songs := cg.itarget.GetCompilerItf().GetSongs()
+    for n, sng := range songs {
+        channels := sng.GetChannels()
+        if n > 0 {
+            cg.itarget.GetCompilerItf().GetContext().Printf("\n")
+        }
+        for _, chn := range channels {
+            if chn.IsVirtual() {
+                continue
+            }
+            commands := chn.GetCommands()
+            cg.addSymbol(fmt.Sprintf("xpmp_s%d_channel_%s", n, chn.GetName()))
+            cg.putBytes(commands)
+            songDataSize += len(commands)
+            cg.itarget.GetCompilerItf().GetContext().Printf("Song %d, Channel %s: %d bytes, %d / %d ticks\n",
+                sng.GetNum(), chn.GetName(), len(commands), utils.Round2(float64(chn.GetTicks())), utils.Round2(float64(chn.GetLoopTicks())))
+        }
+    }
+
+    cg.alignWord()
+    cg.addSymbol("xpmp_song_tbl")
+    for n, sng := range songs {
+        for _, chn := range sng.GetChannels() {
+            if chn.IsVirtual() {
+                continue
+            }
+            cg.putPointer(fmt.Sprintf("xpmp_s%d_channel_%s", n, chn.GetName()), 2)
+            songDataSize += 2
+        }
+    }
+    if cg.itarget.GetID() == TARGET_SMD {
+        // The Genesis player expects the song table to end with a null pointer
+        cg.putWord(0)
+        songDataSize += 2
+    }
+
+    return songDataSize
+}
+
+
+func (cg *CodeGeneratorBinary) OutputComment(outFile OutputWriter, comment string) {
+}
+
+func (cg *CodeGeneratorBinary) OutputDefine(outFile OutputWriter, name string) {
+}
+
+func (cg *CodeGeneratorBinary) OutputEffectFlags(outFile OutputWriter) {
+}
+
+func (cg *CodeGeneratorBinary) OutputElse(outFile OutputWriter) {
+}
+
+func (cg *CodeGeneratorBinary) OutputEndif(outFile OutputWriter) {
+}
+
+func (cg *CodeGeneratorBinary) OutputIfdef(outFile OutputWriter, name string) {
+}
+
+func (cg *CodeGeneratorBinary) OutputIncbin(outFile OutputWriter, fileName string) {
+    cg.itarget.GetCompilerItf().GetContext().WARNINGC(utils.DIAG_UNSUPPORTED, "Binary output can't include %s", fileName)
+}
+
+func (cg *CodeGeneratorBinary) OutputMemoryMap(outFile OutputWriter, slotSize int, numSlots int, numBanks int) {
+}
+
+func (cg *CodeGeneratorBinary) OutputSection(outFile OutputWriter, name string, bank int, slot int, address int) {
+}
+
+
+func (cg *CodeGeneratorBinary) OutputLabel(outFile OutputWriter, name string, export bool) {
+    cg.addSymbol(name)
+}
+
+
+func (cg *CodeGeneratorBinary) OutputString(outFile OutputWriter, str string, exactLength int) {
+    if len(str) >= exactLength {
+        str = str[:exactLength-1]
+    }
+    bytes := make([]int, exactLength)
+    for i := 0; i < len(str); i++ {
+        bytes[i] = int(str[i])
+    }
+    cg.putBytes(bytes)
+}
+
+
+func (cg *CodeGeneratorBinary) OutputPatterns(outFile OutputWriter) int {
+    patSize := 0
+
+    patterns := cg.itarget.GetCompilerItf().GetPatterns()
+    for n, pat := range patterns {
+        cmds := pat.GetCommands()
+        cg.addSymbol(fmt.Sprintf("xpmp_pattern%d", n))
+        cg.putBytes(cmds)
+        patSize += len(cmds)
+    }
+
+    cg.alignWord()
+    cg.addSymbol("xpmp_pattern_tbl")
+    for n := range patterns {
+        cg.putPointer(fmt.Sprintf("xpmp_pattern%d", n), 2)
+        patSize += 2
+    }
+
+    return patSize
+}
+
+
+func (cg *CodeGeneratorBinary) OutputTable(outFile OutputWriter, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int {
+    bytesWritten := 0
+
+    for _, key := range effMap.GetKeys() {
+        name := fmt.Sprintf(tblName + "_%d", key)
+        cg.addSymbol(name)
+        effectData := effMap.GetData(key)
+        bytes := []int{}
+        loopPos := 0
+        for j, param := range effectData.MainPart {
+            dat := (param.(int) * scaling) & 0xFF
+            if canLoop && (dat == loopDelim) {
+                dat++
+            }
+            if canLoop && j == len(effectData.MainPart)-1 && len(effectData.LoopedPart) == 0 {
+                if j > 0 {
+                    bytes = append(bytes, loopDelim)
+                }
+                loopPos = len(bytes)
+                bytes = append(bytes, dat, loopDelim)
+            } else {
+                bytes = append(bytes, dat)
+            }
+        }
+        if canLoop && len(effectData.LoopedPart) > 0 {
+            if len(effectData.MainPart) > 0 {
+                bytes = append(bytes, loopDelim)
+            }
+            loopPos = len(bytes)
+            for _, param := range effectData.LoopedPart {
+                dat := (param.(int) * scaling) & 0xFF
+                if dat == loopDelim {
+                    dat++
+                }
+                bytes = append(bytes, dat)
+            }
+            bytes = append(bytes, loopDelim)
+        }
+        if canLoop {
+            cg.symbols[name + "_loop"] = cg.symbols[name] + loopPos
+            cg.symbolOrder = append(cg.symbolOrder, name + "_loop")
+        }
+        cg.putBytes(bytes)
+        bytesWritten += len(bytes)
+    }
+
+    cg.alignWord()
+    cg.addSymbol(tblName + "_tbl")
+    for _, key := range effMap.GetKeys() {
+        cg.putPointer(fmt.Sprintf(tblName + "_%d", key), 2)
+        bytesWritten += 2
+    }
+    if canLoop {
+        cg.addSymbol(tblName + "_loop_tbl")
+        for _, key := range effMap.GetKeys() {
+            cg.putPointer(fmt.Sprintf(tblName + "_%d_loop", key), 2)
+            bytesWritten += 2
+        }
+    }
+
+    return bytesWritten
+}
+
+
+/* Fills in all pointers to symbols within the blob, assuming that it will
+ * be loaded at baseAddress. Pointers to symbols outside of the blob are
+ * left as zero. Addresses that don't fit in their pointer are reported as
+ * errors.
+ */
+func (cg *CodeGeneratorBinary) Resolve(baseAddress int) {
+    for _, fixup := range cg.fixups {
+        if offset, found := cg.symbols[fixup.symbol]; found {
+            addr := baseAddress + offset
+            if addr >= 1 << uint(fixup.size * 8) {
+                cg.itarget.GetCompilerItf().GetContext().ERRORC(utils.DIAG_OUT_OF_RANGE, "The address of %s ($%X) doesn't fit in a %d-byte pointer; use a lower base address",
+                                                               fixup.symbol, addr, fixup.size)
+            }
+            for i := 0; i < fixup.size; i++ {
+                shift := uint(i * 8)
+                if cg.bigEndian {
+                    shift = uint((fixup.size - 1 - i) * 8)
+                }
+                cg.data[fixup.offset + i] = byte(addr >> shift)
+            }
+        }
+    }
+}
+
+
+/* Writes one line per symbol, sorted by offset: "offset symbol".
+ */
+func (cg *CodeGeneratorBinary) WriteSymbolMap(symFile OutputWriter) {
+    names := make([]string, len(cg.symbolOrder))
+    copy(names, cg.symbolOrder)
+    sort.SliceStable(names, func(i, j int) bool {
+        return cg.symbols[names[i]] < cg.symbols[names[j]]
+    })
+    for _, name := range names {
+        symFile.WriteString(fmt.Sprintf("%04x %s\n", cg.symbols[name], name))
+    }
+}
+
+
+/* Writes one line per pointer in the blob: "offset size symbol", where size
+ * is the size of the pointer in bytes. Pointers to symbols that aren't in
+ * the symbol map (e.g. callbacks) are marked as external and have to be
+ * filled in by whoever loads the blob.
+ */
+func (cg *CodeGeneratorBinary) WriteRelocations(relFile OutputWriter) {
+    for _, fixup := range cg.fixups {
+        if _, found := cg.symbols[fixup.symbol]; found {
+            relFile.WriteString(fmt.Sprintf("%04x %d %s\n", fixup.offset, fixup.size, fixup.symbol))
+        } else {
+            relFile.WriteString(fmt.Sprintf("%04x %d %s extern\n", fixup.offset, fixup.size, fixup.symbol))
+        }
+    }
+}
@@ -0,0 +1,367 @@
+package targets
+
+import (
+    "fmt"
+    "strings"
+    "../effects"
+    "../utils"
+)
+
+import . "../defs"
+
+
+/* Records a declaration that should be repeated as an extern in the header.
+ */
+func (cg *CodeGeneratorC) addExtern(decl string) {
+    cg.externs = append(cg.externs, "extern " + decl + ";")
+}
+
+
+/* Closes the array currently being written, if any.
+ */
+func (cg *CodeGeneratorC) closeArray(outFile OutputWriter) {
+    if cg.arrayOpen {
+        if cg.arrayLen == 0 {
+            // C doesn't allow empty arrays
+            outFile.WriteString("\n    0x00,")
+        }
+        outFile.WriteString("\n};\n\n")
+        cg.arrayOpen = false
+    }
+}
+
+
+/* Starts a new byte array. Data that is written without a preceding label
+ * ends up in an array of its own.
+ */
+func (cg *CodeGeneratorC) openArray(outFile OutputWriter, name string, export bool) {
+    cg.closeArray(outFile)
+    if len(name) == 0 {
+        name = fmt.Sprintf("xpmp_data%d", cg.anonArrays)
+        cg.anonArrays++
+        outFile.WriteString("static ")
+    } else if export {
+        cg.addExtern("const uint8_t " + name + "[]")
+    }
+    outFile.WriteString("const uint8_t " + name + "[] = {")
+    cg.arrayOpen = true
+    cg.arrayLen = 0
+}
+
+
+/* Writes a complete byte array named name.
+ */
+func (cg *CodeGeneratorC) writeArray(outFile OutputWriter, name string, values []int) {
+    cg.openArray(outFile, name, true)
+    if len(values) == 0 {
+        // C doesn't allow empty arrays
+        values = []int{0}
+    }
+    for j, val := range values {
+        if (j % 16) == 0 {
+            outFile.WriteString("\n   ")
+        }
+        outFile.WriteString(fmt.Sprintf(" 0x%02x,", val & 0xFF))
+    }
+    outFile.WriteString("\n};\n\n")
+    cg.arrayOpen = false
+}
+
+
+/* Writes an array of pointers into byte arrays.
+ */
+func (cg *CodeGeneratorC) writePointerArray(outFile OutputWriter, name string, values []string) {
+    cg.closeArray(outFile)
+    cg.addExtern("const uint8_t * const " + name + "[]")
+    outFile.WriteString("const uint8_t * const " + name + "[] = {\n")
+    if len(values) == 0 {
+        outFile.WriteString("    0\n")
+    }
+    for _, val := range values {
+        outFile.WriteString("    " + val + ",\n")
+    }
+    outFile.WriteString("};\n\n")
+}
+
+
+func (cg *CodeGeneratorC) OutputBytes(outFile OutputWriter, values []int, comment string) int {
+    if !cg.arrayOpen {
+        cg.openArray(outFile, "", false)
+    }
+    if len(comment) > 0 {
+        outFile.WriteString("\n    /* " + comment + " */")
+    }
+    for _, val := range values {
+        outFile.WriteString(fmt.Sprintf("\n    0x%02x,", val & 0xFF))
+    }
+    cg.arrayLen += len(values)
+    return len(values)
+}
+
+
+/* Words are stored least significant byte first, the same way as addresses
+ * in the channel data.
+ */
+func (cg *CodeGeneratorC) OutputWords(outFile OutputWriter, values []int, comment string) int {
+    bytes := []int{}
+    for _, val := range values {
+        bytes = append(bytes, val & 0xFF, (val >> 8) & 0xFF)
+    }
+    return cg.OutputBytes(outFile, bytes, comment)
+}
+
+
+func (cg *CodeGeneratorC) OutputCallbacks(outFile OutputWriter) int {
+    callbacksSize := 0
+
+    cg.closeArray(outFile)
+
+    callbacks := cg.itarget.GetCompilerItf().GetCallbacks()
+    for _, cb := range callbacks {
+        outFile.WriteString("extern void " + cb + "(void);\n")
+    }
+    cg.addExtern("void (* const xpmp_callback_tbl[])(void)")
+    outFile.WriteString("void (* const xpmp_callback_tbl[])(void) = {\n")
+    if len(callbacks) == 0 {
+        outFile.WriteString("    0\n")
+    }
+    for _, cb := range callbacks {
+        outFile.WriteString("    " + cb + ",\n")
+        callbacksSize += 2
+    }
+    outFile.WriteString("};\n\n")
+
+    cg.itarget.GetCompilerItf().GetContext().INFO("Size of callback table: %d bytes", callbacksSize)
+
+    return callbacksSize
+}
+
+
+func (cg *CodeGeneratorC) OutputComment(outFile OutputWriter, comment string) {
+    outFile.WriteString("/* " + comment + " */\n")
+}
+
+
+func (cg *CodeGeneratorC) OutputDefine(outFile OutputWriter, name string) {
+    cg.closeArray(outFile)
+    outFile.WriteString("#define " + name + "\n")
+}
+
+
+func (cg *CodeGeneratorC) OutputEffectFlags(outFile OutputWriter) {
+    songs := cg.itarget.GetCompilerItf().GetSongs()
+    numChannels := len(songs[0].GetChannels())
+
+    for _, effName := range EFFECT_STRINGS {
+        for c := 0; c < numChannels; c++ {
+            for _, sng := range songs {
+                channels := sng.GetChannels()
+                if channels[c].IsUsingEffect(effName) {
+                    cg.OutputDefine(outFile, fmt.Sprintf("XPMP_CHN%d_USES_", channels[c].GetNum()) + effName)
+                    break
+                }
+            }
+        }
+    }
+}
+
+
+func (cg *CodeGeneratorC) OutputIfdef(outFile OutputWriter, name string) {
+    cg.closeArray(outFile)
+    outFile.WriteString("#ifdef " + name + "\n\n")
+}
+
+
+func (cg *CodeGeneratorC) OutputElse(outFile OutputWriter) {
+    cg.closeArray(outFile)
+    outFile.WriteString("#else\n\n")
+}
+
+
+func (cg *CodeGeneratorC) OutputEndif(outFile OutputWriter) {
+    cg.closeArray(outFile)
+    outFile.WriteString("#endif\n")
+}
+
+
+/* There's no portable way of including a binary file in C, so this is
+ * left to the build.
+ */
+func (cg *CodeGeneratorC) OutputIncbin(outFile OutputWriter, fileName string) {
+    cg.closeArray(outFile)
+    outFile.WriteString("/* " + fileName + " has to be linked separately */\n\n")
+}
+
+
+func (cg *CodeGeneratorC) OutputLabel(outFile OutputWriter, name string, export bool) {
+    cg.openArray(outFile, name, export)
+}
+
+
+func (cg *CodeGeneratorC) OutputMemoryMap(outFile OutputWriter, slotSize int, numSlots int, numBanks int) {
+}
+
+
+func (cg *CodeGeneratorC) OutputSection(outFile OutputWriter, name string, bank int, slot int, address int) {
+}
+
+
+func (cg *CodeGeneratorC) OutputString(outFile OutputWriter, str string, exactLength int) {
+    if len(str) >= exactLength {
+        str = str[:exactLength-1]
+    }
+    bytes := make([]int, exactLength)
+    for i := 0; i < len(str); i++ {
+        bytes[i] = int(str[i])
+    }
+    cg.OutputBytes(outFile, bytes, "\"" + strings.Replace(str, "*/", "* /", -1) + "\"")
+}
+
+
+/* Outputs the pattern data and addresses.
+ */
+func (cg *CodeGeneratorC) OutputPatterns(outFile OutputWriter) int {
+    patSize := 0
+
+    patterns := cg.itarget.GetCompilerItf().GetPatterns()
+    names := []string{}
+    for n, pat := range patterns {
+        cmds := pat.GetCommands()
+        cg.writeArray(outFile, fmt.Sprintf("xpmp_pattern%d", n), cmds)
+        names = append(names, fmt.Sprintf("xpmp_pattern%d", n))
+        patSize += len(cmds) + 2
+    }
+    cg.writePointerArray(outFile, "xpmp_pattern_tbl", names)
+
+    return patSize
+}
+
+
+/* Outputs the channel data (the actual notes, volume commands, effect invokations, etc)
+ * for all channels and all songs.
+ */
+func (cg *CodeGeneratorC) OutputChannelData(outFile OutputWriter) int {
+    songDataSize := 0
+
+    songs := cg.itarget.GetCompilerItf().GetSongs()
+    names := []string{}
+    for n, sng := range songs {
+        channels := sng.GetChannels()
+        if n > 0 {
+            cg.itarget.GetCompilerItf().GetContext().Printf("\n")
+        }
+        for _, chn := range channels {
+            if chn.IsVirtual() {
+                continue
+            }
+            commands := chn.GetCommands()
+            name := fmt.Sprintf("xpmp_s%d_channel_%s", n, chn.GetName())
+            cg.writeArray(outFile, name, commands)
+            names = append(names, name)
+            songDataSize += len(commands) + 2
+            cg.itarget.GetCompilerItf().GetContext().Printf("Song %d, Channel %s: %d bytes, %d / %d ticks\n",
+                sng.GetNum(), chn.GetName(), len(commands), utils.Round2(float64(chn.GetTicks())), utils.Round2(float64(chn.GetLoopTicks())))
+        }
+    }
+    if cg.itarget.GetID() == TARGET_SMD {
+        // The Genesis player expects the song table to end with a null pointer
+        names = append(names, "0")
+        songDataSize += 2
+    }
+    cg.writePointerArray(outFile, "xpmp_song_tbl", names)
+
+    return songDataSize
+}
+
+
+/* Outputs an effect table. Each effect gets an array of its own, and the
+ * loop table points into those arrays.
+ */
+func (cg *CodeGeneratorC) OutputTable(outFile OutputWriter, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int {
+    bytesWritten := 0
+
+    names := []string{}
+    loopNames := []string{}
+    for _, key := range effMap.GetKeys() {
+        effectData := effMap.GetData(key)
+        bytes := []int{}
+        loopPos := 0
+        for j, param := range effectData.MainPart {
+            dat := (param.(int) * scaling) & 0xFF
+            if canLoop && (dat == loopDelim) {
+                dat++
+            }
+            if canLoop && j == len(effectData.MainPart)-1 && len(effectData.LoopedPart) == 0 {
+                // Loop on the last value
+                if j > 0 {
+                    bytes = append(bytes, loopDelim)
+                }
+                loopPos = len(bytes)
+                bytes = append(bytes, dat, loopDelim)
+            } else {
+                bytes = append(bytes, dat)
+            }
+        }
+        if canLoop && len(effectData.LoopedPart) > 0 {
+            if len(effectData.MainPart) > 0 {
+                bytes = append(bytes, loopDelim)
+            }
+            loopPos = len(bytes)
+            for _, param := range effectData.LoopedPart {
+                dat := (param.(int) * scaling) & 0xFF
+                if dat == loopDelim {
+                    dat++
+                }
+                bytes = append(bytes, dat)
+            }
+            bytes = append(bytes, loopDelim)
+        }
+
+        name := fmt.Sprintf(tblName + "_%d", key)
+        cg.writeArray(outFile, name, bytes)
+        names = append(names, name)
+        loopNames = append(loopNames, fmt.Sprintf("%s + %d", name, loopPos))
+        bytesWritten += len(bytes) + 2
+        if canLoop {
+            bytesWritten += 2
+        }
+    }
+
+    cg.writePointerArray(outFile, tblName + "_tbl", names)
+    if canLoop {
+        cg.writePointerArray(outFile, tblName + "_loop_tbl", loopNames)
+    }
+
+    return bytesWritten
+}
+
+
+/* Writes the header that goes with the C file: the effect usage flags,
+ * the number of songs and channels, and externs for everything that was
+ * written to the C file.
+ */
+func (cg *CodeGeneratorC) OutputHeader(hFile OutputWriter, guard string) {
+    songs := cg.itarget.GetCompilerItf().GetSongs()
+
+    hFile.WriteString("#ifndef " + guard + "\n")
+    hFile.WriteString("#define " + guard + "\n\n")
+    hFile.WriteString("#include <stdint.h>\n\n")
+
+    cg.OutputEffectFlags(hFile)
+    hFile.WriteString("\n")
+
+    numChannels := 0
+    for _, chn := range songs[0].GetChannels() {
+        if !chn.IsVirtual() {
+            numChannels++
+        }
+    }
+    hFile.WriteString(fmt.Sprintf("#define XPMP_NUM_SONGS %d\n", len(songs)))
+    hFile.WriteString(fmt.Sprintf("#define XPMP_NUM_CHANNELS %d\n\n", numChannels))
+
+    for _, ext := range cg.externs {
+        hFile.WriteString(ext + "\n")
+    }
+
+    hFile.WriteString("\n#endif\n")
+}
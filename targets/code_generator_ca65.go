@@ -0,0 +1,331 @@
+package targets
+
+import (
+    "fmt"
+    "../effects"
+    "../utils"
+)
+
+import . "../defs"
+
+
+/* Emits the .segment directive the first time any data is written
+ * by this generator.
+ */
+func (cg *CodeGeneratorCa65) beginSegment(outFile OutputWriter) {
+    if !cg.segmentStarted {
+        outFile.WriteString(".segment \"" + cg.segment + "\"\n\n")
+        cg.segmentStarted = true
+    }
+}
+
+
+func (cg *CodeGeneratorCa65) OutputCallbacks(outFile OutputWriter) int {
+    callbacksSize := 0
+
+    cg.beginSegment(outFile)
+
+    // The callbacks are normally defined by the engine, so let ca65 decide
+    // whether to import or export them.
+    for _, cb := range cg.itarget.GetCompilerItf().GetCallbacks() {
+        outFile.WriteString(".global " + cb + "\n")
+    }
+    outFile.WriteString(".export xpmp_callback_tbl\n")
+    outFile.WriteString("xpmp_callback_tbl:\n")
+    for _, cb := range cg.itarget.GetCompilerItf().GetCallbacks() {
+        outFile.WriteString(".word " + cb + "\n")
+        callbacksSize += 2
+    }
+    outFile.WriteString("\n")
+
+    cg.itarget.GetCompilerItf().GetContext().INFO("Size of callback table: %d bytes", callbacksSize)
+
+    return callbacksSize
+}
+
+
+/* Defines a symbol that the playback library can test with .ifdef.
+ * ca65's .ifdef only sees symbols, so these can't be .define'd.
+ */
+func (cg *CodeGeneratorCa65) OutputDefine(outFile OutputWriter, name string) {
+    outFile.WriteString(name + " = 1\n")
+}
+
+
+func (cg *CodeGeneratorCa65) OutputEffectFlags(outFile OutputWriter) {
+    songs := cg.itarget.GetCompilerItf().GetSongs()
+    numChannels := len(songs[0].GetChannels())
+
+    for _, effName := range EFFECT_STRINGS {
+        for c := 0; c < numChannels; c++ {
+            for _, sng := range songs {
+                channels := sng.GetChannels()
+                if channels[c].IsUsingEffect(effName) {
+                    cg.OutputDefine(outFile, fmt.Sprintf("XPMP_CHN%d_USES_", channels[c].GetNum()) + effName)
+                    break
+                }
+            }
+        }
+    }
+}
+
+
+func (cg *CodeGeneratorCa65) OutputString(outFile OutputWriter, str string, exactLength int) {
+    cg.beginSegment(outFile)
+
+    if len(str) >= exactLength {
+        outFile.WriteString(".byte \"" + str[:exactLength-1] + "\", 0\n")
+    } else {
+        outFile.WriteString(".byte \"" + str + "\"")
+        for i := 0; i < exactLength - len(str); i++ {
+            outFile.WriteString(", 0")
+        }
+        outFile.WriteString("\n")
+    }
+}
+
+
+/* Outputs the pattern data and addresses.
+ */
+func (cg *CodeGeneratorCa65) OutputPatterns(outFile OutputWriter) int {
+    patSize := 0
+
+    cg.beginSegment(outFile)
+
+    patterns := cg.itarget.GetCompilerItf().GetPatterns()
+    for n, pat := range patterns {
+        outFile.WriteString(fmt.Sprintf("xpmp_pattern%d:", n))
+        cmds := pat.GetCommands()
+        for j, cmd := range cmds {
+            if (j % 16) == 0 {
+                outFile.WriteString("\n.byte ")
+            }
+            outFile.WriteString(fmt.Sprintf("$%02x", cmd & 0xFF))
+            if j < len(cmds)-1 && (j % 16) != 15 {
+                outFile.WriteString(",")
+            }
+        }
+        outFile.WriteString("\n")
+        patSize += len(cmds)
+    }
+
+    outFile.WriteString("\n.export xpmp_pattern_tbl\n")
+    outFile.WriteString("xpmp_pattern_tbl:\n")
+    for n := range patterns {
+        outFile.WriteString(fmt.Sprintf(".word xpmp_pattern%d\n", n))
+        patSize += 2
+    }
+    outFile.WriteString("\n")
+
+    return patSize
+}
+
+
+/* Outputs the channel data (the actual notes, volume commands, effect invokations, etc)
+ * for all channels and all songs.
+ */
+func (cg *CodeGeneratorCa65) OutputChannelData(outFile OutputWriter) int {
+    songDataSize := 0
+
+    cg.beginSegment(outFile)
+
+    songs := cg.itarget.GetCompilerItf().GetSongs()
+    for n, sng := range songs {
+        channels := sng.GetChannels()
+        if n > 0 {
+            cg.itarget.GetCompilerItf().GetContext().Printf("\n")
+        }
+        for _, chn := range channels {
+            if chn.IsVirtual() {
+                continue
+            }
+            outFile.WriteString(fmt.Sprintf("xpmp_s%d_channel_%s:", n, chn.GetName()))
+            commands := chn.GetCommands()
+            for j, cmd := range commands {
+                if (j % 16) == 0 {
+                    outFile.WriteString("\n.byte ")
+                }
+                outFile.WriteString(fmt.Sprintf("$%02x", cmd & 0xFF))
+                songDataSize++
+                if j < len(commands)-1 && (j % 16) != 15 {
+                   outFile.WriteString(",")
+                }
+            }
+            outFile.WriteString("\n")
+            cg.itarget.GetCompilerItf().GetContext().Printf("Song %d, Channel %s: %d bytes, %d / %d ticks\n",
+                sng.GetNum(), chn.GetName(), len(commands), utils.Round2(float64(chn.GetTicks())), utils.Round2(float64(chn.GetLoopTicks())))
+        }
+    }
+
+    outFile.WriteString("\n.export xpmp_song_tbl\n")
+    outFile.WriteString("xpmp_song_tbl:\n")
+    for n, sng := range songs {
+        channels := sng.GetChannels()
+        for _, chn := range channels {
+            if chn.IsVirtual() {
+                continue
+            }
+            outFile.WriteString(fmt.Sprintf(".word xpmp_s%d_channel_%s\n", n, chn.GetName()))
+            songDataSize += 2
+        }
+    }
+
+    return songDataSize
+}
+
+
+/* Outputs an effect table. Each effect is placed in its own .proc so that
+ * its loop point can be a local label, reachable from the outside as
+ * tblName_<key>::loop.
+ */
+func (cg *CodeGeneratorCa65) OutputTable(outFile OutputWriter, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int {
+    var bytesWritten, dat int
+
+    bytesWritten = 0
+
+    hexPrefix := "$"
+    byteDecl := ".byte"
+    wordDecl := ".word"
+
+    cg.beginSegment(outFile)
+
+    if effMap.Len() > 0 {
+        for _, key := range effMap.GetKeys() {
+            outFile.WriteString(fmt.Sprintf(".proc " + tblName + "_%d", key))
+            effectData := effMap.GetData(key)
+            for j, param := range effectData.MainPart {
+                dat = (param.(int) * scaling) & 0xFF
+                if canLoop && (dat == loopDelim) {
+                    dat++
+                }
+
+                if canLoop && j == len(effectData.MainPart)-1 && len(effectData.LoopedPart) == 0 {
+                    if j > 0 {
+                        outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, loopDelim))
+                    }
+                    outFile.WriteString("\nloop:\n")
+                    outFile.WriteString(fmt.Sprintf("%s %s%02x, %s%02x", byteDecl, hexPrefix, dat, hexPrefix, loopDelim))
+                    bytesWritten += 3
+                } else if j == 0 {
+                    outFile.WriteString(fmt.Sprintf("\n%s %s%02x", byteDecl, hexPrefix, dat))
+                    bytesWritten += 1
+                } else {
+                    outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, dat))
+                    bytesWritten += 1
+                }
+            }
+            if canLoop && len(effectData.LoopedPart) > 0 {
+                if len(effectData.MainPart) > 0 {
+                    outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, loopDelim))
+                    bytesWritten += 1
+                }
+                outFile.WriteString("\nloop:\n")
+                for j, param := range effectData.LoopedPart {
+                    dat = (param.(int) * scaling) & 0xFF
+                    if dat == loopDelim && canLoop {
+                        dat++
+                    }
+                    if j == 0 {
+                        outFile.WriteString(fmt.Sprintf("%s %s%02x", byteDecl, hexPrefix, dat))
+                    } else {
+                        outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, dat))
+                    }
+                    bytesWritten += 1
+                }
+                outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, loopDelim))
+                bytesWritten += 1
+            }
+            outFile.WriteString("\n.endproc\n")
+        }
+        outFile.WriteString(".export " + tblName + "_tbl\n")
+        outFile.WriteString(tblName + "_tbl:\n")
+        for _, key := range effMap.GetKeys() {
+            outFile.WriteString(fmt.Sprintf("%s " + tblName + "_%d\n", wordDecl, key))
+            bytesWritten += 2
+        }
+        if canLoop {
+            outFile.WriteString(".export " + tblName + "_loop_tbl\n")
+            outFile.WriteString(tblName + "_loop_tbl:\n")
+            for _, key := range effMap.GetKeys() {
+                outFile.WriteString(fmt.Sprintf("%s " + tblName + "_%d::loop\n", wordDecl, key))
+                bytesWritten += 2
+            }
+        }
+        outFile.WriteString("\n")
+    } else {
+        outFile.WriteString(".export " + tblName + "_tbl\n")
+        outFile.WriteString(tblName + "_tbl:\n")
+        if canLoop {
+            outFile.WriteString(".export " + tblName + "_loop_tbl\n")
+            outFile.WriteString(tblName + "_loop_tbl:\n")
+        }
+        outFile.WriteString("\n")
+    }
+
+    return bytesWritten
+}
+
+
+func (cg *CodeGeneratorCa65) OutputBytes(outFile OutputWriter, values []int, comment string) int {
+    cg.beginSegment(outFile)
+    writeDataList(outFile, ".byte", "$%02x", values, ";", comment)
+    return len(values)
+}
+
+
+func (cg *CodeGeneratorCa65) OutputWords(outFile OutputWriter, values []int, comment string) int {
+    cg.beginSegment(outFile)
+    writeDataList(outFile, ".word", "$%04x", values, ";", comment)
+    return len(values) * 2
+}
+
+
+func (cg *CodeGeneratorCa65) OutputComment(outFile OutputWriter, comment string) {
+    outFile.WriteString("; " + comment + "\n")
+}
+
+
+func (cg *CodeGeneratorCa65) OutputIfdef(outFile OutputWriter, name string) {
+    outFile.WriteString(".ifdef " + name + "\n\n")
+}
+
+
+/* The two branches of a conditional are assembled independently, so the
+ * .segment directive has to be repeated in the else-branch.
+ */
+func (cg *CodeGeneratorCa65) OutputElse(outFile OutputWriter) {
+    outFile.WriteString(".else\n\n")
+    cg.segmentStarted = false
+}
+
+
+func (cg *CodeGeneratorCa65) OutputEndif(outFile OutputWriter) {
+    outFile.WriteString(".endif\n")
+}
+
+
+func (cg *CodeGeneratorCa65) OutputIncbin(outFile OutputWriter, fileName string) {
+    cg.beginSegment(outFile)
+    outFile.WriteString(".incbin \"" + fileName + "\"\n\n")
+}
+
+
+func (cg *CodeGeneratorCa65) OutputLabel(outFile OutputWriter, name string, export bool) {
+    cg.beginSegment(outFile)
+    if export {
+        outFile.WriteString(".export " + name + "\n")
+    }
+    outFile.WriteString(name + ":\n")
+}
+
+
+/* The memory layout is left to the ld65 config file.
+ */
+func (cg *CodeGeneratorCa65) OutputMemoryMap(outFile OutputWriter, slotSize int, numSlots int, numBanks int) {
+}
+
+
+func (cg *CodeGeneratorCa65) OutputSection(outFile OutputWriter, name string, bank int, slot int, address int) {
+    outFile.WriteString(".segment \"" + name + "\"\n\n")
+    cg.segmentStarted = true
+}
@@ -2,7 +2,6 @@ package targets
 
 import (
     "fmt"
-    "os"
     "../effects"
     "../utils"
 )
@@ -10,12 +9,27 @@ import (
 import . "../defs"
 
 
-func (cg *CodeGeneratorGas68k) OutputCallbacks(outFile *os.File) int {
+/* The 68000 can't read words from odd addresses, so any word data that
+ * follows byte data has to be aligned.
+ */
+func (cg *CodeGeneratorGas68k) alignWord(outFile OutputWriter) {
+    outFile.WriteString(".even\n")
+}
+
+
+func (cg *CodeGeneratorGas68k) OutputCallbacks(outFile OutputWriter) int {
     callbacksSize := 0
 
-    // ToDo: implement
+    cg.alignWord(outFile)
+    outFile.WriteString(".globl xpmp_callback_tbl\n")
+    outFile.WriteString("xpmp_callback_tbl:\n")
+    for _, cb := range cg.itarget.GetCompilerItf().GetCallbacks() {
+        outFile.WriteString("dc.l " + cb + "\n")
+        callbacksSize += 4
+    }
+    outFile.WriteString("\n")
 
-    utils.INFO("Size of callback table: %d bytes", callbacksSize)  
+    cg.itarget.GetCompilerItf().GetContext().INFO("Size of callback table: %d bytes", callbacksSize)  
     
     return callbacksSize
 }
@@ -24,14 +38,14 @@ func (cg *CodeGeneratorGas68k) OutputCallbacks(outFile *os.File) int {
 /* Outputs the channel data (the actual notes, volume commands, effect invokations, etc)
  * for all channels and all songs.
  */
-func (cg *CodeGeneratorGas68k) OutputChannelData(outFile *os.File) int {
+func (cg *CodeGeneratorGas68k) OutputChannelData(outFile OutputWriter) int {
     songDataSize := 0
     
     songs := cg.itarget.GetCompilerItf().GetSongs()
     for n, sng := range songs {
         channels := sng.GetChannels()
         if n > 0 {
-            fmt.Printf("\n")
+            cg.itarget.GetCompilerItf().GetContext().Printf("\n")
         }
         for _, chn := range channels {  
             if chn.IsVirtual() {
@@ -51,11 +65,13 @@ func (cg *CodeGeneratorGas68k) OutputChannelData(outFile *os.File) int {
                 }
             }
             outFile.WriteString("\n")
-            fmt.Printf("Song %d, Channel %s: %d bytes, %d / %d ticks\n", sng.GetNum(), chn.GetName(), len(commands), utils.Round2(float64(chn.GetTicks())), utils.Round2(float64(chn.GetLoopTicks())))
+            cg.itarget.GetCompilerItf().GetContext().Printf("Song %d, Channel %s: %d bytes, %d / %d ticks\n", sng.GetNum(), chn.GetName(), len(commands), utils.Round2(float64(chn.GetTicks())), utils.Round2(float64(chn.GetLoopTicks())))
         }
     }
 
-    outFile.WriteString("\n.globl xpmp_song_tbl")
+    outFile.WriteString("\n")
+    cg.alignWord(outFile)
+    outFile.WriteString(".globl xpmp_song_tbl")
     outFile.WriteString("\nxpmp_song_tbl:\n")
     for n, sng := range songs {
         channels := sng.GetChannels()
@@ -74,7 +90,12 @@ func (cg *CodeGeneratorGas68k) OutputChannelData(outFile *os.File) int {
 }
 
 
-func (cg *CodeGeneratorGas68k) OutputEffectFlags(outFile *os.File) {
+func (cg *CodeGeneratorGas68k) OutputDefine(outFile OutputWriter, name string) {
+    outFile.WriteString(".equ " + name + ", 1\n")
+}
+
+
+func (cg *CodeGeneratorGas68k) OutputEffectFlags(outFile OutputWriter) {
     songs := cg.itarget.GetCompilerItf().GetSongs()
     numChannels := len(songs[0].GetChannels())
     
@@ -83,7 +104,7 @@ func (cg *CodeGeneratorGas68k) OutputEffectFlags(outFile *os.File) {
             for _, sng := range songs {
                 channels := sng.GetChannels()
                 if channels[c].IsUsingEffect(effName) {
-                    // ToDo: translate: outFile.WriteString(fmt.Sprintf(".DEFINE XPMP_CHN%d_USES_", channels[c].GetNum()) + effName + "\n")
+                    cg.OutputDefine(outFile, fmt.Sprintf("XPMP_CHN%d_USES_", channels[c].GetNum()) + effName)
                     break
                 }
             }
@@ -92,9 +113,22 @@ func (cg *CodeGeneratorGas68k) OutputEffectFlags(outFile *os.File) {
 }
 
 
+func (cg *CodeGeneratorGas68k) OutputString(outFile OutputWriter, str string, exactLength int) {
+    if len(str) >= exactLength {
+        outFile.WriteString("dc.b \"" + str[:exactLength-1] + "\", 0\n")
+    } else {
+        outFile.WriteString("dc.b \"" + str + "\"")
+        for i := 0; i < exactLength - len(str); i++ {
+            outFile.WriteString(", 0")
+        }
+        outFile.WriteString("\n")
+    }
+}
+
+
 /* Outputs the pattern data and addresses.
  */
-func (cg *CodeGeneratorGas68k) OutputPatterns(outFile *os.File) int {
+func (cg *CodeGeneratorGas68k) OutputPatterns(outFile OutputWriter) int {
     patSize := 0
     
     patterns := cg.itarget.GetCompilerItf().GetPatterns()
@@ -114,7 +148,9 @@ func (cg *CodeGeneratorGas68k) OutputPatterns(outFile *os.File) int {
         patSize += len(cmds)
     }
 
-    outFile.WriteString("\n.globl xpmp_pattern_tbl\n")
+    outFile.WriteString("\n")
+    cg.alignWord(outFile)
+    outFile.WriteString(".globl xpmp_pattern_tbl\n")
     outFile.WriteString("xpmp_pattern_tbl:\n")
     for n := range patterns {
         outFile.WriteString(fmt.Sprintf("dc.w xpmp_pattern%d\n", n))
@@ -126,7 +162,7 @@ func (cg *CodeGeneratorGas68k) OutputPatterns(outFile *os.File) int {
 }
 
 
-func (cg *CodeGeneratorGas68k) OutputTable(outFile *os.File, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int {
+func (cg *CodeGeneratorGas68k) OutputTable(outFile OutputWriter, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int {
     var bytesWritten, dat int
     
     bytesWritten = 0
@@ -183,6 +219,7 @@ func (cg *CodeGeneratorGas68k) OutputTable(outFile *os.File, tblName string, eff
             }
             outFile.WriteString("\n")
         }
+        cg.alignWord(outFile)
         outFile.WriteString(tblName + "_tbl:\n")
         for _, key := range effMap.GetKeys() {
             outFile.WriteString(fmt.Sprintf("%s " + tblName + "_%d\n", wordDecl, key))
@@ -207,3 +244,60 @@ func (cg *CodeGeneratorGas68k) OutputTable(outFile *os.File, tblName string, eff
     return bytesWritten
 }
 
+
+
+func (cg *CodeGeneratorGas68k) OutputBytes(outFile OutputWriter, values []int, comment string) int {
+    writeDataList(outFile, "dc.b", "0x%02x", values, "|", comment)
+    return len(values)
+}
+
+
+func (cg *CodeGeneratorGas68k) OutputWords(outFile OutputWriter, values []int, comment string) int {
+    cg.alignWord(outFile)
+    writeDataList(outFile, "dc.w", "0x%04x", values, "|", comment)
+    return len(values) * 2
+}
+
+
+func (cg *CodeGeneratorGas68k) OutputComment(outFile OutputWriter, comment string) {
+    outFile.WriteString("| " + comment + "\n")
+}
+
+
+func (cg *CodeGeneratorGas68k) OutputIfdef(outFile OutputWriter, name string) {
+    outFile.WriteString(".ifdef " + name + "\n\n")
+}
+
+
+func (cg *CodeGeneratorGas68k) OutputElse(outFile OutputWriter) {
+    outFile.WriteString(".else\n\n")
+}
+
+
+func (cg *CodeGeneratorGas68k) OutputEndif(outFile OutputWriter) {
+    outFile.WriteString(".endif\n")
+}
+
+
+func (cg *CodeGeneratorGas68k) OutputIncbin(outFile OutputWriter, fileName string) {
+    outFile.WriteString(".incbin \"" + fileName + "\"\n\n")
+}
+
+
+func (cg *CodeGeneratorGas68k) OutputLabel(outFile OutputWriter, name string, export bool) {
+    if export {
+        outFile.WriteString(".globl " + name + "\n")
+    }
+    outFile.WriteString(name + ":\n")
+}
+
+
+/* The memory layout is left to the linker script.
+ */
+func (cg *CodeGeneratorGas68k) OutputMemoryMap(outFile OutputWriter, slotSize int, numSlots int, numBanks int) {
+}
+
+
+func (cg *CodeGeneratorGas68k) OutputSection(outFile OutputWriter, name string, bank int, slot int, address int) {
+    outFile.WriteString(fmt.Sprintf(".org 0x%x\n\n", address))
+}
@@ -0,0 +1,302 @@
+package targets
+
+import (
+    "fmt"
+    "../effects"
+    "../utils"
+)
+
+import . "../defs"
+
+
+/* Same as CodeGeneratorGas68k.alignWord.
+ */
+func (cg *CodeGeneratorMot68k) alignWord(outFile OutputWriter) {
+    outFile.WriteString("    even\n")
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputCallbacks(outFile OutputWriter) int {
+    callbacksSize := 0
+
+    cg.alignWord(outFile)
+    outFile.WriteString("    xdef xpmp_callback_tbl\n")
+    outFile.WriteString("xpmp_callback_tbl:\n")
+    for _, cb := range cg.itarget.GetCompilerItf().GetCallbacks() {
+        outFile.WriteString("    dc.l " + cb + "\n")
+        callbacksSize += 4
+    }
+    outFile.WriteString("\n")
+
+    cg.itarget.GetCompilerItf().GetContext().INFO("Size of callback table: %d bytes", callbacksSize)  
+    
+    return callbacksSize
+}
+
+
+/* Outputs the channel data (the actual notes, volume commands, effect invokations, etc)
+ * for all channels and all songs.
+ */
+func (cg *CodeGeneratorMot68k) OutputChannelData(outFile OutputWriter) int {
+    songDataSize := 0
+    
+    songs := cg.itarget.GetCompilerItf().GetSongs()
+    for n, sng := range songs {
+        channels := sng.GetChannels()
+        if n > 0 {
+            cg.itarget.GetCompilerItf().GetContext().Printf("\n")
+        }
+        for _, chn := range channels {  
+            if chn.IsVirtual() {
+                continue       
+            }          
+            outFile.WriteString(fmt.Sprintf("xpmp_s%d_channel_%s:", n, chn.GetName()))
+
+            commands := chn.GetCommands()
+            for j, cmd := range commands {
+                if (j % 16) == 0 {
+                    outFile.WriteString("\n    dc.b ")
+                }
+                outFile.WriteString(fmt.Sprintf("$%02x", cmd & 0xFF))
+                songDataSize++
+                if j < len(commands)-1 && (j % 16) != 15 {
+                   outFile.WriteString(",")
+                }
+            }
+            outFile.WriteString("\n")
+            cg.itarget.GetCompilerItf().GetContext().Printf("Song %d, Channel %s: %d bytes, %d / %d ticks\n", sng.GetNum(), chn.GetName(), len(commands), utils.Round2(float64(chn.GetTicks())), utils.Round2(float64(chn.GetLoopTicks())))
+        }
+    }
+
+    outFile.WriteString("\n")
+    cg.alignWord(outFile)
+    outFile.WriteString("    xdef xpmp_song_tbl")
+    outFile.WriteString("\nxpmp_song_tbl:\n")
+    for n, sng := range songs {
+        channels := sng.GetChannels()
+        for _, chn := range channels { 
+            if chn.IsVirtual() {
+                continue
+            }
+            outFile.WriteString(fmt.Sprintf("    dc.w xpmp_s%d_channel_%s\n", n, chn.GetName()))
+            songDataSize += 2       // ToDo: should it be += 4 like in the original code?
+        }
+    }
+    outFile.WriteString("    dc.w 0\n")
+    songDataSize += 2
+    
+    return songDataSize
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputDefine(outFile OutputWriter, name string) {
+    outFile.WriteString(name + " equ 1\n")
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputEffectFlags(outFile OutputWriter) {
+    songs := cg.itarget.GetCompilerItf().GetSongs()
+    numChannels := len(songs[0].GetChannels())
+    
+    for _, effName := range EFFECT_STRINGS {
+        for c := 0; c < numChannels; c++ {
+            for _, sng := range songs {
+                channels := sng.GetChannels()
+                if channels[c].IsUsingEffect(effName) {
+                    cg.OutputDefine(outFile, fmt.Sprintf("XPMP_CHN%d_USES_", channels[c].GetNum()) + effName)
+                    break
+                }
+            }
+        }
+    }
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputString(outFile OutputWriter, str string, exactLength int) {
+    if len(str) >= exactLength {
+        outFile.WriteString("    dc.b \"" + str[:exactLength-1] + "\", 0\n")
+    } else {
+        outFile.WriteString("    dc.b \"" + str + "\"")
+        for i := 0; i < exactLength - len(str); i++ {
+            outFile.WriteString(", 0")
+        }
+        outFile.WriteString("\n")
+    }
+}
+
+
+/* Outputs the pattern data and addresses.
+ */
+func (cg *CodeGeneratorMot68k) OutputPatterns(outFile OutputWriter) int {
+    patSize := 0
+    
+    patterns := cg.itarget.GetCompilerItf().GetPatterns()
+    for n, pat := range patterns {
+        outFile.WriteString(fmt.Sprintf("xpmp_pattern%d:", n))
+        cmds := pat.GetCommands()
+        for j, cmd := range cmds {
+            if (j % 16) == 0 {
+                outFile.WriteString("\n    dc.b ")
+            }              
+            outFile.WriteString(fmt.Sprintf("$%02x", cmd & 0xFF))
+            if j < len(cmds)-1 && (j % 16) != 15 {
+                outFile.WriteString(",")
+            }
+        }
+        outFile.WriteString("\n")
+        patSize += len(cmds)
+    }
+
+    outFile.WriteString("\n")
+    cg.alignWord(outFile)
+    outFile.WriteString("    xdef xpmp_pattern_tbl\n")
+    outFile.WriteString("xpmp_pattern_tbl:\n")
+    for n := range patterns {
+        outFile.WriteString(fmt.Sprintf("    dc.w xpmp_pattern%d\n", n))
+        patSize += 2
+    }
+    outFile.WriteString("\n")
+    
+    return patSize
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputTable(outFile OutputWriter, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int {
+    var bytesWritten, dat int
+    
+    bytesWritten = 0
+    
+    hexPrefix := "$"
+    byteDecl := "    dc.b"
+    wordDecl := "    dc.w"
+
+    if effMap.Len() > 0 {
+        for _, key := range effMap.GetKeys() {
+            outFile.WriteString(fmt.Sprintf(tblName + "_%d:", key))
+            effectData := effMap.GetData(key)
+            for j, param := range effectData.MainPart {
+                dat = (param.(int) * scaling) & 0xFF
+                if canLoop && (dat == loopDelim) {
+                    dat++
+                }
+
+                if canLoop && j == len(effectData.MainPart)-1 && len(effectData.LoopedPart) == 0 {
+                    if j > 0 {
+                        outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, loopDelim))
+                    }
+                    outFile.WriteString(fmt.Sprintf("\n" + tblName + "_%d_loop:\n", key))
+                    outFile.WriteString(fmt.Sprintf("%s %s%02x, %s%02x", byteDecl, hexPrefix, dat, hexPrefix, loopDelim))
+                    bytesWritten += 3
+                } else if j == 0 {
+                    outFile.WriteString(fmt.Sprintf("\n%s %s%02x", byteDecl, hexPrefix, dat))
+                    bytesWritten += 1
+                } else {
+                    outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, dat))
+                    bytesWritten += 1
+                }
+            }
+            if canLoop && len(effectData.LoopedPart) > 0 {
+                if len(effectData.MainPart) > 0 {
+                    outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, loopDelim))
+                    bytesWritten += 1
+                }
+                outFile.WriteString(fmt.Sprintf("\n" + tblName + "_%d_loop:\n", key))
+                for j, param := range effectData.LoopedPart {
+                    dat = (param.(int) * scaling) & 0xFF
+                    if dat == loopDelim && canLoop {
+                        dat++
+                    }
+                    if j == 0 {
+                        outFile.WriteString(fmt.Sprintf("%s %s%02x", byteDecl, hexPrefix, dat))
+                    } else {
+                        outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, dat))
+                    }
+                    bytesWritten += 1
+                }
+                outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, loopDelim))
+                bytesWritten += 1
+            }
+            outFile.WriteString("\n")
+        }
+        cg.alignWord(outFile)
+        outFile.WriteString(tblName + "_tbl:\n")
+        for _, key := range effMap.GetKeys() {
+            outFile.WriteString(fmt.Sprintf("%s " + tblName + "_%d\n", wordDecl, key))
+            bytesWritten += 2
+        }
+        if canLoop {
+            outFile.WriteString(tblName + "_loop_tbl:\n")
+            for _, key := range effMap.GetKeys() {
+                outFile.WriteString(fmt.Sprintf("%s " + tblName + "_%d_loop\n", wordDecl, key))
+                bytesWritten += 2
+            }
+        }
+        outFile.WriteString("\n")
+    } else {
+        outFile.WriteString(tblName + "_tbl:\n")
+        if canLoop {
+            outFile.WriteString(tblName + "_loop_tbl:\n")
+        }
+        outFile.WriteString("\n")
+    }
+        
+    return bytesWritten
+}
+
+
+
+func (cg *CodeGeneratorMot68k) OutputBytes(outFile OutputWriter, values []int, comment string) int {
+    writeDataList(outFile, "    dc.b", "$%02x", values, ";", comment)
+    return len(values)
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputWords(outFile OutputWriter, values []int, comment string) int {
+    cg.alignWord(outFile)
+    writeDataList(outFile, "    dc.w", "$%04x", values, ";", comment)
+    return len(values) * 2
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputComment(outFile OutputWriter, comment string) {
+    outFile.WriteString("; " + comment + "\n")
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputIfdef(outFile OutputWriter, name string) {
+    outFile.WriteString("    ifd " + name + "\n\n")
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputElse(outFile OutputWriter) {
+    outFile.WriteString("    else\n\n")
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputEndif(outFile OutputWriter) {
+    outFile.WriteString("    endc\n")
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputIncbin(outFile OutputWriter, fileName string) {
+    outFile.WriteString("    incbin \"" + fileName + "\"\n\n")
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputLabel(outFile OutputWriter, name string, export bool) {
+    if export {
+        outFile.WriteString("    xdef " + name + "\n")
+    }
+    outFile.WriteString(name + ":\n")
+}
+
+
+/* The memory layout is left to the linker script.
+ */
+func (cg *CodeGeneratorMot68k) OutputMemoryMap(outFile OutputWriter, slotSize int, numSlots int, numBanks int) {
+}
+
+
+func (cg *CodeGeneratorMot68k) OutputSection(outFile OutputWriter, name string, bank int, slot int, address int) {
+    outFile.WriteString(fmt.Sprintf("    org $%x\n\n", address))
+}
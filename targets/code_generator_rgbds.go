@@ -0,0 +1,330 @@
+package targets
+
+import (
+    "fmt"
+    "../effects"
+    "../utils"
+)
+
+import . "../defs"
+
+
+/* Emits a SECTION directive the first time any data is written by this
+ * generator. RGBDS refuses data outside of a section.
+ */
+func (cg *CodeGeneratorRgbds) beginSection(outFile OutputWriter) {
+    if !cg.sectionStarted {
+        outFile.WriteString("SECTION \"" + cg.section + "\", ROMX\n\n")
+        cg.sectionStarted = true
+    }
+}
+
+
+func (cg *CodeGeneratorRgbds) OutputBytes(outFile OutputWriter, values []int, comment string) int {
+    cg.beginSection(outFile)
+    writeDataList(outFile, "db", "$%02x", values, ";", comment)
+    return len(values)
+}
+
+
+func (cg *CodeGeneratorRgbds) OutputWords(outFile OutputWriter, values []int, comment string) int {
+    cg.beginSection(outFile)
+    writeDataList(outFile, "dw", "$%04x", values, ";", comment)
+    return len(values) * 2
+}
+
+
+func (cg *CodeGeneratorRgbds) OutputCallbacks(outFile OutputWriter) int {
+    callbacksSize := 0
+
+    cg.beginSection(outFile)
+
+    outFile.WriteString("EXPORT xpmp_callback_tbl\n")
+    outFile.WriteString("xpmp_callback_tbl:\n")
+    for _, cb := range cg.itarget.GetCompilerItf().GetCallbacks() {
+        outFile.WriteString("dw " + cb + "\n")
+        callbacksSize += 2
+    }
+    outFile.WriteString("\n")
+
+    cg.itarget.GetCompilerItf().GetContext().INFO("Size of callback table: %d bytes", callbacksSize)
+
+    return callbacksSize
+}
+
+
+func (cg *CodeGeneratorRgbds) OutputComment(outFile OutputWriter, comment string) {
+    outFile.WriteString("; " + comment + "\n")
+}
+
+
+func (cg *CodeGeneratorRgbds) OutputDefine(outFile OutputWriter, name string) {
+    outFile.WriteString("DEF " + name + " EQU 1\n")
+}
+
+
+func (cg *CodeGeneratorRgbds) OutputEffectFlags(outFile OutputWriter) {
+    songs := cg.itarget.GetCompilerItf().GetSongs()
+    numChannels := len(songs[0].GetChannels())
+
+    for _, effName := range EFFECT_STRINGS {
+        for c := 0; c < numChannels; c++ {
+            for _, sng := range songs {
+                channels := sng.GetChannels()
+                if channels[c].IsUsingEffect(effName) {
+                    cg.OutputDefine(outFile, fmt.Sprintf("XPMP_CHN%d_USES_", channels[c].GetNum()) + effName)
+                    break
+                }
+            }
+        }
+    }
+}
+
+
+func (cg *CodeGeneratorRgbds) OutputIfdef(outFile OutputWriter, name string) {
+    outFile.WriteString("IF DEF(" + name + ")\n\n")
+}
+
+
+/* Only one of the branches will be assembled, so the else-branch needs a
+ * SECTION of its own.
+ */
+func (cg *CodeGeneratorRgbds) OutputElse(outFile OutputWriter) {
+    outFile.WriteString("ELSE\n\n")
+    cg.sectionStarted = false
+}
+
+
+func (cg *CodeGeneratorRgbds) OutputEndif(outFile OutputWriter) {
+    outFile.WriteString("ENDC\n")
+}
+
+
+func (cg *CodeGeneratorRgbds) OutputIncbin(outFile OutputWriter, fileName string) {
+    cg.beginSection(outFile)
+    outFile.WriteString("INCBIN \"" + fileName + "\"\n\n")
+}
+
+
+func (cg *CodeGeneratorRgbds) OutputLabel(outFile OutputWriter, name string, export bool) {
+    cg.beginSection(outFile)
+    if export {
+        outFile.WriteString("EXPORT " + name + "\n")
+    }
+    outFile.WriteString(name + ":\n")
+}
+
+
+/* The memory layout is decided by rgblink.
+ */
+func (cg *CodeGeneratorRgbds) OutputMemoryMap(outFile OutputWriter, slotSize int, numSlots int, numBanks int) {
+}
+
+
+/* Outputs a SECTION at a fixed address. Bank 0 maps to ROM0, anything else
+ * to ROMX in the given bank.
+ */
+func (cg *CodeGeneratorRgbds) OutputSection(outFile OutputWriter, name string, bank int, slot int, address int) {
+    if bank == 0 {
+        outFile.WriteString(fmt.Sprintf("SECTION \"%s\", ROM0[$%04x]\n\n", name, address))
+    } else {
+        outFile.WriteString(fmt.Sprintf("SECTION \"%s\", ROMX[$%04x], BANK[%d]\n\n", name, address, bank))
+    }
+    cg.sectionStarted = true
+}
+
+
+func (cg *CodeGeneratorRgbds) OutputString(outFile OutputWriter, str string, exactLength int) {
+    cg.beginSection(outFile)
+
+    if len(str) >= exactLength {
+        outFile.WriteString("db \"" + str[:exactLength-1] + "\", 0\n")
+    } else {
+        outFile.WriteString("db \"" + str + "\"")
+        for i := 0; i < exactLength - len(str); i++ {
+            outFile.WriteString(", 0")
+        }
+        outFile.WriteString("\n")
+    }
+}
+
+
+/* Outputs the pattern data and addresses.
+ */
+func (cg *CodeGeneratorRgbds) OutputPatterns(outFile OutputWriter) int {
+    patSize := 0
+
+    cg.beginSection(outFile)
+
+    patterns := cg.itarget.GetCompilerItf().GetPatterns()
+    for n, pat := range patterns {
+        outFile.WriteString(fmt.Sprintf("xpmp_pattern%d:", n))
+        cmds := pat.GetCommands()
+        for j, cmd := range cmds {
+            if (j % 16) == 0 {
+                outFile.WriteString("\ndb ")
+            }
+            outFile.WriteString(fmt.Sprintf("$%02x", cmd & 0xFF))
+            if j < len(cmds)-1 && (j % 16) != 15 {
+                outFile.WriteString(",")
+            }
+        }
+        outFile.WriteString("\n")
+        patSize += len(cmds)
+    }
+
+    outFile.WriteString("\nEXPORT xpmp_pattern_tbl\n")
+    outFile.WriteString("xpmp_pattern_tbl:\n")
+    for n := range patterns {
+        outFile.WriteString(fmt.Sprintf("dw xpmp_pattern%d\n", n))
+        patSize += 2
+    }
+    outFile.WriteString("\n")
+
+    return patSize
+}
+
+
+/* Outputs the channel data (the actual notes, volume commands, effect invokations, etc)
+ * for all channels and all songs.
+ */
+func (cg *CodeGeneratorRgbds) OutputChannelData(outFile OutputWriter) int {
+    songDataSize := 0
+
+    cg.beginSection(outFile)
+
+    songs := cg.itarget.GetCompilerItf().GetSongs()
+    for n, sng := range songs {
+        channels := sng.GetChannels()
+        if n > 0 {
+            cg.itarget.GetCompilerItf().GetContext().Printf("\n")
+        }
+        for _, chn := range channels {
+            if chn.IsVirtual() {
+                continue
+            }
+            outFile.WriteString(fmt.Sprintf("xpmp_s%d_channel_%s:", n, chn.GetName()))
+            commands := chn.GetCommands()
+            for j, cmd := range commands {
+                if (j % 16) == 0 {
+                    outFile.WriteString("\ndb ")
+                }
+                outFile.WriteString(fmt.Sprintf("$%02x", cmd & 0xFF))
+                songDataSize++
+                if j < len(commands)-1 && (j % 16) != 15 {
+                   outFile.WriteString(",")
+                }
+            }
+            outFile.WriteString("\n")
+            cg.itarget.GetCompilerItf().GetContext().Printf("Song %d, Channel %s: %d bytes, %d / %d ticks\n",
+                sng.GetNum(), chn.GetName(), len(commands), utils.Round2(float64(chn.GetTicks())), utils.Round2(float64(chn.GetLoopTicks())))
+        }
+    }
+
+    outFile.WriteString("\nEXPORT xpmp_song_tbl\n")
+    outFile.WriteString("xpmp_song_tbl:\n")
+    for n, sng := range songs {
+        channels := sng.GetChannels()
+        for _, chn := range channels {
+            if chn.IsVirtual() {
+                continue
+            }
+            outFile.WriteString(fmt.Sprintf("dw xpmp_s%d_channel_%s\n", n, chn.GetName()))
+            songDataSize += 2
+        }
+    }
+    outFile.WriteString("\n")
+
+    return songDataSize
+}
+
+
+/* Outputs an effect table. The loop point of each effect is a local label
+ * (.loop) under the effect's own label, i.e. tblName_<key>.loop.
+ */
+func (cg *CodeGeneratorRgbds) OutputTable(outFile OutputWriter, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int {
+    var bytesWritten, dat int
+
+    bytesWritten = 0
+
+    hexPrefix := "$"
+    byteDecl := "db"
+    wordDecl := "dw"
+
+    cg.beginSection(outFile)
+
+    if effMap.Len() > 0 {
+        for _, key := range effMap.GetKeys() {
+            outFile.WriteString(fmt.Sprintf(tblName + "_%d:", key))
+            effectData := effMap.GetData(key)
+            for j, param := range effectData.MainPart {
+                dat = (param.(int) * scaling) & 0xFF
+                if canLoop && (dat == loopDelim) {
+                    dat++
+                }
+
+                if canLoop && j == len(effectData.MainPart)-1 && len(effectData.LoopedPart) == 0 {
+                    if j > 0 {
+                        outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, loopDelim))
+                    }
+                    outFile.WriteString("\n.loop:\n")
+                    outFile.WriteString(fmt.Sprintf("%s %s%02x, %s%02x", byteDecl, hexPrefix, dat, hexPrefix, loopDelim))
+                    bytesWritten += 3
+                } else if j == 0 {
+                    outFile.WriteString(fmt.Sprintf("\n%s %s%02x", byteDecl, hexPrefix, dat))
+                    bytesWritten += 1
+                } else {
+                    outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, dat))
+                    bytesWritten += 1
+                }
+            }
+            if canLoop && len(effectData.LoopedPart) > 0 {
+                if len(effectData.MainPart) > 0 {
+                    outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, loopDelim))
+                    bytesWritten += 1
+                }
+                outFile.WriteString("\n.loop:\n")
+                for j, param := range effectData.LoopedPart {
+                    dat = (param.(int) * scaling) & 0xFF
+                    if dat == loopDelim && canLoop {
+                        dat++
+                    }
+                    if j == 0 {
+                        outFile.WriteString(fmt.Sprintf("%s %s%02x", byteDecl, hexPrefix, dat))
+                    } else {
+                        outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, dat))
+                    }
+                    bytesWritten += 1
+                }
+                outFile.WriteString(fmt.Sprintf(", %s%02x", hexPrefix, loopDelim))
+                bytesWritten += 1
+            }
+            outFile.WriteString("\n")
+        }
+        outFile.WriteString("EXPORT " + tblName + "_tbl\n")
+        outFile.WriteString(tblName + "_tbl:\n")
+        for _, key := range effMap.GetKeys() {
+            outFile.WriteString(fmt.Sprintf("%s " + tblName + "_%d\n", wordDecl, key))
+            bytesWritten += 2
+        }
+        if canLoop {
+            outFile.WriteString("EXPORT " + tblName + "_loop_tbl\n")
+            outFile.WriteString(tblName + "_loop_tbl:\n")
+            for _, key := range effMap.GetKeys() {
+                outFile.WriteString(fmt.Sprintf("%s " + tblName + "_%d.loop\n", wordDecl, key))
+                bytesWritten += 2
+            }
+        }
+        outFile.WriteString("\n")
+    } else {
+        outFile.WriteString("EXPORT " + tblName + "_tbl\n")
+        outFile.WriteString(tblName + "_tbl:\n")
+        if canLoop {
+            outFile.WriteString("EXPORT " + tblName + "_loop_tbl\n")
+            outFile.WriteString(tblName + "_loop_tbl:\n")
+        }
+        outFile.WriteString("\n")
+    }
+
+    return bytesWritten
+}
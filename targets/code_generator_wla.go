@@ -2,7 +2,6 @@ package targets
 
 import (
     "fmt"
-    "os"
     "../effects"
     "../utils"
 )
@@ -10,7 +9,7 @@ import (
 import . "../defs"
 
 
-func (cg *CodeGeneratorWla) OutputCallbacks(outFile *os.File) int {
+func (cg *CodeGeneratorWla) OutputCallbacks(outFile OutputWriter) int {
     callbacksSize := 0
 
     outFile.WriteString("xpmp_callback_tbl:\n")
@@ -20,13 +19,18 @@ func (cg *CodeGeneratorWla) OutputCallbacks(outFile *os.File) int {
     }
     outFile.WriteString("\n")
 
-    utils.INFO("Size of callback table: %d bytes", callbacksSize)  
+    cg.itarget.GetCompilerItf().GetContext().INFO("Size of callback table: %d bytes", callbacksSize)  
     
     return callbacksSize
 }
 
 
-func (cg *CodeGeneratorWla) OutputEffectFlags(outFile *os.File) {
+func (cg *CodeGeneratorWla) OutputDefine(outFile OutputWriter, name string) {
+    outFile.WriteString(".DEFINE " + name + "\n")
+}
+
+
+func (cg *CodeGeneratorWla) OutputEffectFlags(outFile OutputWriter) {
     songs := cg.itarget.GetCompilerItf().GetSongs()
     numChannels := len(songs[0].GetChannels())
     
@@ -44,9 +48,14 @@ func (cg *CodeGeneratorWla) OutputEffectFlags(outFile *os.File) {
 }
 
 
+func (cg *CodeGeneratorWla) OutputString(outFile OutputWriter, str string, exactLength int) {
+    outputStringWithExactLength(outFile, str, exactLength)
+}
+
+
 /* Outputs the pattern data and addresses.
  */
-func (cg *CodeGeneratorWla) OutputPatterns(outFile *os.File) int {
+func (cg *CodeGeneratorWla) OutputPatterns(outFile OutputWriter) int {
     patSize := 0
     
     patterns := cg.itarget.GetCompilerItf().GetPatterns()
@@ -80,14 +89,14 @@ func (cg *CodeGeneratorWla) OutputPatterns(outFile *os.File) int {
 /* Outputs the channel data (the actual notes, volume commands, effect invokations, etc)
  * for all channels and all songs.
  */
-func (cg *CodeGeneratorWla) OutputChannelData(outFile *os.File) int {
+func (cg *CodeGeneratorWla) OutputChannelData(outFile OutputWriter) int {
     songDataSize := 0
     
     songs := cg.itarget.GetCompilerItf().GetSongs()
     for n, sng := range songs {
         channels := sng.GetChannels()
         if n > 0 {
-            fmt.Printf("\n")
+            cg.itarget.GetCompilerItf().GetContext().Printf("\n")
         }
         for _, chn := range channels {  
             if chn.IsVirtual() {
@@ -106,7 +115,7 @@ func (cg *CodeGeneratorWla) OutputChannelData(outFile *os.File) int {
                 }
             }
             outFile.WriteString("\n")
-            fmt.Printf("Song %d, Channel %s: %d bytes, %d / %d ticks\n",
+            cg.itarget.GetCompilerItf().GetContext().Printf("Song %d, Channel %s: %d bytes, %d / %d ticks\n",
                 sng.GetNum(), chn.GetName(), len(commands), utils.Round2(float64(chn.GetTicks())), utils.Round2(float64(chn.GetLoopTicks())))
         }
     }
@@ -127,7 +136,7 @@ func (cg *CodeGeneratorWla) OutputChannelData(outFile *os.File) int {
 }
 
 
-func (cg *CodeGeneratorWla) OutputTable(outFile *os.File, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int {
+func (cg *CodeGeneratorWla) OutputTable(outFile OutputWriter, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int {
     var bytesWritten, dat int
     
     bytesWritten = 0
@@ -208,3 +217,73 @@ func (cg *CodeGeneratorWla) OutputTable(outFile *os.File, tblName string, effMap
     return bytesWritten
 }
 
+
+
+func (cg *CodeGeneratorWla) OutputBytes(outFile OutputWriter, values []int, comment string) int {
+    writeDataList(outFile, ".db", "$%02x", values, ";", comment)
+    return len(values)
+}
+
+
+func (cg *CodeGeneratorWla) OutputWords(outFile OutputWriter, values []int, comment string) int {
+    writeDataList(outFile, ".dw", "$%04x", values, ";", comment)
+    return len(values) * 2
+}
+
+
+func (cg *CodeGeneratorWla) OutputComment(outFile OutputWriter, comment string) {
+    outFile.WriteString("; " + comment + "\n")
+}
+
+
+func (cg *CodeGeneratorWla) OutputIfdef(outFile OutputWriter, name string) {
+    outFile.WriteString(".IFDEF " + name + "\n\n")
+}
+
+
+func (cg *CodeGeneratorWla) OutputElse(outFile OutputWriter) {
+    outFile.WriteString(".ELSE\n\n")
+}
+
+
+func (cg *CodeGeneratorWla) OutputEndif(outFile OutputWriter) {
+    outFile.WriteString(".ENDIF")
+}
+
+
+func (cg *CodeGeneratorWla) OutputIncbin(outFile OutputWriter, fileName string) {
+    outFile.WriteString(".INCBIN \"" + fileName + "\"\n\n")
+}
+
+
+/* WLA-DX doesn't need labels to be exported, so the export flag is ignored.
+ */
+func (cg *CodeGeneratorWla) OutputLabel(outFile OutputWriter, name string, export bool) {
+    outFile.WriteString(name + ":\n")
+}
+
+
+/* Outputs a .MEMORYMAP with numSlots slots of slotSize bytes each, and the
+ * matching ROM bank setup.
+ */
+func (cg *CodeGeneratorWla) OutputMemoryMap(outFile OutputWriter, slotSize int, numSlots int, numBanks int) {
+    outFile.WriteString(
+    ".MEMORYMAP\n" +
+    fmt.Sprintf("\tDEFAULTSLOT %d\n", numSlots - 1) +
+    fmt.Sprintf("\tSLOTSIZE $%x\n", slotSize))
+    for i := 0; i < numSlots; i++ {
+        outFile.WriteString(fmt.Sprintf("\tSLOT %d $%04x\n", i, i * slotSize))
+    }
+    outFile.WriteString(".ENDME\n\n")
+
+    outFile.WriteString(
+    fmt.Sprintf(".ROMBANKSIZE $%x\n", slotSize) +
+    fmt.Sprintf(".ROMBANKS %d\n", numBanks))
+}
+
+
+func (cg *CodeGeneratorWla) OutputSection(outFile OutputWriter, name string, bank int, slot int, address int) {
+    outFile.WriteString(
+    fmt.Sprintf(".BANK %d SLOT %d\n", bank, slot) +
+    fmt.Sprintf(".ORGA $%02x\n\n", address))
+}
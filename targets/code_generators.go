@@ -1,7 +1,7 @@
 package targets
 
 import (
-    "os"
+    "fmt"
     "../effects"
 )
 import . "../defs"
@@ -9,14 +9,29 @@ import . "../defs"
 const (
     SYNTAX_WLA_DX = 0
     SYNTAX_GAS_68K = 1
+    SYNTAX_CA65 = 2
+    SYNTAX_RGBDS = 3
+    SYNTAX_MOT_68K = 4
 )
 
 type ICodeGenerator interface {
-    OutputCallbacks(outFile *os.File) int
-    OutputChannelData(outFile *os.File) int
-    OutputEffectFlags(outFile *os.File)
-    OutputPatterns(outFile *os.File) int
-    OutputTable(outFile *os.File, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int
+    OutputBytes(outFile OutputWriter, values []int, comment string) int
+    OutputCallbacks(outFile OutputWriter) int
+    OutputChannelData(outFile OutputWriter) int
+    OutputComment(outFile OutputWriter, comment string)
+    OutputDefine(outFile OutputWriter, name string)
+    OutputEffectFlags(outFile OutputWriter)
+    OutputElse(outFile OutputWriter)
+    OutputEndif(outFile OutputWriter)
+    OutputIfdef(outFile OutputWriter, name string)
+    OutputIncbin(outFile OutputWriter, fileName string)
+    OutputLabel(outFile OutputWriter, name string, export bool)
+    OutputMemoryMap(outFile OutputWriter, slotSize int, numSlots int, numBanks int)
+    OutputPatterns(outFile OutputWriter) int
+    OutputSection(outFile OutputWriter, name string, bank int, slot int, address int)
+    OutputString(outFile OutputWriter, str string, exactLength int)
+    OutputTable(outFile OutputWriter, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int
+    OutputWords(outFile OutputWriter, values []int, comment string) int
 }
     
 type CodeGenerator struct {
@@ -31,6 +46,56 @@ type CodeGeneratorGas68k struct {
     CodeGenerator
 }
 
+type CodeGeneratorMot68k struct {
+    CodeGenerator
+}
+
+type CodeGeneratorCa65 struct {
+    CodeGenerator
+    segment string
+    segmentStarted bool
+}
+
+type CodeGeneratorRgbds struct {
+    CodeGenerator
+    section string
+    sectionStarted bool
+}
+
+/* A pointer in the binary output that has to be resolved (or relocated)
+ * once the final address of symbol is known.
+ */
+type binaryFixup struct {
+    offset int
+    symbol string
+    size int    // The size of the pointer in bytes
+}
+
+/* Lays out the data as a single binary blob instead of assembly. Not
+ * selectable with -syntax; it's used when the output format is
+ * OUTPUT_BINARY.
+ */
+type CodeGeneratorBinary struct {
+    CodeGenerator
+    data []byte
+    symbols map[string]int
+    symbolOrder []string
+    fixups []binaryFixup
+    bigEndian bool
+    callbackSize int    // The size of a pointer to a callback (the player's code addresses)
+}
+
+/* Emits C source instead of assembly. Not selectable with -syntax; it's
+ * used when the output format is OUTPUT_C.
+ */
+type CodeGeneratorC struct {
+    CodeGenerator
+    arrayOpen bool
+    arrayLen int
+    anonArrays int
+    externs []string
+}
+
 func NewCodeGenerator(cgID int, itarget ITarget) ICodeGenerator {
     var cg ICodeGenerator = ICodeGenerator(nil)
     
@@ -40,7 +105,92 @@ func NewCodeGenerator(cgID int, itarget ITarget) ICodeGenerator {
 
     case SYNTAX_GAS_68K:
         cg = &CodeGeneratorGas68k{CodeGenerator: CodeGenerator{itarget}}
+
+    case SYNTAX_CA65:
+        cg = &CodeGeneratorCa65{CodeGenerator: CodeGenerator{itarget}, segment: "RODATA"}
+
+    case SYNTAX_RGBDS:
+        cg = &CodeGeneratorRgbds{CodeGenerator: CodeGenerator{itarget}, section: "XPMP music data"}
+
+    case SYNTAX_MOT_68K:
+        cg = &CodeGeneratorMot68k{CodeGenerator: CodeGenerator{itarget}}
     }
       
     return cg
+}
+
+
+/* Maps syntax name strings to SYNTAX_* int constants (e.g.
+ * "ca65" -> SYNTAX_CA65). Returns -1 for unknown names.
+ */
+func SyntaxNameToID(syntaxName string) int {
+    switch syntaxName {
+    case "wla", "wla-dx":
+        return SYNTAX_WLA_DX
+
+    case "gas", "gas68k":
+        return SYNTAX_GAS_68K
+
+    case "ca65", "cc65":
+        return SYNTAX_CA65
+
+    case "rgbds", "rgbasm":
+        return SYNTAX_RGBDS
+
+    case "asm68k", "vasm", "motorola":
+        return SYNTAX_MOT_68K
+    }
+    return -1
+}
+
+
+/* Returns the -syntax name of a SYNTAX_* constant.
+ */
+func SyntaxIDToName(syntax int) string {
+    switch syntax {
+    case SYNTAX_WLA_DX:
+        return "wla"
+
+    case SYNTAX_GAS_68K:
+        return "gas"
+
+    case SYNTAX_CA65:
+        return "ca65"
+
+    case SYNTAX_RGBDS:
+        return "rgbds"
+
+    case SYNTAX_MOT_68K:
+        return "asm68k"
+    }
+    return "unknown"
+}
+
+
+/* Writes a list of values as data directives with at most 16 values per
+ * line, e.g. ".db $01,$02,$03". The comment (if any) is appended to the
+ * first line.
+ */
+func writeDataList(outFile OutputWriter, decl string, format string, values []int, commentPrefix string, comment string) {
+    for j, val := range values {
+        if (j % 16) == 0 {
+            if j > 0 {
+                outFile.WriteString("\n")
+            }
+            outFile.WriteString(decl + " ")
+        }
+        outFile.WriteString(fmt.Sprintf(format, val))
+        if j < len(values)-1 && (j % 16) != 15 {
+            outFile.WriteString(",")
+        }
+        if j == 0 && len(comment) > 0 && len(values) == 1 {
+            outFile.WriteString("\t\t" + commentPrefix + " " + comment)
+        }
+    }
+    if len(values) > 1 && len(comment) > 0 {
+        outFile.WriteString("\t\t" + commentPrefix + " " + comment)
+    }
+    if len(values) > 0 {
+        outFile.WriteString("\n")
+    }
 }
\ No newline at end of file
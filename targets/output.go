@@ -0,0 +1,80 @@
+/*
+ * Package targets
+ * Output files
+ *
+ * Part of XPMC.
+ * Contains the functions for creating the output files, which can
+ * either be written to disk or handed to a user-supplied io.Writer.
+ */
+
+package targets
+
+import (
+    "bufio"
+    "io"
+    "os"
+)
+
+/* The code generators write their output through this interface.
+ * *os.File, *bytes.Buffer and *bufio.Writer all satisfy it.
+ */
+type OutputWriter interface {
+    io.Writer
+    io.StringWriter
+}
+
+/* An output file created with Target.createOutputFile.
+ */
+type outputFile struct {
+    *bufio.Writer
+    closer io.Closer
+}
+
+
+/* Flushes the buffered output and closes the underlying writer if it can
+ * be closed.
+ */
+func (f *outputFile) Close() error {
+    err := f.Flush()
+    if f.closer != nil {
+        if closeErr := f.closer.Close(); err == nil {
+            err = closeErr
+        }
+    }
+    return err
+}
+
+
+/* Sets the function used for creating the output files. If no opener has
+ * been set the files are created on disk.
+ */
+func (t *Target) SetOutputOpener(opener func(fileName string) (io.Writer, error)) {
+    t.outputOpener = opener
+}
+
+
+/* Creates the output file with the given name, using the output opener
+ * if there is one.
+ */
+func (t *Target) createOutputFile(fileName string) (*outputFile, error) {
+    var w io.Writer
+    if t.outputOpener != nil {
+        opened, err := t.outputOpener(fileName)
+        if err != nil {
+            return nil, err
+        }
+        w = opened
+    } else {
+        file, err := os.Create(fileName)
+        if err != nil {
+            return nil, err
+        }
+        w = file
+    }
+
+    f := &outputFile{Writer: bufio.NewWriter(w)}
+    if closer, ok := w.(io.Closer); ok {
+        f.closer = closer
+    }
+    return f, nil
+}
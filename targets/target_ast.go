@@ -11,11 +11,9 @@
 package targets
 
 import (
-    "os"
     "time"
     "../specs"
     "../utils"
-    "../timing"
 )
 
 
@@ -23,7 +21,7 @@ func (t *TargetAST) Init() {
     t.Target.Init()
     t.Target.SetOutputSyntax(SYNTAX_GAS_68K)
     
-    utils.DefineSymbol("AST", 1) 
+    t.CompilerItf.GetContext().DefineSymbol("AST", 1) 
     
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 0, specs.SpecsAY_3_8910)   // A..C
     
@@ -32,15 +30,16 @@ func (t *TargetAST) Init() {
     t.MinVolume         = 0
     t.SupportsPal       = true
     t.MaxLoopDepth      = 2
+    t.Syntaxes          = []int{SYNTAX_GAS_68K, SYNTAX_MOT_68K}
     t.MachineSpeed      = 2000000
-    timing.UpdateFreq   = 50.0  // Use PAL as default
+    t.CompilerItf.GetTiming().UpdateFreq   = 50.0  // Use PAL as default
 }
 
 
 /* Output data suitable for the Atari ST
  */
 func (t *TargetAST) Output(outputFormat int) {
-    utils.DEBUG("TargetAST.Output")
+    t.CompilerItf.GetContext().DEBUG("TargetAST.Output")
 
     fileEnding := ".s"
     outputVgm := false
@@ -59,9 +58,9 @@ func (t *TargetAST) Output(outputFormat int) {
         return
     }
     
-    outFile, err := os.Create(t.CompilerItf.GetShortFileName() + fileEnding)
+    outFile, err := t.createOutputFile(t.CompilerItf.GetShortFileName() + fileEnding)
     if err != nil {
-        utils.ERROR("Unable to open file: " + t.CompilerItf.GetShortFileName() + fileEnding)
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s%s", t.CompilerItf.GetShortFileName(), fileEnding)
     }
 
     now := time.Now()
@@ -2,8 +2,9 @@ package targets
 
 import (
     "fmt"
-    "os"
+    "path/filepath"
     "time"
+    "../defs"
     "../specs"
     "../utils"
 )
@@ -16,7 +17,7 @@ func (t *TargetAt8) Init() {
     t.Target.Init()
     t.Target.SetOutputSyntax(SYNTAX_WLA_DX)
 
-    utils.DefineSymbol("AT8", 1)
+    t.CompilerItf.GetContext().DefineSymbol("AT8", 1)
     
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 0, specs.SpecsPokey)      // A..D
       
@@ -25,6 +26,7 @@ func (t *TargetAt8) Init() {
     t.MinVolume         = 0
     t.SupportsPanning   = 1
     t.MaxLoopDepth      = 2
+    t.Syntaxes          = []int{SYNTAX_WLA_DX, SYNTAX_CA65}
     t.SupportsPal       = true
     //timing.UpdateFreq     = 50.0  // Use PAL by default
 }
@@ -34,16 +36,23 @@ func (t *TargetAt8) Init() {
 /* Output data suitable for the Atari 8-bit (400/800/XE/XL) playback library (WLA-DX).
  */
 func (t *TargetAt8) Output(outputFormat int) {
-    utils.DEBUG("TargetAt8.Output")
+    t.CompilerItf.GetContext().DEBUG("TargetAt8.Output")
 
-    outFile, err := os.Create(t.CompilerItf.GetShortFileName() + ".asm")
+    if outputFormat == OUTPUT_C || outputFormat == OUTPUT_BINARY {
+        t.outputStandalone(outputFormat, nil)
+        return
+    }
+
+    outFile, err := t.createOutputFile(t.CompilerItf.GetShortFileName() + ".asm")
     if err != nil {
-        utils.ERROR("Unable to open file: " + t.CompilerItf.GetShortFileName() + ".asm")
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s.asm", t.CompilerItf.GetShortFileName())
     }
 
-    saphdr, err := os.Create("sapheader.txt")
+    // The SAP header goes in the same directory as the output file
+    sapName := filepath.Join(filepath.Dir(t.CompilerItf.GetShortFileName()), "sapheader.txt")
+    saphdr, err := t.createOutputFile(sapName)
     if err != nil {
-        utils.ERROR("Unable to create file: sapheader.txt");    
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to create file: %s", sapName);    
     }
 
     now := time.Now()
@@ -60,24 +69,24 @@ func (t *TargetAt8) Output(outputFormat int) {
         "PLAYER 2011\n")
     saphdr.Close()
 
-    outputStringWithExactLength(outFile, t.CompilerItf.GetSongs()[0].GetTitle(), 32)
-    outputStringWithExactLength(outFile, t.CompilerItf.GetSongs()[0].GetComposer(), 32)
+    t.outputCodeGenerator.OutputString(outFile, t.CompilerItf.GetSongs()[0].GetTitle(), 32)
+    t.outputCodeGenerator.OutputString(outFile, t.CompilerItf.GetSongs()[0].GetComposer(), 32)
     
-    outFile.WriteString(".DEFINE XPMP_AT8\n")
+    t.outputCodeGenerator.OutputDefine(outFile, "XPMP_AT8")
     
     t.outputEffectFlags(outFile)
      
     tableSize := t.outputStandardEffects(outFile)
     outFile.WriteString("\n")
-    utils.INFO("Size of effect tables: %d bytes", tableSize)
+    t.CompilerItf.GetContext().INFO("Size of effect tables: %d bytes", tableSize)
 
     cbSize := t.outputCallbacks(outFile)
 
     patSize := t.outputPatterns(outFile)
-    utils.INFO("Size of pattern table: %d bytes", patSize)
+    t.CompilerItf.GetContext().INFO("Size of pattern table: %d bytes", patSize)
         
     songSize := t.outputChannelData(outFile)  
-    utils.INFO("Total size of song(s): %d bytes", songSize + tableSize + cbSize + patSize)
+    t.reportSizes(defs.TableSizes{Effects: tableSize, Callbacks: cbSize, Patterns: patSize, Songs: songSize})
 
     outFile.Close()
 }
@@ -12,15 +12,13 @@ package targets
 
 import (
     "../specs"
-    "../utils"
-    "../timing"
 )
 
 
 func (t *TargetC64) Init() {
     t.Target.Init()
 
-    utils.DefineSymbol("C64", 1)
+    t.CompilerItf.GetContext().DefineSymbol("C64", 1)
     
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 0, specs.SpecsSID)    // A..C
     
@@ -29,7 +27,7 @@ func (t *TargetC64) Init() {
     t.MinVolume         = 0
     t.MaxLoopDepth      = 2
     t.SupportsPal       = true
-    timing.UpdateFreq   = 50.0
+    t.CompilerItf.GetTiming().UpdateFreq   = 50.0
 }
 
 
@@ -11,17 +11,15 @@
 package targets
 
 import (
+    "flag"
     "fmt"
-    "os"
     "strconv"
     "time"
     "../defs"
     "../specs"
     "../utils"
-    "../effects"
 )
 
-import . "../utils"
 
 /* Gameboy Color (and DMG) 
  */
@@ -29,8 +27,8 @@ func (t *TargetGBC) Init() {
     t.Target.Init()
     t.Target.SetOutputSyntax(SYNTAX_WLA_DX)
     
-    utils.DefineSymbol("DMG", 1)
-    utils.DefineSymbol("GBC", 1)
+    t.CompilerItf.GetContext().DefineSymbol("DMG", 1)
+    t.CompilerItf.GetContext().DefineSymbol("GBC", 1)
     
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 0, specs.SpecsGBAPU)      // A..D
 
@@ -39,6 +37,7 @@ func (t *TargetGBC) Init() {
     t.MinVolume         = 0
     t.SupportsPanning   = 1
     t.MaxLoopDepth      = 2
+    t.Syntaxes          = []int{SYNTAX_WLA_DX, SYNTAX_RGBDS}
     t.MinWavLength      = 32
     t.MaxWavLength      = 32
     t.MinWavSample      = 0
@@ -50,137 +49,160 @@ func (t *TargetGBC) Init() {
 
     
 func (t *TargetGBC) Output(outputFormat int) {
-    utils.DEBUG("TargetGBC.Output")
+    t.CompilerItf.GetContext().DEBUG("TargetGBC.Output")
+    effs := t.CompilerItf.GetEffects()
 
-    outFile, err := os.Create(t.CompilerItf.GetShortFileName() + ".asm")
+    if outputFormat == OUTPUT_C || outputFormat == OUTPUT_BINARY {
+        t.outputStandalone(outputFormat, func(cg ICodeGenerator, outFile OutputWriter) int {
+            tableSize := cg.OutputTable(outFile, "xpmp_WT_mac", effs.WaveformMacros, true, 1, 0x80)
+            return tableSize + t.outputWaveforms(cg, outFile)
+        })
+        return
+    }
+
+    outFile, err := t.createOutputFile(t.CompilerItf.GetShortFileName() + ".asm")
     if err != nil {
-        utils.ERROR("Unable to open file: " + t.CompilerItf.GetShortFileName() + ".asm")
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s.asm", t.CompilerItf.GetShortFileName())
     }
 
+    cg := t.outputCodeGenerator
+    songs := t.CompilerItf.GetSongs()
+
     now := time.Now()
-    outFile.WriteString("; Written by XPMC on " + now.Format(time.RFC1123) + "\n\n")
+    cg.OutputComment(outFile, "Written by XPMC on " + now.Format(time.RFC1123))
+    outFile.WriteString("\n")
     
     // Output the GBS header
-    outFile.WriteString(
-    ".IFDEF XPMP_MAKE_GBS\n\n" +
-    ".MEMORYMAP\n" +
-    "\tDEFAULTSLOT 1\n" +
-    "\tSLOTSIZE $4000\n" +
-    "\tSLOT 0 $0000\n" +
-    "\tSLOT 1 $4000\n" +
-    ".ENDME\n\n")
-    
-    outFile.WriteString(
-    ".ROMBANKSIZE $4000\n" +
-    ".ROMBANKS 2\n" +
-    ".BANK 0 SLOT 0\n" +
-    ".ORGA $00\n\n")
+    cg.OutputIfdef(outFile, "XPMP_MAKE_GBS")
+    cg.OutputMemoryMap(outFile, 0x4000, 2, 2)
+    cg.OutputSection(outFile, "GBS header", 0, 0, 0x00)
     
-    outFile.WriteString(
-    ".db \"GBS\"\n" +
-    ".db 1\t\t; Version\n" +
-    fmt.Sprintf(".db %d\t\t; Number of songs\n", len(t.CompilerItf.GetSongs())) +
-    ".db 1\t\t; Start song\n" +
-    ".dw $0400\t; Load address\n" +
-    ".dw $0400\t; Init address\n" +
-    ".dw $0408\t; Play address\n" +
-    ".dw $fffe\t; Stack pointer\n" +
-    ".db 0\n" +
-    ".db 0\n")
+    cg.OutputBytes(outFile, []int{'G', 'B', 'S'}, "")
+    cg.OutputBytes(outFile, []int{1}, "Version")
+    cg.OutputBytes(outFile, []int{len(songs)}, "Number of songs")
+    cg.OutputBytes(outFile, []int{1}, "Start song")
+    cg.OutputWords(outFile, []int{0x0400}, "Load address")
+    cg.OutputWords(outFile, []int{0x0400}, "Init address")
+    cg.OutputWords(outFile, []int{0x0408}, "Play address")
+    cg.OutputWords(outFile, []int{0xfffe}, "Stack pointer")
+    cg.OutputBytes(outFile, []int{0}, "")
+    cg.OutputBytes(outFile, []int{0}, "")
     
-    outputStringWithExactLength(outFile, t.CompilerItf.GetSongs()[0].GetTitle(), 32)
-    outputStringWithExactLength(outFile, t.CompilerItf.GetSongs()[0].GetComposer(), 32)
-    outputStringWithExactLength(outFile, t.CompilerItf.GetSongs()[0].GetProgrammer(), 32)   
+    cg.OutputString(outFile, songs[0].GetTitle(), 32)
+    cg.OutputString(outFile, songs[0].GetComposer(), 32)
+    cg.OutputString(outFile, songs[0].GetProgrammer(), 32)   
 
-    outFile.WriteString(".INCBIN \"gbs.bin\"\n\n")
-    outFile.WriteString(".ELSE\n\n") 
+    cg.OutputIncbin(outFile, "gbs.bin")
+    cg.OutputElse(outFile) 
 
     t.outputEffectFlags(outFile)
     
     if t.GetExtraInt("NoiseCtrl", 0) == 1 { //t.CompilerItf.GetGbNoiseType() == 1 {
-        outFile.WriteString(".DEFINE XPMP_ALT_GB_NOISE\n")
+        cg.OutputDefine(outFile, "XPMP_ALT_GB_NOISE")
     }
     if t.GetExtraInt("VolCtrl", 0) == 1 { //t.CompilerItf.GetGbVolCtrlType() == 1 {
-        outFile.WriteString(".DEFINE XPMP_ALT_GB_VOLCTRL\n")
+        cg.OutputDefine(outFile, "XPMP_ALT_GB_VOLCTRL")
     }
     
     tableSize := t.outputStandardEffects(outFile)
     
     // ToDo: output waveform macros (WTM)
     /*tableSize += output_wla_table("xpmp_WT_mac", waveformMacros, 1, 1, #80)*/
-    tableSize += t.outputCodeGenerator.OutputTable(outFile, "xpmp_WT_mac", effects.WaveformMacros,   true,  1, 0x80)
-    
-    wavSize := 0
-    outFile.WriteString("xpmp_waveform_data:")
-    for _, key := range effects.Waveforms.GetKeys() {
-        params := effects.Waveforms.GetData(key).MainPart
-        for j := 0; j < len(params); j += 2 {
-            if j == 0 {
-                outFile.WriteString("\n.db ")
-            }             
-            // Pack two 4-bit samples into one byte
-            outFile.WriteString(fmt.Sprintf("$%02x", params[j].(int) * 0x10 + params[j+1].(int)))
-            wavSize++
-            if j < len(params) - 1 {
-                outFile.WriteString(",")
-            }
-        }
-    }
-    outFile.WriteString("\n\n")
+    tableSize += cg.OutputTable(outFile, "xpmp_WT_mac", effs.WaveformMacros,   true,  1, 0x80)
     
-    cbSize := 0
-    outFile.WriteString("xpmp_callback_tbl:\n")
-    for _, cb := range t.CompilerItf.GetCallbacks() {
-        outFile.WriteString(".dw " + cb + "\n")
-        cbSize += 2
-    }
+    wavSize := t.outputWaveforms(cg, outFile)
     outFile.WriteString("\n")
+    
+    cbSize := t.outputCallbacks(outFile)
 
-    utils.INFO("Size of effect tables: %d bytes", tableSize)
-    utils.INFO("Size of waveform table: %d bytes", wavSize)
+    t.CompilerItf.GetContext().INFO("Size of effect tables: %d bytes", tableSize)
+    t.CompilerItf.GetContext().INFO("Size of waveform table: %d bytes", wavSize)
 
     patSize := t.outputPatterns(outFile)
-    utils.INFO("Size of pattern table: %d bytes\n", patSize)
+    t.CompilerItf.GetContext().INFO("Size of pattern table: %d bytes\n", patSize)
   
     songSize := t.outputChannelData(outFile)
-    utils.INFO("Total size of song(s): %d bytes\n", songSize + tableSize + wavSize + cbSize + patSize )
+    t.reportSizes(defs.TableSizes{Effects: tableSize, Waveforms: wavSize, Callbacks: cbSize, Patterns: patSize, Songs: songSize})
     
-    outFile.WriteString(".ENDIF")
+    cg.OutputEndif(outFile)
     outFile.Close()
 }
 
 
+/* Outputs the waveforms with two 4-bit samples packed into each byte.
+ */
+func (t *TargetGBC) outputWaveforms(cg ICodeGenerator, outFile OutputWriter) int {
+    effs := t.CompilerItf.GetEffects()
+    wavSize := 0
+    cg.OutputLabel(outFile, "xpmp_waveform_data", true)
+    for _, key := range effs.Waveforms.GetKeys() {
+        params := effs.Waveforms.GetData(key).MainPart
+        packed := []int{}
+        for j := 0; j < len(params); j += 2 {
+            // Pack two 4-bit samples into one byte
+            packed = append(packed, params[j].(int) * 0x10 + params[j+1].(int))
+        }
+        wavSize += cg.OutputBytes(outFile, packed, "")
+    }
+    return wavSize
+}
+
+
+/* Adds the -gb-volume-control and -gb-noise options, which work like
+ * the corresponding meta commands.
+ */
+func (t *TargetGBC) RegisterOptions(flags *flag.FlagSet) {
+    flags.Var(&intOption{set: func(val int) error { return setGbVolCtrl(t, val) }},
+              "gb-volume-control", "Same as #GB-VOLUME-CONTROL `n` (0 or 1)")
+    flags.Var(&intOption{set: func(val int) error { return setGbNoiseCtrl(t, val) }},
+              "gb-noise", "Same as #GB-NOISE `n` (0 or 1)")
+}
+
+
+func setGbVolCtrl(itarget defs.ITarget, val int) error {
+    if val != 0 && val != 1 {
+        return fmt.Errorf("Expected 0 or 1, got: %d", val)
+    }
+    itarget.PutExtraInt("VolCtrl", val)
+    return nil
+}
+
+func setGbNoiseCtrl(itarget defs.ITarget, val int) error {
+    if val == 1 {
+        itarget.PutExtraInt("NoiseCtrl", 1)
+        itarget.GetCompilerItf().GetCurrentSong().GetChannels()[3].SetMaxOctave(5)
+    } else if val == 0 {
+        itarget.PutExtraInt("NoiseCtrl", 0)
+        itarget.GetCompilerItf().GetCurrentSong().GetChannels()[3].SetMaxOctave(11)
+    } else {
+        return fmt.Errorf("Expected 0 or 1, got: %d", val)
+    }
+    return nil
+}
+
+
 func handleGbVolCtrl(cmd string, itarget defs.ITarget) {
-    s := Parser.GetString()
+    ctx := itarget.GetCompilerItf().GetContext()
+    s := ctx.Parser.GetString()
     ctl, err := strconv.Atoi(s)
     if err == nil {
-        if ctl == 1 {
-            itarget.PutExtraInt("VolCtrl", 1)
-        } else if ctl == 0 {
-            itarget.PutExtraInt("VolCtrl", 0)
-        } else {
-            WARNING(cmd + ": Expected 0 or 1, got: " + s)
+        if setGbVolCtrl(itarget, ctl) != nil {
+            ctx.WARNINGC(utils.DIAG_SYNTAX, "%s: Expected 0 or 1, got: %s", cmd, s)
         }
     } else {
-        ERROR(cmd + ": Expected 0 or 1, got: " + s)
+        ctx.ERRORC(utils.DIAG_SYNTAX, "%s: Expected 0 or 1, got: %s", cmd, s)
     }
 }
 
 func handleGbNoiseCtrl(cmd string, itarget defs.ITarget) {
-    s := Parser.GetString()
+    ctx := itarget.GetCompilerItf().GetContext()
+    s := ctx.Parser.GetString()
     val, err := strconv.Atoi(s)
     if err == nil {
-        if val == 1 {
-            itarget.PutExtraInt("NoiseCtrl", 1)
-            itarget.GetCompilerItf().GetCurrentSong().GetChannels()[3].SetMaxOctave(5)
-        } else if val == 0 {
-            itarget.PutExtraInt("NoiseCtrl", 0)
-            itarget.GetCompilerItf().GetCurrentSong().GetChannels()[3].SetMaxOctave(11)
-        } else {
-            WARNING(cmd + ": Expected 0 or 1, defaulting to 0: " + s)
+        if setGbNoiseCtrl(itarget, val) != nil {
+            ctx.WARNINGC(utils.DIAG_SYNTAX, "%s: Expected 0 or 1, defaulting to 0: %s", cmd, s)
         }
     } else {
-        ERROR(cmd + ": Expected 0 or 1, got: " + s)
+        ctx.ERRORC(utils.DIAG_SYNTAX, "%s: Expected 0 or 1, got: %s", cmd, s)
     }
 }
-
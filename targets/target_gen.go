@@ -11,12 +11,10 @@
 package targets
 
 import (
-    "os"
     "time"
+    "../defs"
     "../specs"
     "../utils"
-    "../effects"
-    "../timing"
 )
 
 
@@ -27,17 +25,19 @@ func (t *TargetGen) Init() {
     t.Target.Init()
     t.Target.SetOutputSyntax(SYNTAX_GAS_68K)
 
-    utils.DefineSymbol("GEN", 1)
-    utils.DefineSymbol("SMD", 1)
+    t.CompilerItf.GetContext().DefineSymbol("GEN", 1)
+    t.CompilerItf.GetContext().DefineSymbol("SMD", 1)
     
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 0, specs.SpecsSN76489)    // A..D
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 4, specs.SpecsYM2612)     // E..J
 
     t.ID                = TARGET_SMD
+    t.BigEndian         = true
     t.MaxTempo          = 300
     t.MinVolume         = 0
     t.SupportsPanning   = 1
     t.MaxLoopDepth      = 2
+    t.Syntaxes          = []int{SYNTAX_GAS_68K, SYNTAX_MOT_68K}
     t.SupportsPal       = true
     t.AdsrLen           = 5
     t.AdsrMax           = 63
@@ -52,7 +52,8 @@ func (t *TargetGen) Init() {
 /* Output data suitable for the SEGA Genesis (Megadrive) playback library
  */
 func (t *TargetGen) Output(outputFormat int) {
-    utils.DEBUG("TargetGen.Output")
+    t.CompilerItf.GetContext().DEBUG("TargetGen.Output")
+    effs := t.CompilerItf.GetEffects()
 
     fileEnding := ".asm"
     outputVgm := false
@@ -69,29 +70,41 @@ func (t *TargetGen) Output(outputFormat int) {
         return
     }
   
-    outFile, err := os.Create(t.CompilerItf.GetShortFileName() + fileEnding)
-    if err != nil {
-        utils.ERROR("Unable to open file: " + t.CompilerItf.GetShortFileName() + fileEnding)
-    }
-
-    now := time.Now()
-    outFile.WriteString("; Written by XPMC on " + now.Format(time.RFC1123) + "\n\n")
-    
     // Convert ADSR envelopes to the format used by the YM2612
-    envelopes := make([][]interface{}, len(effects.ADSRs.GetKeys()))
-    for i, key := range effects.ADSRs.GetKeys() {
-        envelopes[i] = packADSR(effects.ADSRs.GetData(key).MainPart, specs.CHIP_YM2612)
-        effects.ADSRs.GetData(key).MainPart = make([]interface{}, len(envelopes[i]))
-        copy(effects.ADSRs.GetData(key).MainPart, envelopes[i])
+    envelopes := make([][]interface{}, len(effs.ADSRs.GetKeys()))
+    for i, key := range effs.ADSRs.GetKeys() {
+        envelopes[i] = packADSR(effs.ADSRs.GetData(key).MainPart, specs.CHIP_YM2612)
+        effs.ADSRs.GetData(key).MainPart = make([]interface{}, len(envelopes[i]))
+        copy(effs.ADSRs.GetData(key).MainPart, envelopes[i])
     }
 
     // Convert modulation parameters to the format used by the YM2612
-    mods := make([][]interface{}, len(effects.MODs.GetKeys()))
-    for i, key := range effects.MODs.GetKeys() {
-        mods[i] = packMOD(effects.MODs.GetData(key).MainPart, specs.CHIP_YM2612)
-        effects.MODs.GetData(key).MainPart = make([]interface{}, len(mods[i]))
-        copy(effects.MODs.GetData(key).MainPart, mods[i])
+    mods := make([][]interface{}, len(effs.MODs.GetKeys()))
+    for i, key := range effs.MODs.GetKeys() {
+        mods[i] = packMOD(effs.MODs.GetData(key).MainPart, specs.CHIP_YM2612)
+        effs.MODs.GetData(key).MainPart = make([]interface{}, len(mods[i]))
+        copy(effs.MODs.GetData(key).MainPart, mods[i])
     } 
+
+    if outputFormat == OUTPUT_C || outputFormat == OUTPUT_BINARY {
+        t.outputStandalone(outputFormat, func(cg ICodeGenerator, outFile OutputWriter) int {
+            tableSize := cg.OutputTable(outFile, "xpmp_FB_mac", effs.FeedbackMacros, true,  1, 0x80)
+            tableSize += cg.OutputTable(outFile, "xpmp_ADSR",   effs.ADSRs,          false, 1, 0)
+            tableSize += cg.OutputTable(outFile, "xpmp_MOD",    effs.MODs,           false, 1, 0)
+            return tableSize
+        })
+        return
+    }
+
+    outFile, err := t.createOutputFile(t.CompilerItf.GetShortFileName() + fileEnding)
+    if err != nil {
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s%s", t.CompilerItf.GetShortFileName(), fileEnding)
+    }
+
+    now := time.Now()
+    t.outputCodeGenerator.OutputComment(outFile, "Written by XPMC on " + now.Format(time.RFC1123))
+    outFile.WriteString("\n")
+    
    
     
     /* ToDo: translate
@@ -107,33 +120,33 @@ func (t *TargetGen) Output(outputFormat int) {
         end if
     end for*/
              
-    if timing.UpdateFreq == 50 {
-        outFile.WriteString(".equ XPMP_50_HZ, 1\n")
+    if t.CompilerItf.GetTiming().UpdateFreq == 50 {
+        t.outputCodeGenerator.OutputDefine(outFile, "XPMP_50_HZ")
         t.MachineSpeed = 3546893
     } else {
         t.MachineSpeed = 3579545
     }
 
     tableSize := t.outputStandardEffects(outFile)
-    tableSize += t.outputTable(outFile, "xpmp_FB_mac", effects.FeedbackMacros, true,  1, 0x80)
-    tableSize += t.outputTable(outFile, "xpmp_ADSR",   effects.ADSRs,          false, 1, 0)  
-    tableSize += t.outputTable(outFile, "xpmp_MOD",    effects.MODs,           false, 1, 0)  
+    tableSize += t.outputTable(outFile, "xpmp_FB_mac", effs.FeedbackMacros, true,  1, 0x80)
+    tableSize += t.outputTable(outFile, "xpmp_ADSR",   effs.ADSRs,          false, 1, 0)  
+    tableSize += t.outputTable(outFile, "xpmp_MOD",    effs.MODs,           false, 1, 0)  
     
     /*tableSize += output_m68kas_table("xpmp_VS_mac", volumeSlides, 1, 1, 0)     
     tableSize += output_m68kas_table("xpmp_FB_mac", feedbackMacros,1, 1, 0)
     tableSize += output_m68kas_table("xpmp_ADSR",   adsrs,        0, 1, 0)
     tableSize += output_m68kas_table("xpmp_MOD",    mods,         0, 1, 0)*/
 
-    cbSize := 0
+    cbSize := t.outputCallbacks(outFile)
         
-    utils.INFO("Size of effect tables: %d bytes\n", tableSize)
+    t.CompilerItf.GetContext().INFO("Size of effect tables: %d bytes\n", tableSize)
 
     patSize := t.outputPatterns(outFile)
-    utils.INFO("Size of patterns table: %d bytes\n", patSize)
+    t.CompilerItf.GetContext().INFO("Size of patterns table: %d bytes\n", patSize)
     
     songSize := t.outputChannelData(outFile) 
 
-    utils.INFO("Total size of song(s): %d bytes\n", songSize + patSize + tableSize + cbSize)
+    t.reportSizes(defs.TableSizes{Effects: tableSize, Callbacks: cbSize, Patterns: patSize, Songs: songSize})
 
     outFile.Close()
 }
@@ -12,11 +12,10 @@ package targets
 
 import (
     "fmt"
-    "os"
     "time"
+    "../defs"
     "../specs"
     "../utils"
-    "../effects"
 )
 
 
@@ -27,7 +26,7 @@ func (t *TargetKSS) Init() {
     t.Target.Init()
     t.Target.SetOutputSyntax(SYNTAX_WLA_DX)
 
-    utils.DefineSymbol("KSS", 1)
+    t.CompilerItf.GetContext().DefineSymbol("KSS", 1)
     
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 0, specs.SpecsSN76489)    // A..D
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 4, specs.SpecsAY_3_8910)  // E..G
@@ -41,6 +40,7 @@ func (t *TargetKSS) Init() {
     t.MinVolume         = 0
     t.SupportsPanning   = 1
     t.MaxLoopDepth      = 2
+    t.Syntaxes          = []int{SYNTAX_WLA_DX}     // The KSS header is written as WLA-DX directives
     t.AdsrLen           = 5
     t.AdsrMax           = 63
     t.MinWavLength      = 32
@@ -51,15 +51,9 @@ func (t *TargetKSS) Init() {
 
 
 func (t *TargetKSS) Output(outputFormat int) {
-    utils.DEBUG("TargetKSS.Output")
+    t.CompilerItf.GetContext().DEBUG("TargetKSS.Output")
+    effs := t.CompilerItf.GetEffects()
 
-    outFile, err := os.Create(t.CompilerItf.GetShortFileName() + ".asm")
-    if err != nil {
-        utils.ERROR("Unable to open file: " + t.CompilerItf.GetShortFileName() + ".asm")
-    }
-
-    now := time.Now()
-    outFile.WriteString("; Written by XPMC on " + now.Format(time.RFC1123) + "\n\n")
   
     usesPSG := 0
     usesSCC := 0
@@ -83,19 +77,38 @@ func (t *TargetKSS) Output(outputFormat int) {
         }
     }
     
-    envelopes := make([][]interface{}, len(effects.ADSRs.GetKeys()))
-    for i, key := range effects.ADSRs.GetKeys() {
-        envelopes[i] = packADSR(effects.ADSRs.GetData(key).MainPart, specs.CHIP_YM2151)
-        effects.ADSRs.GetData(key).MainPart = make([]interface{}, len(envelopes[i]))
-        copy(effects.ADSRs.GetData(key).MainPart, envelopes[i])      
+    envelopes := make([][]interface{}, len(effs.ADSRs.GetKeys()))
+    for i, key := range effs.ADSRs.GetKeys() {
+        envelopes[i] = packADSR(effs.ADSRs.GetData(key).MainPart, specs.CHIP_YM2151)
+        effs.ADSRs.GetData(key).MainPart = make([]interface{}, len(envelopes[i]))
+        copy(effs.ADSRs.GetData(key).MainPart, envelopes[i])      
     }
     
-    mods := make([][]interface{}, len(effects.MODs.GetKeys()))
-    for i, key := range effects.MODs.GetKeys() {
-        mods[i] = packMOD(effects.MODs.GetData(key).MainPart, specs.CHIP_YM2151)
-        effects.MODs.GetData(key).MainPart = make([]interface{}, len(mods[i]))
-        copy(effects.MODs.GetData(key).MainPart, mods[i])        
+    mods := make([][]interface{}, len(effs.MODs.GetKeys()))
+    for i, key := range effs.MODs.GetKeys() {
+        mods[i] = packMOD(effs.MODs.GetData(key).MainPart, specs.CHIP_YM2151)
+        effs.MODs.GetData(key).MainPart = make([]interface{}, len(mods[i]))
+        copy(effs.MODs.GetData(key).MainPart, mods[i])        
+    }
+
+    if outputFormat == OUTPUT_C || outputFormat == OUTPUT_BINARY {
+        t.outputStandalone(outputFormat, func(cg ICodeGenerator, outFile OutputWriter) int {
+            tableSize := cg.OutputTable(outFile, "xpmp_FB_mac", effs.FeedbackMacros, true,  1, 0x80)
+            tableSize += cg.OutputTable(outFile, "xpmp_WT_mac", effs.WaveformMacros, true,  1, 0x80)
+            tableSize += cg.OutputTable(outFile, "xpmp_ADSR",   effs.ADSRs,          false, 1, 0)
+            tableSize += cg.OutputTable(outFile, "xpmp_MOD",    effs.MODs,           false, 1, 0)
+            return tableSize
+        })
+        return
     }
+
+    outFile, err := t.createOutputFile(t.CompilerItf.GetShortFileName() + ".asm")
+    if err != nil {
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s.asm", t.CompilerItf.GetShortFileName())
+    }
+
+    now := time.Now()
+    outFile.WriteString("; Written by XPMC on " + now.Format(time.RFC1123) + "\n\n")
     
     outFile.WriteString( 
         ".IFDEF XPMP_MAKE_KSS\n" +
@@ -138,16 +151,16 @@ func (t *TargetKSS) Output(outputFormat int) {
     }
     
     tableSize := t.outputStandardEffects(outFile)
-    tableSize += t.outputTable(outFile, "xpmp_FB_mac", effects.FeedbackMacros, true,  1, 0x80)
-    tableSize += t.outputTable(outFile, "xpmp_WT_mac", effects.WaveformMacros, true,  1, 0x80)
-    tableSize += t.outputTable(outFile, "xpmp_ADSR",   effects.ADSRs,          false, 1, 0)    
-    tableSize += t.outputTable(outFile, "xpmp_MOD",    effects.MODs,           false, 1, 0)    
+    tableSize += t.outputTable(outFile, "xpmp_FB_mac", effs.FeedbackMacros, true,  1, 0x80)
+    tableSize += t.outputTable(outFile, "xpmp_WT_mac", effs.WaveformMacros, true,  1, 0x80)
+    tableSize += t.outputTable(outFile, "xpmp_ADSR",   effs.ADSRs,          false, 1, 0)    
+    tableSize += t.outputTable(outFile, "xpmp_MOD",    effs.MODs,           false, 1, 0)    
     
     patSize := t.outputPatterns(outFile)
-    utils.INFO("Size of patterns table: %d bytes\n", patSize)
+    t.CompilerItf.GetContext().INFO("Size of patterns table: %d bytes\n", patSize)
 
     songSize := t.outputChannelData(outFile)
-    utils.INFO("Total size of song(s): %d bytes\n", songSize + tableSize + patSize) // + cbSize + wavSize)
+    t.reportSizes(defs.TableSizes{Effects: tableSize, Patterns: patSize, Songs: songSize})
     
     outFile.Close()
 }
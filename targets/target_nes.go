@@ -11,18 +11,16 @@
 package targets
 
 import (
-    "os"
     "time"
     "../specs"
     "../utils"
-    "../timing"
 )
 
 
 func (t *TargetNES) Init() {
     t.Target.Init()
 
-    utils.DefineSymbol("NES", 1) 
+    t.CompilerItf.GetContext().DefineSymbol("NES", 1) 
     
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 0, specs.Specs2A03)   // A..E
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 5, specs.SpecsVRC6)   // F..H
@@ -37,18 +35,18 @@ func (t *TargetNES) Init() {
     t.MaxWavLength      = 32
     t.MinWavSample      = 0
     t.MaxWavSample      = 15
-    timing.UpdateFreq   = 60.0  // Use NTSC as default
+    t.CompilerItf.GetTiming().UpdateFreq   = 60.0  // Use NTSC as default
 }
 
 
 /* Output data suitable for the NES/Famicom (WLA-DX)
  */
 func (t *TargetNES) Output(outputFormat int) {
-    utils.DEBUG("TargetNES.Output")
+    t.CompilerItf.GetContext().DEBUG("TargetNES.Output")
     
-    outFile, err := os.Create(t.CompilerItf.GetShortFileName() + ".asm")
+    outFile, err := t.createOutputFile(t.CompilerItf.GetShortFileName() + ".asm")
     if err != nil {
-        utils.ERROR("Unable to open file: " + t.CompilerItf.GetShortFileName() + ".asm")
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s.asm", t.CompilerItf.GetShortFileName())
     }
 
     now := time.Now()
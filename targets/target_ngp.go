@@ -2,7 +2,6 @@ package targets
 
 import (
     "../specs"
-    "../utils"
 )
 
 
@@ -12,7 +11,7 @@ import (
 func (t *TargetNGP) Init() {
     t.Target.Init()
 
-    utils.DefineSymbol("NGP", 1)
+    t.CompilerItf.GetContext().DefineSymbol("NGP", 1)
     
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 0, specs.SpecsT6W28)      // A..D
     
@@ -2,11 +2,10 @@ package targets
 
 import (
     "fmt"
-    "os"
     "time"
+    "../defs"
     "../specs"
     "../utils"
-    "../effects"
 )
 
 
@@ -14,8 +13,8 @@ func (t *TargetPCE) Init() {
     t.Target.Init()
     t.Target.SetOutputSyntax(SYNTAX_WLA_DX)
     
-    utils.DefineSymbol("PCE", 1)
-    utils.DefineSymbol("TGX", 1)
+    t.CompilerItf.GetContext().DefineSymbol("PCE", 1)
+    t.CompilerItf.GetContext().DefineSymbol("TGX", 1)
     
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 0, specs.SpecsHuC6280)      // A..F
     
@@ -25,6 +24,7 @@ func (t *TargetPCE) Init() {
     t.SupportsPanning   = 1
     t.SupportsPal       = true
     t.MaxLoopDepth      = 2
+    t.Syntaxes          = []int{SYNTAX_WLA_DX}     // The XPCM banks are written as WLA-DX directives
     t.MinWavLength      = 32
     t.MaxWavLength      = 32
     t.MinWavSample      = 0
@@ -34,7 +34,8 @@ func (t *TargetPCE) Init() {
 /* Output data suitable for the PC-Engine / TurboGrafx-16 (WLA-DX)
  */
 func (t *TargetPCE) Output(outputFormat int) {
-    utils.DEBUG("TargetPCE.Output")
+    t.CompilerItf.GetContext().DEBUG("TargetPCE.Output")
+    effs := t.CompilerItf.GetEffects()
     
     fileEnding := ".asm"
     outputVgm := false
@@ -51,9 +52,18 @@ func (t *TargetPCE) Output(outputFormat int) {
         return
     }
     
-    outFile, err := os.Create(t.CompilerItf.GetShortFileName() + fileEnding)
+    if outputFormat == OUTPUT_C || outputFormat == OUTPUT_BINARY {
+        t.outputStandalone(outputFormat, func(cg ICodeGenerator, outFile OutputWriter) int {
+            tableSize := cg.OutputTable(outFile, "xpmp_WT_mac", effs.WaveformMacros, true, 1, 0x80)
+            tableSize += cg.OutputTable(outFile, "xpmp_MOD",    effs.MODs, false, 1, 0)
+            return tableSize + t.outputWaveforms(cg, outFile)
+        })
+        return
+    }
+
+    outFile, err := t.createOutputFile(t.CompilerItf.GetShortFileName() + fileEnding)
     if err != nil {
-        utils.ERROR("Unable to open file: " + t.CompilerItf.GetShortFileName() + fileEnding)
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s%s", t.CompilerItf.GetShortFileName(), fileEnding)
     }
 
     now := time.Now()
@@ -62,28 +72,14 @@ func (t *TargetPCE) Output(outputFormat int) {
     t.outputEffectFlags(outFile)
     tableSize := t.outputStandardEffects(outFile)  
     outFile.WriteString("\n")
-    utils.INFO("Size of effect tables: %d bytes", tableSize)
+    t.CompilerItf.GetContext().INFO("Size of effect tables: %d bytes", tableSize)
     
-    tableSize += t.outputTable(outFile, "xpmp_WT_mac", effects.WaveformMacros, true, 1, 0x80)
-    tableSize += t.outputTable(outFile, "xpmp_MOD",   effects.MODs, false, 1, 0)
+    tableSize += t.outputTable(outFile, "xpmp_WT_mac", effs.WaveformMacros, true, 1, 0x80)
+    tableSize += t.outputTable(outFile, "xpmp_MOD",   effs.MODs, false, 1, 0)
 
-    wavSize := 0
-    outFile.WriteString("xpmp_waveform_data:")
-    for _, key := range effects.Waveforms.GetKeys() {
-        params := effects.Waveforms.GetData(key).MainPart
-        for j := 0; j < len(params); j += 1 {
-            if j == 0 {
-                outFile.WriteString("\n.db ")
-            }             
-            outFile.WriteString(fmt.Sprintf("$%02x", params[j].(int)))
-            wavSize++
-            if j < len(params) - 1 {
-                outFile.WriteString(",")
-            }
-        }
-    }
-    outFile.WriteString("\n\n")
-    utils.INFO("Size of waveform table: %d bytes", wavSize)
+    wavSize := t.outputWaveforms(t.outputCodeGenerator, outFile)
+    outFile.WriteString("\n")
+    t.CompilerItf.GetContext().INFO("Size of waveform table: %d bytes", wavSize)
     
     cbSize := t.outputCallbacks(outFile)
 
@@ -96,7 +92,7 @@ func (t *TargetPCE) Output(outputFormat int) {
     outFile.WriteString("\n")
         
     patSize := t.outputPatterns(outFile)
-    utils.INFO("Size of pattern table: %d bytes", patSize)
+    t.CompilerItf.GetContext().INFO("Size of pattern table: %d bytes", patSize)
     
     songSize := t.outputChannelData(outFile) 
 
@@ -107,7 +103,7 @@ func (t *TargetPCE) Output(outputFormat int) {
     for i := 1; i <= 12; i++ {
         outFile.WriteString(fmt.Sprintf("xpmp_pcm%d:", i - 1))
         pcmNum := -1
-        for j, key := range effects.PCMs.GetKeys() {
+        for j, key := range effs.PCMs.GetKeys() {
             if key == i - 1 {
                 pcmNum = j
                 break
@@ -115,7 +111,7 @@ func (t *TargetPCE) Output(outputFormat int) {
         }
        
         if pcmNum >= 0 {
-            params := effects.PCMs.GetDataAt(pcmNum).LoopedPart[0].([]int)
+            params := effs.PCMs.GetDataAt(pcmNum).LoopedPart[0].([]int)
             params = append(params, 0x80 * 8)
             column := 1
             for j, smp := range params {
@@ -138,10 +134,28 @@ func (t *TargetPCE) Output(outputFormat int) {
         outFile.WriteString("\n")
     }
     outFile.WriteString("\n\n")
-    utils.INFO("Size of XPCM data: %d bytes", pcmSize)
+    t.CompilerItf.GetContext().INFO("Size of XPCM data: %d bytes", pcmSize)
 
-    utils.INFO("Total size of song(s): %d bytes\n", songSize + patSize + tableSize + cbSize + wavSize + pcmSize)
+    t.reportSizes(defs.TableSizes{Effects: tableSize, Waveforms: wavSize, Samples: pcmSize,
+                                  Callbacks: cbSize, Patterns: patSize, Songs: songSize})
    
     outFile.Close()
 }
 
+
+/* Outputs the waveforms, one sample per byte.
+ */
+func (t *TargetPCE) outputWaveforms(cg ICodeGenerator, outFile OutputWriter) int {
+    effs := t.CompilerItf.GetEffects()
+    wavSize := 0
+    cg.OutputLabel(outFile, "xpmp_waveform_data", true)
+    for _, key := range effs.Waveforms.GetKeys() {
+        params := effs.Waveforms.GetData(key).MainPart
+        samples := []int{}
+        for _, param := range params {
+            samples = append(samples, param.(int))
+        }
+        wavSize += cg.OutputBytes(outFile, samples, "")
+    }
+    return wavSize
+}
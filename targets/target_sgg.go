@@ -12,8 +12,8 @@ package targets
 
 import (
     "fmt"
-    "os"
     "time"
+    "../defs"
     "../specs"
     "../utils"
 )
@@ -26,7 +26,7 @@ func (t *TargetSGG) Init() {
     t.Target.Init()
     t.Target.SetOutputSyntax(SYNTAX_WLA_DX)
 
-    utils.DefineSymbol("SGG", 1)
+    t.CompilerItf.GetContext().DefineSymbol("SGG", 1)
     
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 0, specs.SpecsSN76489)    // A..D
     
@@ -35,12 +35,13 @@ func (t *TargetSGG) Init() {
     t.MinVolume         = 0
     t.SupportsPanning   = 1
     t.MaxLoopDepth      = 2
+    t.Syntaxes          = []int{SYNTAX_WLA_DX}     // The SGC header is written as WLA-DX directives
     t.MachineSpeed      = 3579545
 }
 
 
 func (t *TargetSGG) Output(outputFormat int) {
-    utils.DEBUG("TargetSGG.Output")
+    t.CompilerItf.GetContext().DEBUG("TargetSGG.Output")
 
     fileEnding := ".asm"
     outputVgm := false
@@ -57,9 +58,14 @@ func (t *TargetSGG) Output(outputFormat int) {
         return
     }
   
-    outFile, err := os.Create(t.CompilerItf.GetShortFileName() + fileEnding)
+    if outputFormat == OUTPUT_C || outputFormat == OUTPUT_BINARY {
+        t.outputStandalone(outputFormat, nil)
+        return
+    }
+
+    outFile, err := t.createOutputFile(t.CompilerItf.GetShortFileName() + fileEnding)
     if err != nil {
-        utils.ERROR("Unable to open file: " + t.CompilerItf.GetShortFileName() + fileEnding)
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s%s", t.CompilerItf.GetShortFileName(), fileEnding)
     }
 
     now := time.Now()
@@ -126,13 +132,13 @@ func (t *TargetSGG) Output(outputFormat int) {
          
     tableSize := t.outputStandardEffects(outFile)  
     outFile.WriteString("\n")
-    utils.INFO("Size of effect tables: %d bytes", tableSize)
+    t.CompilerItf.GetContext().INFO("Size of effect tables: %d bytes", tableSize)
 
     patSize := t.outputPatterns(outFile)
-    utils.INFO("Size of patterns table: %d bytes\n", patSize)
+    t.CompilerItf.GetContext().INFO("Size of patterns table: %d bytes\n", patSize)
  
     songSize := t.outputChannelData(outFile) 
-    utils.INFO("Total size of song(s): %d bytes", songSize + tableSize)
+    t.reportSizes(defs.TableSizes{Effects: tableSize, Patterns: patSize, Songs: songSize})
 
     outFile.Close()    
 }
@@ -12,12 +12,10 @@ package targets
 
 import (
     "fmt"
-    "os"
     "time"
+    "../defs"
     "../specs"
     "../utils"
-    "../effects"
-    "../timing"
 )
 
 
@@ -25,7 +23,7 @@ func (t *TargetSMS) Init() {
     t.Target.Init()
     t.Target.SetOutputSyntax(SYNTAX_WLA_DX)
 
-    utils.DefineSymbol("SMS", 1)       
+    t.CompilerItf.GetContext().DefineSymbol("SMS", 1)       
     
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 0, specs.SpecsSN76489)    // A..D
     specs.SetChannelSpecs(&t.ChannelSpecs, 0, 4, specs.SpecsYM2413)     // E..M
@@ -36,6 +34,7 @@ func (t *TargetSMS) Init() {
     t.MaxTempo          = 300
     t.MinVolume         = 0
     t.MaxLoopDepth      = 2
+    t.Syntaxes          = []int{SYNTAX_WLA_DX}     // The SGC header is written as WLA-DX directives
     t.MachineSpeed      = 3579545
     t.AdsrLen           = 4
     t.AdsrMax           = 15
@@ -44,7 +43,8 @@ func (t *TargetSMS) Init() {
 
 
 func (t *TargetSMS) Output(outputFormat int) {
-    utils.DEBUG("TargetSMS.Output")
+    t.CompilerItf.GetContext().DEBUG("TargetSMS.Output")
+    effs := t.CompilerItf.GetEffects()
 
     fileEnding := ".asm"
     outputVgm := false
@@ -61,23 +61,30 @@ func (t *TargetSMS) Output(outputFormat int) {
         return
     }
 
-    envelopes := make([][]interface{}, len(effects.ADSRs.GetKeys()))
-    for i, key := range effects.ADSRs.GetKeys() {
-        envelopes[i] = packADSR(effects.ADSRs.GetData(key).MainPart, specs.CHIP_YM2413)
-        effects.ADSRs.GetData(key).MainPart = make([]interface{}, len(envelopes[i]))
-        copy(effects.ADSRs.GetData(key).MainPart, envelopes[i])        
+    envelopes := make([][]interface{}, len(effs.ADSRs.GetKeys()))
+    for i, key := range effs.ADSRs.GetKeys() {
+        envelopes[i] = packADSR(effs.ADSRs.GetData(key).MainPart, specs.CHIP_YM2413)
+        effs.ADSRs.GetData(key).MainPart = make([]interface{}, len(envelopes[i]))
+        copy(effs.ADSRs.GetData(key).MainPart, envelopes[i])        
     }
     
-    outFile, err := os.Create(t.CompilerItf.GetShortFileName() + fileEnding)
+    if outputFormat == OUTPUT_C || outputFormat == OUTPUT_BINARY {
+        t.outputStandalone(outputFormat, func(cg ICodeGenerator, outFile OutputWriter) int {
+            return cg.OutputTable(outFile, "xpmp_ADSR", effs.ADSRs, false, 1, 0)
+        })
+        return
+    }
+
+    outFile, err := t.createOutputFile(t.CompilerItf.GetShortFileName() + fileEnding)
     if err != nil {
-        utils.ERROR("Unable to open file: " + t.CompilerItf.GetShortFileName() + fileEnding)
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s%s", t.CompilerItf.GetShortFileName(), fileEnding)
     }
 
     now := time.Now()
     outFile.WriteString("; Written by XPMC on " + now.Format(time.RFC1123) + "\n\n")
 
     palNtscString := ".db 0"
-    if timing.UpdateFreq == 50 {
+    if t.CompilerItf.GetTiming().UpdateFreq == 50 {
         outFile.WriteString(".DEFINE XPMP_50_HZ\n")
         t.MachineSpeed = 3546893
         palNtscString = ".db 1"
@@ -157,7 +164,7 @@ func (t *TargetSMS) Output(outputFormat int) {
         
     tableSize := t.outputStandardEffects(outFile)
     if usesFM {
-        tableSize += t.outputTable(outFile, "xpmp_ADSR",   effects.ADSRs, false, 1, 0)  
+        tableSize += t.outputTable(outFile, "xpmp_ADSR",   effs.ADSRs, false, 1, 0)  
     }    
     /*outFile.WriteString("xpmp_ADSR_tbl:\n")
     if usesFM {
@@ -167,15 +174,15 @@ func (t *TargetSMS) Output(outputFormat int) {
         }
     }*/
     outFile.WriteString("\n")
-    utils.INFO("Size of effect tables: %d bytes", tableSize)
+    t.CompilerItf.GetContext().INFO("Size of effect tables: %d bytes", tableSize)
 
     cbSize := t.outputCallbacks(outFile)
         
     patSize := t.outputPatterns(outFile)
-    utils.INFO("Size of patterns table: %d bytes\n", patSize)
+    t.CompilerItf.GetContext().INFO("Size of patterns table: %d bytes\n", patSize)
         
     songSize := t.outputChannelData(outFile)  
-    utils.INFO("Total size of song(s): %d bytes", songSize + tableSize + cbSize + patSize)
+    t.reportSizes(defs.TableSizes{Effects: tableSize, Callbacks: cbSize, Patterns: patSize, Songs: songSize})
 
     outFile.Close()
 }
@@ -10,10 +10,15 @@
 package targets
 
 import (
+    "flag"
     "fmt"
-    "os"
+    "io"
+    "strconv"
+    "strings"
+    "time"
     "../specs"
     "../effects"
+    "../utils"
 )
 
 import . "../defs"
@@ -55,6 +60,7 @@ const (
     OUTPUT_VGM = 3
     OUTPUT_VGZ = 4
     OUTPUT_YM = 5
+    OUTPUT_BINARY = 6
 )
 
 
@@ -63,6 +69,7 @@ type Target struct {
     MinVolume int
     SupportsPanning int
     MaxLoopDepth int
+    MaxPatternDepth int
     SupportsPal bool
     MinWavLength int
     MaxWavLength int
@@ -74,8 +81,12 @@ type Target struct {
     CompilerItf ICompiler
     MachineSpeed int
     ID int
+    BigEndian bool
+    Syntaxes []int          // The assembler syntaxes (SYNTAX_*) that the output can be written in
     outputCodeGenerator ICodeGenerator
+    outputOpener func(fileName string) (io.Writer, error)
     extraData map[string]interface{}
+    tableSizes TableSizes
 }
 
 type TargetAST struct {
@@ -166,58 +177,151 @@ func NewTarget(tID int, icomp ICompiler) ITarget {
 }
 
 
+/* Describes one of the targets. The first name is the one that's shown
+ * in lists, the others are aliases.
+ */
+type TargetInfo struct {
+    Names []string
+    ID int
+    Description string
+    Implemented bool    // False for targets that can't write any output yet
+}
+
+var targetInfos = []TargetInfo{
+    {[]string{"ast"}, TARGET_AST, "Atari ST", true},
+    {[]string{"at8"}, TARGET_AT8, "Atari 8-bit", true},
+    {[]string{"c64"}, TARGET_C64, "Commodore 64", false},
+    {[]string{"gbc"}, TARGET_GBC, "Gameboy / Gameboy Color", true},
+    {[]string{"gen", "smd"}, TARGET_SMD, "SEGA Genesis / Megadrive", true},
+    {[]string{"kss"}, TARGET_KSS, "KSS", true},
+    {[]string{"nes"}, TARGET_NES, "Nintendo Entertainment System", false},
+    {[]string{"pce"}, TARGET_PCE, "PC-Engine", true},
+    {[]string{"sgg"}, TARGET_SGG, "SEGA Game Gear", true},
+    {[]string{"sms"}, TARGET_SMS, "SEGA Master System", true},
+}
+
+
+/* Returns information about all the implemented targets, sorted by name.
+ */
+func ListTargets() []TargetInfo {
+    infos := []TargetInfo{}
+    for _, info := range targetInfos {
+        if info.Implemented {
+            infos = append(infos, info)
+        }
+    }
+    return infos
+}
+
+
+/* Returns information about all the targets, including the ones that
+ * aren't implemented.
+ */
+func ListAllTargets() []TargetInfo {
+    infos := make([]TargetInfo, len(targetInfos))
+    copy(infos, targetInfos)
+    return infos
+}
+
+
+/* Returns an error if the target with the given TARGET_* ID is known, but
+ * can't write any output yet.
+ */
+func CheckImplemented(targetID int) error {
+    for _, info := range targetInfos {
+        if info.ID == targetID && !info.Implemented {
+            return fmt.Errorf("The %s target is not implemented", info.Names[0])
+        }
+    }
+    return nil
+}
+
+
 /* Maps target name strings to TARGET_* int constants (e.g.
  * "sms" -> TARGET_SMS).
  */
 func NameToID(targetName string) int {
-    switch targetName {
-    case "ast":
-        return TARGET_AST;
+    for _, info := range targetInfos {
+        for _, name := range info.Names {
+            if name == targetName {
+                return info.ID
+            }
+        }
+    }
+    return TARGET_UNKNOWN;
+}
 
-    case "at8":
-        return TARGET_AT8;
-    
-    case "c64":
-        return TARGET_C64;
-    
-    case "gbc":
-        return TARGET_GBC;
-    
-    case "kss":
-        return TARGET_KSS;
 
-    case "nes":
-        return TARGET_NES;
-    
-    case "pce":
-        return TARGET_PCE;
-    
-    case "sgg":
-        return TARGET_SGG;
-    
-    case "smd", "gen":
-        return TARGET_SMD;
-    
-    case "sms":
-        return TARGET_SMS;
+/* Maps TARGET_* int constants to target names (e.g. TARGET_SMS -> "sms").
+ * Returns an empty string for unknown targets.
+ */
+func IDToName(targetID int) string {
+    for _, info := range targetInfos {
+        if info.ID == targetID {
+            return info.Names[0]
+        }
     }
-    return TARGET_UNKNOWN;
+    return ""
+}
+
+
+/* Maps output format names to OUTPUT_* int constants (e.g.
+ * "bin" -> OUTPUT_BINARY). Returns -1 for unknown names.
+ */
+func FormatNameToID(formatName string) int {
+    switch formatName {
+    case "asm", "assembly":
+        return OUTPUT_ASSEMBLY
+
+    case "c":
+        return OUTPUT_C
+
+    case "bin", "binary":
+        return OUTPUT_BINARY
+    }
+    return -1
 }
 
         
 func (t *Target) Init() {
     // Stub to fulfill the ITarget interface
     t.extraData = map[string]interface{}{}
+    t.MaxPatternDepth = 1     // The players only support one level of CMD_JSR
 }
 
-func (t *Target) SetOutputSyntax(outputSyntax int) {
+/* Selects the assembler syntax of the output. Parts of some targets' output
+ * are only written in their default syntax, so an error is returned for
+ * syntaxes that aren't in t.Syntaxes.
+ */
+func (t *Target) SetOutputSyntax(outputSyntax int) error {
+    if t.Syntaxes != nil && utils.PositionOfInt(t.Syntaxes, outputSyntax) < 0 {
+        names := []string{}
+        for _, syntax := range t.Syntaxes {
+            names = append(names, SyntaxIDToName(syntax))
+        }
+        return fmt.Errorf("The %s target doesn't support %s syntax (use %s)", IDToName(t.ID), SyntaxIDToName(outputSyntax), strings.Join(names, " or "))
+    }
     t.outputCodeGenerator = NewCodeGenerator(outputSyntax, t)
+    return nil
 }
    
 func (t *Target) Output(outputFormat int) {
     // Stub to fulfill the ITarget interface
 }
 
+/* Remembers the sizes of the tables that were written, and prints the
+ * total size.
+ */
+func (t *Target) reportSizes(sizes TableSizes) {
+    sizes.Total = sizes.Effects + sizes.Waveforms + sizes.Samples + sizes.Callbacks + sizes.Patterns + sizes.Songs
+    t.tableSizes = sizes
+    t.CompilerItf.GetContext().INFO("Total size of song(s): %d bytes", sizes.Total)
+}
+
+func (t *Target) GetTableSizes() TableSizes {
+    return t.tableSizes
+}
+
 func (t *Target) GetCompilerItf() ICompiler {
     return t.CompilerItf
 }
@@ -238,6 +342,39 @@ func (t *Target) PutExtraInt(name string, val int) {
 }
 
 
+/* Adds the command-line options that are specific to this target to
+ * flags. Most targets don't have any.
+ */
+func (t *Target) RegisterOptions(flags *flag.FlagSet) {
+    // Stub to fulfill the ITarget interface
+}
+
+
+/* An integer-valued target option. Setting the option calls set with the
+ * parsed value.
+ */
+type intOption struct {
+    value string
+    set func(val int) error
+}
+
+func (o *intOption) String() string {
+    return o.value
+}
+
+func (o *intOption) Set(s string) error {
+    val, err := strconv.Atoi(s)
+    if err != nil {
+        return err
+    }
+    if err = o.set(val); err != nil {
+        return err
+    }
+    o.value = s
+    return nil
+}
+
+
 /* Returns the ID (one of the TARGET_* constants) of this
  * target.
  */
@@ -304,6 +441,13 @@ func (t *Target) GetMaxLoopDepth() int {
     return t.MaxLoopDepth
 }
 
+/* Returns the maximum pattern depth (the number of pattern calls that
+ * the playback library can return from) for this target.
+ */
+func (t *Target) GetMaxPatternDepth() int {
+    return t.MaxPatternDepth
+}
+
 func (t *Target) GetMinOctave() int {
     minOct := t.ChannelSpecs.MinOct[0]
     for i, o := range t.ChannelSpecs.MinOct {
@@ -443,7 +587,7 @@ func packMOD(modParams []interface{}, chipType int) []interface{} {
 
 /* Outputs the pattern data and addresses.
  */
-func (t *Target) outputPatterns(outFile *os.File) int {
+func (t *Target) outputPatterns(outFile OutputWriter) int {
     return t.outputCodeGenerator.OutputPatterns(outFile)
 }
 
@@ -451,7 +595,7 @@ func (t *Target) outputPatterns(outFile *os.File) int {
 /* Outputs the channel data (the actual notes, volume commands, effect invokations, etc)
  * for all channels and all songs.
  */
-func (t *Target) outputChannelData(outFile *os.File) int {
+func (t *Target) outputChannelData(outFile OutputWriter) int {
     return t.outputCodeGenerator.OutputChannelData(outFile)
 }
 
@@ -460,7 +604,7 @@ func (t *Target) outputChannelData(outFile *os.File) int {
  * The string will be padded if it's too short, and truncated if it's too
  * long.
  */
-func outputStringWithExactLength(outFile *os.File, str string, exactLength int) {
+func outputStringWithExactLength(outFile OutputWriter, str string, exactLength int) {
     if len(str) >= exactLength {
         outFile.WriteString(".db \"" + str[:exactLength-1] + "\", 0\n")
     } else {
@@ -475,29 +619,151 @@ func outputStringWithExactLength(outFile *os.File, str string, exactLength int)
 
 /* Outputs the tables for the standard effects (the ones that are common for most/all targets).
  */
-func (t *Target) outputStandardEffects(outFile *os.File) int {
-    tableSize := t.outputCodeGenerator.OutputTable(outFile, "xpmp_dt_mac", effects.DutyMacros,   true,  1, 0x80)
-    tableSize += t.outputCodeGenerator.OutputTable(outFile, "xpmp_v_mac",  effects.VolumeMacros, true,  1, 0x80)
-    tableSize += t.outputCodeGenerator.OutputTable(outFile, "xpmp_EP_mac", effects.PitchMacros,  true,  1, 0x80)
-    tableSize += t.outputCodeGenerator.OutputTable(outFile, "xpmp_EN_mac", effects.Arpeggios,    true,  1, 0x80)
-    tableSize += t.outputCodeGenerator.OutputTable(outFile, "xpmp_MP_mac", effects.Vibratos,     false, 1, 0x80)
-    tableSize += t.outputCodeGenerator.OutputTable(outFile, "xpmp_CS_mac", effects.PanMacros,    true,  1, 0x80)
+func (t *Target) outputStandardEffects(outFile OutputWriter) int {
+    return t.outputStandardEffectsWith(t.outputCodeGenerator, outFile)
+}
+
+func (t *Target) outputStandardEffectsWith(cg ICodeGenerator, outFile OutputWriter) int {
+    effs := t.CompilerItf.GetEffects()
+    tableSize := cg.OutputTable(outFile, "xpmp_dt_mac", effs.DutyMacros,   true,  1, 0x80)
+    tableSize += cg.OutputTable(outFile, "xpmp_v_mac",  effs.VolumeMacros, true,  1, 0x80)
+    tableSize += cg.OutputTable(outFile, "xpmp_EP_mac", effs.PitchMacros,  true,  1, 0x80)
+    tableSize += cg.OutputTable(outFile, "xpmp_EN_mac", effs.Arpeggios,    true,  1, 0x80)
+    tableSize += cg.OutputTable(outFile, "xpmp_MP_mac", effs.Vibratos,     false, 1, 0x80)
+    tableSize += cg.OutputTable(outFile, "xpmp_CS_mac", effs.PanMacros,    true,  1, 0x80)
     return tableSize
 }
 
 
-func (t *Target) outputCallbacks(outFile *os.File) int {
+func (t *Target) outputCallbacks(outFile OutputWriter) int {
     return t.outputCodeGenerator.OutputCallbacks(outFile)
 }
 
 
-func (t *Target) outputEffectFlags(outFile *os.File) {
+func (t *Target) outputEffectFlags(outFile OutputWriter) {
     t.outputCodeGenerator.OutputEffectFlags(outFile)
 }
 
 
-func (t *Target) outputTable(outFile *os.File, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int {
+func (t *Target) outputTable(outFile OutputWriter, tblName string, effMap *effects.EffectMap, canLoop bool, scaling int, loopDelim int) int {
     return t.outputCodeGenerator.OutputTable(outFile, tblName, effMap, canLoop, scaling, loopDelim)
 }
 
 
+/* Handles the output formats that don't go through the target's assembly
+ * output, i.e. OUTPUT_C and OUTPUT_BINARY.
+ */
+func (t *Target) outputStandalone(outputFormat int, extraTables func(cg ICodeGenerator, outFile OutputWriter) int) {
+    if outputFormat == OUTPUT_C {
+        t.outputC(extraTables)
+    } else if outputFormat == OUTPUT_BINARY {
+        t.outputBinary(extraTables)
+    }
+}
+
+
+/* Outputs the song as a C source file with a matching header, instead of
+ * assembly. extraTables (which may be nil) is called to output any tables
+ * that are specific to the target.
+ */
+func (t *Target) outputC(extraTables func(cg ICodeGenerator, outFile OutputWriter) int) {
+    shortFileName := t.CompilerItf.GetShortFileName()
+
+    outFile, err := t.createOutputFile(shortFileName + ".c")
+    if err != nil {
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s.c", shortFileName)
+    }
+    hFile, err := t.createOutputFile(shortFileName + ".h")
+    if err != nil {
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s.h", shortFileName)
+    }
+
+    baseName := shortFileName
+    if lastSlash := strings.LastIndexAny(baseName, "/\\"); lastSlash >= 0 {
+        baseName = baseName[lastSlash+1:]
+    }
+    guard := "XPMP_"
+    for _, c := range strings.ToUpper(baseName) {
+        if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+            guard += string(c)
+        } else {
+            guard += "_"
+        }
+    }
+    guard += "_H"
+
+    cg := &CodeGeneratorC{CodeGenerator: CodeGenerator{t}}
+
+    now := time.Now()
+    cg.OutputComment(outFile, "Written by XPMC on " + now.Format(time.RFC1123))
+    outFile.WriteString("\n#include \"" + baseName + ".h\"\n\n")
+
+    tableSize := t.outputStandardEffectsWith(cg, outFile)
+    if extraTables != nil {
+        tableSize += extraTables(cg, outFile)
+    }
+    t.CompilerItf.GetContext().INFO("Size of effect tables: %d bytes", tableSize)
+
+    cbSize := cg.OutputCallbacks(outFile)
+
+    patSize := cg.OutputPatterns(outFile)
+    t.CompilerItf.GetContext().INFO("Size of pattern table: %d bytes\n", patSize)
+
+    songSize := cg.OutputChannelData(outFile)
+    t.reportSizes(TableSizes{Effects: tableSize, Callbacks: cbSize, Patterns: patSize, Songs: songSize})
+
+    cg.closeArray(outFile)
+    outFile.Close()
+
+    hFile.WriteString("/* Written by XPMC on " + now.Format(time.RFC1123) + " */\n\n")
+    cg.OutputHeader(hFile, guard)
+    hFile.Close()
+}
+
+
+/* Outputs the song as a single binary blob, along with a symbol map and a
+ * relocation list. The blob is resolved for the base address given with
+ * -base (0 by default).
+ */
+func (t *Target) outputBinary(extraTables func(cg ICodeGenerator, outFile OutputWriter) int) {
+    shortFileName := t.CompilerItf.GetShortFileName()
+
+    cg := NewCodeGeneratorBinary(t, t.BigEndian)
+
+    tableSize := t.outputStandardEffectsWith(cg, nil)
+    if extraTables != nil {
+        tableSize += extraTables(cg, nil)
+    }
+    t.CompilerItf.GetContext().INFO("Size of effect tables: %d bytes", tableSize)
+
+    cbSize := cg.OutputCallbacks(nil)
+
+    patSize := cg.OutputPatterns(nil)
+    t.CompilerItf.GetContext().INFO("Size of pattern table: %d bytes\n", patSize)
+
+    songSize := cg.OutputChannelData(nil)
+    t.reportSizes(TableSizes{Effects: tableSize, Callbacks: cbSize, Patterns: patSize, Songs: songSize})
+
+    cg.Resolve(t.GetExtraInt("BaseAddress", 0))
+
+    outFile, err := t.createOutputFile(shortFileName + ".bin")
+    if err != nil {
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s.bin", shortFileName)
+    }
+    outFile.Write(cg.data)
+    outFile.Close()
+
+    symFile, err := t.createOutputFile(shortFileName + ".sym")
+    if err != nil {
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s.sym", shortFileName)
+    }
+    cg.WriteSymbolMap(symFile)
+    symFile.Close()
+
+    relFile, err := t.createOutputFile(shortFileName + ".rel")
+    if err != nil {
+        t.CompilerItf.GetContext().ERRORC(utils.DIAG_OUTPUT_FILE, "Unable to open file: %s.rel", shortFileName)
+    }
+    cg.WriteRelocations(relFile)
+    relFile.Close()
+}
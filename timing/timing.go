@@ -5,21 +5,34 @@ import (
 	"math"
 )
 
-var UseFractionalDelays bool
-var UpdateFreq float64
-var ShortestDelay struct {
-	Lo, Hi int
+/* The timing parameters for one compilation.
+ */
+type Timing struct {
+	UseFractionalDelays bool
+	UpdateFreq float64
+	ShortestDelay struct {
+		Lo, Hi int
+	}
+	LongestDelay int
+	SupportedLengths []int
+}
+
+
+func NewTiming() *Timing {
+	t := &Timing{}
+	t.UseFractionalDelays = true
+	t.UpdateFreq = 60.0
+	t.SupportedLengths = []int{32, 24, 16, 12, 8, 6, 4, 3, 2, 1}
+	return t
 }
-var LongestDelay int
-var SupportedLengths = []int{32, 24, 16, 12, 8, 6, 4, 3, 2, 1}
 
 
 // Update the current minimum and maximum delay.
-func UpdateDelayMinMax(delay int) {
-	if (delay & 0xFF) < ShortestDelay.Lo &&
+func (t *Timing) UpdateDelayMinMax(delay int) {
+	if (delay & 0xFF) < t.ShortestDelay.Lo &&
 	   (delay & 0xFF) > 0 {
-		ShortestDelay.Lo = delay & 0xFF
+		t.ShortestDelay.Lo = delay & 0xFF
 	}
-	ShortestDelay.Hi = int(math.Min(float64(delay >> 8), float64(ShortestDelay.Hi)))
-	LongestDelay = int(math.Max(float64(delay >> 8), float64(LongestDelay)))
+	t.ShortestDelay.Hi = int(math.Min(float64(delay >> 8), float64(t.ShortestDelay.Hi)))
+	t.LongestDelay = int(math.Max(float64(delay >> 8), float64(t.LongestDelay)))
 }
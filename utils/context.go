@@ -0,0 +1,217 @@
+/*
+ * Package utils
+ * Compilation context
+ *
+ * Part of XPMC.
+ * Contains the state that is shared by the different parts of
+ * the compiler during one compilation.
+ */
+
+package utils
+
+import (
+    "fmt"
+    "io"
+    "io/fs"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+/* The parser and diagnostics for one compilation. Each compilation gets its
+ * own Context, so that several of them can run in the same process.
+ */
+type Context struct {
+    Parser *ParserState
+    OldParsers *GenericStack
+    Diagnostics *Diagnostics
+    WarningsAreErrors bool
+    Verbose bool        // Print INFO messages
+    Debug bool          // Print DEBUG messages
+    FS fs.FS            // Where input files are read from. nil means the OS file system
+    Log io.Writer       // Where statistics like channel sizes are printed. nil means stdout
+    IncludePaths []string   // Directories that #INCLUDEd files are looked for in
+    CommandLocation *SourceLocation // Where the command currently being compiled is located
+    definedSymbols map[string]int
+}
+
+
+func NewContext() *Context {
+    return &Context{OldParsers: NewGenericStack(),
+                    Diagnostics: NewDiagnostics(),
+                    definedSymbols: map[string]int{}}
+}
+
+
+/* Reads an input file (an MML file or a sample), either from ctx.FS or
+ * from disk. Paths in an fs.FS are always relative and slash-separated,
+ * so the name is converted to that form first.
+ */
+func (ctx *Context) ReadFile(fileName string) ([]byte, error) {
+    if ctx.FS == nil {
+        return ioutil.ReadFile(fileName)
+    }
+    return fs.ReadFile(ctx.FS, fsName(fileName))
+}
+
+/* Converts a file name to the form used by fs.FS.
+ */
+func fsName(fileName string) string {
+    name := path.Clean(strings.Replace(fileName, "\\", "/", -1))
+    return strings.TrimLeft(name, "/")
+}
+
+
+/* Prints an informational message (e.g. the size of each channel) to
+ * ctx.Log.
+ */
+func (ctx *Context) Printf(format string, args ...interface{}) {
+    if ctx.Log == nil {
+        fmt.Fprintf(os.Stdout, format, args...)
+    } else {
+        fmt.Fprintf(ctx.Log, format, args...)
+    }
+}
+
+
+/* Returns true if the input file exists, either in ctx.FS or on disk.
+ */
+func (ctx *Context) FileExists(fileName string) bool {
+    var err error
+    if ctx.FS == nil {
+        _, err = os.Stat(fileName)
+    } else {
+        _, err = fs.Stat(ctx.FS, fsName(fileName))
+    }
+    return err == nil
+}
+
+
+/* Returns a name that identifies the file, so that different paths to the
+ * same file can be compared.
+ */
+func (ctx *Context) FileKey(fileName string) string {
+    if ctx.FS != nil {
+        return fsName(fileName)
+    }
+    if abs, err := filepath.Abs(fileName); err == nil {
+        return abs
+    }
+    return filepath.Clean(fileName)
+}
+
+
+// Compiler messages
+
+func (ctx *Context) ERROR(msg string, args ...interface{}) {
+    ctx.ERRORC(DIAG_NONE, msg, args...)
+}
+
+func (ctx *Context) ERRORC(code string, msg string, args ...interface{}) {
+    ctx.addDiagnostic(SEVERITY_ERROR, code, fmt.Sprintf(msg, args...))
+    ctx.failCommand()
+}
+
+func (ctx *Context) WARNING(msg string, args ...interface{}) {
+    ctx.WARNINGC(DIAG_NONE, msg, args...)
+}
+
+func (ctx *Context) WARNINGC(code string, msg string, args ...interface{}) {
+    ctx.addDiagnostic(SEVERITY_WARNING, code, fmt.Sprintf(msg, args...))
+    if ctx.WarningsAreErrors {
+        ctx.failCommand()
+    }
+}
+
+func (ctx *Context) INFO(msg string, args ...interface{}) {
+    if ctx.Verbose {
+        ctx.Printf("Info: " + msg + "\n", args...)
+    }
+}
+
+func (ctx *Context) DEBUG(msg string, args ...interface{}) {
+    if ctx.Debug {
+        ctx.Printf("Debug: " + msg + "\n", args...)
+    }
+}
+
+////////
+
+func (ctx *Context) DefineSymbol(sym string, val int) {
+    ctx.definedSymbols[sym] = val
+}
+
+func (ctx *Context) UndefineSymbol(sym string) {
+    delete(ctx.definedSymbols, sym)
+}
+
+func (ctx *Context) IsDefined(sym string) int {
+    if _, defined := ctx.definedSymbols[sym]; defined {
+        return 1
+    }
+    return 0
+}
+
+/* Returns the value of a symbol, and whether it has been defined. Symbols
+ * that haven't been defined have the value 0.
+ */
+func (ctx *Context) SymbolValue(sym string) (int, bool) {
+    val, defined := ctx.definedSymbols[sym]
+    return val, defined
+}
+
+
+/* Adds a diagnostic at the current position of the parser.
+ */
+func (ctx *Context) addDiagnostic(severity int, code string, msg string) {
+    diag := Diagnostic{Severity: severity, Code: code, Message: msg}
+    if ctx.Parser != nil {
+        diag.File = ctx.Parser.ShortFileName
+        diag.Line = ctx.Parser.LineNum
+        diag.Column = ctx.Parser.Column
+    }
+    ctx.Diagnostics.Add(diag)
+}
+
+/* Abandons the current command, or the whole compilation if the maximum
+ * number of errors has been reached.
+ */
+func (ctx *Context) failCommand() {
+    d := ctx.Diagnostics
+    d.failed = true
+    if d.MaxErrors > 0 && d.ErrorCount() >= d.MaxErrors {
+        d.Add(Diagnostic{Severity: SEVERITY_INFO,
+                         Message: fmt.Sprintf("Too many errors (%d), stopping", d.ErrorCount())})
+        panic(compilationAborted{})
+    }
+    panic(commandFailed{})
+}
+
+/* Should be deferred by any function that may end up calling ERROR.
+ * Recovers from a failed or aborted compilation and stores the diagnostics
+ * in *err. Any other panic is passed on.
+ */
+func (ctx *Context) RecoverErrors(err *error) {
+    if r := recover(); r != nil {
+        _, aborted := r.(compilationAborted)
+        _, failed := r.(commandFailed)
+        if !aborted && !failed {
+            panic(r)
+        }
+        *err = ctx.Diagnostics.Err()
+    }
+}
+
+/* Deferred by the compiler's command loop. Recovers from a failed command
+ * and sets *done to false, so that the loop can be resumed.
+ */
+func RecoverCommandError(done *bool) {
+    if r := recover(); r != nil {
+        if _, ok := r.(commandFailed); !ok {
+            panic(r)
+        }
+        *done = false
+    }
+}
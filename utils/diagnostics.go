@@ -0,0 +1,152 @@
+/*
+ * Package utils
+ * Compiler diagnostics
+ *
+ * Part of XPMC.
+ * Contains the types used for collecting errors and warnings
+ * during compilation.
+ */
+
+package utils
+
+import (
+    "fmt"
+    "strings"
+)
+
+const (
+    SEVERITY_INFO = 0
+    SEVERITY_WARNING = 1
+    SEVERITY_ERROR = 2
+)
+
+// Diagnostic codes
+const (
+    DIAG_NONE = ""
+    DIAG_FILE_NOT_FOUND = "file-not-found"
+    DIAG_OUTPUT_FILE = "output-file"
+    DIAG_UNEXPECTED_CHAR = "unexpected-char"
+    DIAG_INPUT_FILE = "input-file"
+    DIAG_USER = "user"                          // #ERROR / #WARNING
+    DIAG_SYNTAX = "syntax-error"
+    DIAG_BAD_ARGUMENT = "bad-argument"
+    DIAG_BAD_LENGTH = "bad-length"
+    DIAG_OUT_OF_RANGE = "out-of-range"
+    DIAG_NO_ACTIVE_CHANNEL = "no-active-channel"
+    DIAG_UNSUPPORTED = "unsupported"
+    DIAG_UNKNOWN_COMMAND = "unknown-command"
+    DIAG_UNDEFINED = "undefined"
+    DIAG_REDEFINITION = "redefinition"
+    DIAG_CONDITIONAL = "conditional"            // #IFDEF / #IF and friends
+    DIAG_LOOP = "loop"
+    DIAG_PATTERN = "pattern"
+    DIAG_VOLUME_CLAMPED = "volume-clamped"      // A pattern's volume offset took a volume out of range
+    DIAG_MACRO = "macro"
+    DIAG_BLOCK = "block"                        // #REPEAT / #FOR / #SECTION / #ORDER
+    DIAG_TEMPO = "tempo"
+    DIAG_GROOVE = "groove"
+    DIAG_CHORD = "chord"
+    DIAG_DRUMS = "drums"
+    DIAG_LENGTH_MISMATCH = "length-mismatch"    // Channels of different lengths
+)
+
+type Diagnostic struct {
+    Severity int
+    File string
+    Line int
+    Column int
+    Code string
+    Message string
+}
+
+type Diagnostics struct {
+    list []Diagnostic
+    failed bool
+    handler func(Diagnostic)
+    MaxErrors int        // Compilation stops after this many errors (0 = no limit)
+}
+
+/* The error returned by the compiler when compilation failed.
+ */
+type DiagnosticsError struct {
+    Diagnostics []Diagnostic
+}
+
+/* Used as the panic value when compilation is aborted.
+ */
+type compilationAborted struct{}
+
+/* Used as the panic value when the current command failed to compile,
+ * but compilation can resume with the next command.
+ */
+type commandFailed struct{}
+
+
+/* Formats the diagnostic the way the compiler has always printed its
+ * messages, e.g. "[song.mml:12,5] Error: Bad tempo: 0".
+ */
+func (d Diagnostic) String() string {
+    sev := "Info"
+    switch d.Severity {
+    case SEVERITY_WARNING:
+        sev = "Warning"
+    case SEVERITY_ERROR:
+        sev = "Error"
+    }
+    if len(d.File) == 0 {
+        return sev + ": " + d.Message
+    }
+    return fmt.Sprintf("[%s:%d,%d] %s: %s", d.File, d.Line, d.Column, sev, d.Message)
+}
+
+
+func NewDiagnostics() *Diagnostics {
+    return &Diagnostics{list: []Diagnostic{}}
+}
+
+/* Sets a function that gets called for each diagnostic as soon as it has
+ * been added, e.g. for printing it.
+ */
+func (d *Diagnostics) SetHandler(handler func(Diagnostic)) {
+    d.handler = handler
+}
+
+func (d *Diagnostics) Add(diag Diagnostic) {
+    d.list = append(d.list, diag)
+    if d.handler != nil {
+        d.handler(diag)
+    }
+}
+
+func (d *Diagnostics) All() []Diagnostic {
+    return d.list
+}
+
+func (d *Diagnostics) ErrorCount() int {
+    count := 0
+    for _, diag := range d.list {
+        if diag.Severity == SEVERITY_ERROR {
+            count++
+        }
+    }
+    return count
+}
+
+/* Returns a DiagnosticsError if there were any errors (or any warnings
+ * that were treated as errors), and nil otherwise.
+ */
+func (d *Diagnostics) Err() error {
+    if d.ErrorCount() == 0 && !d.failed {
+        return nil
+    }
+    return &DiagnosticsError{d.list}
+}
+
+
+func (e *DiagnosticsError) Error() string {
+    lines := []string{}
+    for _, diag := range e.Diagnostics {
+        lines = append(lines, diag.String())
+    }
+    return strings.Join(lines, "\n")
+}
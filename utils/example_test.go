@@ -2,12 +2,60 @@ package utils_test
 
 import (
 	"fmt"
-	"./utils"
+	"../utils"
 )
 
-func ExampleGetStringUntil() {
-	s := utils.GetStringUntil("abc")
+func ExampleParserState_GetStringUntil() {
+	p := utils.NewParserStateFromData("test", []byte("apa,bepa"), utils.NewContext())
+	s := p.GetStringUntil(",")
 	fmt.Println("s = " + s)
 	// Output:
-	// apa
+	// s = apa
+}
+
+func ExampleContext_EvalExpression() {
+	ctx := utils.NewContext()
+	ctx.DefineSymbol("SMS", 1)
+	ctx.DefineSymbol("TEMPO_VARIANT", 3)
+	for _, expr := range []string{"TEMPO_VARIANT >= 2 && SMS", "(1 + 2) * -3 % 5", "UNDEFINED + 1", "defined(SMS) && !defined(NES)", "1 / 0", "(1 + 2"} {
+		if val, err := ctx.EvalExpression(expr); err != nil {
+			fmt.Println(expr, "->", err)
+		} else {
+			fmt.Println(expr, "=", val)
+		}
+	}
+	// Output:
+	// TEMPO_VARIANT >= 2 && SMS = 1
+	// (1 + 2) * -3 % 5 = -4
+	// UNDEFINED + 1 = 1
+	// defined(SMS) && !defined(NES) = 1
+	// 1 / 0 -> Division by zero in expression
+	// (1 + 2 -> Missing ) in expression
+}
+
+func ExampleContext_EvalExpressionWith() {
+	ctx := utils.NewContext()
+	ctx.DefineSymbol("N", 10)
+	vars := func(name string) (int, bool, error) {
+		if name == "i" {
+			return 4, true, nil
+		}
+		return 0, false, nil
+	}
+	val, err := ctx.EvalExpressionWith("N - i * 2", vars)
+	fmt.Println(val, err)
+	// Output:
+	// 2 <nil>
+}
+
+func ExampleExpressionNames() {
+	names, err := utils.ExpressionNames("a + defined(b) * c / 0")
+	fmt.Println(names, err)
+	_, err = utils.ExpressionNames("a +")
+	fmt.Println(err != nil)
+	fmt.Println(utils.IsIdentifier("vol_2"), utils.IsIdentifier("2vol"), utils.IsIdentifier(""))
+	// Output:
+	// [a c] <nil>
+	// true
+	// true false false
 }
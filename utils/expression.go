@@ -0,0 +1,327 @@
+/*
+ * Package utils
+ * Expression evaluation
+ *
+ * Part of XPMC.
+ * Contains the evaluator for the integer expressions used in
+ * #IF, #ELIF, #DEFINE, #REPEAT/#FOR and macro bodies.
+ */
+
+package utils
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+/* A recursive descent parser for expressions like "TEMPO_VARIANT >= 2 && SMS".
+ * The operators and their precedence are the same as in C:
+ *   ||
+ *   &&
+ *   == !=
+ *   < <= > >=
+ *   + -
+ *   * / %
+ *   ! - (unary)
+ * Symbols evaluate to their defined value, or to 0 if they aren't defined.
+ * defined(SYM) evaluates to 1 if SYM has been defined, regardless of its value.
+ */
+type exprParser struct {
+    expr string
+    pos int
+    ctx *Context
+    vars func(name string) (int, bool, error)   // Looks up names before the symbols are searched
+    names []string                              // The names used in the expression
+    syntaxOnly bool                             // Only check the syntax, without evaluating anything
+}
+
+
+/* Evaluates expr using the symbols defined in ctx. Comparisons and logical
+ * operators evaluate to 0 or 1.
+ */
+func (ctx *Context) EvalExpression(expr string) (int, error) {
+    p := &exprParser{expr: expr, ctx: ctx}
+    return p.parse()
+}
+
+
+/* Evaluates expr like EvalExpression, but looks up every name in vars first.
+ * vars returns false if the name should be looked up among the symbols
+ * instead (e.g. macro parameters are looked up in vars).
+ */
+func (ctx *Context) EvalExpressionWith(expr string, vars func(name string) (int, bool, error)) (int, error) {
+    p := &exprParser{expr: expr, ctx: ctx, vars: vars}
+    return p.parse()
+}
+
+
+/* Checks the syntax of expr and returns the names that it uses, not counting
+ * the arguments of defined().
+ */
+func ExpressionNames(expr string) ([]string, error) {
+    p := &exprParser{expr: expr, syntaxOnly: true}
+    _, err := p.parse()
+    return p.names, err
+}
+
+
+/* Returns true if s can be used as the name of a symbol or variable.
+ */
+func IsIdentifier(s string) bool {
+    if len(s) == 0 || IsNumeric(int(s[0])) {
+        return false
+    }
+    for i := 0; i < len(s); i++ {
+        if !isIdentifierChar(s[i]) {
+            return false
+        }
+    }
+    return true
+}
+
+
+func (p *exprParser) parse() (int, error) {
+    val, err := p.parseOr()
+    if err == nil {
+        p.skipWhitespace()
+        if p.pos < len(p.expr) {
+            err = fmt.Errorf("Unexpected %q in expression", p.expr[p.pos:])
+        }
+    }
+    return val, err
+}
+
+
+func boolToInt(b bool) int {
+    if b {
+        return 1
+    }
+    return 0
+}
+
+func (p *exprParser) skipWhitespace() {
+    for p.pos < len(p.expr) && (p.expr[p.pos] == ' ' || p.expr[p.pos] == '\t') {
+        p.pos++
+    }
+}
+
+/* Consumes the first of the given operators that the expression continues
+ * with, and returns it. Returns an empty string if none of them match.
+ */
+func (p *exprParser) acceptOperator(ops ...string) string {
+    p.skipWhitespace()
+    for _, op := range ops {
+        if strings.HasPrefix(p.expr[p.pos:], op) {
+            p.pos += len(op)
+            return op
+        }
+    }
+    return ""
+}
+
+func (p *exprParser) parseOr() (int, error) {
+    lhs, err := p.parseAnd()
+    for err == nil && p.acceptOperator("||") != "" {
+        var rhs int
+        if rhs, err = p.parseAnd(); err == nil {
+            lhs = boolToInt(lhs != 0 || rhs != 0)
+        }
+    }
+    return lhs, err
+}
+
+func (p *exprParser) parseAnd() (int, error) {
+    lhs, err := p.parseEquality()
+    for err == nil && p.acceptOperator("&&") != "" {
+        var rhs int
+        if rhs, err = p.parseEquality(); err == nil {
+            lhs = boolToInt(lhs != 0 && rhs != 0)
+        }
+    }
+    return lhs, err
+}
+
+func (p *exprParser) parseEquality() (int, error) {
+    lhs, err := p.parseRelational()
+    for err == nil {
+        op := p.acceptOperator("==", "!=")
+        if op == "" {
+            break
+        }
+        var rhs int
+        if rhs, err = p.parseRelational(); err == nil {
+            if op == "==" {
+                lhs = boolToInt(lhs == rhs)
+            } else {
+                lhs = boolToInt(lhs != rhs)
+            }
+        }
+    }
+    return lhs, err
+}
+
+func (p *exprParser) parseRelational() (int, error) {
+    lhs, err := p.parseAdditive()
+    for err == nil {
+        op := p.acceptOperator("<=", ">=", "<", ">")
+        if op == "" {
+            break
+        }
+        var rhs int
+        if rhs, err = p.parseAdditive(); err == nil {
+            switch op {
+            case "<=":
+                lhs = boolToInt(lhs <= rhs)
+            case ">=":
+                lhs = boolToInt(lhs >= rhs)
+            case "<":
+                lhs = boolToInt(lhs < rhs)
+            case ">":
+                lhs = boolToInt(lhs > rhs)
+            }
+        }
+    }
+    return lhs, err
+}
+
+func (p *exprParser) parseAdditive() (int, error) {
+    lhs, err := p.parseMultiplicative()
+    for err == nil {
+        op := p.acceptOperator("+", "-")
+        if op == "" {
+            break
+        }
+        var rhs int
+        if rhs, err = p.parseMultiplicative(); err == nil {
+            if op == "+" {
+                lhs += rhs
+            } else {
+                lhs -= rhs
+            }
+        }
+    }
+    return lhs, err
+}
+
+func (p *exprParser) parseMultiplicative() (int, error) {
+    lhs, err := p.parseUnary()
+    for err == nil {
+        op := p.acceptOperator("*", "/", "%")
+        if op == "" {
+            break
+        }
+        var rhs int
+        if rhs, err = p.parseUnary(); err == nil {
+            if op == "*" {
+                lhs *= rhs
+            } else if rhs == 0 && p.syntaxOnly {
+                // Nothing is evaluated
+            } else if rhs == 0 {
+                err = fmt.Errorf("Division by zero in expression")
+            } else if op == "/" {
+                lhs /= rhs
+            } else {
+                lhs %= rhs
+            }
+        }
+    }
+    return lhs, err
+}
+
+func (p *exprParser) parseUnary() (int, error) {
+    // "!=" is not a unary operator, so check for it before "!"
+    p.skipWhitespace()
+    if strings.HasPrefix(p.expr[p.pos:], "!") && !strings.HasPrefix(p.expr[p.pos:], "!=") {
+        p.pos++
+        val, err := p.parseUnary()
+        return boolToInt(val == 0), err
+    }
+    if p.acceptOperator("-") != "" {
+        val, err := p.parseUnary()
+        return -val, err
+    }
+    return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (int, error) {
+    p.skipWhitespace()
+    if p.pos >= len(p.expr) {
+        return 0, fmt.Errorf("Unexpected end of expression")
+    }
+
+    c := p.expr[p.pos]
+    if c == '(' {
+        p.pos++
+        val, err := p.parseOr()
+        if err == nil && p.acceptOperator(")") == "" {
+            err = fmt.Errorf("Missing ) in expression")
+        }
+        return val, err
+    }
+
+    if IsNumeric(int(c)) || c == '$' {
+        start := p.pos
+        p.pos++
+        for p.pos < len(p.expr) && isIdentifierChar(p.expr[p.pos]) {
+            p.pos++
+        }
+        num, base := p.expr[start:p.pos], 10
+        if strings.HasPrefix(num, "$") {
+            num, base = num[1:], 16
+        } else if strings.HasPrefix(num, "0x") || strings.HasPrefix(num, "0X") {
+            num, base = num[2:], 16
+        }
+        val, err := strconv.ParseInt(num, base, 0)
+        if err != nil {
+            return 0, fmt.Errorf("Bad number in expression: %s", p.expr[start:p.pos])
+        }
+        return int(val), nil
+    }
+
+    if isIdentifierChar(c) {
+        name := p.parseIdentifier()
+        if name == "defined" {
+            hasParen := p.acceptOperator("(") != ""
+            p.skipWhitespace()
+            sym := p.parseIdentifier()
+            if len(sym) == 0 {
+                return 0, fmt.Errorf("Expected a symbol after defined")
+            }
+            if hasParen && p.acceptOperator(")") == "" {
+                return 0, fmt.Errorf("Missing ) in expression")
+            }
+            if p.syntaxOnly {
+                return 0, nil
+            }
+            return p.ctx.IsDefined(sym), nil
+        }
+        if PositionOfString(p.names, name) < 0 {
+            p.names = append(p.names, name)
+        }
+        if p.syntaxOnly {
+            return 0, nil
+        }
+        if p.vars != nil {
+            if val, found, err := p.vars(name); found {
+                return val, err
+            }
+        }
+        val, _ := p.ctx.SymbolValue(name)
+        return val, nil
+    }
+
+    return 0, fmt.Errorf("Unexpected %q in expression", p.expr[p.pos:])
+}
+
+func isIdentifierChar(c byte) bool {
+    return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_'
+}
+
+func (p *exprParser) parseIdentifier() string {
+    start := p.pos
+    for p.pos < len(p.expr) && isIdentifierChar(p.expr[p.pos]) {
+        p.pos++
+    }
+    return p.expr[start:p.pos]
+}
@@ -0,0 +1,83 @@
+/*
+ * Package utils
+ * Source locations
+ *
+ * Part of XPMC.
+ * Contains the types used for recording where in the MML source
+ * each command came from.
+ */
+
+package utils
+
+/* A position in an MML file. Lines and columns start at 1.
+ */
+type SourcePos struct {
+    File string     `json:"file"`
+    Line int        `json:"line"`
+    Column int      `json:"column"`
+}
+
+const (
+    FRAME_INCLUDE = "include"
+    FRAME_MACRO = "macro"
+    FRAME_PATTERN = "pattern"
+    FRAME_DRUMS = "drums"
+    FRAME_REPEAT = "repeat"
+    FRAME_LOOP = "loop"
+    FRAME_SECTION = "section"
+)
+
+/* One step on the way to a source location: an #INCLUDE, the invocation
+ * of a macro, the invocation of a pattern that was compiled anew for
+ * that invocation, a #DRUMS track, an iteration of a #REPEAT / #FOR or of
+ * a [] loop that had to be unrolled, or a #SECTION.
+ */
+type SourceFrame struct {
+    Kind string     `json:"kind"`           // One of the FRAME_* constants
+    Name string     `json:"name,omitempty"` // The name of the macro, pattern, drum kit, etc.
+    SourcePos
+}
+
+/* Where a command came from. Chain lists the #INCLUDEs and macro
+ * invocations that led there, outermost first. Commands that were
+ * produced by a macro are located at the macro invocation.
+ */
+type SourceLocation struct {
+    SourcePos
+    Chain []SourceFrame `json:"chain,omitempty"`
+}
+
+
+/* Returns the current location of the parser, including the chain of
+ * #INCLUDEs and macro expansions.
+ */
+func (ctx *Context) Location() *SourceLocation {
+    parsers := []*ParserState{}
+    for e := ctx.OldParsers.data.Front(); e != nil; e = e.Next() {
+        if p, ok := e.Value.(*ParserState); ok && p != nil {
+            parsers = append(parsers, p)
+        }
+    }
+    if ctx.Parser == nil {
+        return nil
+    }
+    parsers = append(parsers, ctx.Parser)
+
+    loc := &SourceLocation{}
+    for i, p := range parsers {
+        pos, macros := p.Position()
+        for _, name := range macros {
+            loc.Chain = append(loc.Chain, SourceFrame{Kind: FRAME_MACRO, Name: name, SourcePos: pos})
+        }
+        if i < len(parsers)-1 {
+            frame := SourceFrame{Kind: FRAME_INCLUDE, SourcePos: pos}
+            if next := parsers[i+1]; len(next.FrameKind) > 0 {
+                frame.Kind, frame.Name = next.FrameKind, next.FrameName
+            }
+            loc.Chain = append(loc.Chain, frame)
+        } else {
+            loc.SourcePos = pos
+        }
+    }
+    return loc
+}
@@ -12,12 +12,11 @@
 package utils
 
 import (
+    "bytes"
     "errors"
-    "fmt"
     "os"
     "strconv"
     "strings"
-    "io/ioutil"
 )
 
 type ParserState struct {
@@ -25,6 +24,7 @@ type ParserState struct {
     Column int
     ShortFileName string
     WorkDir string
+    FrameKind, FrameName string // How the parser was entered, if not by #INCLUDE (see SourceFrame)
     fileData []byte
     fileDataPos int
     UserDefinedBase int
@@ -32,13 +32,37 @@ type ParserState struct {
     allowFloats bool
     wtListOk bool
     listDelimiter string    
+    ctx *Context
+    expansions []*macroExpansion    // Macro expansions that haven't been read completely
+    lastExpansion *macroExpansion   // The most recently completed expansion
+    expandedLines int               // Newlines read inside macro expansions
+}
+
+/* MML code that was inserted into the parser's data blob by expanding
+ * a macro.
+ */
+type macroExpansion struct {
+    name string
+    start, end int      // The range of fileData that holds the expanded code
+    pos SourcePos       // Where the macro was invoked
+    endColumn int       // The column of the last character of the invocation
+    nested bool         // Whether the macro was invoked by another macro
 }
 
 
 func (s *ParserState) Init(fileName string) error {
-    var err error
-    s.fileData, err = ioutil.ReadFile(fileName)
-    DEBUG("Parsing " + fileName)
+    data, err := s.ctx.ReadFile(fileName)
+    s.InitWithData(fileName, data)
+    return err
+}
+
+
+/* Initializes the parser to parse the given data. fileName is only used
+ * in messages and for finding files relative to the data.
+ */
+func (s *ParserState) InitWithData(fileName string, data []byte) {
+    s.fileData = data
+    s.ctx.DEBUG("Parsing %s", fileName)
     s.fileDataPos = 0
     s.LineNum = 1
     s.Column = 0
@@ -50,26 +74,55 @@ func (s *ParserState) Init(fileName string) error {
     s.WorkDir = ""
     lastSlash := strings.LastIndexAny(fileName, "\\/")
     if lastSlash >= 0 {
-        s.WorkDir = fileName[:lastSlash] + string(os.PathSeparator)
+        s.WorkDir = fileName[:lastSlash+1]
         s.ShortFileName = fileName[lastSlash+1:]
-        DEBUG("WorkDir = " + s.WorkDir)
+        s.ctx.DEBUG("WorkDir = %s", s.WorkDir)
     } else {
         s.ShortFileName = fileName
-        s.WorkDir, _ = os.Getwd()
-        s.WorkDir += string(os.PathSeparator)
-        DEBUG("WorkDir = " + s.WorkDir)
+        if s.ctx.FS == nil {
+            s.WorkDir, _ = os.Getwd()
+            s.WorkDir += string(os.PathSeparator)
+        }
+        s.ctx.DEBUG("WorkDir = %s", s.WorkDir)
     }
     s.listDelimiter = "{}"
-    return err
+    s.expansions = nil
+    s.lastExpansion = nil
+    s.expandedLines = 0
 }
 
 
-func NewParserState(fileName string) (parser *ParserState, err error) {
-    parser = &ParserState{}
+func NewParserState(fileName string, ctx *Context) (parser *ParserState, err error) {
+    parser = &ParserState{ctx: ctx}
     err = parser.Init(fileName)
     return
 }
 
+func NewParserStateFromData(fileName string, data []byte, ctx *Context) *ParserState {
+    parser := &ParserState{ctx: ctx}
+    parser.InitWithData(fileName, data)
+    return parser
+}
+
+
+/* Returns the offset in the parser's data blob of the next character to
+ * be read.
+ */
+func (p *ParserState) Offset() int {
+    return p.fileDataPos
+}
+
+
+/* Returns the code between the offsets start and end of the parser's
+ * data blob, including any macro expansions.
+ */
+func (p *ParserState) GetSource(start, end int) string {
+    if start < 0 || end > len(p.fileData) || start > end {
+        return ""
+    }
+    return string(p.fileData[start:end])
+}
+
 
 /* Inserts the MML code in the given string into the parser's data blob
  * at the current position.
@@ -86,6 +139,72 @@ func (p *ParserState) InsertString(s string) {
 }
 
 
+/* Inserts the expansion of the named macro at the current position. The
+ * inserted code is remembered, so that the commands it produces can be
+ * located at the macro invocation, which is at pos.
+ */
+func (p *ParserState) InsertExpansion(name string, s string, pos SourcePos) {
+    endPos, _ := p.Position()
+    nested := false
+    for _, e := range p.expansions {
+        if e.start < p.fileDataPos {
+            // The new code is part of this expansion
+            e.end += len(s)
+            nested = true
+        }
+    }
+    p.expansions = append(p.expansions, &macroExpansion{name: name,
+                                                        start: p.fileDataPos,
+                                                        end: p.fileDataPos + len(s),
+                                                        pos: pos,
+                                                        endColumn: endPos.Column,
+                                                        nested: nested})
+    p.InsertString(s)
+}
+
+
+/* Removes any expansions that have been read completely from
+ * p.expansions.
+ */
+func (p *ParserState) retireExpansions() {
+    active := p.expansions[:0]
+    for _, e := range p.expansions {
+        if e.end >= p.fileDataPos {
+            active = append(active, e)
+        } else if !e.nested {
+            p.lastExpansion = e
+        }
+    }
+    p.expansions = active
+}
+
+
+/* Returns the position in the file of the last character read, and the
+ * names of the macros that it was expanded from (outermost first). Inside
+ * a macro expansion the position is that of the macro invocation.
+ */
+func (p *ParserState) Position() (SourcePos, []string) {
+    p.retireExpansions()
+
+    macros := []string{}
+    for _, e := range p.expansions {
+        if e.start < p.fileDataPos {
+            macros = append(macros, e.name)
+        }
+    }
+    if len(macros) > 0 {
+        return p.expansions[0].pos, macros
+    }
+
+    pos := SourcePos{File: p.ShortFileName, Line: p.LineNum - p.expandedLines, Column: p.Column}
+    // The column counter includes any macro code that has been read on this line
+    if e := p.lastExpansion; e != nil && e.pos.Line == pos.Line && p.fileDataPos > e.end {
+        pos.Column = e.endColumn + (p.fileDataPos - e.end)
+    }
+    return pos, macros
+}
+
+
 /* Returns the next character from the fileData slice.
  */
 func (p *ParserState) Getch() int {
@@ -144,7 +263,19 @@ func (p *ParserState) SkipN(n int) {
     p.Column += n
 }
 
+/* Skips ahead to the end of the current line. The newline itself is left
+ * unread, so that the caller can keep count of the lines.
+ */
+func (p *ParserState) SkipToEndOfLine() {
+    for p.Peekch() != -1 && p.Peekch() != '\n' {
+        p.Getch()
+    }
+}
+
 func (p *ParserState) AdvanceLine() {
+    if _, macros := p.Position(); len(macros) > 0 {
+        p.expandedLines++
+    }
     p.LineNum++
     p.Column = 0
 }
@@ -181,6 +312,9 @@ func (p *ParserState) UnskipWhitespace() {
         if c == ' ' || c == '\t' || c == 13 || c == 10 {
             if c == 10 {
                 p.LineNum--
+                p.Column = p.fileDataPos - (bytes.LastIndexByte(p.fileData[:p.fileDataPos], 10) + 1)
+            } else {
+                p.Column--
             }
         } else {
             p.fileDataPos++
@@ -261,6 +395,25 @@ func (p *ParserState) GetStringUntil(endChars string) string {
     return s
 }
 
+/* Reads and returns the rest of the current line, excluding any ; comment.
+ * Unlike GetStringUntil this never continues onto the next line.
+ */
+func (p *ParserState) GetRestOfLine() string {
+    s := ""
+    c := p.Getch()
+    for c == ' ' || c == '\t' {
+        c = p.Getch()
+    }
+    for c != -1 && c != 13 && c != 10 && c != ';' {
+        s += string(byte(c))
+        c = p.Getch()
+    }
+    
+    p.Ungetch()
+    
+    return strings.TrimRight(s, " \t")
+}
+
 func (p *ParserState) GetAlphaString() string {
     var c int
     
@@ -414,7 +567,7 @@ func (p *ParserState) GetList() (*ParamList,error) {
                                 if e == nil {
                                     stepVal = int(num)
                                 } else {
-                                    ERROR("Malformed interval: " + t)
+                                    p.ctx.ERRORC(DIAG_SYNTAX, "Malformed interval: %s", t)
                                 }
                                 c = p.Getch()
                                 if c == '\''{
@@ -422,18 +575,18 @@ func (p *ParserState) GetList() (*ParamList,error) {
                                     num, e = strconv.ParseInt(t, 0, 0)
                                     if e == nil {
                                         if num < 1 {
-                                            ERROR("Repeat value must be >= 1",)
+                                            p.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Repeat value must be >= 1")
                                         }
                                         rept = int(num)
                                     } else {
-                                        ERROR("Expected a repeat value, got " + t)
+                                        p.ctx.ERRORC(DIAG_SYNTAX, "Expected a repeat value, got %s", t)
                                     }
                                 } else {
                                     p.Ungetch()
                                 }
                             } else if c == '\'' {
                                 if rept != 0 {
-                                    ERROR("Found more than one repeat value for the same interval")
+                                    p.ctx.ERRORC(DIAG_SYNTAX, "Found more than one repeat value for the same interval")
                                 }
                                 if stopVal < startVal {
                                     stepVal = -1
@@ -444,11 +597,11 @@ func (p *ParserState) GetList() (*ParamList,error) {
                                 num, e = strconv.ParseInt(t, 0, 0)
                                 if e == nil {
                                     if num < 1 {
-                                        ERROR("Repeat value must be >= 1")
+                                        p.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Repeat value must be >= 1")
                                     }
                                     rept = int(num)
                                 } else {
-                                    ERROR("Expected a repeat value, got " + t)
+                                    p.ctx.ERRORC(DIAG_SYNTAX, "Expected a repeat value, got %s", t)
                                 }
                                                                 
                             } else {
@@ -460,19 +613,19 @@ func (p *ParserState) GetList() (*ParamList,error) {
                                 }
                             }
                         } else {
-                            ERROR("Malformed interval: "  + t)
+                            p.ctx.ERRORC(DIAG_SYNTAX, "Malformed interval: %s", t)
                         }
                         
                         if stopVal < startVal && stepVal >= 0 {
-                            WARNING(fmt.Sprintf("Auto-negating step value for interval %d:%d", startVal, stopVal))
+                            p.ctx.WARNINGC(DIAG_BAD_ARGUMENT, "Auto-negating step value for interval %d:%d", startVal, stopVal)
                             stepVal = -stepVal
                         } else if stopVal > startVal && stepVal <= 0 {
-                            WARNING(fmt.Sprintf("Auto-negating step value for interval %d:%d", startVal, stopVal))
+                            p.ctx.WARNINGC(DIAG_BAD_ARGUMENT, "Auto-negating step value for interval %d:%d", startVal, stopVal)
                             stepVal = -stepVal
                         }
 
                         if stepVal == 0 {
-                            ERROR("Step value must be non-zero")
+                            p.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Step value must be non-zero")
                         }
                         
                         if rept == 0 {
@@ -497,10 +650,10 @@ func (p *ParserState) GetList() (*ParamList,error) {
                         num, e = strconv.ParseInt(t, 0, 0)
                         if e == nil {
                             if num < 1 {
-                                ERROR("Repeat value must be >= 1")
+                                p.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Repeat value must be >= 1")
                             } else {
                                 if num > 100 {
-                                    WARNING("Ignoring repeat values > 100")
+                                    p.ctx.WARNINGC(DIAG_OUT_OF_RANGE, "Ignoring repeat values > 100")
                                     num = 1
                                 }
                                 for i := 1; i <= int(num); i++ {
@@ -508,7 +661,7 @@ func (p *ParserState) GetList() (*ParamList,error) {
                                 }
                             }
                         } else {
-                            ERROR("Expected a repeat value, got " + t)
+                            p.ctx.ERRORC(DIAG_SYNTAX, "Expected a repeat value, got %s", t)
                         }
                     } else {
                         p.Ungetch()
@@ -518,13 +671,13 @@ func (p *ParserState) GetList() (*ParamList,error) {
                     pipeOk  = true
                     endOk   = true
                 } else {
-                    ERROR("Syntax error while parsing list: " + t)
+                    p.ctx.ERRORC(DIAG_SYNTAX, "Syntax error while parsing list: %s", t)
                 }
             } else {
                 c = p.Getch()
                 if c == ',' {
                     if !commaOk {
-                        ERROR("Unexpected comma")
+                        p.ctx.ERRORC(DIAG_SYNTAX, "Unexpected comma")
                     }
                     commaOk = false
                     pipeOk  = false
@@ -538,7 +691,7 @@ func (p *ParserState) GetList() (*ParamList,error) {
                         endOk   = false
                         gotPipe = true
                     } else {
-                        ERROR("Unexpected |")
+                        p.ctx.ERRORC(DIAG_SYNTAX, "Unexpected |")
                     }
                 } else if byte(c) == p.listDelimiter[1] {
                     if endOk {
@@ -550,7 +703,7 @@ func (p *ParserState) GetList() (*ParamList,error) {
                         err = nil
                         break
                     } else {
-                        ERROR("Malformed list")
+                        p.ctx.ERRORC(DIAG_SYNTAX, "Malformed list")
                     }
                 } else if c == ';' {
                     for c != 10 && c != -1 {
@@ -565,7 +718,7 @@ func (p *ParserState) GetList() (*ParamList,error) {
                     }
                     concatTo = append(concatTo, t)
                 } else if c == '\'' || c == ':' {
-                    ERROR("Unexpected " + string(byte(c)))
+                    p.ctx.ERRORC(DIAG_SYNTAX, "Unexpected %c", c)
                 } else if c == 'W' && p.wtListOk {
                     c = p.Getch()
                     if c == 'T' {
@@ -579,10 +732,10 @@ func (p *ParserState) GetList() (*ParamList,error) {
                             pipeOk  = true
                             endOk   = true
                         } else {
-                            ERROR("Expected a number, got " + t)
+                            p.ctx.ERRORC(DIAG_SYNTAX, "Expected a number, got %s", t)
                         }
                     } else {
-                        ERROR("Expected WT, got W" + string(byte(c)))
+                        p.ctx.ERRORC(DIAG_SYNTAX, "Expected WT, got W%c", c)
                     }
                 } else if c == -1 {
                     break
@@ -590,7 +743,7 @@ func (p *ParserState) GetList() (*ParamList,error) {
             }
         }
     } else {
-        ERROR("Expected {, got " + string(byte(c)))
+        p.ctx.ERRORC(DIAG_SYNTAX, "Expected {, got %c", c)
     }
     
     // The list body has been parsed. Check for any trailing operators
@@ -638,10 +791,10 @@ func (p *ParserState) GetList() (*ParamList,error) {
                         
                         } else if c == '\'' {
                             if num < 1 {
-                                ERROR("Repeat value must be >= 1")
+                                p.ctx.ERRORC(DIAG_OUT_OF_RANGE, "Repeat value must be >= 1")
                             }
                             if num > 100 {
-                                WARNING("Repeat values > 100 are ignored")
+                                p.ctx.WARNINGC(DIAG_OUT_OF_RANGE, "Repeat values > 100 are ignored")
                             } else {
                                 t := []interface{}{}
                                 for j, _ := range lst.MainPart {
@@ -661,10 +814,10 @@ func (p *ParserState) GetList() (*ParamList,error) {
                             }
                         }
                     } else {
-                        ERROR("Syntax error while parsing list: " + t)
+                        p.ctx.ERRORC(DIAG_SYNTAX, "Syntax error while parsing list: %s", t)
                     }
                 } else {
-                    ERROR("Expected a numeric constant after " + string(byte(c)))
+                    p.ctx.ERRORC(DIAG_SYNTAX, "Expected a numeric constant after %c", c)
                 }
             } else {
                 p.Ungetch()
@@ -12,9 +12,7 @@ package utils
 
 import (
     "encoding/binary"
-    "fmt"
     "math"
-    "os"
     "strings"
     "container/list"
 )
@@ -77,75 +75,6 @@ func NewGenericStack() *GenericStack {
 }
 
 
-// Global variables
-
-var Parser *ParserState
-var OldParsers *GenericStack
-
-// Local variables
-
-var warningsAreErrors bool = false
-var verboseMode bool = false
-var debugMode bool = false
-var definedSymbols map[string]bool
-
-// Compiler messages
-
-func ERROR(msg string, args ...interface{}) {
-    fmt.Printf(fmt.Sprintf("[%s:%d,%d] Error: ", Parser.ShortFileName, Parser.LineNum, Parser.Column) +
-               fmt.Sprintf(msg + "\n", args...))
-    os.Exit(1)
-}
-
-func WARNING(msg string, args ...interface{}) {
-    fmt.Printf(fmt.Sprintf("[%s:%d,%d] Warning: ", Parser.ShortFileName, Parser.LineNum, Parser.Column) +
-               fmt.Sprintf(msg + "\n", args...))
-    if warningsAreErrors {
-        os.Exit(1)
-    }
-}
-
-func INFO(msg string, args ...interface{}) {
-    if verboseMode {
-        fmt.Printf("Info: " + msg + "\n", args...)
-    }
-}
-
-func DEBUG(msg string, args ...interface{}) {
-    if debugMode {
-        fmt.Printf("Debug: " + msg + "\n", args...)
-    }
-}
-
-func Verbose(flag bool) {
-    verboseMode = flag
-}
-
-func DebugMode(flag bool) {
-    debugMode = flag
-}
-
-func WarningsAreErrors(flag bool) {
-    warningsAreErrors = flag
-}
-
-////////
-
-func DefineSymbol(sym string, val int) {
-    if definedSymbols == nil {
-        definedSymbols = map[string]bool{}
-    }
-    definedSymbols[sym] = true
-}
-
-func IsDefined(sym string) int {
-    if (definedSymbols[sym]) {
-        return 1
-    }
-    return 0
-}
-
-
 func IsNumeric(c int) bool {
     return strings.ContainsRune("0123456789", rune(c))
 }
@@ -1,36 +1,37 @@
 package wav
 
 import (
-    "fmt"
-    "io/ioutil"
     "math"
     "../utils"
 )
 
-var fileData []byte
-var fileDataPos int
+// The contents of the WAV file being converted
+type wavReader struct {
+    fileData []byte
+    fileDataPos int
+}
 
 
 // Get an unsigned word (16 bits)
-func getWord() int {
+func (r *wavReader) getWord() int {
     var w int
-    w = int(fileData[fileDataPos])
-    fileDataPos++
-    w += (int(fileData[fileDataPos]) * 0x100)
-    fileDataPos++
+    w = int(r.fileData[r.fileDataPos])
+    r.fileDataPos++
+    w += (int(r.fileData[r.fileDataPos]) * 0x100)
+    r.fileDataPos++
     return w
 }
 
 // Get a signed word (16 bits) from file fh
-func getSword() int {
+func (r *wavReader) getSword() int {
     var w int
-    if fileDataPos >= len(fileData) {
+    if r.fileDataPos >= len(r.fileData) {
         return 65536
     }
-    w = int(fileData[fileDataPos])
-    fileDataPos++
-    w += (int(fileData[fileDataPos]) * 0x100)
-    fileDataPos++
+    w = int(r.fileData[r.fileDataPos])
+    r.fileDataPos++
+    w += (int(r.fileData[r.fileDataPos]) * 0x100)
+    r.fileDataPos++
     if (w & 0x8000) != 0 {
         return -(32768 - (w & 0x7FFF))
     }
@@ -38,43 +39,44 @@ func getSword() int {
 }
 
 // Get a dword (32 bits)
-func getDword() int {
+func (r *wavReader) getDword() int {
     var dw int
     
-    dw = int(fileData[fileDataPos])
-    dw += (int(fileData[fileDataPos+1]) * 0x100)
-    dw += (int(fileData[fileDataPos+2]) * 0x10000)
-    dw += (int(fileData[fileDataPos+3]) * 0x1000000)
-    fileDataPos += 4
+    dw = int(r.fileData[r.fileDataPos])
+    dw += (int(r.fileData[r.fileDataPos+1]) * 0x100)
+    dw += (int(r.fileData[r.fileDataPos+2]) * 0x10000)
+    dw += (int(r.fileData[r.fileDataPos+3]) * 0x1000000)
+    r.fileDataPos += 4
     return dw
 }
 
 
 // Extract the sample data from a WAV file and convert it to mono with a given sample rate and volume
-func ConvertWav(fname string, sampleRate int, volume int) []int {
+func ConvertWav(ctx *utils.Context, fname string, sampleRate int, volume int) []int {
     var accum int
     var wavFormat, wavChannels, wavSamplesPerSec, wavBitsPerSample int
     var err error
     var pos, deltaPos float64
+    r := &wavReader{}
     
-    fileData, err = ioutil.ReadFile(fname)
+    r.fileData, err = ctx.ReadFile(fname)
     if err != nil {
-        utils.ERROR("Unable to read from " + fname)
+        ctx.ERRORC(utils.DIAG_INPUT_FILE, "Unable to read from %s", fname)
     }
-    fileDataPos = 0
+    r.fileDataPos = 0
     
-    s := string(fileData[fileDataPos : fileDataPos+4])
-    fileDataPos += 4
+    s := string(r.fileData[r.fileDataPos : r.fileDataPos+4])
+    r.fileDataPos += 4
     if s != "RIFF" {
-        utils.ERROR("No RIFF tag found in " + fname)
+        ctx.ERRORC(utils.DIAG_INPUT_FILE, "No RIFF tag found in %s", fname)
     }
     
-    _ = getDword()
+    _ = r.getDword()
     
-    s = string(fileData[fileDataPos : fileDataPos+4])
-    fileDataPos += 4
+    s = string(r.fileData[r.fileDataPos : r.fileDataPos+4])
+    r.fileDataPos += 4
     if s != "WAVE" {
-        utils.ERROR("No WAVE tag found in " + fname)
+        ctx.ERRORC(utils.DIAG_INPUT_FILE, "No WAVE tag found in %s", fname)
     }
 
     dataSize := -1
@@ -83,27 +85,27 @@ func ConvertWav(fname string, sampleRate int, volume int) []int {
     // Read the chunks
     for {
         // Get the chunk ID
-        if (fileDataPos + 3) >= len(fileData) {
+        if (r.fileDataPos + 3) >= len(r.fileData) {
             break
         }
-        chunkId := string(fileData[fileDataPos : fileDataPos+4])
-        fileDataPos += 4
+        chunkId := string(r.fileData[r.fileDataPos : r.fileDataPos+4])
+        r.fileDataPos += 4
 
         // Get the chunk size
-        chunkSize := getDword()
+        chunkSize := r.getDword()
     
         if chunkId == "fmt " {
-            wavFormat         = getWord()
-            wavChannels       = getWord()
-            wavSamplesPerSec  = getDword()
-            _                 = getDword()      // Average bytes per second
-            _                 = getWord()       // Block alignment
-            wavBitsPerSample  = getWord()
+            wavFormat         = r.getWord()
+            wavChannels       = r.getWord()
+            wavSamplesPerSec  = r.getDword()
+            _                 = r.getDword()      // Average bytes per second
+            _                 = r.getWord()       // Block alignment
+            wavBitsPerSample  = r.getWord()
         
-            fileDataPos += chunkSize - 16
+            r.fileDataPos += chunkSize - 16
             
             if wavFormat != 1 || (wavBitsPerSample != 8 && wavBitsPerSample != 16) || wavChannels > 2 {
-                utils.ERROR("Unsupported wav format in " + fname)
+                ctx.ERRORC(utils.DIAG_INPUT_FILE, "Unsupported wav format in %s", fname)
             }
         
             deltaPos = 1.0
@@ -113,21 +115,21 @@ func ConvertWav(fname string, sampleRate int, volume int) []int {
             pos = 1.0
             
             if deltaPos != 1.0 {
-                utils.INFO(fmt.Sprintf("Resampling %s from %d to %d Hz", fname, wavSamplesPerSec, sampleRate))
+                ctx.INFO("Resampling %s from %d to %d Hz", fname, wavSamplesPerSec, sampleRate)
             }
             
             if wavChannels > 1 {
-                utils.INFO("Converting sample to mono")
+                ctx.INFO("Converting sample to mono")
             }
             
             if wavBitsPerSample != 8 {
-                utils.INFO("Converting sample to 8-bit unsigned")
+                ctx.INFO("Converting sample to 8-bit unsigned")
             }
             
         } else if chunkId == "data" {
             dataSize = chunkSize
             
-            utils.DEBUG("Found data chunk, bits=%d, channels=%d, chunk size=%d", wavBitsPerSample, wavChannels, dataSize)
+            ctx.DEBUG("Found data chunk, bits=%d, channels=%d, chunk size=%d", wavBitsPerSample, wavChannels, dataSize)
             
             sampleDiv := 0
                        
@@ -141,8 +143,8 @@ func ConvertWav(fname string, sampleRate int, volume int) []int {
                             accum = 0
                             sampleDiv = 0
                             for int(pos) < nextPos {
-                                accum += int(fileData[fileDataPos])
-                                fileDataPos++
+                                accum += int(r.fileData[r.fileDataPos])
+                                r.fileDataPos++
                                 pos += 1.0 
                                 sampleDiv++
                             }
@@ -160,9 +162,9 @@ func ConvertWav(fname string, sampleRate int, volume int) []int {
                             accum = 0
                             sampleDiv = 0
                             for int(pos) < nextPos {
-                                accum += int(fileData[fileDataPos])
-                                accum += int(fileData[fileDataPos+1])
-                                fileDataPos += 2
+                                accum += int(r.fileData[r.fileDataPos])
+                                accum += int(r.fileData[r.fileDataPos+1])
+                                r.fileDataPos += 2
                                 pos += 1.0 
                                 sampleDiv++
                             }
@@ -182,7 +184,7 @@ func ConvertWav(fname string, sampleRate int, volume int) []int {
                             accum = 0
                             sampleDiv = 0
                             for int(pos) < nextPos {
-                                accum += int(float64(getSword() + 32768) / 256.0)
+                                accum += int(float64(r.getSword() + 32768) / 256.0)
                                 pos += 1.0 
                                 sampleDiv++
                             }
@@ -200,7 +202,7 @@ func ConvertWav(fname string, sampleRate int, volume int) []int {
                             accum = 0
                             sampleDiv = 0
                             for int(pos) < nextPos {
-                                accum += int(float64(getSword() + 32768) / 256.0) + int(float64(getSword() + 32768) / 256.0) 
+                                accum += int(float64(r.getSword() + 32768) / 256.0) + int(float64(r.getSword() + 32768) / 256.0) 
                                 pos += 1.0 
                                 sampleDiv++
                             }
@@ -215,12 +217,12 @@ func ConvertWav(fname string, sampleRate int, volume int) []int {
 
         } else {
             // Unhandled chunk type, just skip it.
-            utils.DEBUG("Skipping unhandled WAV chunk \"%s\"", chunkId)
-            fileDataPos += chunkSize
+            ctx.DEBUG("Skipping unhandled WAV chunk \"%s\"", chunkId)
+            r.fileDataPos += chunkSize
         }
     }
        
-    utils.INFO(fmt.Sprintf("Size of converted sample: %d bytes", len(wavData)))
+    ctx.INFO("Size of converted sample: %d bytes", len(wavData))
     
     wavDataInt := make([]int, len(wavData))
     for i := range wavData {
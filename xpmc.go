@@ -1,52 +1,129 @@
 package main
 
 import (
-    //"flag"
+    "bytes"
+    "encoding/json"
+    "flag"
     "fmt"
+    "io"
     "os"
-    //"runtime/pprof"
+    "path/filepath"
+    "runtime"
+    "runtime/pprof"
+    "strconv"
     "strings"
+    "sync"
     "./compiler"
-    "./defs"
     "./targets"
-    "./timing"
     "./utils"
 //    "./player"
 )
 
 
+/* A command-line option that can be given more than once, e.g. -I.
+ */
+type stringList []string
+
+func (l *stringList) String() string {
+    return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+    *l = append(*l, s)
+    return nil
+}
+
+
+var targetName = flag.String("target", "", "The target `platform` (see -list-targets)")
+var outputName = flag.String("o", "", "The `name` of the output file. Defaults to the name of the input file")
+var outputDir = flag.String("outdir", "", "Compile all input files in batch mode, writing the output to `dir`")
+var numJobs = flag.Int("j", 0, "Compile `n` files at the same time in batch mode (0 = number of CPUs)")
+var formatName = flag.String("format", "asm", "The output `format`: asm, c or bin")
+var cOutput = flag.Bool("c", false, "Same as -format=c")
+var binOutput = flag.Bool("bin", false, "Same as -format=bin")
+var syntaxName = flag.String("syntax", "", "Assembler `syntax` to output (wla, ca65, rgbds, gas, asm68k).\nDefaults to the target's usual syntax")
+var baseAddressArg = flag.String("base", "0", "Base `address` of the binary blob (e.g. $4000)")
+var maxErrors = flag.Int("max-errors", 50, "Stop after `n` errors (0 = no limit)")
+var warningsAreErrors = flag.Bool("w", false, "Treat warnings as errors")
+var pal = flag.Bool("pal", false, "Use PAL timing (50 Hz) if the target supports it")
+var ntsc = flag.Bool("ntsc", false, "Use NTSC timing (60 Hz). This is the default")
+var listTargets = flag.Bool("list-targets", false, "List the supported targets")
+var writeDebugMap = flag.Bool("debug-map", false, "Also write a JSON map from the compiled song data to the MML source (<name>.debug.json)")
+var reportName = flag.String("report", "", "Write a JSON report of the song, channel and table sizes to `file`.\nIn batch mode the report covers all input files")
+var cpuprofile = flag.String("cpuprofile", "", "Write a CPU profile to `file`")
+var verbose, debug bool
+var defines, includeDirs stringList
+
 var target int
-/*var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
-var gbc = flag.String("gbc", "", "select GBC target")*/
-
-func showHelp(what string) {
-    switch what {
-    case "EN":
-        fmt.Println("EN:\tArpeggio macro: { num | num}. num is zero or more numbers in\n\tthe range -63-63.\n")
-    default:
-        fmt.Println("Usage: xpmc.exe [options] target input [output]\n")
-        fmt.Println("Options:")
-        fmt.Println("\t-h\tShow this information") 
-        fmt.Println("\t-v\tVerbose mode")
-        fmt.Println("\t-w\tTreat warnings as errors")
-        fmt.Println("\nTarget:")
-        fmt.Println("\t-at8\tAtari 8-bit")
-        fmt.Println("\t-c64\tCommodore 64")
-        fmt.Println("\t-clv\tColecoVision")
-        fmt.Println("\t-cpc\tAmstrad CPC")
-        fmt.Println("\t-cps\tCPS-1")
-        //fmt.Println(1, "\t-gba\tGameboy Advance")
-        fmt.Println("\t-gbc\tGameboy / Gameboy Color")
-        fmt.Println("\t-gen\tSEGA Genesis")
-        fmt.Println("\t-kss\tKSS")
-        fmt.Println("\t-nes\tNintendo Entertainment System")
-        fmt.Println("\t-pce\tPC-Engine")
-        //fmt.Println(1, "\t-nds\tNintendo DS")
-        //fmt.Println(1, "\t-sat\tSEGA Saturn")
-        fmt.Println("\t-sgg\tSEGA Game Gear")
-        fmt.Println("\t-sms\tSEGA Master System")
+var outputSyntax int = -1
+var outputFormat int = targets.OUTPUT_ASSEMBLY
+var baseAddress int = 0
+var targetOptions [][2]string
+var diagnosticsShown int = 0
+
+func init() {
+    flag.BoolVar(&verbose, "v", false, "Verbose mode")
+    flag.BoolVar(&verbose, "verbose", false, "Verbose mode")
+    flag.BoolVar(&debug, "d", false, "Debug mode")
+    flag.BoolVar(&debug, "debug", false, "Debug mode")
+    flag.Var(&defines, "D", "Define a `SYMBOL`, or SYMBOL=value, for use with #IFDEF and #IF.\nCan also be written as -DSYMBOL=value")
+    flag.Var(&includeDirs, "I", "Look for #INCLUDEd files in `dir` if they aren't found\nnext to the including file. The directories are searched in\nthe order they're given, followed by those in XPMC_INCLUDE")
+
+    // The target can also be given as e.g. -sms instead of -target sms
+    for _, info := range targets.ListAllTargets() {
+        for _, name := range info.Names {
+            name := name
+            flag.BoolFunc(name, "Same as -target " + name, func(string) error {
+                *targetName = name
+                return nil
+            })
+        }
+    }
+    flag.Usage = showHelp
+}
+
+
+/* Returns true if the flag selects a target, like -sms.
+ */
+func isTargetFlag(f *flag.Flag) bool {
+    return targets.NameToID(f.Name) != targets.TARGET_UNKNOWN
+}
+
+func showHelp() {
+    out := flag.CommandLine.Output()
+    fmt.Fprintln(out, "Usage: xpmc.exe [options] input")
+    fmt.Fprintln(out, "       xpmc.exe [options] [-outdir dir] [-j n] input...")
+    fmt.Fprintln(out, "\nOptions:")
+    flag.VisitAll(func(f *flag.Flag) {
+        if isTargetFlag(f) {
+            return
+        }
+        argName, usage := flag.UnquoteUsage(f)
+        if f.DefValue != "" && f.DefValue != "0" && f.DefValue != "false" {
+            usage += fmt.Sprintf(" (default %s)", f.DefValue)
+        }
+        fmt.Fprintf(out, "  %s\n\t%s\n", strings.TrimSpace("-" + f.Name + " " + argName),
+                    strings.Replace(usage, "\n", "\n\t", -1))
+    })
+    fmt.Fprintln(out, "\nTarget (either -target <name> or -<name>):")
+    printTargets(out)
+}
+
+func printTargets(out io.Writer) {
+    for _, info := range targets.ListTargets() {
+        fmt.Fprintf(out, "  %s\t%s\n", strings.Join(info.Names, ", "), info.Description)
+    }
+}
+
 
+/* Prints the diagnostics that haven't been printed yet.
+ */
+func showDiagnostics(comp *compiler.Compiler) {
+    all := comp.Diagnostics.All()
+    for _, diag := range all[diagnosticsShown:] {
+        fmt.Println(diag)
     }
+    diagnosticsShown = len(all)
 }
 
 
@@ -85,126 +162,468 @@ func removeUnusedEffects(effectMap *effects.EffectMap, effectCmd int)
 }    */
 
 
+/* Finds the target selected on the command line, before the command line
+ * is parsed. This is needed because the target's own options have to be
+ * registered before parsing.
+ */
+func findTargetName(args []string) string {
+    name := ""
+    for i, arg := range args {
+        if arg == "--" {
+            break
+        }
+        if !strings.HasPrefix(arg, "-") {
+            continue
+        }
+        arg = "-" + strings.TrimLeft(arg, "-")
+        if arg == "-target" && i + 1 < len(args) {
+            name = args[i + 1]
+        } else if strings.HasPrefix(arg, "-target=") {
+            name = arg[len("-target="):]
+        } else if targets.NameToID(arg[1:]) != targets.TARGET_UNKNOWN {
+            name = arg[1:]
+        }
+    }
+    return name
+}
+
+
+/* Adds the options of the given target to the command line flags, and
+ * returns their names.
+ */
+func registerTargetOptions(targetID int) []string {
+    probe := &compiler.Compiler{}
+    probe.Init(targetID)
+    targetFlags := flag.NewFlagSet("", flag.ContinueOnError)
+    probe.CurrSong.Target.RegisterOptions(targetFlags)
+
+    names := []string{}
+    targetFlags.VisitAll(func(f *flag.Flag) {
+        flag.Var(f.Value, f.Name, f.Usage)
+        names = append(names, f.Name)
+    })
+    return names
+}
+
+
+/* Parses the command line. Options may be placed both before and after
+ * the input files. Returns the input file names.
+ */
+func parseCommandLine() []string {
+    args := []string{}
+    for _, arg := range os.Args[1:] {
+        // Split C compiler style options like -DNAME=value into -D NAME=value
+        if (strings.HasPrefix(arg, "-D") || strings.HasPrefix(arg, "-I")) && len(arg) > 2 && arg[2] != '=' {
+            args = append(args, arg[:2], arg[2:])
+        } else {
+            args = append(args, arg)
+        }
+    }
+
+    targetOptionNames := []string{}
+    if id := targets.NameToID(findTargetName(args)); id != targets.TARGET_UNKNOWN {
+        targetOptionNames = registerTargetOptions(id)
+    }
+
+    inputFileNames := []string{}
+    for {
+        flag.CommandLine.Parse(args)
+        args = flag.Args()
+        if len(args) == 0 {
+            break
+        }
+        inputFileNames = append(inputFileNames, args[0])
+        args = args[1:]
+    }
+
+    // The directories in XPMC_INCLUDE are searched after the ones given with -I
+    for _, dir := range filepath.SplitList(os.Getenv("XPMC_INCLUDE")) {
+        if len(dir) > 0 {
+            includeDirs = append(includeDirs, dir)
+        }
+    }
+
+    flag.Visit(func(f *flag.Flag) {
+        for _, name := range targetOptionNames {
+            if f.Name == name {
+                targetOptions = append(targetOptions, [2]string{f.Name, f.Value.String()})
+            }
+        }
+    })
+    return inputFileNames
+}
+
+
+/* Checks the values of the options and converts them to the form used by
+ * the compiler. Returns false if any option is invalid.
+ */
+func checkOptions() bool {
+    target = targets.NameToID(*targetName)
+    if target == targets.TARGET_UNKNOWN {
+        if len(*targetName) == 0 {
+            fmt.Println("Error: No target platform specified.\nRun the compiler with the -list-targets option to see a list of targets.")
+        } else {
+            fmt.Printf("Error: Unknown target: %s\n", *targetName)
+        }
+        return false
+    }
+    if err := targets.CheckImplemented(target); err != nil {
+        fmt.Printf("Error: %s\n", err)
+        return false
+    }
+
+    if outputFormat = targets.FormatNameToID(*formatName); outputFormat == -1 {
+        fmt.Printf("Error: Unknown output format: %s\n", *formatName)
+        return false
+    }
+    if *cOutput {
+        outputFormat = targets.OUTPUT_C
+    } else if *binOutput {
+        outputFormat = targets.OUTPUT_BINARY
+    }
+
+    if len(*syntaxName) > 0 {
+        if outputSyntax = targets.SyntaxNameToID(*syntaxName); outputSyntax == -1 {
+            fmt.Printf("Error: Unknown assembler syntax: %s\n", *syntaxName)
+            return false
+        }
+    }
+
+    addr, err := strconv.ParseInt(strings.Replace(*baseAddressArg, "$", "0x", 1), 0, 32)
+    if err != nil {
+        fmt.Printf("Error: Bad base address: %s\n", *baseAddressArg)
+        return false
+    }
+    baseAddress = int(addr)
+
+    if *maxErrors < 0 {
+        fmt.Printf("Error: Bad error limit: %d\n", *maxErrors)
+        return false
+    }
+    if *numJobs < 0 {
+        fmt.Printf("Error: Bad number of jobs: %d\n", *numJobs)
+        return false
+    }
+    if *pal && *ntsc {
+        fmt.Println("Error: -pal and -ntsc can't be used together")
+        return false
+    }
+
+    for _, def := range defines {
+        if _, _, ok := parseDefine(def); !ok {
+            fmt.Printf("Error: Bad symbol definition: %s\n", def)
+            return false
+        }
+    }
+    return true
+}
+
+
+/* Splits a -D argument on the form SYMBOL or SYMBOL=value. The value
+ * defaults to 1.
+ */
+func parseDefine(def string) (string, int, bool) {
+    sym, val := def, 1
+    if eq := strings.Index(def, "="); eq >= 0 {
+        n, err := strconv.Atoi(def[eq+1:])
+        if err != nil {
+            return "", 0, false
+        }
+        sym, val = def[:eq], n
+    }
+    return sym, val, len(sym) > 0
+}
+
+
 func main() {
-    /*flag.Parse()
+    inputFileNames := parseCommandLine()
+
+    if *listTargets {
+        printTargets(os.Stdout)
+        return
+    }
+
     if *cpuprofile != "" {
         f, err := os.Create(*cpuprofile)
         if err != nil {
-            //log.Fatal(err)
+            fmt.Printf("Error: Unable to create file: %s\n", *cpuprofile)
+            os.Exit(1)
         }
         pprof.StartCPUProfile(f)
         defer pprof.StopCPUProfile()
-    }*/
-    
-    timing.UpdateFreq = 60.0
-    timing.UseFractionalDelays = true
+    }
 
-    if timing.UseFractionalDelays {
-        timing.SupportedLengths = defs.EXTENDED_LENGTHS()
+    if len(inputFileNames) == 0 {
+        showHelp()
+        return
+    }
+    if !checkOptions() {
+        os.Exit(2)
+    }
+
+    if len(inputFileNames) > 1 || len(*outputDir) > 0 || *numJobs > 0 {
+        if len(*outputName) > 0 {
+            fmt.Println("Error: -o can't be used in batch mode, use -outdir instead")
+            os.Exit(2)
+        }
+        jobs := *numJobs
+        if jobs == 0 {
+            jobs = runtime.NumCPU()
+        }
+        exitCode := compileBatch(inputFileNames, *outputDir, jobs)
+        pprof.StopCPUProfile()
+        os.Exit(exitCode)
+    }
+
+    comp := newCompiler()
+
+    inputFileName := inputFileNames[0]
+    if len(filepath.Ext(inputFileName)) == 0 {
+        inputFileName += ".mml"
+    }
+    comp.ShortFileName = strings.TrimSuffix(inputFileName, filepath.Ext(inputFileName))
+    if len(*outputName) > 0 {
+        comp.ShortFileName = strings.TrimSuffix(*outputName, filepath.Ext(*outputName))
     }
     
-    utils.OldParsers = utils.NewGenericStack()
-    
-    utils.Verbose(false)
-    utils.DebugMode(false)
-    utils.WarningsAreErrors(false)
-    target = targets.TARGET_UNKNOWN
+    err := comp.CompileFile(inputFileName)
+    showDiagnostics(comp)
+    if err != nil {
+        fmt.Printf("%d error(s)\n", comp.Diagnostics.ErrorCount())
+        pprof.StopCPUProfile()
+        os.Exit(1)
+    }
+
+    comp.FinishSongs()
+    showDiagnostics(comp)
+    comp.RemoveUnusedEffects()
+
+    err = outputFiles(comp)
+    showDiagnostics(comp)
+    if err == nil && len(*reportName) > 0 {
+        err = writeReport(*reportName, comp.WriteReport)
+        if err != nil {
+            fmt.Printf("Error: Unable to write report: %s\n", err)
+        }
+    }
+    if err != nil {
+        pprof.StopCPUProfile()
+        os.Exit(1)
+    }
+}
 
+
+/* Creates the file fileName and lets write fill it with the report.
+ */
+func writeReport(fileName string, write func(w io.Writer) error) error {
+    f, err := os.Create(fileName)
+    if err != nil {
+        return err
+    }
+    err = write(f)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    return err
+}
+
+
+/* Creates a compiler for the selected target, with the settings given on
+ * the command line.
+ */
+func newCompiler() *compiler.Compiler {
     comp := &compiler.Compiler{}
+    comp.Init(target)
+    comp.Diagnostics.MaxErrors = *maxErrors
+    ctx := comp.GetContext()
+    ctx.WarningsAreErrors = *warningsAreErrors
+    ctx.Verbose, ctx.Debug = verbose, debug
+    ctx.IncludePaths = includeDirs
+    for _, def := range defines {
+        sym, val, _ := parseDefine(def)
+        ctx.DefineSymbol(sym, val)
+    }
+    if *pal || *ntsc {
+        comp.SetPAL(*pal)
+    }
+    for _, option := range targetOptions {
+        comp.SetTargetOption(option[0], option[1])
+    }
+    return comp
+}
+
+
+/* Writes the output files for a compiled song, in the format given on the
+ * command line.
+ */
+func outputFiles(comp *compiler.Compiler) error {
+    if outputSyntax != -1 {
+        if err := comp.CurrSong.Target.SetOutputSyntax(outputSyntax); err != nil {
+            comp.GetContext().Printf("Error: %s\n", err)
+            return err
+        }
+    }
     
-    for i, arg := range os.Args {
-        if i >= 1 {
-            if arg[0] == '-' {
-                if arg == "-v" || arg == "-verbose" {
-                    utils.Verbose(true);
-                } else if arg == "-d" || arg == "-debug" {
-                    utils.DebugMode(true);
-                } else if arg == "-w" {
-                    utils.WarningsAreErrors(true);
-                } else if arg == "-h" || arg == "-help" {
-                    showHelp("")
-                    return
-                } else if targets.NameToID(arg[1:]) != targets.TARGET_UNKNOWN {
-                    target = targets.NameToID(arg[1:])
-                } 
-            } else {
-                if target == targets.TARGET_UNKNOWN {
-                    fmt.Printf("Error: No target platform specified.\nRun the compiler with the -h option to see a list of targets.")
-                    return
-                }
-                comp.Init(target)
-
-                inputFileName := arg
-                lastDot := strings.LastIndexAny(inputFileName, ".")
-                lastSlash := strings.LastIndexAny(inputFileName, "/\\")
-                
-                if lastDot >= 0 && lastSlash < 0 {
-                    comp.ShortFileName = inputFileName[:lastDot]
-                } else {
-                    comp.ShortFileName = inputFileName
-                    inputFileName += ".mml"
-                }
-
-                if i < len(os.Args)-1 {
-                    comp.ShortFileName = os.Args[i + 1]
-                    lastDot = strings.LastIndexAny(os.Args[i + 1], ".")
-                    if lastDot >= 0 {
-                        comp.ShortFileName = os.Args[i+1][:lastDot]
-                        //writeVGM = equal(lower(fileNames[2][n..length(fileNames[2])]), ".vgm")
-                        //writeVGM += equal(lower(fileNames[2][n..length(fileNames[2])]), ".vgz") * 2
-                        //writeWAV = equal(lower(fileNames[2][n..length(fileNames[2])]), ".wav")
-                    }
-                }
-                
-                //fmt.Printf("compiler.SFN = " + comp.ShortFileName + "\n")
-                
-                comp.CompileFile(inputFileName);
-    
-                // Insert END markers or jumps at the end of the command sequence for each channel
-                for _, song := range comp.Songs {
-                    for _, chn := range song.Channels {
-                        if chn.IsVirtual() {
-                            continue
-                        }
-                        chn.LoopTicks = chn.Ticks - chn.LoopTicks
-                        if chn.LoopPoint == -1 {
-                            chn.AddCmd([]int{defs.CMD_END})
-                        } else {
-                            if !chn.HasAnyNote {
-                                chn.AddCmd([]int{defs.CMD_END})
-                            } else {
-                                chn.AddCmd([]int{defs.CMD_JMP, chn.LoopPoint & 0xFF, chn.LoopPoint / 0x100})
-                            }
-                        }
-                    }
-                }
- 
-                // Compare the total lengths of all channels
-                ticks := -1
-                for _, song := range comp.Songs {
-                    for _, chn := range song.Channels {
-                        if chn.IsVirtual() {
-                            continue
-                        }
-                        if chn.HasAnyNote {
-                            if ticks == -1 {
-                                ticks = chn.Ticks
-                            } else if chn.Ticks != ticks {
-                                fmt.Printf("Warning: Mismatch in length between channels in song %d\n", song.Num)
-                                break
-                            }
-                        }
-                    }
-                }
+    comp.CurrSong.Target.PutExtraInt("BaseAddress", baseAddress)
+    if err := comp.Output(outputFormat); err != nil {
+        return err
+    }
+
+    if *writeDebugMap {
+        f, err := os.Create(comp.ShortFileName + ".debug.json")
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        return comp.WriteDebugMap(f)
+    }
+    return nil
+}
+
+
+/* The outcome of compiling one file in batch mode.
+ */
+type batchResult struct {
+    fileName string
+    log bytes.Buffer            // Channel sizes and other statistics
+    diagnostics []utils.Diagnostic
+    failed bool
+    report json.RawMessage      // The compile report, if one was requested
+}
+
+
+/* Returns the name (without extension) of the output files of fileName in
+ * batch mode. The output files are written to outputDir (or next to the
+ * input file if outputDir is empty) and get the same base name as the input
+ * file.
+ */
+func batchOutputName(fileName string, outputDir string) string {
+    baseName := filepath.Base(fileName)
+    if len(outputDir) == 0 {
+        outputDir = filepath.Dir(fileName)
+    }
+    return filepath.Join(outputDir, strings.TrimSuffix(baseName, filepath.Ext(baseName)))
+}
+
+
+/* Compiles one file in batch mode.
+ */
+func compileBatchFile(fileName string, outputDir string) *batchResult {
+    res := &batchResult{fileName: fileName}
+
+    comp := newCompiler()
+    comp.GetContext().Log = &res.log
+    comp.ShortFileName = batchOutputName(fileName, outputDir)
     
-                comp.RemoveUnusedEffects()
-                
-                comp.CurrSong.Target.Output(targets.OUTPUT_ASSEMBLY)
-                
-                return
+    err := comp.CompileFile(fileName)
+    if err == nil {
+        comp.FinishSongs()
+        comp.RemoveUnusedEffects()
+        err = outputFiles(comp)
+    }
+    if err == nil && len(*reportName) > 0 {
+        var buf bytes.Buffer
+        if err = comp.WriteReport(&buf); err == nil {
+            res.report = buf.Bytes()
+        }
+    }
+    res.diagnostics = comp.Diagnostics.All()
+    res.failed = err != nil
+    return res
+}
+
+
+/* Writes the reports of all files compiled in batch mode as a JSON array.
+ * Files that failed to compile have no report.
+ */
+func writeBatchReport(w io.Writer, results []*batchResult) error {
+    type fileReport struct {
+        File string                 `json:"file"`
+        Failed bool                 `json:"failed"`
+        Report json.RawMessage      `json:"report,omitempty"`
+    }
+    reports := []fileReport{}
+    for _, res := range results {
+        reports = append(reports, fileReport{File: res.fileName, Failed: res.failed, Report: res.report})
+    }
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    return enc.Encode(reports)
+}
+
+
+/* Compiles all the given files, numJobs files at a time, and then prints
+ * the results for each file in the order that the files were given in,
+ * followed by a summary. Returns the exit code.
+ */
+func compileBatch(fileNames []string, outputDir string, numJobs int) int {
+    // Files whose output would overwrite each other's are not compiled at all
+    outputNames := map[string]string{}
+    for _, fileName := range fileNames {
+        outputName := batchOutputName(fileName, outputDir)
+        if other, ok := outputNames[outputName]; ok {
+            fmt.Printf("Error: %s and %s would both be written to %s.*\n", other, fileName, outputName)
+            return 1
+        }
+        outputNames[outputName] = fileName
+    }
+
+    if len(outputDir) > 0 {
+        if err := os.MkdirAll(outputDir, 0755); err != nil {
+            fmt.Printf("Error: Unable to create directory: %s\n", outputDir)
+            return 1
+        }
+    }
+
+    results := make([]*batchResult, len(fileNames))
+    jobs := make(chan int)
+    var wg sync.WaitGroup
+    for w := 0; w < numJobs; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for n := range jobs {
+                results[n] = compileBatchFile(fileNames[n], outputDir)
             }
+        }()
+    }
+    for n := range fileNames {
+        jobs <- n
+    }
+    close(jobs)
+    wg.Wait()
+
+    numFailed, numErrors, numWarnings := 0, 0, 0
+    for _, res := range results {
+        fmt.Printf("%s:\n", res.fileName)
+        os.Stdout.Write(res.log.Bytes())
+        for _, diag := range res.diagnostics {
+            fmt.Println(diag)
+            if diag.Severity == utils.SEVERITY_WARNING {
+                numWarnings++
+            } else if diag.Severity == utils.SEVERITY_ERROR {
+                numErrors++
+            }
+        }
+        if res.failed {
+            numFailed++
         }
     }
+    
+    fmt.Printf("\n%d file(s) compiled, %d failed, %d error(s), %d warning(s)\n",
+               len(fileNames), numFailed, numErrors, numWarnings)
 
-    showHelp("")
+    if len(*reportName) > 0 {
+        err := writeReport(*reportName, func(w io.Writer) error {
+            return writeBatchReport(w, results)
+        })
+        if err != nil {
+            fmt.Printf("Error: Unable to write report: %s\n", err)
+            return 1
+        }
+    }
+    if numFailed > 0 {
+        return 1
+    }
+    return 0
 }
@@ -0,0 +1,661 @@
+package xpmc_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"../xpmc"
+)
+
+func ExampleCompileString() {
+	r, err := xpmc.CompileString("A o4 l4 c d e f\n", xpmc.Options{Target: "sms", Log: ioutil.Discard})
+	fmt.Println(err, len(r.Songs), r.Songs[0].GetChannels()[0].GetTicks())
+
+	var asm bytes.Buffer
+	err = r.WriteOutput(&asm)
+	fmt.Println(err, strings.Contains(asm.String(), "xpmp_s0_channel_A:"))
+
+	r, err = xpmc.CompileString("A o4 c d\nA o9 c\n", xpmc.Options{Target: "sms", Name: "bad", Log: ioutil.Discard})
+	fmt.Println(err)
+	fmt.Println(r.WriteOutput(ioutil.Discard) != nil)
+
+	_, err = xpmc.CompileString("A c\n", xpmc.Options{Target: "nope"})
+	fmt.Println(err)
+	// Output:
+	// <nil> 1 32
+	// <nil> true
+	// [bad:2,4] Error: Octave out of range: 9 (vs [2,7])
+	// true
+	// Unknown target: nope
+}
+
+/* Compiles src for the SMS and prints the diagnostics, followed by the
+ * length in ticks of each channel that is used.
+ */
+func compileAndPrint(src string) *xpmc.Result {
+	r, err := xpmc.CompileString(src, xpmc.Options{Target: "sms", Name: "test", Log: ioutil.Discard})
+	if r == nil {
+		fmt.Println(err)
+		return nil
+	}
+	for _, diag := range r.Diagnostics {
+		fmt.Println(diag.Code, diag)
+	}
+	for _, chn := range r.Songs[0].GetChannels() {
+		if chn.GetTicks() > 0 && !chn.IsVirtual() {
+			fmt.Println(chn.GetName(), chn.GetTicks(), "ticks")
+		}
+	}
+	return r
+}
+
+/* Prints the playing time in frames of each channel that is used, as
+ * listed in the compile report.
+ */
+func printFrames(r *xpmc.Result) {
+	var buf bytes.Buffer
+	if err := r.WriteReport(&buf); err != nil {
+		fmt.Println(err)
+		return
+	}
+	var report struct {
+		Songs []struct {
+			Channels []struct {
+				Name string
+				Ticks int
+				Frames float64
+			}
+		}
+	}
+	json.Unmarshal(buf.Bytes(), &report)
+	for _, chn := range report.Songs[0].Channels {
+		if chn.Ticks > 0 {
+			fmt.Printf("%s %.1f frames\n", chn.Name, chn.Frames)
+		}
+	}
+}
+
+func ExampleOptions() {
+	// Everything that the compiler prints goes to Log, including the
+	// informational messages of verbose mode
+	var log bytes.Buffer
+	r, _ := xpmc.CompileString("$m(n:num) { c{n} }\nA $m(8)\n", xpmc.Options{Target: "sms", Log: &log, Verbose: true})
+	r.WriteOutput(ioutil.Discard)
+	fmt.Print(log.String())
+	// Output:
+	// Info: Macro m expanded to  c8  on line 2
+	// Info: Removed 0 unused effects
+	// Info: Size of effect tables: 0 bytes
+	// Info: Size of callback table: 0 bytes
+	// Info: Size of patterns table: 0 bytes
+	//
+	// Song 1, Channel A: 4 bytes, 4 / 4 ticks
+	// Song 1, Channel B: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel C: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel D: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel E: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel F: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel G: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel H: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel I: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel J: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel K: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel L: 1 bytes, 0 / 0 ticks
+	// Song 1, Channel M: 1 bytes, 0 / 0 ticks
+	// Info: Total size of song(s): 42 bytes
+}
+func Example_diagnostics() {
+	compileAndPrint("A o4 c d\nA o9 c\n#FOO 1\nB v99 c\n#WARNING \"careful\"\n")
+
+	// Notes too short to be heard only give a warning, unless warnings are treated as errors
+	r, err := xpmc.CompileString("A t300 l32 q1 c\n", xpmc.Options{Target: "sms", Log: ioutil.Discard, WarningsAreErrors: true})
+	fmt.Println(r.Diagnostics[0], err != nil)
+	// Output:
+	// out-of-range [test:2,4] Error: Octave out of range: 9 (vs [2,7])
+	// unknown-command [test:3,4] Error: Unknown command: FOO
+	// out-of-range [test:4,5] Error: Bad volume: 99
+	// user [test:5,18] Warning: careful
+	// A 24 ticks
+	// B 8 ticks
+	// [song:1,13] Warning: Note is too short, will not be heard true
+}
+
+func Example_errorRecovery() {
+	compileAndPrint("A c o9 d v99 e\nB l4 {c o9 d e}4 f\nC [c Q d]2 e\n#FOO\nD c\n")
+
+	r, err := xpmc.CompileString("A o9 c o9 d o9 e\n", xpmc.Options{Target: "sms", Log: ioutil.Discard, MaxErrors: 2})
+	for _, diag := range r.Diagnostics {
+		fmt.Println(diag)
+	}
+	fmt.Println(err != nil)
+	// Output:
+	// out-of-range [test:1,6] Error: Octave out of range: 9 (vs [2,7])
+	// out-of-range [test:1,12] Error: Bad volume: 99
+	// out-of-range [test:2,10] Error: Octave out of range: 9 (vs [2,7])
+	// unexpected-char [test:3,6] Error: Unexpected character: Q
+	// unknown-command [test:4,4] Error: Unknown command: FOO
+	// A 24 ticks
+	// B 16 ticks
+	// C 40 ticks
+	// D 8 ticks
+	// [song:1,4] Error: Octave out of range: 9 (vs [2,7])
+	// [song:1,9] Error: Octave out of range: 9 (vs [2,7])
+	// Info: Too many errors (2), stopping
+	// true
+}
+
+func Example_concurrentCompiles() {
+	song := "#IF LEN == 8\nA l8 c d\n#ELIF LEN >= 2\nA l2 c d\n#ELSE\nA o9 c\n#ENDIF\n"
+	sources := []string{"#DEFINE LEN 8\n" + song, "#DEFINE LEN 2\n" + song, song}
+	results := make([]*xpmc.Result, len(sources))
+	var wg sync.WaitGroup
+	for i, src := range sources {
+		wg.Add(1)
+		go func(i int, src string) {
+			defer wg.Done()
+			results[i], _ = xpmc.CompileString(src, xpmc.Options{Target: "sms", Log: ioutil.Discard})
+		}(i, src)
+	}
+	wg.Wait()
+	for _, r := range results {
+		fmt.Println(r.Songs[0].GetChannels()[0].GetTicks(), len(r.Diagnostics))
+	}
+	// Output:
+	// 8 0
+	// 32 0
+	// 8 1
+}
+
+func Example_tuplets() {
+	r := compileAndPrint("A l8 {c d e}4 {c {d e}8 f}4\nB l8 {[c d]3 e}2\n")
+	printFrames(r)
+	compileAndPrint("C {c [d e}4 ]2\n")
+	// Output:
+	// A 16 ticks
+	// B 16 ticks
+	// A 57.6 frames
+	// B 57.6 frames
+	// loop [test:1,11] Error: Unterminated loop inside {}
+}
+
+func Example_tempoMap() {
+	r := compileAndPrint("#TEMPO-AT 2 60\n#TEMPO-AT 3 90~150:1\n\\p{ o4 l4 c d e f }\nA \\p() \\p() \\p() \\p()\nB o4 l4 c d e f c d e f c d e f c d e f\nC o4 l4 [c d e f]4\nD o4 l4 [c d e f | c d e f]2 c d e f\nE o4 l4 [[c d e f]2]2\n")
+	printFrames(r)
+	compileAndPrint("A l1 c c\n#TEMPO-AT 2 90\n#TEMPO-AT 5 0\n")
+	// Output:
+	// A 128 ticks
+	// B 128 ticks
+	// C 128 ticks
+	// D 128 ticks
+	// E 128 ticks
+	// A 574.8 frames
+	// B 574.8 frames
+	// C 574.8 frames
+	// D 574.8 frames
+	// E 574.8 frames
+	// tempo [test:2,14] Error: TEMPO-AT: Channel A is already past bar 2
+	// tempo [test:3,13] Error: Bad tempo: 0
+	// A 64 ticks
+}
+
+func Example_groove() {
+	r := compileAndPrint("#GROOVE swing = {2 1}\nA l8 GROOVE(swing) c d e f GROOVE() g\nB l8 c d e f g\nC l8 GROOVE(swing) c d e GROOVE() r4\nD l8 c d e r4\nE l8 GROOVE(swing) c d e r4\n")
+	printFrames(r)
+	compileAndPrint("#GROOVE bad = {2 0}\nA GROOVE(nope) c\n")
+	// Output:
+	// groove Warning: Channel E ends in the middle of a groove cycle, and is out of time by 1.3 ticks
+	// A 20 ticks
+	// B 20 ticks
+	// C 20 ticks
+	// D 20 ticks
+	// E 20 ticks
+	// A 72.0 frames
+	// B 72.0 frames
+	// C 72.0 frames
+	// D 72.0 frames
+	// E 76.8 frames
+	// groove [test:1,19] Error: Groove steps must be >= 1: {2 0}
+	// groove [test:2,14] Error: Undefined groove: nope
+	// A 8 ticks
+}
+
+func Example_chords() {
+	r := compileAndPrint("A o4 l4 c:maj d:m7 'c+fa>c'\n")
+	for i := 0; i < r.Effects.Arpeggios.Len(); i++ {
+		fmt.Println(r.Effects.Arpeggios.GetDataAt(i).Format())
+	}
+
+	// In split mode, each active channel plays one note of the chord
+	split := compileAndPrint("#CHORD-MODE SPLIT\nABC o4 l4 c:maj7 d:m\n")
+	written := compileAndPrint("A o4 l4 c d\nB o4 l4 e f\nC o4 l4 g a\n")
+	for i := 0; i < 3; i++ {
+		fmt.Println(reflect.DeepEqual(split.Songs[0].GetChannels()[i].GetCommands(), written.Songs[0].GetChannels()[i].GetCommands()))
+	}
+
+	compileAndPrint("A c:xyzw d 'c>e' 'c\n")
+	// Output:
+	// A 24 ticks
+	// {0 4 7}
+	// {0 3 7 10}
+	// {0 4 8 11}
+	// chord [test:2,17] Warning: Chord with 4 notes played on 3 channels
+	// A 16 ticks
+	// B 16 ticks
+	// C 16 ticks
+	// A 16 ticks
+	// B 16 ticks
+	// C 16 ticks
+	// true
+	// true
+	// true
+	// chord [test:1,4] Error: Unknown chord: xyzw
+	// chord [test:1,20] Error: Missing ' at the end of chord
+	// A 16 ticks
+}
+
+func Example_drums() {
+	kit := "#DRUMKIT std kick k = D o2c v15\n#DRUMKIT std snare s = D o3c v12 EP1\n@EP1 = {1 2 3}\nD v9\n"
+	drums := compileAndPrint(kit + "#DRUMS std 16 k.s.\n")
+	written := compileAndPrint(kit + "D v15 o2c16^16 v12 EP1 o3c16^16 v9 EPOF\n")
+	fmt.Println(reflect.DeepEqual(drums.Songs[0].GetChannels()[3].GetCommands(), written.Songs[0].GetChannels()[3].GetCommands()))
+
+	// Rhythm sounds that are hit at the same time are played as one note
+	rhythm := compileAndPrint("#DRUMKIT fm bd b = BD\n#DRUMKIT fm hh h = HH\n#DRUMS fm 8 b.(bh)h\n")
+	written = compileAndPrint("K M1 o2e8^8 o2f8 o1c+8 M0\n")
+	fmt.Println(reflect.DeepEqual(rhythm.Songs[0].GetChannels()[10].GetCommands(), written.Songs[0].GetChannels()[10].GetCommands()))
+
+	compileAndPrint("#DRUMKIT x kick k = D o2c\n#DRUMKIT x snare s = D o3c @1\n#DRUMKIT x tom t = D o3e\n#DRUMS x 16 sk\n#DRUMS x 16 (kt)\n#DRUMS y 16 k\n")
+	// Output:
+	// D 8 ticks
+	// D 8 ticks
+	// true
+	// K 16 ticks
+	// K 16 ticks
+	// true
+	// drums [test:4,14] Error: snare sets @1 on channel D, which can't be undone for kick; give kick a @ setting as well
+	// drums [test:5,16] Error: kick and tom are both played on channel D in the same step
+	// drums [test:6,8] Error: Undefined drum kit: y
+}
+
+func Example_macroParameters() {
+	r := compileAndPrint("$m(oct:num=4, n:num=2) { o{oct} c{16/n} {x = n*2} d{x} }\nA $m() $m(3, n=4)\nB o4 c8 d4 o3 c4 d8\n")
+	fmt.Println(reflect.DeepEqual(r.Songs[0].GetChannels()[0].GetCommands(), r.Songs[0].GetChannels()[1].GetCommands()))
+
+	compileAndPrint("$z(d:num) { c{4/d} }\n$s(v:str) { {v} }\nA $z(0) $z(q=1) $z(x) $s(c)\n")
+	// Output:
+	// A 24 ticks
+	// B 24 ticks
+	// true
+	// macro [test:2,13] Error: v is a string parameter and can not be used in an expression
+	// macro [test:3,7] Error: Macro z: Division by zero in expression
+	// macro [test:3,15] Error: Macro z has no parameter named q
+	// macro [test:3,21] Error: Macro z: d must be a number, got: x
+	// macro [test:3,27] Error: Undefined macro: s
+}
+
+func Example_repeatBlocks() {
+	blocks := "A o4 l8\n#FOR i = 0 TO 2\nA v{15-i*2} c d\n#FOR j = 1 TO i\nB K{i+j} e\n#END\n#END\n#REPEAT 2\nA f g\n#END\n"
+	written := "A o4 l8\nA v15 c d\nA v13 c d\nB K2 e\nA v11 c d\nB K3 e\nB K4 e\nA f g\nA f g\n"
+	r1, r2 := compileAndPrint(blocks), compileAndPrint(written)
+	for i := 0; i < 2; i++ {
+		fmt.Println(reflect.DeepEqual(r1.Songs[0].GetChannels()[i].GetCommands(), r2.Songs[0].GetChannels()[i].GetCommands()))
+	}
+
+	compileAndPrint("#FOR n = 3 TO 1 STEP -1\nA o{n} c x\n#END\n#FOR 1x = 1 TO 2\n#END\n#REPEAT 2\nA c\n")
+	// Output:
+	// length-mismatch Warning: Mismatch in length between channels in song 1
+	// A 40 ticks
+	// B 24 ticks
+	// length-mismatch Warning: Mismatch in length between channels in song 1
+	// A 40 ticks
+	// B 24 ticks
+	// true
+	// true
+	// unexpected-char [test:2,8] Error: Unexpected character: x
+	// unexpected-char [test:2,8] Error: Unexpected character: x
+	// out-of-range [test:2,4] Error: Octave out of range: 1 (vs [2,7])
+	// unexpected-char [test:2,8] Error: Unexpected character: x
+	// block [test:4,16] Error: FOR: Bad variable name: 1x
+	// block [test:5,4] Error: END with no matching REPEAT, FOR or SECTION
+	// block [test:8,0] Error: Missing #END for #REPEAT
+	// A 24 ticks
+}
+
+func Example_sections() {
+	r := compileAndPrint("\\fill{ l16 c d }\n#SECTION intro\nA o5 l8 c > d\nB o3 l4 c\n#END\n#SECTION verse\nA l8 e \\fill()\nB d\n#END\n#ORDER intro @loop verse intro\nA g g\nB e\n")
+	for _, chn := range r.Songs[0].GetChannels()[:2] {
+		fmt.Println(chn.GetName(), "loop", chn.GetLoopTicks(), "ticks")
+	}
+	fmt.Println(len(r.Patterns), "patterns")
+
+	compileAndPrint("#SECTION x\nA c\nB c4.\n#END\n#SECTION y\nA c\n#END\n#ORDER y z\n#SECTION y\n#END\n#TEMPO-AT 2 90\n")
+	compileAndPrint("#TEMPO-AT 2 90\n#SECTION x\nA c\n#END\n")
+	// Output:
+	// A 32 ticks
+	// B 32 ticks
+	// A loop 24 ticks
+	// B loop 24 ticks
+	// 5 patterns
+	// block [test:4,4] Error: SECTION: Channel B is 12 ticks long in section x, but channel A is 8 ticks long
+	// block [test:8,10] Error: ORDER: Undefined section: z
+	// block [test:10,4] Error: SECTION: Section already defined: y
+	// tempo [test:11,14] Error: TEMPO-AT: Can not be used in songs with sections
+	// tempo [test:4,4] Error: SECTION: Sections can not be used in songs with #TEMPO-AT
+}
+
+func Example_nestedPatterns() {
+	// The player can only return from one level of CMD_JSR, so \riff and \verse
+	// are compiled into the patterns that call them
+	r := compileAndPrint("\\riff{ l16 [c d | e]3 }\n\\verse{ l8 c \\riff() l8 c }\n\\song{ \\verse(2) }\nA \\song()\nB l8 c l16 [c d | e]3 l8 c c l16 [c d | e]3 l8 c\n")
+	fmt.Println(len(r.Patterns), "patterns")
+	// Output:
+	// A 48 ticks
+	// B 48 ticks
+	// 3 patterns
+}
+
+func Example_report() {
+	r, _ := xpmc.CompileString("\\p{ c d }\nA o4 l4 c d e f\nB o4 l4 c L \\p() e f\n", xpmc.Options{Target: "sms", Log: ioutil.Discard})
+	r.WriteOutput(ioutil.Discard)
+	var buf bytes.Buffer
+	r.WriteReport(&buf)
+	var report struct {
+		Target string
+		Songs []struct {
+			Size int
+			Channels []struct {
+				Name string
+				Size, Ticks, LoopTicks int
+				Frames, LoopFrames float64
+				Effects []string
+			}
+		}
+		Patterns []struct {
+			Name string
+			Size, Ticks int
+		}
+		Tables struct {
+			Patterns, Total int
+		}
+	}
+	json.Unmarshal(buf.Bytes(), &report)
+	fmt.Println(report.Target, report.Songs[0].Size, report.Tables.Patterns, report.Tables.Total)
+	for _, chn := range report.Songs[0].Channels[:3] {
+		fmt.Println(chn.Name, chn.Size, chn.Ticks, chn.LoopTicks, chn.Frames, chn.LoopFrames, chn.Effects)
+	}
+	for _, pat := range report.Patterns {
+		fmt.Println(pat.Name, pat.Size, pat.Ticks)
+	}
+	// Output:
+	// sms 32 9 67
+	// A 9 32 0 115.125 0 []
+	// B 12 40 32 143.90625 115.125 [DM EN EN2 EP MP pw]
+	// C 1 0 0 0 0 []
+	// p 7 16
+}
+
+/* The MML code compiled by the output format examples below.
+ */
+const outputSrc = "@v1 = {15 12 8}\nA o4 l8 v1 @v1 c d e f\nB o4 l8 [c d]2 !cb(1)\n"
+
+/* Compiles outputSrc with the given options and prints the name of each
+ * output file, followed by the lines in it that contain any of the given
+ * strings (or by its size, for binary files). Returns the output files.
+ */
+func printOutput(opts xpmc.Options, substrings ...string) map[string]*bytes.Buffer {
+	opts.Name, opts.Log = "song", ioutil.Discard
+	r, err := xpmc.CompileString(outputSrc, opts)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	files := map[string]*bytes.Buffer{}
+	names := []string{}
+	err = r.Output(func(fileName string) (io.Writer, error) {
+		files[fileName] = &bytes.Buffer{}
+		names = append(names, fileName)
+		return files[fileName], nil
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, ".bin") {
+			fmt.Println(name+":", files[name].Len(), "bytes")
+			continue
+		}
+		fmt.Println(name + ":")
+		for _, line := range strings.Split(files[name].String(), "\n") {
+			for _, s := range substrings {
+				if strings.Contains(line, s) {
+					fmt.Println(" ", strings.TrimSpace(line))
+					break
+				}
+			}
+		}
+	}
+	return files
+}
+
+func Example_ca65() {
+	printOutput(xpmc.Options{Target: "at8", Syntax: "ca65"}, ".segment", ".proc", "::loop", ".endproc", ".global", "channel_B")
+	// The ca65 syntax is only available for targets with a 6502
+	printOutput(xpmc.Options{Target: "pce", Syntax: "ca65"})
+	// Output:
+	// song.asm:
+	//   .segment "RODATA"
+	//   .proc xpmp_v_mac_1
+	//   .endproc
+	//   .word xpmp_v_mac_1::loop
+	//   .global cb
+	//   xpmp_s0_channel_B:
+	//   .word xpmp_s0_channel_B
+	// sapheader.txt:
+	// The pce target doesn't support ca65 syntax (use wla)
+}
+
+func Example_rgbds() {
+	printOutput(xpmc.Options{Target: "gbc", Syntax: "rgbds"}, "SECTION", "xpmp_v_mac_1", ".loop", "EXPORT xpmp_callback_tbl", "dw cb", "channel_B")
+	// Output:
+	// song.asm:
+	//   SECTION "GBS header", ROM0[$0000]
+	//   SECTION "XPMP music data", ROMX
+	//   xpmp_v_mac_1:
+	//   .loop:
+	//   dw xpmp_v_mac_1
+	//   dw xpmp_v_mac_1.loop
+	//   EXPORT xpmp_callback_tbl
+	//   dw cb
+	//   xpmp_s0_channel_B:
+	//   dw xpmp_s0_channel_B
+}
+
+func Example_cOutput() {
+	printOutput(xpmc.Options{Target: "sms", Format: "c"}, "#include", "xpmp_v_mac_1", "cb", "channel_B")
+	// Output:
+	// song.c:
+	//   #include "song.h"
+	//   const uint8_t xpmp_v_mac_1[] = {
+	//   xpmp_v_mac_1,
+	//   xpmp_v_mac_1 + 3,
+	//   extern void cb(void);
+	//   cb,
+	//   const uint8_t xpmp_s0_channel_B[] = {
+	//   xpmp_s0_channel_B,
+	// song.h:
+	//   #include <stdint.h>
+	//   extern const uint8_t xpmp_v_mac_1[];
+	//   extern const uint8_t xpmp_s0_channel_B[];
+}
+
+func Example_mot68k() {
+	printOutput(xpmc.Options{Target: "gen", Syntax: "asm68k"}, "xpmp_v_mac_1", "xdef xpmp_callback_tbl", "cb", "channel_B")
+	// Output:
+	// song.asm:
+	//   xpmp_v_mac_1:
+	//   xpmp_v_mac_1_loop:
+	//   dc.w xpmp_v_mac_1
+	//   dc.w xpmp_v_mac_1_loop
+	//   xdef xpmp_callback_tbl
+	//   dc.l cb
+	//   xpmp_s0_channel_B:
+	//   dc.w xpmp_s0_channel_B
+}
+
+func Example_binary() {
+	files := printOutput(xpmc.Options{Target: "sms", Format: "bin", BaseAddress: 0x8000}, "xpmp_v_mac_1", "cb", "channel_B", "song_tbl")
+	// The first two entries of the song table, resolved for the base address
+	fmt.Printf("% x\n", files["song.bin"].Bytes()[0x30:0x34])
+	// The Genesis has 32-bit pointers to the callbacks, and is big-endian
+	files = printOutput(xpmc.Options{Target: "gen", Format: "bin"}, "cb", "channel_B")
+	fmt.Printf("% x\n", files["song.bin"].Bytes()[0x30:0x34])
+	// Addresses that don't fit in a pointer are reported
+	printOutput(xpmc.Options{Target: "sms", Format: "bin", BaseAddress: 0xFFF0})
+	// Output:
+	// song.bin: 74 bytes
+	// song.sym:
+	//   0000 xpmp_v_mac_1
+	//   0003 xpmp_v_mac_1_loop
+	//   0017 xpmp_s0_channel_B
+	//   0030 xpmp_song_tbl
+	// song.rel:
+	//   0005 2 xpmp_v_mac_1
+	//   0007 2 xpmp_v_mac_1_loop
+	//   0009 2 cb extern
+	//   0032 2 xpmp_s0_channel_B
+	// 0b 80 17 80
+	// song.bin: 70 bytes
+	// song.sym:
+	//   001a xpmp_s0_channel_B
+	// song.rel:
+	//   000a 4 cb extern
+	//   0032 2 xpmp_s0_channel_B
+	// 00 0e 00 1a
+	// Error: The address of xpmp_s0_channel_B ($10007) doesn't fit in a 2-byte pointer; use a lower base address
+}
+
+func Example_includes() {
+	fsys := fstest.MapFS{
+		"songs/song.mml":      {Data: []byte("#INCLUDE \"instruments.mml\"\n#INCLUDE \"drums.mml\"\n#INCLUDE \"drums.mml\"\n#INCLUDE-ONCE \"drums.mml\"\n#INCLUDE \"local.mml\"\nA @v1 c\n")},
+		"songs/local.mml":     {Data: []byte("#WARNING \"songs/local.mml\"\n#INCLUDE \"instruments.mml\"\n")},
+		"lib/instruments.mml": {Data: []byte("#PRAGMA ONCE\n#WARNING \"lib/instruments.mml\"\n@v1 = {15 10}\n")},
+		"lib/drums.mml":       {Data: []byte("#WARNING \"lib/drums.mml\"\n")},
+		"songs/loop.mml":      {Data: []byte("#INCLUDE \"loop2.mml\"\n")},
+		"songs/loop2.mml":     {Data: []byte("\n#INCLUDE \"loop.mml\"\n")},
+	}
+	// Included files are looked for next to the including file, and then in
+	// the include paths. #INCLUDE-ONCE skips drums.mml, which has already been
+	// included, and instruments.mml has #PRAGMA ONCE, so it's only included once
+	opts := xpmc.Options{Target: "sms", FS: fsys, IncludePaths: []string{"lib"}, Log: ioutil.Discard}
+	r, _ := xpmc.CompileFile("songs/song.mml", opts)
+	for _, diag := range r.Diagnostics {
+		fmt.Println(diag)
+	}
+	fmt.Println(r.Songs[0].GetChannels()[0].GetTicks())
+
+	// Includes that form a cycle are reported along with the include stack
+	_, err := xpmc.CompileFile("songs/loop.mml", opts)
+	fmt.Println(err)
+	// Output:
+	// [instruments.mml:2,30] Warning: lib/instruments.mml
+	// [drums.mml:1,24] Warning: lib/drums.mml
+	// [drums.mml:1,24] Warning: lib/drums.mml
+	// [local.mml:1,26] Warning: songs/local.mml
+	// 8
+	// [loop2.mml:2,19] Error: Circular #INCLUDE: loop.mml -> loop2.mml -> loop.mml
+}
+
+func Example_debugMap() {
+	fsys := fstest.MapFS{
+		"song.mml":  {Data: []byte("#INCLUDE \"riff.mml\"\n$m() { e f }\nA o4 l4 c d\nA $m() \\riff()\n")},
+		"riff.mml": {Data: []byte("\\riff{ g a }\n")},
+	}
+	r, _ := xpmc.CompileFile("song.mml", xpmc.Options{Target: "sms", FS: fsys, Log: ioutil.Discard})
+	var buf bytes.Buffer
+	if err := r.WriteDebugMap(&buf); err != nil {
+		fmt.Println(err)
+		return
+	}
+	type entry struct {
+		Offset, Length int
+		File string
+		Line, Column int
+		Chain []struct {
+			Kind, Name, File string
+			Line, Column int
+		}
+	}
+	var dm struct {
+		Songs []struct {
+			Channels []struct {
+				Name string
+				Entries []entry
+			}
+		}
+		Patterns []struct {
+			Name string
+			Entries []entry
+		}
+	}
+	json.Unmarshal(buf.Bytes(), &dm)
+	show := func(name string, entries []entry) {
+		for _, e := range entries {
+			fmt.Printf("%s %d+%d %s:%d,%d", name, e.Offset, e.Length, e.File, e.Line, e.Column)
+			for _, frame := range e.Chain {
+				fmt.Printf(" <- %s %s:%d,%d", strings.TrimSpace(frame.Kind+" "+frame.Name), frame.File, frame.Line, frame.Column)
+			}
+			fmt.Println()
+		}
+	}
+	show("A", dm.Songs[0].Channels[0].Entries)
+	for _, pat := range dm.Patterns {
+		show(pat.Name, pat.Entries)
+	}
+	// Output:
+	// A 0+1 song.mml:3,3
+	// A 1+3 song.mml:3,6
+	// A 4+1 song.mml:3,9
+	// A 5+1 song.mml:3,11
+	// A 6+1 song.mml:4,3 <- macro m song.mml:4,3
+	// A 7+1 song.mml:4,3 <- macro m song.mml:4,3
+	// A 8+2 song.mml:4,8
+	// riff 0+3 riff.mml:1,8 <- include song.mml:1,19
+	// riff 3+3 riff.mml:1,10 <- include song.mml:1,19
+	// riff 6+1 riff.mml:1,12 <- include song.mml:1,19
+}
+
+func Example_patternArguments() {
+	// A transpose amount, a volume offset, an octave shift and a repeat count
+	r := compileAndPrint("\\bass{ o3 l8 v12 c e g }\nA \\bass()\nB \\bass(K+5, v-2, o+1, 2)\nC \\bass(v+9)\n")
+	hex := func(cmds []int) string {
+		s := []string{}
+		for _, cmd := range cmds {
+			s = append(s, fmt.Sprintf("%02x", cmd))
+		}
+		return strings.Join(s, " ")
+	}
+	for i, pat := range r.Patterns {
+		fmt.Printf("%d: %s\n", i, hex(pat.GetCommands()))
+	}
+	for _, chn := range r.Songs[0].GetChannels()[:3] {
+		fmt.Printf("%s: %s\n", chn.GetName(), hex(chn.GetCommands()))
+	}
+	// Output:
+	// volume-clamped [test:1,16] Warning: The volume offset +9 takes the volume of pattern bass(v+9) to 21, which is limited to 15
+	// length-mismatch Warning: Mismatch in length between channels in song 1
+	// A 12 ticks
+	// B 24 ticks
+	// C 12 ticks
+	// 0: 13 9a 0e 64 3c 60 64 67 197
+	// 1: 13 9a 0e 64 3a 60 64 67 197
+	// 2: 13 9a 0e 64 3f 60 64 67 197
+	// A: 196 00 ff
+	// B: 9f 11 196 01 196 01 9f 00 ff
+	// C: 196 02 ff
+}
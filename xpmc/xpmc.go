@@ -0,0 +1,219 @@
+/*
+ * Package xpmc
+ *
+ * Part of XPMC.
+ * The public interface for using the compiler as a library. Each call
+ * to Compile uses its own compiler instance, so several compilations
+ * can run at the same time.
+ */
+
+package xpmc
+
+import (
+    "errors"
+    "io"
+    "io/fs"
+    "io/ioutil"
+    "strings"
+    "../compiler"
+    "../defs"
+    "../effects"
+    "../targets"
+    "../utils"
+)
+
+/* Settings for one compilation. Only Target is required.
+ */
+type Options struct {
+    Target string           // The target name, e.g. "sms" or "gen"
+    Name string             // Used in diagnostics and as the base name of the output files. Defaults to "song"
+    FS fs.FS                // Where #INCLUDEd files and samples are read from. nil means the OS file system
+    Log io.Writer           // Where statistics like channel sizes are printed. nil means stdout
+    Verbose bool            // Also print informational messages to Log
+    Debug bool              // Also print debug messages to Log
+    IncludePaths []string   // Directories that #INCLUDEd files are looked for in, after the including file's own directory
+    Format string           // "asm" (default), "c" or "bin"
+    Syntax string           // The assembler syntax. Defaults to the target's own syntax
+    BaseAddress int         // The address that binary output gets resolved for
+    WarningsAreErrors bool
+    MaxErrors int           // Compilation stops after this many errors (0 = no limit)
+}
+
+/* The outcome of a compilation. Each song holds its channels, and the
+ * effect tables are the ones left after unused effects have been removed.
+ */
+type Result struct {
+    Songs []defs.ISong
+    Patterns []defs.IMmlPattern
+    Effects *effects.Effects
+    Callbacks []string
+    Diagnostics []utils.Diagnostic
+
+    comp *compiler.Compiler
+    outputFormat int
+    outputWritten bool
+}
+
+
+/* Compiles the MML code read from src. The Result is returned even if
+ * the compilation failed, so that its Diagnostics can be inspected.
+ */
+func Compile(src io.Reader, opts Options) (*Result, error) {
+    data, err := ioutil.ReadAll(src)
+    if err != nil {
+        return nil, err
+    }
+    name := opts.Name
+    if len(name) == 0 {
+        name = "song"
+    }
+    return compile(opts, name, func(comp *compiler.Compiler) error {
+        return comp.CompileSource(name, data)
+    })
+}
+
+/* Like Compile, but takes the MML code as a string.
+ */
+func CompileString(src string, opts Options) (*Result, error) {
+    return Compile(strings.NewReader(src), opts)
+}
+
+/* Compiles the given file, which is read from opts.FS if it has been set.
+ * If opts.Name is empty, the file name minus its extension is used.
+ */
+func CompileFile(fileName string, opts Options) (*Result, error) {
+    name := opts.Name
+    if len(name) == 0 {
+        name = fileName
+        if lastDot := strings.LastIndex(name, "."); lastDot > strings.LastIndexAny(name, "/\\") {
+            name = name[:lastDot]
+        }
+    }
+    return compile(opts, name, func(comp *compiler.Compiler) error {
+        return comp.CompileFile(fileName)
+    })
+}
+
+
+func compile(opts Options, name string, run func(comp *compiler.Compiler) error) (*Result, error) {
+    target := targets.NameToID(opts.Target)
+    if target == targets.TARGET_UNKNOWN {
+        return nil, errors.New("Unknown target: " + opts.Target)
+    }
+    if err := targets.CheckImplemented(target); err != nil {
+        return nil, err
+    }
+    outputFormat := targets.OUTPUT_ASSEMBLY
+    if len(opts.Format) > 0 {
+        if outputFormat = targets.FormatNameToID(opts.Format); outputFormat == -1 {
+            return nil, errors.New("Unknown output format: " + opts.Format)
+        }
+    }
+    outputSyntax := -1
+    if len(opts.Syntax) > 0 {
+        if outputSyntax = targets.SyntaxNameToID(opts.Syntax); outputSyntax == -1 {
+            return nil, errors.New("Unknown assembler syntax: " + opts.Syntax)
+        }
+    }
+
+    comp := &compiler.Compiler{}
+    comp.Init(target)
+    comp.GetContext().FS = opts.FS
+    comp.GetContext().Log = opts.Log
+    comp.GetContext().IncludePaths = opts.IncludePaths
+    comp.GetContext().WarningsAreErrors = opts.WarningsAreErrors
+    comp.GetContext().Verbose = opts.Verbose
+    comp.GetContext().Debug = opts.Debug
+    comp.Diagnostics.MaxErrors = opts.MaxErrors
+    comp.ShortFileName = name
+    if outputSyntax != -1 {
+        if err := comp.CurrSong.Target.SetOutputSyntax(outputSyntax); err != nil {
+            return nil, err
+        }
+    }
+
+    err := run(comp)
+    if err == nil {
+        err = finish(comp)
+    }
+    if outputSyntax != -1 {
+        // Each song has its own target, so the syntax is set on the last one as well
+        comp.CurrSong.Target.SetOutputSyntax(outputSyntax)
+    }
+    comp.CurrSong.Target.PutExtraInt("BaseAddress", opts.BaseAddress)
+
+    r := &Result{comp: comp, outputFormat: outputFormat}
+    r.Songs = comp.GetSongs()
+    r.Patterns = comp.GetPatterns()
+    r.Effects = comp.GetEffects()
+    r.Callbacks = comp.GetCallbacks()
+    r.Diagnostics = comp.Diagnostics.All()
+    return r, err
+}
+
+func finish(comp *compiler.Compiler) (err error) {
+    defer comp.GetContext().RecoverErrors(&err)
+
+    comp.FinishSongs()
+    comp.RemoveUnusedEffects()
+    return nil
+}
+
+
+/* Writes the output files through create, which gets called once for each
+ * file with the name it would have had on disk (e.g. "song.asm"). Writers
+ * that implement io.Closer are closed when the file is complete.
+ * The output can only be written once, since some targets convert their
+ * effect tables in place while writing them.
+ */
+func (r *Result) Output(create func(fileName string) (io.Writer, error)) error {
+    if err := r.comp.Diagnostics.Err(); err != nil {
+        return err
+    }
+    if r.outputWritten {
+        return errors.New("The output has already been written")
+    }
+    r.outputWritten = true
+
+    r.comp.CurrSong.Target.SetOutputOpener(create)
+    err := r.comp.Output(r.outputFormat)
+    r.Diagnostics = r.comp.Diagnostics.All()
+    return err
+}
+
+/* Writes a JSON report of the sizes of each song, channel, pattern and
+ * table, along with the channels' lengths in ticks and frames and the
+ * effects they use. The table sizes are only known after the output has
+ * been written.
+ */
+func (r *Result) WriteReport(w io.Writer) error {
+    if err := r.comp.Diagnostics.Err(); err != nil {
+        return err
+    }
+    return r.comp.WriteReport(w)
+}
+
+/* Writes a JSON map from the byte offsets within each channel and pattern
+ * to the file, line and column of the MML source that they were compiled
+ * from, including the chain of #INCLUDEs and macro invocations.
+ */
+func (r *Result) WriteDebugMap(w io.Writer) error {
+    if err := r.comp.Diagnostics.Err(); err != nil {
+        return err
+    }
+    return r.comp.WriteDebugMap(w)
+}
+
+/* Writes the main output file (the .asm, .c or .bin file) to w. Any other
+ * files, like C headers or symbol maps, are discarded.
+ */
+func (r *Result) WriteOutput(w io.Writer) error {
+    mainFile := true
+    return r.Output(func(fileName string) (io.Writer, error) {
+        if mainFile {
+            mainFile = false
+            return struct{ io.Writer }{w}, nil     // Hide any Close method from the compiler
+        }
+        return ioutil.Discard, nil
+    })
+}